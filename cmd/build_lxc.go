@@ -0,0 +1,74 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/lxc"
+	"github.com/spf13/cobra"
+)
+
+var buildLxcFlags struct {
+	rootfs      string
+	out         string
+	compression string
+	platform    string
+	tag         string
+}
+
+func init() {
+	buildCmd.AddCommand(buildLxcCmd)
+	f := buildLxcCmd.Flags()
+	f.StringVar(&buildLxcFlags.rootfs, "rootfs", "", "Root filesystem directory to package")
+	f.StringVar(&buildLxcFlags.out, "out", "", "OCI image layout to write the image into")
+	f.StringVar(&buildLxcFlags.compression, "compression", lxc.CompressionZstd, "Layer compression: zstd, gzip or none")
+	f.StringVar(&buildLxcFlags.platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Image platform as os/arch[/variant]")
+	f.StringVar(&buildLxcFlags.tag, "tag", "", "Reference name for the image in the layout")
+	_ = buildLxcCmd.MarkFlagRequired("rootfs")
+	_ = buildLxcCmd.MarkFlagRequired("out")
+}
+
+var buildLxcCmd = &cobra.Command{
+	Use:   "lxc --rootfs DIR --out LAYOUT",
+	Short: "Build a Pextra LXC image from a root filesystem directory",
+	Long: `Packages a root filesystem directory as a Pextra LXC image. Ownership (numeric),
+permissions, xattrs, ACLs, SELinux labels and device nodes are preserved, so the
+command usually needs to run as root.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		platform, err := utils.ParsePlatform(buildLxcFlags.platform)
+		if err != nil {
+			return err
+		}
+
+		desc, err := lxc.Build(buildLxcFlags.out, lxc.BuildOptions{
+			RootfsDir:   buildLxcFlags.rootfs,
+			Compression: buildLxcFlags.compression,
+			Platform:    *platform,
+			Tag:         buildLxcFlags.tag,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Built LXC image %s in %s\n", desc.Digest, buildLxcFlags.out)
+		return nil
+	},
+}
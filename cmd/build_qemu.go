@@ -0,0 +1,72 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/qemu"
+	"github.com/spf13/cobra"
+)
+
+var buildQemuFlags struct {
+	disks    []string
+	out      string
+	platform string
+	tag      string
+}
+
+func init() {
+	buildCmd.AddCommand(buildQemuCmd)
+	f := buildQemuCmd.Flags()
+	f.StringArrayVar(&buildQemuFlags.disks, "disk", nil, "Top-level qcow2 disk to package (repeatable)")
+	f.StringVar(&buildQemuFlags.out, "out", "", "OCI image layout to write the image into")
+	f.StringVar(&buildQemuFlags.platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Image platform as os/arch[/variant]")
+	f.StringVar(&buildQemuFlags.tag, "tag", "", "Reference name for the image in the layout")
+	_ = buildQemuCmd.MarkFlagRequired("disk")
+	_ = buildQemuCmd.MarkFlagRequired("out")
+}
+
+var buildQemuCmd = &cobra.Command{
+	Use:   "qemu --disk DISK [--disk DISK...] --out LAYOUT",
+	Short: "Build a Pextra QEMU image from qcow2 disks",
+	Long: `Packages qcow2 disks as a Pextra QEMU image. The backing chain of every disk is
+discovered with qemu-img and each member is added as a layer, bases first. Backing
+references are rewritten to one-level file names in the stored layers (the source
+files are left untouched), and the given disks are marked for flattening.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		platform, err := utils.ParsePlatform(buildQemuFlags.platform)
+		if err != nil {
+			return err
+		}
+
+		desc, err := qemu.Build(buildQemuFlags.out, qemu.BuildOptions{
+			Disks:    buildQemuFlags.disks,
+			Platform: *platform,
+			Tag:      buildQemuFlags.tag,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Built QEMU image %s in %s\n", desc.Digest, buildQemuFlags.out)
+		return nil
+	},
+}
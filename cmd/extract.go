@@ -16,54 +16,148 @@ limitations under the License.
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 
-	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/utils"
 	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
-	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/lxc"
-	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/qemu"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
-var isJson bool
-
 func init() {
 	rootCmd.AddCommand(extractCmd)
-	extractCmd.Flags().BoolVarP(&isJson, "json", "j", false, "Output information in JSON format")
+	// Kept so existing invocations do not break; it never had any effect.
+	extractCmd.Flags().BoolP("json", "j", false, "Output information in JSON format")
+	_ = extractCmd.Flags().MarkDeprecated("json", "use 'pce-oci inspect --json' instead")
+	extractCmd.Flags().StringVar(&extractPlatform, "platform", "", selectPlatformUsage)
+	extractCmd.Flags().StringVar(&extractProgress, "progress", "auto", progressUsage)
+	extractCmd.Flags().BoolVar(&extractInPlace, "in-place", false, "Write into the output directory directly instead of moving the output into place once complete, e.g. for a mount point; a failed extraction leaves partial output behind")
+	extractCmd.Flags().BoolVar(&extractReplace, "replace", false, "Replace an output directory or image file that exists and is not empty, e.g. from an earlier extraction")
+}
+
+var (
+	extractPlatform string
+	extractProgress string
+	extractInPlace  bool
+	extractReplace  bool
+)
+
+// How extract handles one image type: the flags that only apply to it and how they
+// become the options of its handler
+type extractType struct {
+	flags *pflag.FlagSet
+	// Checks the flags and returns the value for ExtractOptions.TypeOptions. It is
+	// called before the image is read; a non-nil run is called instead of extracting.
+	options func(cmd *cobra.Command) (opts any, run func() error, err error)
+	// What the output is written as, e.g. "directory", and what its config file is
+	output func() (into, config string)
+	// Explains how to get around err, or returns ""; optional
+	hint func(err error) string
+}
+
+// Image types by name
+var extractTypes = map[string]*extractType{}
+
+// Adds the flags of t to the extract command
+func registerExtractType(imageType string, t *extractType) {
+	extractTypes[imageType] = t
+	extractCmd.Flags().AddFlagSet(t.flags)
 }
 
 var extractCmd = &cobra.Command{
-	Use:   "extract [image-path] [output-dir]",
+	Use:   "extract [image-path[:tag][@digest]] [output-dir]",
 	Short: "Extract and flatten layers from a Pextra OCI image",
 	Long: `Extracts and flattens layers from a Pextra-specific OCI image into a specified output directory.
-The output directory will be created if it does not exist.`,
-	Args: cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		imagePath := args[0]
-		outputDir := args[1]
-
-		res, err := oci.GetImageDetails(imagePath)
+The output directory will be created if it does not exist. See the README for how output is
+staged, progress is reported and LXC and QEMU images are written.`,
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer cancelOnSignal(cmd)()
+		typeOptions := make(map[string]any)
+		for _, name := range slices.Sorted(maps.Keys(extractTypes)) {
+			opts, run, err := extractTypes[name].options(cmd)
+			if err != nil {
+				return err
+			}
+			if run != nil {
+				return run()
+			}
+			typeOptions[name] = opts
+		}
+		platform, err := parseSelectPlatform(extractPlatform)
+		if err != nil {
+			return err
+		}
+		progress, err := newProgressWriter(extractProgress, cmd.ErrOrStderr())
+		if err != nil {
+			return err
+		}
+		img, err := selectImage(args[0], platform)
 		if err != nil {
-			fmt.Println("Error:", err)
-			return
+			return err
+		}
+		defer img.Layout.Close()
+		if err := checkExtractFlags(img.Type); err != nil {
+			return err
 		}
 
-		switch res.PextraImageType {
-		case pextraoci.PextraImageTypeLxc:
-			c := lxc.New(res.Manifest.Layers, res.Path, outputDir)
-			err = c.FlattenLxcLayers()
-		case pextraoci.PextraImageTypeQemu:
-			c := qemu.New(res.Manifest.Layers, res.Path, outputDir)
-			err = c.FlattenQemuLayers()
-		default:
-			// Should never happen due to checks in oci.GetImageDetails
-			err = fmt.Errorf("unsupported Pextra image type: %s", res.PextraImageType)
+		res, err := pextraoci.Extract(cmd.Context(), img, args[1], pextraoci.ExtractOptions{
+			Progress:    progress.progressFunc(),
+			InPlace:     extractInPlace,
+			Replace:     extractReplace,
+			TypeOptions: typeOptions,
+		})
+		progress.close()
+		t := extractTypes[img.Type]
+		if errors.Is(err, utils.ErrMountPoint) {
+			return fmt.Errorf("extracting layers: %w (use --in-place to extract into it)", err)
+		}
+		if errors.Is(err, utils.ErrOutputExists) {
+			return fmt.Errorf("extracting layers: %w (use --replace to replace it, or --in-place to extract into it)", err)
 		}
 		if err != nil {
-			fmt.Println("Error extracting layers:", err)
-			return
+			if t != nil && t.hint != nil {
+				if hint := t.hint(err); hint != "" {
+					return fmt.Errorf("extracting layers: %w (%s)", err, hint)
+				}
+			}
+			return fmt.Errorf("extracting layers: %w", err)
 		}
 
-		fmt.Println("Layers extracted successfully to", outputDir)
+		for _, w := range res.Warnings {
+			fmt.Fprintln(cmd.ErrOrStderr(), "Warning:", w)
+		}
+		into, config := "directory", "Config"
+		if t != nil {
+			into, config = t.output()
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Extracted %d/%d %s layers into %s %s\n",
+			len(res.Layers), len(res.Layers)+len(res.Skipped), res.ImageType, into, res.OutputDir)
+		fmt.Fprintln(cmd.OutOrStdout(), "Layers extracted successfully to", res.OutputDir)
+		if res.ConfigFile != "" {
+			fmt.Fprintln(cmd.OutOrStdout(), config, "written to", res.ConfigFile)
+		}
+		return nil
 	},
 }
+
+// Fails if a flag of another image type than imageType was given
+func checkExtractFlags(imageType string) error {
+	var err error
+	for _, name := range slices.Sorted(maps.Keys(extractTypes)) {
+		if name == imageType {
+			continue
+		}
+		extractTypes[name].flags.VisitAll(func(f *pflag.Flag) {
+			if f.Changed && err == nil {
+				err = fmt.Errorf("--%s only applies to %s images, not %s", f.Name, strings.ToUpper(name), imageType)
+			}
+		})
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/lxc"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var extractLxcFlags struct {
+	idmap         []string
+	config        string
+	noConfig      bool
+	format        string
+	fsSize        string
+	fsCompression string
+}
+
+func init() {
+	f := pflag.NewFlagSet("lxc", pflag.ContinueOnError)
+	f.StringArrayVar(&extractLxcFlags.idmap, "idmap", nil, "Shift the owners of LXC files by an ID mapping [u:|g:]CONTAINER:HOST:SIZE, e.g. 0:100000:65536; HOST ranges must be in /etc/subuid and /etc/subgid when not run as root (repeatable)")
+	f.StringVar(&extractLxcFlags.config, "lxc-config", "", "Where to write the LXC container config (default: config next to the output directory)")
+	f.BoolVar(&extractLxcFlags.noConfig, "no-lxc-config", false, "Do not write an LXC container config")
+	f.StringVar(&extractLxcFlags.format, "format", "", "Root filesystem format of LXC images: dir, ext4 (e2fsprogs), squashfs (sqfstar) or erofs (mkfs.erofs); not with --idmap or --in-place (default dir)")
+	f.StringVar(&extractLxcFlags.fsSize, "fs-size", "", "Size of an ext4 root filesystem image, e.g. 2G (default: sized to fit)")
+	f.StringVar(&extractLxcFlags.fsCompression, "fs-compression", "", "Compression of a squashfs or erofs root filesystem image, e.g. zstd, xz or lz4hc,12 (erofs only takes a level; default: that of the mkfs tool)")
+	registerExtractType(pextraoci.PextraImageTypeLxc, &extractType{
+		flags:   f,
+		options: extractLxcOptions,
+		output:  extractLxcOutput,
+		hint:    extractLxcHint,
+	})
+	extractCmd.MarkFlagsMutuallyExclusive("lxc-config", "no-lxc-config")
+}
+
+// Extracting with an ID map as an unprivileged user runs the CLI again in a user
+// namespace set up with it
+func extractLxcOptions(cmd *cobra.Command) (any, func() error, error) {
+	idmap, err := lxc.ParseIDMap(extractLxcFlags.idmap)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fsSize int64
+	if extractLxcFlags.fsSize != "" {
+		if fsSize, err = utils.ParseSize(extractLxcFlags.fsSize); err != nil {
+			return nil, nil, fmt.Errorf("--fs-size: %w", err)
+		}
+	}
+	opts := lxc.ExtractOptions{
+		IDMap:       idmap,
+		ConfigPath:  extractLxcFlags.config,
+		NoConfig:    extractLxcFlags.noConfig,
+		Format:      extractLxcFlags.format,
+		ImageSize:   fsSize,
+		Compression: extractLxcFlags.fsCompression,
+	}
+	if inUserNamespaceChild() {
+		if err := enterUserNamespace(); err != nil {
+			return nil, nil, err
+		}
+		// The kernel maps the IDs of the files written in the user namespace
+		opts.IDsMapped = true
+	} else if !idmap.IsIdentity() && os.Geteuid() != 0 {
+		return nil, func() error { return runInUserNamespace(cmd.Context(), idmap) }, nil
+	}
+	return opts, nil, nil
+}
+
+func extractLxcOutput() (string, string) {
+	if extractLxcFlags.format != "" && extractLxcFlags.format != lxc.FormatDir {
+		return extractLxcFlags.format + " image", "Container config"
+	}
+	return "directory", "Container config"
+}
+
+func extractLxcHint(err error) string {
+	if errors.Is(err, lxc.ErrConfigExists) {
+		return "use --lxc-config to write it elsewhere, or --no-lxc-config"
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/qemu"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var extractQemuFlags struct {
+	vmDefinition  string
+	diskFormat    string
+	compress      bool
+	preallocation string
+	clusterSize   string
+	compat        string
+	unflattened   string
+}
+
+func init() {
+	f := pflag.NewFlagSet("qemu", pflag.ContinueOnError)
+	f.StringVar(&extractQemuFlags.vmDefinition, "vm-definition", "", `Also write a VM definition for QEMU images: "qemu" (a vm.sh script) or "libvirt" (domain.xml)`)
+	f.StringVar(&extractQemuFlags.diskFormat, "disk-format", "", "Format of flattened QEMU disks: qcow2, raw, vmdk or vhdx (default: that of the layer annotations, or qcow2)")
+	f.BoolVar(&extractQemuFlags.compress, "compress", false, "Compress flattened qcow2 or vmdk disks (--compress=false turns off compression the layers ask for)")
+	f.StringVar(&extractQemuFlags.preallocation, "preallocation", "", "Preallocation of flattened qcow2 or raw disks: off, metadata (qcow2 only), falloc or full")
+	f.StringVar(&extractQemuFlags.clusterSize, "cluster-size", "", "Cluster size of flattened qcow2 disks, e.g. 64K")
+	f.StringVar(&extractQemuFlags.compat, "compat", "", "Compatibility level of flattened qcow2 disks: 0.10 or 1.1")
+	f.StringVar(&extractQemuFlags.unflattened, "unflattened", qemu.UnflattenedSkip, `What to do with QEMU layers that are not flattened: "skip" or "copy" (into the output directory, backing files rewritten)`)
+	registerExtractType(pextraoci.PextraImageTypeQemu, &extractType{
+		flags:   f,
+		options: extractQemuOptions,
+		output:  extractQemuOutput,
+	})
+}
+
+func extractQemuOptions(cmd *cobra.Command) (any, func() error, error) {
+	disk := qemu.DiskOptions{
+		Format:        extractQemuFlags.diskFormat,
+		Preallocation: extractQemuFlags.preallocation,
+		Compat:        extractQemuFlags.compat,
+	}
+	if cmd.Flags().Changed("compress") {
+		disk.Compress = &extractQemuFlags.compress
+	}
+	if extractQemuFlags.clusterSize != "" {
+		var err error
+		if disk.ClusterSize, err = utils.ParseSize(extractQemuFlags.clusterSize); err != nil {
+			return nil, nil, fmt.Errorf("--cluster-size: %w", err)
+		}
+	}
+	return qemu.ExtractOptions{
+		VMDefinition: extractQemuFlags.vmDefinition,
+		Disk:         disk,
+		Unflattened:  extractQemuFlags.unflattened,
+	}, nil, nil
+}
+
+func extractQemuOutput() (string, string) {
+	return "directory", "VM definition"
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/lxc"
+	"github.com/spf13/cobra"
+)
+
+var importDockerFlags struct {
+	out         string
+	compression string
+	image       string
+	tag         string
+}
+
+func init() {
+	importCmd.AddCommand(importDockerCmd)
+	f := importDockerCmd.Flags()
+	f.StringVar(&importDockerFlags.out, "out", "", "OCI image layout to write the images into")
+	f.StringVar(&importDockerFlags.compression, "compression", "", "Recompress layers: zstd, gzip or none (default: keep the archive's compression)")
+	f.StringVar(&importDockerFlags.image, "image", "", "Import only the image with this repository tag, e.g. debian:12")
+	f.StringVar(&importDockerFlags.tag, "tag", "", "Reference name for the image in the layout (default: its repository tags)")
+	_ = importDockerCmd.MarkFlagRequired("out")
+}
+
+var importDockerCmd = &cobra.Command{
+	Use:   "docker-archive IMAGE.tar --out LAYOUT",
+	Short: "Import a docker save archive as Pextra LXC images",
+	Long: `Imports the images of a 'docker save' archive as Pextra LXC images. Both the
+manifest.json format and the older repositories format are read. The archive may be
+compressed, an extracted directory or "-" for stdin.
+
+Each Docker layer becomes an LXC layer and the Docker config becomes the OCI image
+config. Layers keep their compression unless --compression is given. Images are
+tagged with their repository tags (e.g. debian:12) unless --tag is given.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		descs, err := lxc.ImportDockerArchive(args[0], importDockerFlags.out, lxc.ImportOptions{
+			Compression: importDockerFlags.compression,
+			Image:       importDockerFlags.image,
+			Tag:         importDockerFlags.tag,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, desc := range descs {
+			fmt.Fprintf(cmd.OutOrStdout(), "Imported LXC image %s into %s\n", desc.Digest, importDockerFlags.out)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+// Version of the JSON document printed by `inspect --json`. Bump on breaking changes.
+const inspectSchemaVersion = 2
+
+var (
+	inspectJson     bool
+	inspectPlatform string
+)
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+	inspectCmd.Flags().BoolVarP(&inspectJson, "json", "j", false, "Output information in JSON format")
+	inspectCmd.Flags().StringVar(&inspectPlatform, "platform", "", selectPlatformUsage)
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [image-path[:tag][@digest]]",
+	Short: "Show details of a Pextra OCI image",
+	Long: `Shows the manifest selected from a Pextra-specific OCI image, together with
+its config, layers and Pextra annotations.
+
+The image may be a layout directory, an OCI archive (.tar, .tar.gz or .tar.zst) or "-"
+to read an archive from stdin. A tag or digest narrows down the manifests to select from.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		platform, err := parseSelectPlatform(inspectPlatform)
+		if err != nil {
+			return err
+		}
+		img, err := selectImage(args[0], platform)
+		if err != nil {
+			return err
+		}
+		defer img.Layout.Close()
+
+		out := newInspectOutput(img)
+		if inspectJson {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(out)
+		}
+		return out.writeTable(cmd.OutOrStdout())
+	},
+}
+
+type inspectOutput struct {
+	SchemaVersion      int                `json:"schemaVersion"`
+	Path               string             `json:"path"`
+	LayoutVersion      string             `json:"layoutVersion"`
+	ImageType          string             `json:"imageType"`
+	SelectedDescriptor inspectDescriptor  `json:"selectedDescriptor"`
+	SelectionReason    string             `json:"selectionReason"`
+	ManifestDigest     string             `json:"manifestDigest"`
+	ConfigDigest       string             `json:"configDigest"`
+	Layers             []inspectLayer     `json:"layers"`
+	Config             inspectImageConfig `json:"config"`
+}
+
+type inspectDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *v1.Platform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type inspectLayer struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	// Facts from the image type's handler, e.g. fileName and flatten for qcow2 layers
+	Details map[string]any `json:"details,omitempty"`
+}
+
+type inspectImageConfig struct {
+	Env    []string          `json:"env"`
+	Labels map[string]string `json:"labels"`
+}
+
+func newInspectOutput(img *pextraoci.Image) *inspectOutput {
+	out := &inspectOutput{
+		SchemaVersion: inspectSchemaVersion,
+		Path:          img.Layout.String(),
+		LayoutVersion: img.LayoutVersion,
+		ImageType:     img.Type,
+		SelectedDescriptor: inspectDescriptor{
+			MediaType:   img.Descriptor.MediaType,
+			Digest:      img.Descriptor.Digest.String(),
+			Size:        img.Descriptor.Size,
+			Platform:    img.Descriptor.Platform,
+			Annotations: img.Descriptor.Annotations,
+		},
+		SelectionReason: img.SelectionReason,
+		ManifestDigest:  img.Descriptor.Digest.String(),
+		ConfigDigest:    img.Manifest.Config.Digest.String(),
+		Layers:          make([]inspectLayer, 0, len(img.Manifest.Layers)),
+		Config: inspectImageConfig{
+			Env:    img.Config.Config.Env,
+			Labels: img.Config.Config.Labels,
+		},
+	}
+	// Keep the JSON shape stable: empty collections instead of null
+	if out.Config.Env == nil {
+		out.Config.Env = []string{}
+	}
+	if out.Config.Labels == nil {
+		out.Config.Labels = map[string]string{}
+	}
+
+	handler, _ := pextraoci.LookupHandler(img.Type)
+	for _, l := range img.Manifest.Layers {
+		il := inspectLayer{
+			MediaType: l.MediaType,
+			Digest:    l.Digest.String(),
+			Size:      l.Size,
+		}
+		if handler != nil {
+			il.Details = handler.DescribeLayer(l)
+		}
+		out.Layers = append(out.Layers, il)
+	}
+	return out
+}
+
+func (o *inspectOutput) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	platform := "-"
+	if p := o.SelectedDescriptor.Platform; p != nil {
+		platform = utils.FormatPlatform(p)
+	}
+	fmt.Fprintf(tw, "Path:\t%s\n", o.Path)
+	fmt.Fprintf(tw, "Layout version:\t%s\n", o.LayoutVersion)
+	fmt.Fprintf(tw, "Image type:\t%s\n", o.ImageType)
+	fmt.Fprintf(tw, "Manifest digest:\t%s\n", o.ManifestDigest)
+	fmt.Fprintf(tw, "Manifest size:\t%d\n", o.SelectedDescriptor.Size)
+	fmt.Fprintf(tw, "Platform:\t%s\n", platform)
+	fmt.Fprintf(tw, "Selected because:\t%s\n", o.SelectionReason)
+	fmt.Fprintf(tw, "Config digest:\t%s\n", o.ConfigDigest)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nLayers (%d):\n", len(o.Layers))
+	fmt.Fprintln(tw, "  #\tMEDIA TYPE\tSIZE\tDIGEST\tDETAILS")
+	for i, l := range o.Layers {
+		details := "-"
+		if len(l.Details) > 0 {
+			var kv []string
+			for _, k := range slices.Sorted(maps.Keys(l.Details)) {
+				kv = append(kv, fmt.Sprintf("%s=%v", k, l.Details[k]))
+			}
+			details = strings.Join(kv, " ")
+		}
+		fmt.Fprintf(tw, "  %d\t%s\t%d\t%s\t%s\n", i, l.MediaType, l.Size, l.Digest, details)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nEnv (%d):\n", len(o.Config.Env))
+	for _, e := range o.Config.Env {
+		fmt.Fprintf(w, "  %s\n", e)
+	}
+	fmt.Fprintf(w, "\nLabels (%d):\n", len(o.Config.Labels))
+	for _, k := range slices.Sorted(maps.Keys(o.Config.Labels)) {
+		fmt.Fprintf(tw, "  %s\t%s\n", k, o.Config.Labels[k])
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+)
+
+// Version of the JSON document printed by `list --json`. Bump on breaking changes.
+const listSchemaVersion = 1
+
+var listFlags struct {
+	json      bool
+	imageType string
+	platform  string
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	f := listCmd.Flags()
+	f.BoolVarP(&listFlags.json, "json", "j", false, "Output information in JSON format")
+	f.StringVar(&listFlags.imageType, "type", "", "Only list images of this Pextra image type, e.g. lxc or qemu")
+	f.StringVar(&listFlags.platform, "platform", "", "Only list images that match this platform as os/arch[/variant]")
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list [image-path]",
+	Short: "List the Pextra images in an OCI layout",
+	Long: `Lists every Pextra image in an OCI layout, including images in nested indexes,
+with its ref name, manifest digest, type, platform, layer count, total compressed
+layer size and creation date. The layout may be a directory, an OCI archive or "-"
+for an archive on stdin.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := pextraoci.ListOptions{ImageType: listFlags.imageType}
+		if _, ok := pextraoci.LookupHandler(opts.ImageType); opts.ImageType != "" && !ok {
+			return fmt.Errorf("unsupported image type %q (want one of %s)", opts.ImageType, strings.Join(pextraoci.ImageTypes(), ", "))
+		}
+		if listFlags.platform != "" {
+			p, err := utils.ParsePlatform(listFlags.platform)
+			if err != nil {
+				return err
+			}
+			opts.Platform = p
+		}
+
+		layout, err := pextraoci.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer layout.Close()
+		images, err := layout.List(opts)
+		if err != nil {
+			return err
+		}
+
+		path := args[0]
+		if path != "-" {
+			path = filepath.Clean(path)
+		}
+		out := newListOutput(path, images)
+		if listFlags.json {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(out)
+		}
+		return out.writeTable(cmd.OutOrStdout())
+	},
+}
+
+type listOutput struct {
+	SchemaVersion int         `json:"schemaVersion"`
+	Path          string      `json:"path"`
+	Images        []listImage `json:"images"`
+}
+
+type listImage struct {
+	RefName   string       `json:"refName,omitempty"`
+	Digest    string       `json:"digest"`
+	ImageType string       `json:"imageType"`
+	Platform  *v1.Platform `json:"platform,omitempty"`
+	Layers    int          `json:"layers"`
+	Size      int64        `json:"size"`
+	Created   *time.Time   `json:"created,omitempty"`
+	// Nested indexes leading to the manifest, outermost first
+	Via []string `json:"via,omitempty"`
+}
+
+func newListOutput(path string, images []pextraoci.ImageSummary) *listOutput {
+	out := &listOutput{
+		SchemaVersion: listSchemaVersion,
+		Path:          path,
+		Images:        make([]listImage, 0, len(images)),
+	}
+	for _, img := range images {
+		li := listImage{
+			RefName:   img.RefName,
+			Digest:    img.Digest.String(),
+			ImageType: img.ImageType,
+			Platform:  img.Platform,
+			Layers:    img.Layers,
+			Size:      img.Size,
+			Created:   img.Created,
+		}
+		for _, d := range img.Via {
+			li.Via = append(li.Via, d.String())
+		}
+		out.Images = append(out.Images, li)
+	}
+	return out
+}
+
+func (o *listOutput) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REF NAME\tDIGEST\tTYPE\tPLATFORM\tLAYERS\tSIZE\tCREATED")
+	for _, img := range o.Images {
+		ref, platform, created := "-", "-", "-"
+		if img.RefName != "" {
+			ref = img.RefName
+		}
+		if img.Platform != nil {
+			platform = utils.FormatPlatform(img.Platform)
+		}
+		if img.Created != nil {
+			created = img.Created.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", ref, img.Digest, img.ImageType, platform, img.Layers, img.Size, created)
+	}
+	return tw.Flush()
+}
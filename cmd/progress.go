@@ -0,0 +1,144 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+)
+
+// Help text of the --progress flags
+const progressUsage = `Progress output on stderr: "bar", "json" (one event per line), "none", or "auto" for a bar when stderr is a terminal`
+
+// How often progress is redrawn or written; the start and end of each layer are
+// always written
+const progressInterval = 200 * time.Millisecond
+
+const progressBarWidth = 30
+
+// Writes progress events as a progress bar or as newline-delimited JSON
+type progressWriter struct {
+	w    io.Writer
+	json bool
+	last time.Time
+	// Length of the bar line currently shown, 0 after a newline
+	lineLen int
+}
+
+// Returns a writer for the --progress mode, or nil if progress is not shown
+func newProgressWriter(mode string, w io.Writer) (*progressWriter, error) {
+	switch mode {
+	case "auto":
+		if !isTerminal(w) {
+			return nil, nil
+		}
+		return &progressWriter{w: w}, nil
+	case "bar":
+		return &progressWriter{w: w}, nil
+	case "json":
+		return &progressWriter{w: w, json: true}, nil
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported progress mode %q (want auto, bar, json or none)", mode)
+}
+
+// The ProgressFunc to extract with; nil if p is nil
+func (p *progressWriter) progressFunc() pextraoci.ProgressFunc {
+	if p == nil {
+		return nil
+	}
+	return p.event
+}
+
+func (p *progressWriter) event(e pextraoci.ProgressEvent) {
+	if e.Done != 0 && e.Done != e.Total && time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+
+	if p.json {
+		_ = json.NewEncoder(p.w).Encode(e)
+		return
+	}
+
+	filled := progressBarWidth
+	if e.Total > 0 {
+		filled = int(e.Done * progressBarWidth / e.Total)
+	}
+	line := fmt.Sprintf("%-7s %s [%s%s] %3d%% %s/%s, %d%% overall",
+		e.Phase, shortDigest(e.Layer.Encoded()),
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled),
+		percent(e.Done, e.Total), formatBytes(e.Done), formatBytes(e.Total),
+		percent(e.OverallDone, e.OverallTotal))
+	// Pad to overwrite what is left of a longer previous line
+	fmt.Fprintf(p.w, "\r%-*s", p.lineLen, line)
+	p.lineLen = len(line)
+	if e.OverallDone == e.OverallTotal {
+		p.close()
+	}
+}
+
+// Ends the bar line, e.g. before an error is printed
+func (p *progressWriter) close() {
+	if p != nil && p.lineLen > 0 {
+		fmt.Fprintln(p.w)
+		p.lineLen = 0
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func shortDigest(hex string) string {
+	if len(hex) > 12 {
+		return hex[:12]
+	}
+	return hex
+}
+
+func percent(done, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+	return done * 100 / total
+}
+
+// Formats n bytes with a binary unit, e.g. "1.5 GiB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/PextraCloud/pce-osi/internal/registry"
+	"github.com/spf13/cobra"
+)
+
+var pullFlags struct {
+	registryFlags
+	platform string
+	tag      string
+}
+
+func init() {
+	rootCmd.AddCommand(pullCmd)
+	f := pullCmd.Flags()
+	pullFlags.register(f)
+	f.StringVar(&pullFlags.platform, "platform", "", "Select the manifest for this platform from multi-platform indexes as os/arch[/variant] (default: host platform)")
+	f.StringVar(&pullFlags.tag, "tag", "", "Reference name for the image in the layout (default: the tag pulled)")
+}
+
+var pullCmd = &cobra.Command{
+	Use:   "pull REGISTRY/REPOSITORY[:TAG][@DIGEST] LAYOUT",
+	Short: "Pull a Pextra OCI image from a registry into a layout",
+	Long: `Pulls a Pextra-specific OCI image from a registry that speaks the OCI distribution
+protocol into an OCI image layout. The layout is created if it does not exist.
+
+Multi-platform indexes are resolved to the manifest for --platform. Every blob is
+verified against its digest before it is stored, and blobs already in the layout are
+not downloaded again. The image is recorded in index.json under the tag pulled, or
+under --tag.
+
+Registries are accessed anonymously unless --username is given; basic and bearer
+token authentication are supported.`,
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer cancelOnSignal(cmd)()
+		ref, err := registry.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
+		platform, err := parseSelectPlatform(pullFlags.platform)
+		if err != nil {
+			return err
+		}
+		opts, err := pullFlags.options(cmd.InOrStdin())
+		if err != nil {
+			return err
+		}
+
+		res, err := registry.Pull(cmd.Context(), ref, args[1], registry.PullOptions{
+			Options:  opts,
+			Platform: platform,
+			Tag:      pullFlags.tag,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Pulled %s as %s into %s (%d blobs fetched, %d already present)\n",
+			ref, res.Descriptor.Digest, args[1], res.Fetched, res.Skipped)
+		return nil
+	},
+}
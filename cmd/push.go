@@ -0,0 +1,93 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/registry"
+	"github.com/spf13/cobra"
+)
+
+var pushFlags struct {
+	registryFlags
+	mountFrom []string
+	chunkSize int64
+}
+
+func init() {
+	rootCmd.AddCommand(pushCmd)
+	f := pushCmd.Flags()
+	pushFlags.register(f)
+	f.StringSliceVar(&pushFlags.mountFrom, "mount-from", nil, "Mount blobs that exist in these repositories of the same registry instead of uploading them")
+	f.Int64Var(&pushFlags.chunkSize, "chunk-size", 0, "Upload blobs larger than this many MiB in chunks of that size (default: every blob in one request)")
+}
+
+var pushCmd = &cobra.Command{
+	Use:   "push LAYOUT[:TAG][@DIGEST] REGISTRY/REPOSITORY[:TAG]",
+	Short: "Push Pextra OCI images from a layout to a registry",
+	Long: `Pushes the Pextra-specific OCI images of a layout to a registry that speaks the OCI
+distribution protocol. The layout may be a directory, an OCI archive or "-" for an
+archive on stdin. TAG and DIGEST select images by ref name and digest; every image in
+the layout is pushed if neither is given.
+
+A single image is tagged directly. Several images (e.g. one per platform) are pushed
+by digest and tagged through a new image index. Manifests and blobs are uploaded
+unchanged, so their digests and Pextra annotations are preserved.
+
+Blobs the registry already has are skipped. Blobs that exist in a repository given
+with --mount-from are mounted instead of uploaded.
+
+Registries are accessed anonymously unless --username is given; basic and bearer
+token authentication are supported.`,
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer cancelOnSignal(cmd)()
+		image, err := oci.ParseImageReference(args[0])
+		if err != nil {
+			return err
+		}
+		ref, err := registry.ParseReference(args[1])
+		if err != nil {
+			return err
+		}
+		if image.Path == "-" && pushFlags.passwordStdin {
+			return fmt.Errorf("--password-stdin cannot be used when the layout is read from stdin")
+		}
+		if pushFlags.chunkSize < 0 {
+			return fmt.Errorf("invalid --chunk-size %d", pushFlags.chunkSize)
+		}
+		opts, err := pushFlags.options(cmd.InOrStdin())
+		if err != nil {
+			return err
+		}
+
+		res, err := registry.Push(cmd.Context(), image, ref, registry.PushOptions{
+			Options:   opts,
+			MountFrom: pushFlags.mountFrom,
+			ChunkSize: pushFlags.chunkSize << 20,
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Pushed %s as %s (%d blobs uploaded, %d mounted, %d already present)\n",
+			ref, res.Descriptor.Digest, res.Uploaded, res.Mounted, res.Skipped)
+		return nil
+	},
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/PextraCloud/pce-osi/internal/registry"
+	"github.com/spf13/pflag"
+)
+
+// Flags shared by the commands that talk to a registry
+type registryFlags struct {
+	username      string
+	passwordStdin bool
+	plainHTTP     bool
+}
+
+func (r *registryFlags) register(f *pflag.FlagSet) {
+	f.StringVarP(&r.username, "username", "u", "", "Registry username (default: anonymous)")
+	f.BoolVar(&r.passwordStdin, "password-stdin", false, "Read the registry password from stdin")
+	f.BoolVar(&r.plainHTTP, "plain-http", false, "Use http instead of https to talk to the registry")
+}
+
+// Returns the client options for the flags, reading the password from stdin if asked
+func (r *registryFlags) options(stdin io.Reader) (registry.Options, error) {
+	opts := registry.Options{Username: r.username, PlainHTTP: r.plainHTTP}
+	if r.passwordStdin {
+		if r.username == "" {
+			return opts, fmt.Errorf("--password-stdin requires --username")
+		}
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return opts, fmt.Errorf("read password from stdin: %w", err)
+		}
+		opts.Password = strings.TrimRight(string(b), "\r\n")
+	}
+	return opts, nil
+}
@@ -16,9 +16,19 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	// Image types the CLI supports
+	_ "github.com/PextraCloud/pce-osi/pkg/pextra-oci/lxc"
+	_ "github.com/PextraCloud/pce-osi/pkg/pextra-oci/qemu"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
 )
 
@@ -27,7 +37,8 @@ var rootCmd = &cobra.Command{
 	Short: "CLI tool for working with Pextra-specific OCI images.",
 	Long: `pce-oci is a CLI for creating and managing
 OCI-compliant images with Pextra-specific extensions.
-It does not interact with registries.
+Images can be pulled from and pushed to registries that
+speak the OCI distribution protocol.
 
 Pextra-specific extensions to the OCI image specification
 are documented at:
@@ -35,11 +46,102 @@ https://github.com/PextraCloud/pce-oci/blob/master/PEXTRA_OCI_EXTENSIONS.md.
 
 Copyright (C) 2025 Pextra Inc. This tool is licensed
 under the Apache License, Version 2.0.`,
+	// Errors are printed once by Execute
+	SilenceErrors: true,
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	cmd, err := rootCmd.ExecuteC()
+	if err == nil {
+		return
 	}
+	var code exitCodeError
+	if errors.As(err, &code) {
+		os.Exit(int(code))
+	}
+	fmt.Fprintln(os.Stderr, err)
+
+	var interrupted interruptedError
+	if errors.As(context.Cause(cmd.Context()), &interrupted) {
+		fmt.Fprintln(os.Stderr, interrupted)
+		os.Exit(interrupted.exitCode())
+	}
+	os.Exit(1)
+}
+
+// Makes Execute exit with this code without printing anything, e.g. that of another
+// process that already reported its error
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+// Why the context of a command was cancelled by cancelOnSignal
+type interruptedError struct {
+	sig os.Signal
+}
+
+func (e interruptedError) Error() string {
+	return fmt.Sprintf("interrupted by signal: %v", e.sig)
+}
+
+// 128 + the signal number, as shells report commands killed by a signal
+func (e interruptedError) exitCode() int {
+	if sig, ok := e.sig.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return 1
+}
+
+// Cancels the context of cmd on SIGINT or SIGTERM, so that the command can stop its
+// child processes and remove partial output before it exits. A second signal
+// terminates the CLI at once. The returned function stops listening for signals.
+func cancelOnSignal(cmd *cobra.Command) (stop func()) {
+	ctx, cancel := context.WithCancelCause(cmd.Context())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			signal.Stop(sigs)
+			cancel(interruptedError{sig: sig})
+		case <-ctx.Done():
+		}
+	}()
+	cmd.SetContext(ctx)
+	return func() {
+		signal.Stop(sigs)
+		cancel(nil)
+	}
+}
+
+// Help text shared by the --platform flags that select a manifest
+const selectPlatformUsage = "Select the manifest for this platform as os/arch[/variant] (default: host platform)"
+
+// Parses a --platform flag that selects a manifest. Empty selects the host platform (nil).
+func parseSelectPlatform(s string) (*v1.Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return utils.ParsePlatform(s)
+}
+
+// Opens the layout of the image reference s and selects the image it names. The
+// caller closes the image's layout.
+func selectImage(s string, platform *v1.Platform) (*pextraoci.Image, error) {
+	ref, err := pextraoci.ParseImageReference(s)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := pextraoci.Open(ref.Path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := layout.Select(pextraoci.SelectOptions{Platform: platform, Tag: ref.Tag, Digest: ref.Digest})
+	if err != nil {
+		layout.Close()
+		return nil, err
+	}
+	return img, nil
 }
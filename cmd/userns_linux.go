@@ -0,0 +1,171 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/lxc"
+	"golang.org/x/sys/unix"
+)
+
+// Set in the environment of the copy of the CLI that runs in a user namespace
+const userNSEnv = "PCE_OCI_USERNS_CHILD"
+
+// Capabilities the extracting child needs to become root and to write files owned by
+// others, with their xattrs and device nodes
+var userNSCaps = []uintptr{
+	unix.CAP_CHOWN, unix.CAP_DAC_OVERRIDE, unix.CAP_DAC_READ_SEARCH, unix.CAP_FOWNER,
+	unix.CAP_FSETID, unix.CAP_MKNOD, unix.CAP_SETFCAP, unix.CAP_SETGID, unix.CAP_SETUID,
+}
+
+// Reports whether the CLI was started by runInUserNamespace
+func inUserNamespaceChild() bool {
+	return os.Getenv(userNSEnv) != ""
+}
+
+// Runs the CLI again with the same arguments, as root of a new user namespace whose ID
+// mappings are set up from ids by newuidmap and newgidmap, so that an unprivileged user
+// can create files owned by their subordinate IDs. The invoking user's own IDs are
+// mapped as well, right after the ranges of ids, so that the namespace root can write to
+// the user's directories. Cancelling ctx forwards the signal that cancelled it.
+func runInUserNamespace(ctx context.Context, ids lxc.IDMap) error {
+	if len(ids.UIDs) == 0 || len(ids.GIDs) == 0 {
+		return errors.New("mapping IDs as an unprivileged user needs both user and group ID mappings")
+	}
+	for _, tool := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("mapping IDs as an unprivileged user needs %s (usually in the uidmap package): %w", tool, err)
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	child := exec.Command("/proc/self/exe", os.Args[1:]...)
+	child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+	child.Env = append(os.Environ(), userNSEnv+"=1")
+	child.ExtraFiles = []*os.File{r}
+	// The child runs as an unmapped user until the mappings are written, so exec would
+	// drop the capabilities it has in the new namespace; ambient ones survive exec. Its
+	// own process group keeps terminal signals away from the child, which only gets the
+	// one forwarded below.
+	child.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER,
+		AmbientCaps: userNSCaps,
+		Setpgid:     true,
+	}
+	err = child.Start()
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("failed to create user namespace: %w", err)
+	}
+
+	if err := writeIDMaps(child.Process.Pid, ids); err != nil {
+		child.Process.Kill()
+		child.Wait()
+		return err
+	}
+	// Lets the child continue
+	if _, err := w.Write([]byte{1}); err != nil {
+		return err
+	}
+	w.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		sig := os.Signal(syscall.SIGTERM)
+		var interrupted interruptedError
+		if errors.As(context.Cause(ctx), &interrupted) {
+			sig = interrupted.sig
+		}
+		child.Process.Signal(sig)
+	})
+	defer stop()
+
+	err = child.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return exitCodeError(128 + int(ws.Signal()))
+		}
+		return exitCodeError(exitErr.ExitCode())
+	}
+	return err
+}
+
+func writeIDMaps(pid int, ids lxc.IDMap) error {
+	for _, m := range []struct {
+		tool   string
+		ranges []lxc.IDMapping
+		own    int
+	}{
+		{"newuidmap", ids.UIDs, os.Getuid()},
+		{"newgidmap", ids.GIDs, os.Getgid()},
+	} {
+		args := []string{strconv.Itoa(pid)}
+		for _, r := range withOwnID(m.ranges, uint32(m.own)) {
+			args = append(args, strconv.FormatUint(uint64(r.ContainerID), 10), strconv.FormatUint(uint64(r.HostID), 10), strconv.FormatUint(uint64(r.Size), 10))
+		}
+		if out, err := exec.Command(m.tool, args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %w: %s", m.tool, err, bytes.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// Adds a mapping for the host ID own after the highest container ID of ranges, unless
+// own is mapped already
+func withOwnID(ranges []lxc.IDMapping, own uint32) []lxc.IDMapping {
+	var next uint64
+	for _, r := range ranges {
+		if own >= r.HostID && uint64(own) < uint64(r.HostID)+uint64(r.Size) {
+			return ranges
+		}
+		next = max(next, uint64(r.ContainerID)+uint64(r.Size))
+	}
+	if next >= 1<<32-1 {
+		return ranges
+	}
+	return append(ranges[:len(ranges):len(ranges)], lxc.IDMapping{ContainerID: uint32(next), HostID: own, Size: 1})
+}
+
+// Waits until runInUserNamespace has set up the ID mappings and becomes root of the
+// user namespace
+func enterUserNamespace() error {
+	f := os.NewFile(3, "userns-sync")
+	defer f.Close()
+	if _, err := io.ReadFull(f, make([]byte, 1)); err != nil {
+		return fmt.Errorf("user namespace was not set up: %w", err)
+	}
+	os.Unsetenv(userNSEnv)
+	if err := syscall.Setresgid(0, 0, 0); err != nil {
+		return fmt.Errorf("failed to become root in the user namespace: %w", err)
+	}
+	if err := syscall.Setresuid(0, 0, 0); err != nil {
+		return fmt.Errorf("failed to become root in the user namespace: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+
+	"github.com/PextraCloud/pce-osi/pkg/pextra-oci/lxc"
+)
+
+func inUserNamespaceChild() bool { return false }
+
+func runInUserNamespace(context.Context, lxc.IDMap) error {
+	return errors.New("mapping IDs requires root on this platform")
+}
+
+func enterUserNamespace() error { return nil }
@@ -0,0 +1,64 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [image-path]",
+	Short: "Check the integrity of a Pextra OCI image layout",
+	Long: `Walks every descriptor reachable from index.json (nested indexes, manifests,
+configs and layers), checking that each blob exists and matches its size and
+digest, and that Pextra manifests follow the Pextra OCI extension rules.
+The layout may be a directory, an OCI archive (.tar, .tar.gz or .tar.zst) or "-"
+to read an archive from stdin.
+
+All problems are reported at once. The command exits non-zero if any are found.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		layout, err := pextraoci.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer layout.Close()
+		res, err := layout.Validate()
+		if err != nil {
+			return err
+		}
+		if len(res.Problems) > 0 {
+			for _, p := range res.Problems {
+				fmt.Fprintln(cmd.OutOrStdout(), p)
+			}
+			return fmt.Errorf("%d problem(s) found in %s", len(res.Problems), args[0])
+		}
+
+		fmt.Fprintln(cmd.OutOrStdout(), "Image layout is valid:", args[0])
+		if res.PextraImages == 0 {
+			fmt.Fprintln(cmd.OutOrStdout(), "It contains no Pextra images (no manifest is annotated with "+pextraoci.AnnotationPextraImageType+")")
+		}
+		return nil
+	},
+}
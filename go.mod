@@ -6,8 +6,12 @@ require github.com/spf13/cobra v1.10.1
 
 require github.com/opencontainers/go-digest v1.0.0
 
+require github.com/klauspost/compress v1.18.0
+
+require golang.org/x/sys v0.41.0
+
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/opencontainers/image-spec v1.1.1
-	github.com/spf13/pflag v1.0.9 // indirect
+	github.com/spf13/pflag v1.0.9
 )
@@ -0,0 +1,411 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive entries up to this size are kept in memory when a streamed archive is read
+// past them, so that JSON blobs can be read in any order
+const archiveMemLimit = 1 << 20
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Opens an OCI archive file. Uncompressed tars are indexed once and read in place;
+// compressed ones are streamed and re-read from the start when an entry behind the
+// current position is needed.
+func openArchive(name string) (Source, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(f, magic)
+	if bytes.HasPrefix(magic[:n], gzipMagic) || bytes.HasPrefix(magic[:n], zstdMagic) {
+		f.Close()
+		reopen := func() (io.ReadCloser, error) { return os.Open(name) }
+		return newStreamSource(name, reopen, nil)
+	}
+
+	s, err := newTarFileSource(name, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Maps an archive entry name to a layout path, e.g. "./blobs/sha256/<hex>" to
+// "blobs/sha256/<hex>". Returns "" for the archive root.
+func archiveEntryName(name string) string {
+	p := path.Clean("/" + name)
+	return strings.TrimPrefix(p, "/")
+}
+
+// Resolves a symlink or hardlink entry to the archive entry it refers to. Tools such as
+// docker save use links to store shared layers once.
+func archiveLinkTarget(hdr *tar.Header) string {
+	if hdr.Typeflag == tar.TypeSymlink && !path.IsAbs(hdr.Linkname) {
+		return archiveEntryName(path.Join(path.Dir(archiveEntryName(hdr.Name)), hdr.Linkname))
+	}
+	return archiveEntryName(hdr.Linkname)
+}
+
+// Links are followed at most this many times, so that link loops fail
+const maxArchiveLinks = 16
+
+// Returns a reader for the tar stream in r, which may be gzip or zstd compressed
+func newArchiveReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return io.NopCloser(br), nil
+	}
+}
+
+// An uncompressed OCI archive file, read in place through the offsets of its entries
+type tarFileSource struct {
+	name    string
+	f       *os.File
+	entries map[string]tarSpan
+	links   map[string]string
+}
+
+type tarSpan struct {
+	offset, size int64
+}
+
+// Tracks the position in a file, so the tar reader can still seek over entry data
+type positionReader struct {
+	f   *os.File
+	pos int64
+}
+
+func (r *positionReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *positionReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.f.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
+
+func newTarFileSource(name string, f *os.File) (*tarFileSource, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	pr := &positionReader{f: f}
+	tr := tar.NewReader(pr)
+	s := &tarFileSource{name: name, f: f, entries: make(map[string]tarSpan), links: make(map[string]string)}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive %s: %w", name, err)
+		}
+		if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+			s.links[archiveEntryName(hdr.Name)] = archiveLinkTarget(hdr)
+			continue
+		}
+		// Sparse entries have no contiguous data to read in place; layouts never use them
+		if hdr.Typeflag != tar.TypeReg || isSparseEntry(hdr) {
+			continue
+		}
+		s.entries[archiveEntryName(hdr.Name)] = tarSpan{offset: pr.pos, size: hdr.Size}
+	}
+	return s, nil
+}
+
+func isSparseEntry(hdr *tar.Header) bool {
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *tarFileSource) Open(name string) (io.ReadCloser, error) {
+	entry := name
+	for i := 0; i < maxArchiveLinks; i++ {
+		target, ok := s.links[entry]
+		if !ok {
+			break
+		}
+		entry = target
+	}
+	e, ok := s.entries[entry]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: s.name + ":" + name, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(io.NewSectionReader(s.f, e.offset, e.size)), nil
+}
+
+func (s *tarFileSource) LocalPath(string) (string, bool) { return "", false }
+
+func (s *tarFileSource) String() string { return s.name }
+
+func (s *tarFileSource) Close() error { return s.f.Close() }
+
+// An OCI archive read as a stream, e.g. a compressed file or stdin. Entries are handed
+// out straight from the stream when they are requested in archive order. Small entries
+// that are skipped are kept in memory; larger ones are read again from the start when
+// the archive can be reopened, and spilled to temporary files otherwise.
+type streamSource struct {
+	name   string
+	reopen func() (io.ReadCloser, error)
+
+	raw io.ReadCloser
+	dec io.ReadCloser
+	tr  *tar.Reader
+	// Incremented whenever the tar reader moves, to invalidate handed-out entry readers
+	gen int
+	eof bool
+
+	seen    map[string]bool
+	links   map[string]string
+	mem     map[string][]byte
+	spilled map[string]string
+	tmpDir  string
+}
+
+// Creates a stream source. With a reopen function the archive is read from it, and
+// re-read when needed; otherwise r is read once.
+func newStreamSource(name string, reopen func() (io.ReadCloser, error), r io.Reader) (*streamSource, error) {
+	s := &streamSource{
+		name:    name,
+		reopen:  reopen,
+		seen:    make(map[string]bool),
+		links:   make(map[string]string),
+		mem:     make(map[string][]byte),
+		spilled: make(map[string]string),
+	}
+	raw := io.NopCloser(r)
+	if reopen != nil {
+		var err error
+		if raw, err = reopen(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.start(raw); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *streamSource) start(raw io.ReadCloser) error {
+	dec, err := newArchiveReader(raw)
+	if err != nil {
+		raw.Close()
+		return fmt.Errorf("read archive %s: %w", s.name, err)
+	}
+	s.raw, s.dec, s.tr = raw, dec, tar.NewReader(dec)
+	s.eof = false
+	s.gen++
+	return nil
+}
+
+func (s *streamSource) stop() {
+	if s.dec != nil {
+		s.dec.Close()
+		s.raw.Close()
+		s.dec, s.raw, s.tr = nil, nil, nil
+	}
+}
+
+func (s *streamSource) Open(name string) (io.ReadCloser, error) {
+	return s.open(name, 0)
+}
+
+func (s *streamSource) open(name string, hops int) (io.ReadCloser, error) {
+	if target, ok := s.links[name]; ok && hops < maxArchiveLinks {
+		return s.open(target, hops+1)
+	}
+	if b, ok := s.mem[name]; ok {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	if p, ok := s.spilled[name]; ok {
+		return os.Open(p)
+	}
+
+	if s.seen[name] {
+		// Already streamed past it
+		if s.reopen == nil {
+			return nil, fmt.Errorf("%s was already read from %s and cannot be read again", name, s.name)
+		}
+		s.stop()
+		raw, err := s.reopen()
+		if err != nil {
+			return nil, err
+		}
+		if err := s.start(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	for !s.eof {
+		hdr, err := s.tr.Next()
+		s.gen++
+		if err == io.EOF {
+			s.eof = true
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive %s: %w", s.name, err)
+		}
+		entry := archiveEntryName(hdr.Name)
+		if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+			s.links[entry] = archiveLinkTarget(hdr)
+			if entry == name && hops < maxArchiveLinks {
+				return s.open(s.links[entry], hops+1)
+			}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		s.seen[entry] = true
+
+		if entry == name {
+			if hdr.Size <= archiveMemLimit {
+				b, err := s.keep(entry)
+				if err != nil {
+					return nil, err
+				}
+				return io.NopCloser(bytes.NewReader(b)), nil
+			}
+			return &streamEntry{s: s, gen: s.gen, name: name}, nil
+		}
+
+		// Keep what cannot be read again cheaply
+		if _, ok := s.mem[entry]; ok {
+			continue
+		}
+		switch {
+		case hdr.Size <= archiveMemLimit:
+			_, err = s.keep(entry)
+		case s.reopen == nil:
+			err = s.spill(entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: s.name + ":" + name, Err: fs.ErrNotExist}
+}
+
+func (s *streamSource) keep(entry string) ([]byte, error) {
+	b, err := io.ReadAll(s.tr)
+	if err != nil {
+		return nil, fmt.Errorf("read %s from archive %s: %w", entry, s.name, err)
+	}
+	s.mem[entry] = b
+	return b, nil
+}
+
+func (s *streamSource) spill(entry string) error {
+	if s.tmpDir == "" {
+		dir, err := os.MkdirTemp("", "pce-oci-archive-")
+		if err != nil {
+			return err
+		}
+		s.tmpDir = dir
+	}
+	p := filepath.Join(s.tmpDir, fmt.Sprintf("%d", len(s.spilled)))
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, s.tr); err != nil {
+		f.Close()
+		return fmt.Errorf("read %s from archive %s: %w", entry, s.name, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.spilled[entry] = p
+	return nil
+}
+
+func (s *streamSource) LocalPath(name string) (string, bool) {
+	for i := 0; i < maxArchiveLinks; i++ {
+		target, ok := s.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	p, ok := s.spilled[name]
+	return p, ok
+}
+
+func (s *streamSource) String() string { return s.name }
+
+func (s *streamSource) Close() error {
+	s.stop()
+	if s.tmpDir != "" {
+		return os.RemoveAll(s.tmpDir)
+	}
+	return nil
+}
+
+// Reads one entry straight from the archive stream, until the stream moves on
+type streamEntry struct {
+	s    *streamSource
+	gen  int
+	name string
+}
+
+func (e *streamEntry) Read(p []byte) (int, error) {
+	if e.s.gen != e.gen || e.s.tr == nil {
+		return 0, fmt.Errorf("%s: archive %s has moved on to another entry", e.name, e.s.name)
+	}
+	return e.s.tr.Read(p)
+}
+
+func (e *streamEntry) Close() error { return nil }
@@ -0,0 +1,320 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/spec"
+	"github.com/klauspost/compress/zstd"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Writes the layout directory base as a tar archive to w. With blobsFirst the blobs
+// come before oci-layout and index.json, as some tools write them.
+func writeLayoutTar(t *testing.T, base string, w io.Writer, blobsFirst bool) {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(base, p)
+		names = append(names, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("walk layout: %v", err)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		bi, bj := strings.HasPrefix(names[i], "blobs/"), strings.HasPrefix(names[j], "blobs/")
+		if bi != bj {
+			return bi == blobsFirst
+		}
+		return names[i] < names[j]
+	})
+
+	tw := tar.NewWriter(w)
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join(base, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "./" + name, Mode: 0o644, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		if _, err := tw.Write(b); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+}
+
+// Writes base as an archive file compressed with compression ("", "gzip" or "zstd")
+func writeLayoutArchive(t *testing.T, base, compression string, blobsFirst bool) string {
+	t.Helper()
+	var buf bytes.Buffer
+	switch compression {
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		writeLayoutTar(t, base, zw, blobsFirst)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeLayoutTar(t, base, zw, blobsFirst)
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		writeLayoutTar(t, base, &buf, blobsFirst)
+	}
+	name := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(name, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// Writes a single-image layout whose layer is larger than archiveMemLimit
+func writeLargeLayerLayout(t *testing.T) (string, v1.Descriptor) {
+	t.Helper()
+	base := filepath.Join(t.TempDir(), "layout")
+	lw, err := NewLayoutWriter(base)
+	if err != nil {
+		t.Fatalf("NewLayoutWriter error: %v", err)
+	}
+	data := make([]byte, 2*archiveMemLimit)
+	rand.New(rand.NewSource(1)).Read(data)
+	layer, err := lw.WriteBlob(bytes.NewReader(data), spec.MediaTypePextraImageLayerLxc)
+	if err != nil {
+		t.Fatalf("WriteBlob error: %v", err)
+	}
+	config := &v1.Image{Platform: v1.Platform{OS: "linux", Architecture: "amd64"}}
+	if _, err := lw.WriteImage(spec.PextraImageTypeLxc, config, []v1.Descriptor{layer}, "big"); err != nil {
+		t.Fatalf("WriteImage error: %v", err)
+	}
+	return base, layer
+}
+
+func TestArchiveSource_Layouts(t *testing.T) {
+	base, images := writeTaggedLayout(t)
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	for _, compression := range []string{"", "gzip", "zstd"} {
+		for _, blobsFirst := range []bool{false, true} {
+			name := compression
+			if blobsFirst {
+				name += "/blobs-first"
+			}
+			t.Run(name, func(t *testing.T) {
+				archive := writeLayoutArchive(t, base, compression, blobsFirst)
+
+				img, err := selectImage(archive, SelectOptions{Platform: amd64, Tag: "alma-9"})
+				if err != nil {
+					t.Fatalf("SelectSourceImage error: %v", err)
+				}
+				defer img.Source.Close()
+				if img.SelectedDescriptor.Digest != images["alma-9/amd64"].Digest || img.Path != archive {
+					t.Fatalf("unexpected image %s from %s", img.SelectedDescriptor.Digest, img.Path)
+				}
+				if _, ok := img.Source.LocalPath(v1.ImageIndexFile); ok {
+					t.Fatalf("archive entries should have no local path")
+				}
+				if err := VerifyBlob(img.Source, img.Manifest.Layers[0]); err != nil {
+					t.Fatalf("VerifyBlob error: %v", err)
+				}
+
+				res, err := validateLayout(t, archive)
+				if err != nil || len(res.Problems) != 0 {
+					t.Fatalf("expected valid archive, got %+v (err=%v)", res, err)
+				}
+				src, err := OpenSource(archive)
+				if err != nil {
+					t.Fatalf("OpenSource error: %v", err)
+				}
+				defer src.Close()
+				summaries, err := ListSourceImages(src, ListOptions{}, testTypes)
+				if err != nil || len(summaries) != 3 {
+					t.Fatalf("expected 3 images, got %v (err=%v)", summaries, err)
+				}
+			})
+		}
+	}
+}
+
+func TestArchiveSource_MissingEntry(t *testing.T) {
+	base, _ := writeTaggedLayout(t)
+	for _, compression := range []string{"", "gzip"} {
+		src, err := OpenSource(writeLayoutArchive(t, base, compression, false))
+		if err != nil {
+			t.Fatalf("OpenSource error: %v", err)
+		}
+		if _, err := src.Open("blobs/sha256/missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("expected ErrNotExist for %q archive, got %v", compression, err)
+		}
+		src.Close()
+	}
+}
+
+func TestStreamSource_RereadsLargeEntries(t *testing.T) {
+	base, layer := writeLargeLayerLayout(t)
+	src, err := OpenSource(writeLayoutArchive(t, base, "gzip", true))
+	if err != nil {
+		t.Fatalf("OpenSource error: %v", err)
+	}
+	defer src.Close()
+
+	// index.json comes after the layer, which is too large to keep in memory
+	if _, _, err := readLayout(src); err != nil {
+		t.Fatalf("readLayout error: %v", err)
+	}
+	if err := VerifyBlob(src, layer); err != nil {
+		t.Fatalf("VerifyBlob error: %v", err)
+	}
+	if _, ok := src.LocalPath(BlobName(layer.Digest)); ok {
+		t.Fatalf("reopenable archives should not spill entries to disk")
+	}
+}
+
+func TestStreamSource_SpillsWhenNotReopenable(t *testing.T) {
+	base, layer := writeLargeLayerLayout(t)
+	b, err := os.ReadFile(writeLayoutArchive(t, base, "zstd", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newStreamSource("stdin", nil, bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("newStreamSource error: %v", err)
+	}
+
+	if _, _, err := readLayout(src); err != nil {
+		t.Fatalf("readLayout error: %v", err)
+	}
+	spilled, ok := src.LocalPath(BlobName(layer.Digest))
+	if !ok {
+		t.Fatalf("expected the skipped layer to be spilled to disk")
+	}
+	if err := VerifyBlob(src, layer); err != nil {
+		t.Fatalf("VerifyBlob error: %v", err)
+	}
+
+	if err := src.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if _, err := os.Stat(spilled); !os.IsNotExist(err) {
+		t.Fatalf("expected spilled entry to be removed on Close, got %v", err)
+	}
+}
+
+func TestStreamSource_EntryInvalidatedWhenStreamMoves(t *testing.T) {
+	base, layer := writeLargeLayerLayout(t)
+	b, err := os.ReadFile(writeLayoutArchive(t, base, "gzip", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := newStreamSource("stdin", nil, bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("newStreamSource error: %v", err)
+	}
+	defer src.Close()
+
+	r, err := src.Open(BlobName(layer.Digest))
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	if _, ok := r.(*streamEntry); !ok {
+		t.Fatalf("expected the large layer to be read straight from the stream, got %T", r)
+	}
+	if _, err := src.Open("blobs/sha256/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if _, err := r.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "moved on") {
+		t.Fatalf("expected a moved-on error, got %v", err)
+	}
+	if _, err := src.Open(BlobName(layer.Digest)); err == nil {
+		t.Fatalf("expected an error re-reading a streamed entry from stdin")
+	}
+}
+
+func TestArchiveSource_FollowsLinks(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(hdr *tar.Header, content string) {
+		t.Helper()
+		hdr.Size = int64(len(content))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(&tar.Header{Name: "a/layer.tar", Typeflag: tar.TypeReg, Mode: 0o644}, "layer")
+	add(&tar.Header{Name: "b/layer.tar", Typeflag: tar.TypeSymlink, Linkname: "../a/layer.tar"}, "")
+	add(&tar.Header{Name: "c/layer.tar", Typeflag: tar.TypeLink, Linkname: "a/layer.tar"}, "")
+	add(&tar.Header{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "loop"}, "")
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(t.TempDir(), "links.tar")
+	if err := os.WriteFile(plain, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := map[string]func() (Source, error){
+		"file":   func() (Source, error) { return OpenSource(plain) },
+		"stream": func() (Source, error) { return newStreamSource("stdin", nil, bytes.NewReader(buf.Bytes())) },
+	}
+	for name, open := range sources {
+		src, err := open()
+		if err != nil {
+			t.Fatalf("%s: open error: %v", name, err)
+		}
+		for _, entry := range []string{"c/layer.tar", "b/layer.tar", "a/layer.tar"} {
+			r, err := src.Open(entry)
+			if err != nil {
+				t.Fatalf("%s: Open(%s) error: %v", name, entry, err)
+			}
+			b, _ := io.ReadAll(r)
+			r.Close()
+			if string(b) != "layer" {
+				t.Fatalf("%s: Open(%s) = %q", name, entry, b)
+			}
+		}
+		if _, err := src.Open("loop"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%s: expected ErrNotExist for a link loop, got %v", name, err)
+		}
+		src.Close()
+	}
+}
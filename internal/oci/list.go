@@ -0,0 +1,93 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Summary of one Pextra image in a layout
+type ImageSummary struct {
+	RefName   string
+	Digest    digest.Digest
+	ImageType string
+	// Platform of the manifest descriptor, or of the nested index it was found in
+	Platform *v1.Platform
+	Layers   int
+	// Sum of the (compressed) layer sizes
+	Size    int64
+	Created *time.Time
+	// Digests of the nested indexes leading to the manifest, outermost first
+	Via []digest.Digest
+}
+
+// Filters for ListSourceImages; zero values match everything
+type ListOptions struct {
+	// Only images with this org.opencontainers.image.ref.name annotation
+	Tag       string
+	ImageType string
+	// Images without a platform match any platform
+	Platform *v1.Platform
+}
+
+// Lists every Pextra image in the layout read from src, including those in nested
+// indexes, in index order
+func ListSourceImages(src Source, opts ListOptions, types ImageTypes) ([]ImageSummary, error) {
+	_, idx, err := readLayout(src)
+	if err != nil {
+		return nil, err
+	}
+
+	w := indexWalker{src: src, types: types, visiting: make(map[digest.Digest]bool)}
+	if err := w.walk(idx, inherited{}, nil); err != nil {
+		return nil, err
+	}
+
+	images := []ImageSummary{}
+	for _, c := range w.candidates {
+		if opts.Tag != "" && c.refName != opts.Tag {
+			continue
+		}
+		if opts.ImageType != "" && c.imageType != opts.ImageType {
+			continue
+		}
+		if opts.Platform != nil && platformScore(c.platform(), opts.Platform) < 0 {
+			continue
+		}
+
+		manifest, config, err := loadManifestAndConfig(src, c.Digest.String())
+		if err != nil {
+			return nil, err
+		}
+		img := ImageSummary{
+			RefName:   c.refName,
+			Digest:    c.Digest,
+			ImageType: c.imageType,
+			Platform:  c.platform(),
+			Layers:    len(manifest.Layers),
+			Created:   config.Created,
+			Via:       c.via,
+		}
+		for _, l := range manifest.Layers {
+			img.Size += l.Size
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
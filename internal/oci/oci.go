@@ -16,83 +16,98 @@ limitations under the License.
 package oci
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
-	"runtime"
+	"io/fs"
 
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// Reads and parses an OCI image from the specified path
-func GetImageDetails(imagePath string) (*OciImage, error) {
-	base := filepath.Clean(imagePath)
-	if fi, err := os.Stat(base); err != nil || !fi.IsDir() {
-		return nil, fmt.Errorf("not a directory: %s", base)
+// Selects the manifest of one of types described by opts from the layout read from src
+// and reads it along with its config. Closing the returned image closes src.
+func SelectSourceImage(src Source, opts SelectOptions, types ImageTypes) (*OciImage, error) {
+	layout, idx, err := readLayout(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(idx.Manifests) == 0 {
+		return nil, fmt.Errorf("index contains no manifests")
 	}
 
-	layoutFile := filepath.Join(base, v1.ImageLayoutFile)
-	indexFile := filepath.Join(base, v1.ImageIndexFile)
-	if _, err := os.Stat(layoutFile); err != nil {
-		return nil, fmt.Errorf("missing %s file at %s: %w", v1.ImageLayoutFile, layoutFile, err)
+	// Choose manifest descriptor by ref name, digest and platform
+	desc, err := selectManifestDescriptor(src, idx, opts, types)
+	if err != nil {
+		return nil, err
 	}
-	if _, err := os.Stat(indexFile); err != nil {
-		return nil, fmt.Errorf("missing %s file at %s: %w", v1.ImageIndexFile, indexFile, err)
+	if opts.Digest != "" {
+		// A pinned image must be exactly the content that was pinned
+		if err := VerifyBlob(src, desc.Descriptor); err != nil {
+			return nil, fmt.Errorf("manifest %s: %w", desc.Digest, err)
+		}
+	}
+
+	manifest, config, err := loadManifestAndConfig(src, desc.Digest.String())
+	if err != nil {
+		return nil, err
 	}
 
+	out := &OciImage{
+		Path:               src.String(),
+		Source:             src,
+		LayoutVersion:      layout.Version,
+		PextraImageType:    desc.imageType,
+		Index:              idx,
+		SelectedDescriptor: &desc.Descriptor,
+		SelectionReason:    desc.reason,
+		Manifest:           manifest,
+		Config:             config,
+	}
+	return out, nil
+}
+
+// Reads and checks the oci-layout and index.json files of a layout
+func readLayout(src Source) (*v1.ImageLayout, *v1.Index, error) {
 	var layout v1.ImageLayout
-	if err := readJSONFile(layoutFile, &layout); err != nil {
-		return nil, fmt.Errorf("parse %s: %w", v1.ImageLayoutFile, err)
+	if err := readSourceJSON(src, v1.ImageLayoutFile, &layout); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, fmt.Errorf("missing %s file in %s", v1.ImageLayoutFile, src)
+		}
+		return nil, nil, fmt.Errorf("parse %s: %w", v1.ImageLayoutFile, err)
 	}
 	if layout.Version != v1.ImageLayoutVersion {
-		return nil, fmt.Errorf("unsupported layout version %q (want %q)", layout.Version, v1.ImageLayoutVersion)
+		return nil, nil, fmt.Errorf("unsupported layout version %q (want %q)", layout.Version, v1.ImageLayoutVersion)
 	}
 
 	// Parse image index
 	var idx v1.Index
-	if err := readJSONFile(indexFile, &idx); err != nil {
-		return nil, fmt.Errorf("parse %s: %w", v1.ImageIndexFile, err)
+	if err := readSourceJSON(src, v1.ImageIndexFile, &idx); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, fmt.Errorf("missing %s file in %s", v1.ImageIndexFile, src)
+		}
+		return nil, nil, fmt.Errorf("parse %s: %w", v1.ImageIndexFile, err)
 	}
 	if idx.MediaType != v1.MediaTypeImageIndex {
-		return nil, fmt.Errorf("unsupported index mediaType %q (want %q)", idx.MediaType, v1.MediaTypeImageIndex)
-	}
-
-	if len(idx.Manifests) == 0 {
-		return nil, fmt.Errorf("index contains no manifests")
-	}
-
-	// Choose manifest descriptor by platform (GOOS/GOARCH), with fallbacks.
-	desc, err := selectManifestDescriptor(base, &idx, runtime.GOOS, runtime.GOARCH)
-	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("unsupported index mediaType %q (want %q)", idx.MediaType, v1.MediaTypeImageIndex)
 	}
+	return &layout, &idx, nil
+}
 
-	// Load manifest
+// Loads a manifest and the image config it refers to
+func loadManifestAndConfig(src Source, manifestDigest string) (*v1.Manifest, *v1.Image, error) {
 	var manifest v1.Manifest
-	if err := readBlobJSON(base, string(desc.Digest), &manifest); err != nil {
-		return nil, fmt.Errorf("load manifest %s: %w", desc.Digest, err)
+	if err := readBlobJSON(src, manifestDigest, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("load manifest %s: %w", manifestDigest, err)
 	}
 	if manifest.MediaType != v1.MediaTypeImageManifest {
-		return nil, fmt.Errorf("unsupported manifest mediaType %q", manifest.MediaType)
+		return nil, nil, fmt.Errorf("unsupported manifest mediaType %q", manifest.MediaType)
 	}
 
-	// Load image config
 	if manifest.Config.MediaType != v1.MediaTypeImageConfig {
-		return nil, fmt.Errorf("unsupported config mediaType %q", manifest.Config.MediaType)
+		return nil, nil, fmt.Errorf("unsupported config mediaType %q", manifest.Config.MediaType)
 	}
 	var config v1.Image
-	if err := readBlobJSON(base, string(manifest.Config.Digest), &config); err != nil {
-		return nil, fmt.Errorf("load config %s: %w", manifest.Config.Digest, err)
-	}
-
-	out := &OciImage{
-		Path:               base,
-		LayoutVersion:      layout.Version,
-		PextraImageType:    desc.imageType,
-		Index:              &idx,
-		SelectedDescriptor: &desc.Descriptor,
-		Manifest:           &manifest,
-		Config:             &config,
+	if err := readBlobJSON(src, string(manifest.Config.Digest), &config); err != nil {
+		return nil, nil, fmt.Errorf("load config %s: %w", manifest.Config.Digest, err)
 	}
-	return out, nil
+	return &manifest, &config, nil
 }
@@ -0,0 +1,101 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Points at an image in an OCI layout: LAYOUT, LAYOUT:TAG, LAYOUT@DIGEST or LAYOUT:TAG@DIGEST
+type ImageReference struct {
+	// Layout directory, OCI archive or "-" for stdin
+	Path string
+	// Matched against the org.opencontainers.image.ref.name annotation
+	Tag string
+	// Digest of a manifest, or of a nested index to select from
+	Digest digest.Digest
+}
+
+func (r ImageReference) String() string {
+	s := r.Path
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// Parses an image reference. An existing path is always taken as a plain layout path, so
+// layouts whose path contains ':' or '@' keep working. Otherwise the tag starts at the
+// first ':' that ends an existing path, so tags may contain ':' and '/' themselves.
+func ParseImageReference(s string) (ImageReference, error) {
+	if isLayoutPath(s) {
+		return ImageReference{Path: s}, nil
+	}
+
+	var ref ImageReference
+	rest := s
+	if i := strings.LastIndexByte(rest, '@'); i >= 0 {
+		d, err := digest.Parse(rest[i+1:])
+		if err != nil {
+			return ImageReference{}, fmt.Errorf("invalid digest in image reference %q: %w", s, err)
+		}
+		ref.Digest = d
+		rest = rest[:i]
+	}
+
+	if isLayoutPath(rest) {
+		ref.Path = rest
+		return ref, nil
+	}
+	split := -1
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == ':' && isLayoutPath(rest[:i]) {
+			split = i
+			break
+		}
+	}
+	if i := strings.LastIndexByte(rest, ':'); split < 0 && i >= 0 && !strings.Contains(rest[i+1:], "/") {
+		// The layout does not exist; split anyway so the error names the right path
+		split = i
+	}
+	if split >= 0 {
+		ref.Path, ref.Tag = rest[:split], rest[split+1:]
+		if ref.Tag == "" {
+			return ImageReference{}, fmt.Errorf("empty tag in image reference %q", s)
+		}
+	} else {
+		ref.Path = rest
+	}
+	if ref.Path == "" {
+		return ImageReference{}, fmt.Errorf("missing layout path in image reference %q", s)
+	}
+	return ref, nil
+}
+
+func isLayoutPath(p string) bool {
+	if p == "-" {
+		return true
+	}
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PextraCloud/pce-osi/internal/spec"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tmp := t.TempDir()
+	layout := filepath.Join(tmp, "layout")
+	colon := filepath.Join(tmp, "odd:dir")
+	mkdirAll := func(p string) {
+		if err := os.MkdirAll(p, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdirAll(layout)
+	mkdirAll(colon)
+	dgst := digest.FromString("x")
+
+	cases := []struct {
+		in   string
+		want ImageReference
+	}{
+		{layout, ImageReference{Path: layout}},
+		{layout + ":debian-12", ImageReference{Path: layout, Tag: "debian-12"}},
+		{layout + "@" + dgst.String(), ImageReference{Path: layout, Digest: dgst}},
+		{layout + ":debian-12@" + dgst.String(), ImageReference{Path: layout, Tag: "debian-12", Digest: dgst}},
+		{layout + ":registry.example.com/debian:12", ImageReference{Path: layout, Tag: "registry.example.com/debian:12"}},
+		{colon, ImageReference{Path: colon}},
+		{colon + ":alma-9", ImageReference{Path: colon, Tag: "alma-9"}},
+		// Missing layouts still split, so that errors name the layout path
+		{filepath.Join(tmp, "missing") + ":tag", ImageReference{Path: filepath.Join(tmp, "missing"), Tag: "tag"}},
+	}
+	for _, tc := range cases {
+		got, err := ParseImageReference(tc.in)
+		if err != nil {
+			t.Fatalf("ParseImageReference(%q) error: %v", tc.in, err)
+		}
+		if got != tc.want {
+			t.Errorf("ParseImageReference(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+		if tc.want.Path == layout && got.String() != tc.in {
+			t.Errorf("String() = %q, want %q", got.String(), tc.in)
+		}
+	}
+
+	for _, bad := range []string{layout + "@sha256:short", layout + ":", ":tag"} {
+		if _, err := ParseImageReference(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+// Writes a layout with debian-12 for two platforms and alma-9 for one
+func writeTaggedLayout(t *testing.T) (string, map[string]v1.Descriptor) {
+	t.Helper()
+	base := filepath.Join(t.TempDir(), "layout")
+	lw, err := NewLayoutWriter(base)
+	if err != nil {
+		t.Fatalf("NewLayoutWriter error: %v", err)
+	}
+
+	images := map[string]v1.Descriptor{}
+	for _, img := range []struct{ tag, arch string }{{"debian-12", "amd64"}, {"debian-12", "arm64"}, {"alma-9", "amd64"}} {
+		layer, err := lw.WriteBlob(strings.NewReader(img.tag+img.arch), spec.MediaTypePextraImageLayerLxc)
+		if err != nil {
+			t.Fatalf("WriteBlob error: %v", err)
+		}
+		created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		config := &v1.Image{Created: &created, Platform: v1.Platform{OS: "linux", Architecture: img.arch}}
+		desc, err := lw.WriteImage(spec.PextraImageTypeLxc, config, []v1.Descriptor{layer}, img.tag)
+		if err != nil {
+			t.Fatalf("WriteImage error: %v", err)
+		}
+		images[img.tag+"/"+img.arch] = desc
+	}
+	return base, images
+}
+
+func TestSelectSourceImage_Tag(t *testing.T) {
+	base, images := writeTaggedLayout(t)
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := &v1.Platform{OS: "linux", Architecture: "arm64"}
+
+	cases := []struct {
+		opts SelectOptions
+		want string
+	}{
+		{SelectOptions{Platform: amd64, Tag: "debian-12"}, "debian-12/amd64"},
+		{SelectOptions{Platform: arm64, Tag: "debian-12"}, "debian-12/arm64"},
+		{SelectOptions{Platform: amd64, Tag: "alma-9"}, "alma-9/amd64"},
+		{SelectOptions{Platform: amd64}, "debian-12/amd64"},
+	}
+	for _, tc := range cases {
+		img, err := selectImage(base, tc.opts)
+		if err != nil {
+			t.Fatalf("%+v: SelectSourceImage error: %v", tc.opts, err)
+		}
+		if img.SelectedDescriptor.Digest != images[tc.want].Digest {
+			t.Errorf("%+v: selected %s, want %s", tc.opts, img.SelectedDescriptor.Digest, tc.want)
+		}
+	}
+
+	_, err := selectImage(base, SelectOptions{Platform: arm64, Tag: "alma-9"})
+	if err == nil || !strings.Contains(err.Error(), "no manifest matches platform linux/arm64") {
+		t.Fatalf("expected a platform error for alma-9 on arm64, got %v", err)
+	}
+	_, err = selectImage(base, SelectOptions{Tag: "ubuntu-24.04"})
+	if err == nil || !strings.Contains(err.Error(), "available: debian-12, alma-9") {
+		t.Fatalf("expected an unknown tag error listing tags, got %v", err)
+	}
+}
+
+func TestSelectSourceImage_Digest(t *testing.T) {
+	base, images := writeTaggedLayout(t)
+	arm64 := images["debian-12/arm64"]
+
+	// A pinned manifest is selected even though it does not match the host platform
+	img, err := selectImage(base, SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}, Digest: arm64.Digest})
+	if err != nil {
+		t.Fatalf("SelectSourceImage error: %v", err)
+	}
+	if img.SelectedDescriptor.Digest != arm64.Digest || img.SelectionReason != "pinned by digest" {
+		t.Fatalf("unexpected selection %s (%q)", img.SelectedDescriptor.Digest, img.SelectionReason)
+	}
+
+	// Tag and digest have to agree
+	_, err = selectImage(base, SelectOptions{Tag: "alma-9", Digest: arm64.Digest})
+	if err == nil || !strings.Contains(err.Error(), "does not refer to") {
+		t.Fatalf("expected a tag/digest conflict, got %v", err)
+	}
+	_, err = selectImage(base, SelectOptions{Digest: digest.FromString("unknown")})
+	if err == nil || !strings.Contains(err.Error(), "no manifest or index with digest") {
+		t.Fatalf("expected an unknown digest error, got %v", err)
+	}
+
+	// Pinned content must hash to the pinned digest
+	p := utils.BlobPath(base, arm64.Digest.String())
+	b, _ := os.ReadFile(p)
+	b[len(b)-2] ^= 1
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = selectImage(base, SelectOptions{Digest: arm64.Digest})
+	if !errors.Is(err, utils.ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch for a modified manifest, got %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Read access to the files of an OCI image layout, wherever it is stored
+type Source interface {
+	// Opens the layout file at the slash-separated path name, e.g. "index.json" or
+	// "blobs/sha256/<hex>". Streaming sources may invalidate a reader once another file
+	// is opened, so callers should finish reading one file before opening the next.
+	Open(name string) (io.ReadCloser, error)
+	// Returns the path of the file on the local filesystem, if the source has one
+	LocalPath(name string) (string, bool)
+	// Describes the source in messages, e.g. the layout directory
+	String() string
+	// Releases resources such as temporary files
+	Close() error
+}
+
+// Opens the image layout at path, which may be a layout directory, an OCI archive
+// (tar, optionally gzip or zstd compressed) or "-" for an archive read from stdin
+func OpenSource(path string) (Source, error) {
+	if path == "-" {
+		return newStreamSource("stdin", nil, os.Stdin)
+	}
+
+	base := filepath.Clean(path)
+	fi, err := os.Stat(base)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open image %s: %w", base, err)
+	}
+	if fi.IsDir() {
+		return NewDirSource(base), nil
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a directory or archive: %s", base)
+	}
+	return openArchive(base)
+}
+
+// An image layout stored in a directory
+type dirSource struct {
+	base string
+}
+
+func NewDirSource(base string) Source {
+	return &dirSource{base: filepath.Clean(base)}
+}
+
+func (s *dirSource) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.base, filepath.FromSlash(name)))
+}
+
+func (s *dirSource) LocalPath(name string) (string, bool) {
+	return filepath.Join(s.base, filepath.FromSlash(name)), true
+}
+
+func (s *dirSource) String() string { return s.base }
+
+func (s *dirSource) Close() error { return nil }
+
+// Returns the layout path of the blob with digest d, e.g. "blobs/sha256/<hex>"
+func BlobName(d digest.Digest) string {
+	algo, hex := utils.SplitDigest(d.String())
+	return path.Join(v1.ImageBlobsDir, algo, hex)
+}
+
+// Opens the blob for desc. Reading it to EOF fails if it does not match the size and
+// digest in desc.
+func OpenBlob(src Source, desc v1.Descriptor) (io.ReadCloser, error) {
+	f, err := src.Open(BlobName(desc.Digest))
+	if err != nil {
+		return nil, err
+	}
+	vr, err := utils.NewVerifiedReader(f, desc)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{vr, f}, nil
+}
+
+// Reads the blob for desc from src and checks its size and digest
+func VerifyBlob(src Source, desc v1.Descriptor) error {
+	r, err := OpenBlob(src, desc)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
@@ -15,19 +15,37 @@ limitations under the License.
 */
 package oci
 
-import v1 "github.com/opencontainers/image-spec/specs-go/v1"
+import (
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
 
 type OciImage struct {
-	Path               string
+	// Layout directory, archive path or "-" for stdin
+	Path string
+	// Where the layout files are read from; release it with Close
+	Source             Source
 	LayoutVersion      string
 	PextraImageType    string
 	Index              *v1.Index
 	SelectedDescriptor *v1.Descriptor
+	SelectionReason    string
 	Manifest           *v1.Manifest
 	Config             *v1.Image
 }
 
+// Narrows down which manifest of a layout is selected
+type SelectOptions struct {
+	// Platform to match; nil selects the host platform
+	Platform *v1.Platform
+	// Only consider images with this org.opencontainers.image.ref.name annotation
+	Tag string
+	// Only consider this manifest, or the manifests below this nested index
+	Digest digest.Digest
+}
+
 type manifestDesc struct {
 	v1.Descriptor
 	imageType string
+	reason    string
 }
@@ -0,0 +1,44 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"fmt"
+
+	"github.com/PextraCloud/pce-osi/internal/spec"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Checks a manifest against the rules of a Pextra image type
+type ManifestValidator func(manifest *v1.Manifest) []error
+
+// Pextra image types known to selection and validation, with their validators; a nil
+// validator means the type has no rules of its own. pkg/pextra-oci passes the types of
+// its registered handlers. Manifests of other types are ignored by selection and
+// reported by validation.
+type ImageTypes map[string]ManifestValidator
+
+// Checks a manifest against the rules of imageType
+func (t ImageTypes) validate(imageType string, manifest *v1.Manifest) []error {
+	validate, ok := t[imageType]
+	if !ok {
+		return []error{fmt.Errorf("unknown %s %q", spec.AnnotationPextraImageType, imageType)}
+	}
+	if validate == nil {
+		return nil
+	}
+	return validate(manifest)
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/spec"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The lxc and qemu packages register their types but cannot be imported here; stand in
+// for them without any rules of their own
+var testTypes = ImageTypes{spec.PextraImageTypeLxc: nil, spec.PextraImageTypeQemu: nil}
+
+func TestImageTypes(t *testing.T) {
+	errBad := errors.New("bad layer")
+	types := ImageTypes{"test-type": func(m *v1.Manifest) []error {
+		if len(m.Layers) != 1 {
+			return []error{errBad}
+		}
+		return nil
+	}}
+
+	d := v1.Descriptor{Annotations: map[string]string{spec.AnnotationPextraImageType: "test-type"}}
+	if got, ok := checkManifestAnnotations(d, types); !ok || got != "test-type" {
+		t.Fatalf("got (%v,%v), want (test-type,true)", got, ok)
+	}
+	if _, ok := checkManifestAnnotations(d, testTypes); ok {
+		t.Fatalf("expected a type that is not passed to be unknown")
+	}
+	if errs := types.validate("test-type", &v1.Manifest{}); len(errs) != 1 || !errors.Is(errs[0], errBad) {
+		t.Fatalf("expected the rules of the type to run, got %v", errs)
+	}
+	if errs := types.validate("test-type", &v1.Manifest{Layers: make([]v1.Descriptor, 1)}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+}
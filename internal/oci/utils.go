@@ -19,89 +19,308 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 
+	"github.com/PextraCloud/pce-osi/internal/spec"
 	"github.com/PextraCloud/pce-osi/internal/utils"
-	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-// Selects the most appropriate manifest descriptor from the index based on platform information
-func selectManifestDescriptor(base string, idx *v1.Index, goos, goarch string) (*manifestDesc, error) {
-	var manifestDescs []manifestDesc
-	for _, d := range idx.Manifests {
-		switch d.MediaType {
-		case v1.MediaTypeImageManifest, "": // empty is tolerated by some tools
-			var imageType string
-			var ok bool
-			if imageType, ok = checkManifestAnnotations(d); !ok {
-				continue
+// Maximum nesting of image indexes followed during manifest selection, locally and
+// when pulling
+const MaxIndexDepth = 8
+
+// Selects the manifest descriptor that best matches opts from the whole index tree.
+// Candidates are first narrowed by ref name and digest, then ranked by platform.
+// Nested indexes are walked depth-first; the platform and ref name of a nested index
+// descriptor are inherited by manifests inside it that declare none, and a conflicting
+// platform prunes the subtree. Manifests without any platform match any platform, but
+// lose against a real match; ties go to the manifest found first. A manifest pinned
+// directly by digest is selected regardless of its platform.
+func selectManifestDescriptor(src Source, idx *v1.Index, opts SelectOptions, types ImageTypes) (*manifestDesc, error) {
+	want := opts.Platform
+	if want == nil {
+		want = utils.HostPlatform()
+	}
+	w := indexWalker{src: src, types: types, want: want, pin: opts.Digest, visiting: make(map[digest.Digest]bool)}
+	if err := w.walk(idx, inherited{}, nil); err != nil {
+		return nil, err
+	}
+
+	candidates := slices.Clone(w.candidates)
+	if opts.Tag != "" {
+		candidates = slices.DeleteFunc(candidates, func(c candidate) bool { return c.refName != opts.Tag })
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("no image with ref name %q (available: %s)", opts.Tag, strings.Join(w.refNames(), ", "))
+		}
+	}
+	if opts.Digest != "" {
+		candidates = slices.DeleteFunc(candidates, func(c candidate) bool { return !c.pinned })
+		if len(candidates) == 0 {
+			if opts.Tag != "" {
+				return nil, fmt.Errorf("ref name %q does not refer to %s", opts.Tag, opts.Digest)
+			}
+			return nil, fmt.Errorf("no manifest or index with digest %s", opts.Digest)
+		}
+	}
+
+	var best *candidate
+	for i := range candidates {
+		c := &candidates[i]
+		if opts.Digest != "" && c.Digest == opts.Digest {
+			best = c
+			break
+		}
+		if c.score >= 0 && (best == nil || c.score > best.score) {
+			best = c
+		}
+	}
+	if best == nil {
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("no suitable manifest descriptor found")
+		}
+		available := make([]string, 0, len(candidates))
+		for _, c := range candidates {
+			if p := utils.FormatPlatform(c.platform()); !slices.Contains(available, p) {
+				available = append(available, p)
 			}
-			manifestDescs = append(manifestDescs, manifestDesc{Descriptor: d, imageType: imageType})
-		case v1.MediaTypeImageIndex:
-			// Nested index, handle later
-		default:
 		}
+		return nil, fmt.Errorf("no manifest matches platform %s (available: %s)", utils.FormatPlatform(want), strings.Join(available, ", "))
 	}
 
-	// Platform match
-	for i := range manifestDescs {
-		if matchesPlatform(manifestDescs[i].Platform, goos, goarch) {
-			return &manifestDescs[i], nil
+	md := best.manifestDesc
+	switch {
+	case opts.Digest != "" && best.Digest == opts.Digest:
+		md.reason = "pinned by digest"
+	case best.platform() != nil:
+		md.reason = fmt.Sprintf("matches platform %s", utils.FormatPlatform(want))
+	default:
+		md.reason = "platform unspecified, treated as wildcard"
+	}
+	if opts.Tag != "" {
+		md.reason = fmt.Sprintf("ref name %q, %s", opts.Tag, md.reason)
+	}
+	if len(best.via) > 0 {
+		via := make([]string, len(best.via))
+		for i, d := range best.via {
+			via[i] = d.String()
 		}
+		md.reason = fmt.Sprintf("via nested index %s: %s", strings.Join(via, " -> "), md.reason)
 	}
-	// Fallback to first manifest descriptor (for non-nested index)
-	if len(manifestDescs) > 0 {
-		return &manifestDescs[0], nil
+	return &md, nil
+}
+
+// Properties a manifest inherits from the nested index descriptors enclosing it
+type inherited struct {
+	platform *v1.Platform
+	refName  string
+	pinned   bool
+}
+
+// A Pextra manifest found while walking the index tree
+type candidate struct {
+	manifestDesc
+	inherited *v1.Platform
+	refName   string
+	// Set if the manifest or an enclosing index has the digest asked for
+	pinned bool
+	// Digests of the nested indexes leading to the manifest, outermost first
+	via   []digest.Digest
+	score int
+}
+
+func (c *candidate) platform() *v1.Platform {
+	if c.Platform != nil {
+		return c.Platform
 	}
+	return c.inherited
+}
 
-	// If no manifest descriptors found, try nested index (one level deep, last resort)
+type indexWalker struct {
+	src Source
+	// Manifests of other types are skipped
+	types ImageTypes
+	// Platform to score candidates against; nil collects all of them unscored
+	want       *v1.Platform
+	pin        digest.Digest
+	visiting   map[digest.Digest]bool
+	candidates []candidate
+}
+
+func (w *indexWalker) walk(idx *v1.Index, parent inherited, via []digest.Digest) error {
 	for _, d := range idx.Manifests {
-		if d.MediaType != v1.MediaTypeImageIndex {
-			continue
+		cur := parent
+		if d.Platform != nil {
+			cur.platform = d.Platform
+		}
+		if ref := d.Annotations[v1.AnnotationRefName]; ref != "" {
+			cur.refName = ref
+		}
+		if w.pin != "" && d.Digest == w.pin {
+			cur.pinned = true
 		}
 
-		var nested v1.Index
-		if err := readBlobJSON(base, d.Digest.String(), &nested); err != nil {
-			return nil, fmt.Errorf("load nested index %s: %w", d.Digest, err)
+		switch d.MediaType {
+		case v1.MediaTypeImageManifest, "": // empty is tolerated by some tools
+			imageType, ok := checkManifestAnnotations(d, w.types)
+			if !ok {
+				continue
+			}
+			c := candidate{
+				manifestDesc: manifestDesc{Descriptor: d, imageType: imageType},
+				inherited:    parent.platform,
+				refName:      cur.refName,
+				pinned:       cur.pinned,
+				via:          via,
+			}
+			if w.want != nil {
+				c.score = platformScore(c.platform(), w.want)
+			}
+			w.candidates = append(w.candidates, c)
+		case v1.MediaTypeImageIndex:
+			if w.want != nil && d.Platform != nil && !cur.pinned && platformScore(d.Platform, w.want) < 0 {
+				continue
+			}
+			if len(via) >= MaxIndexDepth {
+				return fmt.Errorf("nested index %s exceeds the maximum depth of %d", d.Digest, MaxIndexDepth)
+			}
+			if w.visiting[d.Digest] {
+				return fmt.Errorf("nested index %s refers back to itself", d.Digest)
+			}
+
+			if d.Digest == w.pin {
+				if err := VerifyBlob(w.src, d); err != nil {
+					return fmt.Errorf("nested index %s: %w", d.Digest, err)
+				}
+			}
+			var nested v1.Index
+			if err := readBlobJSON(w.src, d.Digest.String(), &nested); err != nil {
+				return fmt.Errorf("load nested index %s: %w", d.Digest, err)
+			}
+			w.visiting[d.Digest] = true
+			err := w.walk(&nested, cur, append(slices.Clip(via), d.Digest))
+			delete(w.visiting, d.Digest)
+			if err != nil {
+				return err
+			}
+		default:
 		}
-		return selectManifestDescriptor(base, &nested, goos, goarch)
 	}
+	return nil
+}
 
-	return nil, fmt.Errorf("no suitable manifest descriptor found")
+// Returns the distinct ref names of all candidates, in index order
+func (w *indexWalker) refNames() []string {
+	var names []string
+	for _, c := range w.candidates {
+		if c.refName != "" && !slices.Contains(names, c.refName) {
+			names = append(names, c.refName)
+		}
+	}
+	if len(names) == 0 {
+		return []string{"none"}
+	}
+	return names
 }
 
 // Checks for Pextra-specific annotations in the manifest descriptor
-func checkManifestAnnotations(d v1.Descriptor) (string, bool) {
+func checkManifestAnnotations(d v1.Descriptor, types ImageTypes) (string, bool) {
 	if d.Annotations == nil {
 		return "", false
 	}
-	it, ok := d.Annotations[pextraoci.AnnotationPextraImageType]
+	it, ok := d.Annotations[spec.AnnotationPextraImageType]
 	if !ok {
 		return "", false
 	}
-	switch it {
-	case pextraoci.PextraImageTypeQemu, pextraoci.PextraImageTypeLxc:
-		return it, true
-	default:
+	if _, known := types[it]; !known {
 		return "", false
 	}
+	return it, true
+}
+
+// Returns the manifest or index descriptor in descs that best matches the platform want
+// (the host platform if nil), using the same ranking as manifest selection
+func MatchPlatform(descs []v1.Descriptor, want *v1.Platform) (v1.Descriptor, error) {
+	if want == nil {
+		want = utils.HostPlatform()
+	}
+	best, bestScore := -1, -1
+	var available []string
+	found := false
+	for i, d := range descs {
+		if d.MediaType != v1.MediaTypeImageManifest && d.MediaType != v1.MediaTypeImageIndex {
+			continue
+		}
+		found = true
+		if d.Platform != nil && !slices.Contains(available, utils.FormatPlatform(d.Platform)) {
+			available = append(available, utils.FormatPlatform(d.Platform))
+		}
+		if score := platformScore(d.Platform, want); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		if !found {
+			return v1.Descriptor{}, fmt.Errorf("index contains no manifests")
+		}
+		return v1.Descriptor{}, fmt.Errorf("no manifest matches platform %s (available: %s)", utils.FormatPlatform(want), strings.Join(available, ", "))
+	}
+	return descs[best], nil
 }
 
-// Checks if the image platform matches the given GOOS and GOARCH
-func matchesPlatform(p *v1.Platform, goos, goarch string) bool {
+// Scores how well the image platform p matches the wanted platform, or returns -1 if it
+// does not match. A missing platform is a wildcard (0). Otherwise OS, architecture,
+// variant and os.version must not conflict; a missing variant is the baseline of the
+// architecture (amd64/v1, arm/v7, arm64/v8), and amd64 images also run on later
+// variants. An explicitly declared variant or os.version that equals the wanted one
+// scores higher than one that is merely implied or absent, so linux/arm64/v8 prefers an
+// arm64/v8 manifest over a plain arm64 one but accepts both. When want lists OS
+// features, the image may only require features from that list.
+func platformScore(p *v1.Platform, want *v1.Platform) int {
 	if p == nil {
-		// If platform is unspecified, many tools treat it as a wildcard.
-		return true
+		return 0
+	}
+	got, w := utils.NormalizePlatform(*p), utils.NormalizePlatform(*want)
+
+	if got.OS != "" && got.OS != w.OS {
+		return -1
+	}
+	if got.Architecture != "" && got.Architecture != w.Architecture {
+		return -1
+	}
+	if got.Variant != "" && w.Variant != "" && !variantRuns(got.Architecture, got.Variant, w.Variant) {
+		return -1
 	}
-	if p.OS != "" && !strings.EqualFold(p.OS, goos) {
-		return false
+	if got.OSVersion != "" && w.OSVersion != "" && got.OSVersion != w.OSVersion {
+		return -1
 	}
-	// Architecture comparisons can have variants; basic match first.
-	if p.Architecture != "" && !strings.EqualFold(p.Architecture, goarch) {
-		return false
+	if len(w.OSFeatures) > 0 {
+		for _, f := range got.OSFeatures {
+			if !slices.Contains(w.OSFeatures, f) {
+				return -1
+			}
+		}
+	}
+
+	score := 1
+	if p.Variant != "" && got.Variant == w.Variant {
+		score += 2
+	} else if p.Variant != "" {
+		score++
+	}
+	if got.OSVersion != "" && got.OSVersion == w.OSVersion {
+		score++
 	}
-	return true
+	return score
+}
+
+// Reports whether an image built for variant got of arch runs on variant want. amd64
+// microarchitecture levels (v1 to v4) run on every later level; other variants must be
+// equal.
+func variantRuns(arch, got, want string) bool {
+	return got == want || arch == "amd64" && got < want
 }
 
 func readJSONFile(path string, v any) error {
@@ -112,11 +331,15 @@ func readJSONFile(path string, v any) error {
 	return json.Unmarshal(b, v)
 }
 
-func readBlobJSON(base, digest string, v any) error {
-	p := utils.BlobPath(base, digest)
-	b, err := os.ReadFile(p)
+func readBlobJSON(src Source, dgst string, v any) error {
+	return readSourceJSON(src, BlobName(digest.Digest(dgst)), v)
+}
+
+func readSourceJSON(src Source, name string, v any) error {
+	f, err := src.Open(name)
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(b, v)
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
 }
@@ -17,12 +17,14 @@ package oci
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/PextraCloud/pce-osi/internal/spec"
 	"github.com/PextraCloud/pce-osi/internal/utils"
-	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -30,51 +32,94 @@ import (
 func TestCheckManifestAnnotations(t *testing.T) {
 	t.Run("qemu", func(t *testing.T) {
 		d := v1.Descriptor{Annotations: map[string]string{
-			pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeQemu,
+			spec.AnnotationPextraImageType: spec.PextraImageTypeQemu,
 		}}
-		got, ok := checkManifestAnnotations(d)
-		if !ok || got != pextraoci.PextraImageTypeQemu {
-			t.Fatalf("got (%v,%v), want (%v,true)", got, ok, pextraoci.PextraImageTypeQemu)
+		got, ok := checkManifestAnnotations(d, testTypes)
+		if !ok || got != spec.PextraImageTypeQemu {
+			t.Fatalf("got (%v,%v), want (%v,true)", got, ok, spec.PextraImageTypeQemu)
 		}
 	})
 	t.Run("lxc", func(t *testing.T) {
 		d := v1.Descriptor{Annotations: map[string]string{
-			pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeLxc,
+			spec.AnnotationPextraImageType: spec.PextraImageTypeLxc,
 		}}
-		got, ok := checkManifestAnnotations(d)
-		if !ok || got != pextraoci.PextraImageTypeLxc {
-			t.Fatalf("got (%v,%v), want (%v,true)", got, ok, pextraoci.PextraImageTypeLxc)
+		got, ok := checkManifestAnnotations(d, testTypes)
+		if !ok || got != spec.PextraImageTypeLxc {
+			t.Fatalf("got (%v,%v), want (%v,true)", got, ok, spec.PextraImageTypeLxc)
 		}
 	})
 	t.Run("unknown", func(t *testing.T) {
 		d := v1.Descriptor{Annotations: map[string]string{
-			pextraoci.AnnotationPextraImageType: "other",
+			spec.AnnotationPextraImageType: "other",
 		}}
-		if _, ok := checkManifestAnnotations(d); ok {
+		if _, ok := checkManifestAnnotations(d, testTypes); ok {
 			t.Fatalf("expected false for unknown type")
 		}
 	})
 	t.Run("missing", func(t *testing.T) {
-		if _, ok := checkManifestAnnotations(v1.Descriptor{}); ok {
+		if _, ok := checkManifestAnnotations(v1.Descriptor{}, testTypes); ok {
 			t.Fatalf("expected false for missing annotations")
 		}
 	})
 }
 
-func TestMatchesPlatform(t *testing.T) {
-	goos, goarch := "linux", "amd64"
+func TestPlatformScore(t *testing.T) {
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64v8 := &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
 
-	if !matchesPlatform(nil, goos, goarch) {
-		t.Fatalf("nil platform should match")
+	cases := []struct {
+		name string
+		p    *v1.Platform
+		want *v1.Platform
+		ok   bool
+	}{
+		{"nil is wildcard", nil, amd64, true},
+		{"case-insensitive", &v1.Platform{OS: "LINUX", Architecture: "AMD64"}, amd64, true},
+		{"arch alias", &v1.Platform{OS: "linux", Architecture: "x86_64"}, amd64, true},
+		{"os mismatch", &v1.Platform{OS: "windows", Architecture: "amd64"}, amd64, false},
+		{"arch mismatch", &v1.Platform{OS: "linux", Architecture: "arm64"}, amd64, false},
+		{"arm64 implies v8", &v1.Platform{OS: "linux", Architecture: "arm64"}, arm64v8, true},
+		{"arm64 v8 for plain arm64", arm64v8, &v1.Platform{OS: "linux", Architecture: "arm64"}, true},
+		{"variant mismatch", &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, false},
+		{"amd64 implies v1", &v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, amd64, false},
+		{"amd64 v1 on v3", amd64, &v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, true},
+		{"amd64 v2 on v3", &v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v2"}, &v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, true},
+		{"amd64 v4 on v3", &v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v4"}, &v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, false},
+		{"os.version mismatch", &v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.1"}, &v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.2"}, false},
+		{"missing os feature", &v1.Platform{OS: "windows", Architecture: "amd64", OSFeatures: []string{"win32k"}}, &v1.Platform{OS: "windows", Architecture: "amd64", OSFeatures: []string{"other"}}, false},
 	}
-	if !matchesPlatform(&v1.Platform{OS: "LINUX", Architecture: "AMD64"}, goos, goarch) {
-		t.Fatalf("case-insensitive match failed")
+	for _, tc := range cases {
+		if got := platformScore(tc.p, tc.want) >= 0; got != tc.ok {
+			t.Errorf("%s: match = %v, want %v", tc.name, got, tc.ok)
+		}
+	}
+
+	// An exact variant beats an implied one, which beats a wildcard
+	exact := platformScore(arm64v8, arm64v8)
+	implied := platformScore(&v1.Platform{OS: "linux", Architecture: "arm64"}, arm64v8)
+	wildcard := platformScore(nil, arm64v8)
+	if !(exact > implied && implied > wildcard) {
+		t.Fatalf("unexpected score order: exact=%d implied=%d wildcard=%d", exact, implied, wildcard)
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	descs := []v1.Descriptor{
+		{MediaType: "application/vnd.example.other", Digest: "sha256:other", Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{MediaType: v1.MediaTypeImageManifest, Digest: "sha256:arm64", Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+		{MediaType: v1.MediaTypeImageIndex, Digest: "sha256:amd64", Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+	}
+	got, err := MatchPlatform(descs, &v1.Platform{OS: "linux", Architecture: "amd64"})
+	if err != nil || got.Digest != "sha256:amd64" {
+		t.Fatalf("MatchPlatform = %s (err=%v), want sha256:amd64", got.Digest, err)
 	}
-	if matchesPlatform(&v1.Platform{OS: "windows", Architecture: "amd64"}, goos, goarch) {
-		t.Fatalf("unexpected match on OS mismatch")
+
+	_, err = MatchPlatform(descs, &v1.Platform{OS: "linux", Architecture: "riscv64"})
+	if err == nil || !strings.Contains(err.Error(), "linux/arm64, linux/amd64") {
+		t.Fatalf("error should name the available platforms: %v", err)
 	}
-	if matchesPlatform(&v1.Platform{OS: "linux", Architecture: "arm64"}, goos, goarch) {
-		t.Fatalf("unexpected match on arch mismatch")
+	if _, err := MatchPlatform(descs[:1], nil); err == nil {
+		t.Fatalf("expected an error without manifests")
 	}
 }
 
@@ -86,7 +131,7 @@ func TestSelectManifestDescriptor_PlatformMatch(t *testing.T) {
 				Digest:    "sha256:aaa",
 				Platform:  &v1.Platform{OS: "linux", Architecture: "amd64"},
 				Annotations: map[string]string{
-					pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeLxc,
+					spec.AnnotationPextraImageType: spec.PextraImageTypeLxc,
 				},
 			},
 			{
@@ -94,21 +139,24 @@ func TestSelectManifestDescriptor_PlatformMatch(t *testing.T) {
 				Digest:    "sha256:bbb",
 				Platform:  &v1.Platform{OS: "windows", Architecture: "amd64"},
 				Annotations: map[string]string{
-					pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeLxc,
+					spec.AnnotationPextraImageType: spec.PextraImageTypeLxc,
 				},
 			},
 		},
 	}
-	md, err := selectManifestDescriptor(t.TempDir(), &idx, "linux", "amd64")
+	md, err := selectManifestDescriptor(NewDirSource(t.TempDir()), &idx, SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}, testTypes)
 	if err != nil {
 		t.Fatalf("selectManifestDescriptor error: %v", err)
 	}
-	if md == nil || md.Digest != "sha256:aaa" || md.imageType != pextraoci.PextraImageTypeLxc {
+	if md == nil || md.Digest != "sha256:aaa" || md.imageType != spec.PextraImageTypeLxc {
 		t.Fatalf("unexpected selection: %+v", md)
 	}
+	if md.reason != "matches platform linux/amd64" {
+		t.Fatalf("unexpected selection reason: %q", md.reason)
+	}
 }
 
-func TestSelectManifestDescriptor_FallbackFirst(t *testing.T) {
+func TestSelectManifestDescriptor_NoPlatformMatch(t *testing.T) {
 	idx := v1.Index{
 		Manifests: []v1.Descriptor{
 			{
@@ -116,7 +164,7 @@ func TestSelectManifestDescriptor_FallbackFirst(t *testing.T) {
 				Digest:    "sha256:first",
 				Platform:  &v1.Platform{OS: "windows", Architecture: "arm64"},
 				Annotations: map[string]string{
-					pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeQemu,
+					spec.AnnotationPextraImageType: spec.PextraImageTypeQemu,
 				},
 			},
 			{
@@ -124,17 +172,52 @@ func TestSelectManifestDescriptor_FallbackFirst(t *testing.T) {
 				Digest:    "sha256:second",
 				Platform:  &v1.Platform{OS: "darwin", Architecture: "arm64"},
 				Annotations: map[string]string{
-					pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeQemu,
+					spec.AnnotationPextraImageType: spec.PextraImageTypeQemu,
 				},
 			},
 		},
 	}
-	md, err := selectManifestDescriptor(t.TempDir(), &idx, "linux", "amd64")
-	if err != nil {
-		t.Fatalf("selectManifestDescriptor error: %v", err)
+	// No silent fallback to the first manifest: that would deploy the wrong architecture
+	_, err := selectManifestDescriptor(NewDirSource(t.TempDir()), &idx, SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}, testTypes)
+	if err == nil {
+		t.Fatalf("expected an error when no manifest matches the platform")
+	}
+	if !strings.Contains(err.Error(), "linux/amd64") || !strings.Contains(err.Error(), "windows/arm64, darwin/arm64") {
+		t.Fatalf("error should name the wanted and available platforms: %v", err)
+	}
+}
+
+func TestSelectManifestDescriptor_PrefersExactVariant(t *testing.T) {
+	lxc := map[string]string{spec.AnnotationPextraImageType: spec.PextraImageTypeLxc}
+	idx := v1.Index{
+		Manifests: []v1.Descriptor{
+			{MediaType: v1.MediaTypeImageManifest, Digest: "sha256:any", Annotations: lxc},
+			{MediaType: v1.MediaTypeImageManifest, Digest: "sha256:amd64", Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}, Annotations: lxc},
+			{MediaType: v1.MediaTypeImageManifest, Digest: "sha256:arm64", Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}, Annotations: lxc},
+			{MediaType: v1.MediaTypeImageManifest, Digest: "sha256:arm64v8", Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, Annotations: lxc},
+			{MediaType: v1.MediaTypeImageManifest, Digest: "sha256:armv7", Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, Annotations: lxc},
+		},
 	}
-	if md == nil || md.Digest != "sha256:first" {
-		t.Fatalf("expected fallback to first, got %+v", md)
+
+	cases := map[string]digest.Digest{
+		"linux/arm64/v8": "sha256:arm64v8",
+		"linux/arm64":    "sha256:arm64v8",
+		"linux/amd64":    "sha256:amd64",
+		"linux/arm/v7":   "sha256:armv7",
+		"linux/riscv64":  "sha256:any",
+	}
+	for platform, want := range cases {
+		p, err := utils.ParsePlatform(platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, err := selectManifestDescriptor(NewDirSource(t.TempDir()), &idx, SelectOptions{Platform: p}, testTypes)
+		if err != nil {
+			t.Fatalf("%s: selectManifestDescriptor error: %v", platform, err)
+		}
+		if md.Digest != want {
+			t.Errorf("%s: selected %s, want %s", platform, md.Digest, want)
+		}
 	}
 }
 
@@ -153,7 +236,7 @@ func TestSelectManifestDescriptor_NestedIndex(t *testing.T) {
 				Digest:    "sha256:inner",
 				Platform:  &v1.Platform{OS: "linux", Architecture: "amd64"},
 				Annotations: map[string]string{
-					pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeLxc,
+					spec.AnnotationPextraImageType: spec.PextraImageTypeLxc,
 				},
 			},
 		},
@@ -177,13 +260,113 @@ func TestSelectManifestDescriptor_NestedIndex(t *testing.T) {
 		},
 	}
 
-	md, err := selectManifestDescriptor(base, &idx, "linux", "amd64")
+	md, err := selectManifestDescriptor(NewDirSource(base), &idx, SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}, testTypes)
 	if err != nil {
 		t.Fatalf("selectManifestDescriptor nested error: %v", err)
 	}
-	if md == nil || md.Digest != "sha256:inner" || md.imageType != pextraoci.PextraImageTypeLxc {
+	if md == nil || md.Digest != "sha256:inner" || md.imageType != spec.PextraImageTypeLxc {
 		t.Fatalf("unexpected nested selection: %+v", md)
 	}
+	if !strings.HasPrefix(md.reason, "via nested index "+nestedDigest+": ") {
+		t.Fatalf("unexpected selection reason: %q", md.reason)
+	}
+}
+
+// Writes idx as a blob under a made-up digest, so that tests can build cycles
+func writeNamedIndexBlob(t *testing.T, base string, name digest.Digest, idx v1.Index) v1.Descriptor {
+	t.Helper()
+	idx.MediaType = v1.MediaTypeImageIndex
+	b, _ := json.Marshal(idx)
+	p := utils.BlobPath(base, name.String())
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("mkdir blobs: %v", err)
+	}
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatalf("write index blob: %v", err)
+	}
+	return v1.Descriptor{MediaType: v1.MediaTypeImageIndex, Digest: name, Size: int64(len(b))}
+}
+
+func lxcManifestDesc(d digest.Digest, p *v1.Platform) v1.Descriptor {
+	return v1.Descriptor{
+		MediaType:   v1.MediaTypeImageManifest,
+		Digest:      d,
+		Platform:    p,
+		Annotations: map[string]string{spec.AnnotationPextraImageType: spec.PextraImageTypeLxc},
+	}
+}
+
+func TestSelectManifestDescriptor_IndexOfIndexes(t *testing.T) {
+	base := t.TempDir()
+
+	// Per-architecture indexes whose manifests only carry the platform on the index descriptor
+	amd64 := writeNamedIndexBlob(t, base, "sha256:amd64idx", v1.Index{Manifests: []v1.Descriptor{lxcManifestDesc("sha256:amd64", nil)}})
+	amd64.Platform = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := writeNamedIndexBlob(t, base, "sha256:arm64idx", v1.Index{Manifests: []v1.Descriptor{lxcManifestDesc("sha256:arm64", nil)}})
+	arm64.Platform = &v1.Platform{OS: "linux", Architecture: "arm64"}
+	// A second level below an index without a platform
+	deep := writeNamedIndexBlob(t, base, "sha256:deep", v1.Index{Manifests: []v1.Descriptor{
+		lxcManifestDesc("sha256:riscv", &v1.Platform{OS: "linux", Architecture: "riscv64"}),
+	}})
+	mid := writeNamedIndexBlob(t, base, "sha256:mid", v1.Index{Manifests: []v1.Descriptor{deep}})
+
+	idx := v1.Index{Manifests: []v1.Descriptor{
+		lxcManifestDesc("sha256:wildcard", nil),
+		amd64,
+		arm64,
+		mid,
+	}}
+
+	cases := []struct {
+		platform   v1.Platform
+		want       digest.Digest
+		wantReason string
+	}{
+		{v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, "sha256:arm64", "via nested index sha256:arm64idx: matches platform linux/arm64/v8"},
+		{v1.Platform{OS: "linux", Architecture: "amd64"}, "sha256:amd64", "via nested index sha256:amd64idx: matches platform linux/amd64"},
+		{v1.Platform{OS: "linux", Architecture: "riscv64"}, "sha256:riscv", "via nested index sha256:mid -> sha256:deep: matches platform linux/riscv64"},
+		{v1.Platform{OS: "linux", Architecture: "s390x"}, "sha256:wildcard", "platform unspecified, treated as wildcard"},
+	}
+	for _, tc := range cases {
+		md, err := selectManifestDescriptor(NewDirSource(base), &idx, SelectOptions{Platform: &tc.platform}, testTypes)
+		if err != nil {
+			t.Fatalf("%s: selectManifestDescriptor error: %v", utils.FormatPlatform(&tc.platform), err)
+		}
+		if md.Digest != tc.want || md.reason != tc.wantReason {
+			t.Errorf("%s: selected %s (%q), want %s (%q)", utils.FormatPlatform(&tc.platform), md.Digest, md.reason, tc.want, tc.wantReason)
+		}
+	}
+}
+
+func TestSelectManifestDescriptor_NestedNoMatch(t *testing.T) {
+	base := t.TempDir()
+	arm64 := writeNamedIndexBlob(t, base, "sha256:arm64idx", v1.Index{Manifests: []v1.Descriptor{
+		lxcManifestDesc("sha256:arm64", &v1.Platform{OS: "linux", Architecture: "arm64"}),
+	}})
+	idx := v1.Index{Manifests: []v1.Descriptor{arm64}}
+
+	_, err := selectManifestDescriptor(NewDirSource(base), &idx, SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}, testTypes)
+	if err == nil || !strings.Contains(err.Error(), "available: linux/arm64") {
+		t.Fatalf("expected a no-match error listing nested platforms, got %v", err)
+	}
+}
+
+func TestSelectManifestDescriptor_NestedCycleAndDepth(t *testing.T) {
+	base := t.TempDir()
+	loop := writeNamedIndexBlob(t, base, "sha256:loop", v1.Index{Manifests: []v1.Descriptor{
+		{MediaType: v1.MediaTypeImageIndex, Digest: "sha256:loop"},
+	}})
+	if _, err := selectManifestDescriptor(NewDirSource(base), &v1.Index{Manifests: []v1.Descriptor{loop}}, SelectOptions{Platform: utils.HostPlatform()}, testTypes); err == nil || !strings.Contains(err.Error(), "refers back to itself") {
+		t.Fatalf("expected a cycle error, got %v", err)
+	}
+
+	next := lxcManifestDesc("sha256:leaf", nil)
+	for i := 0; i <= MaxIndexDepth; i++ {
+		next = writeNamedIndexBlob(t, base, digest.Digest(fmt.Sprintf("sha256:level%d", i)), v1.Index{Manifests: []v1.Descriptor{next}})
+	}
+	if _, err := selectManifestDescriptor(NewDirSource(base), &v1.Index{Manifests: []v1.Descriptor{next}}, SelectOptions{Platform: utils.HostPlatform()}, testTypes); err == nil || !strings.Contains(err.Error(), "maximum depth") {
+		t.Fatalf("expected a depth error, got %v", err)
+	}
 }
 
 func TestSelectManifestDescriptor_NoSuitable(t *testing.T) {
@@ -192,7 +375,7 @@ func TestSelectManifestDescriptor_NoSuitable(t *testing.T) {
 			{MediaType: v1.MediaTypeImageManifest, Digest: "sha256:x"}, // no annotations
 		},
 	}
-	if _, err := selectManifestDescriptor(t.TempDir(), &idx, "linux", "amd64"); err == nil {
+	if _, err := selectManifestDescriptor(NewDirSource(t.TempDir()), &idx, SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}, testTypes); err == nil {
 		t.Fatalf("expected error when no suitable manifest found")
 	}
 }
@@ -238,14 +421,14 @@ func TestReadBlobJSON_SuccessAndError(t *testing.T) {
 	}
 
 	var got Y
-	if err := readBlobJSON(base, digest, &got); err != nil {
+	if err := readBlobJSON(NewDirSource(base), digest, &got); err != nil {
 		t.Fatalf("readBlobJSON error: %v", err)
 	}
 	if got != want {
 		t.Fatalf("got %+v want %+v", got, want)
 	}
 
-	if err := readBlobJSON(base, "sha256:doesnotexist", &got); err == nil {
+	if err := readBlobJSON(NewDirSource(base), "sha256:doesnotexist", &got); err == nil {
 		t.Fatalf("expected error for missing blob")
 	}
 }
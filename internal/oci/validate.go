@@ -0,0 +1,183 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/PextraCloud/pce-osi/internal/spec"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// A single problem found while validating an image layout
+type ValidationProblem struct {
+	// Where the problem was found, e.g. "index.json/manifests[0]/layers[1]"
+	Location string
+	Err      error
+}
+
+func (p ValidationProblem) String() string {
+	return p.Location + ": " + p.Err.Error()
+}
+
+// Outcome of validating an image layout
+type ValidationResult struct {
+	Problems []ValidationProblem
+	// Number of manifests annotated with a Pextra image type
+	PextraImages int
+}
+
+type layoutValidator struct {
+	src   Source
+	types ImageTypes
+	res   ValidationResult
+	// Verification result per blob digest, so shared blobs are only hashed once
+	verified map[string]error
+}
+
+// Checks the image layout read from src: every blob reachable from index.json must
+// exist and match its descriptor, and Pextra manifests must follow the rules in
+// PEXTRA_OCI_EXTENSIONS.md and the rules of their type in types. All problems are
+// collected; the error is only set when the layout cannot be read at all.
+func ValidateSource(src Source, types ImageTypes) (*ValidationResult, error) {
+	v := &layoutValidator{src: src, types: types, verified: make(map[string]error)}
+
+	var layout v1.ImageLayout
+	if err := readSourceJSON(src, v1.ImageLayoutFile, &layout); err != nil {
+		v.report(v1.ImageLayoutFile, err)
+	} else if layout.Version != v1.ImageLayoutVersion {
+		v.report(v1.ImageLayoutFile, fmt.Errorf("unsupported layout version %q (want %q)", layout.Version, v1.ImageLayoutVersion))
+	}
+
+	var idx v1.Index
+	if err := readSourceJSON(src, v1.ImageIndexFile, &idx); err != nil {
+		v.report(v1.ImageIndexFile, err)
+		return &v.res, nil
+	}
+	v.validateIndex(v1.ImageIndexFile, &idx)
+	return &v.res, nil
+}
+
+func (v *layoutValidator) report(location string, err error) {
+	v.res.Problems = append(v.res.Problems, ValidationProblem{Location: location, Err: err})
+}
+
+// Verifies the blob behind d, reporting a problem if it is missing or does not match
+func (v *layoutValidator) checkBlob(location string, d v1.Descriptor) bool {
+	key := d.Digest.String()
+	err, seen := v.verified[key]
+	if !seen {
+		err = VerifyBlob(v.src, d)
+		v.verified[key] = err
+	}
+	if err != nil {
+		v.report(location, blobProblem(d, err))
+		return false
+	}
+	return true
+}
+
+// Verifies the blob behind d and parses it into out from the same read
+func (v *layoutValidator) readBlob(location string, d v1.Descriptor, out any) bool {
+	b, err := readVerifiedBlob(v.src, d)
+	v.verified[d.Digest.String()] = err
+	if err != nil {
+		v.report(location, blobProblem(d, err))
+		return false
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		v.report(location, fmt.Errorf("parse %s: %w", d.Digest, err))
+		return false
+	}
+	return true
+}
+
+func blobProblem(d v1.Descriptor, err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("blob %s is missing", d.Digest)
+	}
+	return err
+}
+
+func readVerifiedBlob(src Source, d v1.Descriptor) ([]byte, error) {
+	r, err := OpenBlob(src, d)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (v *layoutValidator) validateIndex(location string, idx *v1.Index) {
+	if idx.MediaType != v1.MediaTypeImageIndex {
+		v.report(location, fmt.Errorf("unsupported index mediaType %q (want %q)", idx.MediaType, v1.MediaTypeImageIndex))
+	}
+	if len(idx.Manifests) == 0 {
+		v.report(location, fmt.Errorf("index contains no manifests"))
+	}
+
+	for i, d := range idx.Manifests {
+		loc := fmt.Sprintf("%s/manifests[%d]", location, i)
+		switch d.MediaType {
+		case v1.MediaTypeImageIndex:
+			var nested v1.Index
+			if v.readBlob(loc, d, &nested) {
+				v.validateIndex(loc, &nested)
+			}
+		case v1.MediaTypeImageManifest, "": // empty is tolerated by some tools
+			var manifest v1.Manifest
+			if v.readBlob(loc, d, &manifest) {
+				v.validateManifest(loc, d, &manifest)
+			}
+		default:
+			v.checkBlob(loc, d)
+		}
+	}
+}
+
+func (v *layoutValidator) validateManifest(location string, d v1.Descriptor, manifest *v1.Manifest) {
+	if manifest.MediaType != v1.MediaTypeImageManifest {
+		v.report(location, fmt.Errorf("unsupported manifest mediaType %q", manifest.MediaType))
+	}
+
+	if manifest.Config.MediaType != v1.MediaTypeImageConfig {
+		v.report(location+"/config", fmt.Errorf("unsupported config mediaType %q", manifest.Config.MediaType))
+	}
+	var config v1.Image
+	v.readBlob(location+"/config", manifest.Config, &config)
+
+	for i, l := range manifest.Layers {
+		v.checkBlob(fmt.Sprintf("%s/layers[%d]", location, i), l)
+	}
+
+	// The descriptor annotation drives selection; fall back to the manifest's own annotations
+	imageType, ok := d.Annotations[spec.AnnotationPextraImageType]
+	if !ok {
+		imageType, ok = manifest.Annotations[spec.AnnotationPextraImageType]
+	}
+	if !ok {
+		return
+	}
+	v.res.PextraImages++
+
+	for _, err := range v.types.validate(imageType, manifest) {
+		v.report(location, err)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/spec"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestValidateSource_Valid(t *testing.T) {
+	base := t.TempDir()
+	writeTestLxcLayout(t, base)
+
+	res, err := validateLayout(t, base)
+	if err != nil {
+		t.Fatalf("ValidateSource error: %v", err)
+	}
+	if len(res.Problems) != 0 || res.PextraImages != 1 {
+		t.Fatalf("expected one valid Pextra image, got %+v", res)
+	}
+}
+
+func TestValidateSource_NoPextraImages(t *testing.T) {
+	base := t.TempDir()
+	config := writeTestJSONBlob(t, base, v1.MediaTypeImageConfig, v1.Image{})
+	manifest := v1.Manifest{MediaType: v1.MediaTypeImageManifest, Config: config, Layers: []v1.Descriptor{}}
+	manifest.SchemaVersion = 2
+	writeTestIndex(t, base, writeTestJSONBlob(t, base, v1.MediaTypeImageManifest, manifest))
+
+	res, err := validateLayout(t, base)
+	if err != nil {
+		t.Fatalf("ValidateSource error: %v", err)
+	}
+	if len(res.Problems) != 0 || res.PextraImages != 0 {
+		t.Fatalf("expected a valid layout without Pextra images, got %+v", res)
+	}
+}
+
+func TestValidateSource_ReportsAllProblems(t *testing.T) {
+	base := t.TempDir()
+	manifest := writeTestLxcLayout(t, base)
+
+	// Corrupt the layer and remove the config
+	if err := os.WriteFile(utils.BlobPath(base, manifest.Layers[0].Digest.String()), []byte("tampered"), 0o644); err != nil {
+		t.Fatalf("write layer: %v", err)
+	}
+	if err := os.Remove(utils.BlobPath(base, manifest.Config.Digest.String())); err != nil {
+		t.Fatalf("remove config: %v", err)
+	}
+
+	res, err := validateLayout(t, base)
+	if err != nil {
+		t.Fatalf("ValidateSource error: %v", err)
+	}
+	problems := res.Problems
+	if len(problems) != 2 {
+		t.Fatalf("expected 2 problems, got %v", problems)
+	}
+	if !strings.HasSuffix(problems[0].Location, "/config") || !strings.Contains(problems[0].Err.Error(), "missing") {
+		t.Fatalf("unexpected config problem: %v", problems[0])
+	}
+	if !strings.HasSuffix(problems[1].Location, "/layers[0]") {
+		t.Fatalf("unexpected layer problem: %v", problems[1])
+	}
+}
+
+func TestImageTypes_Validate(t *testing.T) {
+	if errs := testTypes.validate(spec.PextraImageTypeLxc, &v1.Manifest{}); len(errs) != 0 {
+		t.Fatalf("expected no errors, got %v", errs)
+	}
+	if errs := testTypes.validate("other", &v1.Manifest{}); len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+}
+
+// helpers
+
+// Selects an image from the layout at p, which stays open until img.Source is closed
+func selectImage(p string, opts SelectOptions) (*OciImage, error) {
+	src, err := OpenSource(p)
+	if err != nil {
+		return nil, err
+	}
+	img, err := SelectSourceImage(src, opts, testTypes)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return img, nil
+}
+
+func validateLayout(t *testing.T, p string) (*ValidationResult, error) {
+	t.Helper()
+	src, err := OpenSource(p)
+	if err != nil {
+		t.Fatalf("OpenSource error: %v", err)
+	}
+	defer src.Close()
+	return ValidateSource(src, testTypes)
+}
+
+func writeTestBlob(t *testing.T, base, mediaType string, content []byte) v1.Descriptor {
+	t.Helper()
+	d := v1.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(content), Size: int64(len(content))}
+	p := utils.BlobPath(base, d.Digest.String())
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("mkdir blobs: %v", err)
+	}
+	if err := os.WriteFile(p, content, 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	return d
+}
+
+func writeTestJSONBlob(t *testing.T, base, mediaType string, v any) v1.Descriptor {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return writeTestBlob(t, base, mediaType, b)
+}
+
+func writeTestIndex(t *testing.T, base string, manifests ...v1.Descriptor) {
+	t.Helper()
+	idx := v1.Index{MediaType: v1.MediaTypeImageIndex, Manifests: manifests}
+	idx.SchemaVersion = 2
+	b, _ := json.Marshal(idx)
+	if err := os.WriteFile(filepath.Join(base, v1.ImageIndexFile), b, 0o644); err != nil {
+		t.Fatalf("write index: %v", err)
+	}
+	b, _ = json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err := os.WriteFile(filepath.Join(base, v1.ImageLayoutFile), b, 0o644); err != nil {
+		t.Fatalf("write layout: %v", err)
+	}
+}
+
+// Writes a single-manifest LXC layout and returns its manifest
+func writeTestLxcLayout(t *testing.T, base string) *v1.Manifest {
+	t.Helper()
+	layer := writeTestBlob(t, base, spec.MediaTypePextraImageLayerLxc, []byte("not really a tar"))
+	config := writeTestJSONBlob(t, base, v1.MediaTypeImageConfig, v1.Image{
+		Platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+	})
+	manifest := &v1.Manifest{
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []v1.Descriptor{layer},
+	}
+	manifest.SchemaVersion = 2
+	md := writeTestJSONBlob(t, base, v1.MediaTypeImageManifest, manifest)
+	md.Platform = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	md.Annotations = map[string]string{spec.AnnotationPextraImageType: spec.PextraImageTypeLxc}
+	writeTestIndex(t, base, md)
+	return manifest
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/PextraCloud/pce-osi/internal/spec"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Writes blobs and images into an OCI image layout directory
+type LayoutWriter struct {
+	Path string
+}
+
+// Opens the image layout at path for writing, creating it if it does not exist
+func NewLayoutWriter(path string) (*LayoutWriter, error) {
+	base := filepath.Clean(path)
+	if err := os.MkdirAll(filepath.Join(base, v1.ImageBlobsDir, string(digest.Canonical)), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create layout directory: %w", err)
+	}
+
+	layoutFile := filepath.Join(base, v1.ImageLayoutFile)
+	var layout v1.ImageLayout
+	switch err := readJSONFile(layoutFile, &layout); {
+	case os.IsNotExist(err):
+		layout.Version = v1.ImageLayoutVersion
+		if err := writeJSONFile(layoutFile, layout); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("parse %s: %w", v1.ImageLayoutFile, err)
+	case layout.Version != v1.ImageLayoutVersion:
+		return nil, fmt.Errorf("unsupported layout version %q (want %q)", layout.Version, v1.ImageLayoutVersion)
+	}
+
+	indexFile := filepath.Join(base, v1.ImageIndexFile)
+	if _, err := os.Stat(indexFile); os.IsNotExist(err) {
+		if err := writeJSONFile(indexFile, newIndex()); err != nil {
+			return nil, err
+		}
+	}
+
+	return &LayoutWriter{Path: base}, nil
+}
+
+// Stores the content of r as a sha256 blob and returns its descriptor
+func (w *LayoutWriter) WriteBlob(r io.Reader, mediaType string) (v1.Descriptor, error) {
+	return w.writeBlob(r, mediaType, digest.Canonical)
+}
+
+// Stores the content of r as the blob described by desc. Fails, storing nothing, if the
+// content does not match the size and digest in desc.
+func (w *LayoutWriter) PutBlob(r io.Reader, desc v1.Descriptor) error {
+	vr, err := utils.NewVerifiedReader(r, desc)
+	if err != nil {
+		return err
+	}
+	if _, err := w.writeBlob(vr, desc.MediaType, desc.Digest.Algorithm()); err != nil {
+		return fmt.Errorf("blob %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// Reports whether the blob for desc is already stored with the expected size
+func (w *LayoutWriter) HasBlob(desc v1.Descriptor) bool {
+	fi, err := os.Stat(utils.BlobPath(w.Path, desc.Digest.String()))
+	return err == nil && fi.Mode().IsRegular() && fi.Size() == desc.Size
+}
+
+func (w *LayoutWriter) writeBlob(r io.Reader, mediaType string, algo digest.Algorithm) (v1.Descriptor, error) {
+	dir := filepath.Join(w.Path, v1.ImageBlobsDir, string(algo))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	digester := algo.Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	desc := v1.Descriptor{MediaType: mediaType, Digest: digester.Digest(), Size: size}
+	if err := os.Rename(tmp.Name(), utils.BlobPath(w.Path, desc.Digest.String())); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to store blob %s: %w", desc.Digest, err)
+	}
+	return desc, nil
+}
+
+// Stores v as a JSON blob and returns its descriptor
+func (w *LayoutWriter) WriteJSONBlob(v any, mediaType string) (v1.Descriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	return w.WriteBlob(bytes.NewReader(b), mediaType)
+}
+
+// Adds a manifest (or nested index) descriptor to index.json. An existing entry with the same
+// ref name and platform, or with the same digest, is replaced.
+func (w *LayoutWriter) AddManifest(desc v1.Descriptor) error {
+	indexFile := filepath.Join(w.Path, v1.ImageIndexFile)
+	var idx v1.Index
+	if err := readJSONFile(indexFile, &idx); err != nil {
+		return fmt.Errorf("parse %s: %w", v1.ImageIndexFile, err)
+	}
+
+	ref := desc.Annotations[v1.AnnotationRefName]
+	manifests := idx.Manifests[:0]
+	for _, d := range idx.Manifests {
+		if d.Digest == desc.Digest && d.Annotations[v1.AnnotationRefName] == ref {
+			continue
+		}
+		if ref != "" && d.Annotations[v1.AnnotationRefName] == ref && samePlatform(d.Platform, desc.Platform) {
+			continue
+		}
+		manifests = append(manifests, d)
+	}
+	idx.Manifests = append(manifests, desc)
+
+	return writeJSONFile(indexFile, idx)
+}
+
+// Writes the config and manifest for a Pextra image and adds it to index.json under tag
+// (if not empty). Returns the manifest descriptor as recorded in the index.
+func (w *LayoutWriter) WriteImage(imageType string, config *v1.Image, layers []v1.Descriptor, tag string) (v1.Descriptor, error) {
+	configDesc, err := w.WriteJSONBlob(config, v1.MediaTypeImageConfig)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to write config: %w", err)
+	}
+
+	annotations := map[string]string{spec.AnnotationPextraImageType: imageType}
+	if config.Created != nil {
+		annotations[v1.AnnotationCreated] = config.Created.UTC().Format(time.RFC3339)
+	}
+	manifest := v1.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   v1.MediaTypeImageManifest,
+		Config:      configDesc,
+		Layers:      layers,
+		Annotations: annotations,
+	}
+	desc, err := w.WriteJSONBlob(manifest, v1.MediaTypeImageManifest)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	platform := config.Platform
+	desc.Platform = &platform
+	desc.Annotations = map[string]string{spec.AnnotationPextraImageType: imageType}
+	if tag != "" {
+		desc.Annotations[v1.AnnotationRefName] = tag
+	}
+	if err := w.AddManifest(desc); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func newIndex() v1.Index {
+	return v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+}
+
+func samePlatform(a, b *v1.Platform) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.OS == b.OS && a.Architecture == b.Architecture && a.Variant == b.Variant && a.OSVersion == b.OSVersion
+}
+
+// Writes v as JSON to path, replacing the file atomically
+func writeJSONFile(path string, v any) error {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package oci
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/spec"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestLayoutWriter_WriteImage(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "layout")
+	lw, err := NewLayoutWriter(base)
+	if err != nil {
+		t.Fatalf("NewLayoutWriter error: %v", err)
+	}
+
+	layer, err := lw.WriteBlob(strings.NewReader("layer"), spec.MediaTypePextraImageLayerLxc)
+	if err != nil {
+		t.Fatalf("WriteBlob error: %v", err)
+	}
+	if err := VerifyBlob(NewDirSource(base), layer); err != nil {
+		t.Fatalf("written blob does not verify: %v", err)
+	}
+	if fi, err := os.Stat(utils.BlobPath(base, layer.Digest.String())); err != nil || fi.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected blob mode (err=%v)", err)
+	}
+
+	config := &v1.Image{Platform: v1.Platform{OS: "linux", Architecture: "amd64"}}
+	desc, err := lw.WriteImage(spec.PextraImageTypeLxc, config, []v1.Descriptor{layer}, "debian-12")
+	if err != nil {
+		t.Fatalf("WriteImage error: %v", err)
+	}
+	if desc.Annotations[v1.AnnotationRefName] != "debian-12" {
+		t.Fatalf("expected ref name annotation, got %v", desc.Annotations)
+	}
+
+	res, err := validateLayout(t, base)
+	if err != nil || len(res.Problems) != 0 {
+		t.Fatalf("expected valid layout, got %+v (err=%v)", res, err)
+	}
+	img, err := selectImage(base, SelectOptions{Platform: &config.Platform})
+	if err != nil {
+		t.Fatalf("SelectSourceImage error: %v", err)
+	}
+	defer img.Source.Close()
+	if img.SelectedDescriptor.Digest != desc.Digest || img.PextraImageType != spec.PextraImageTypeLxc {
+		t.Fatalf("unexpected image: %+v", img)
+	}
+}
+
+func TestLayoutWriter_AddManifestReplacesTag(t *testing.T) {
+	lw, err := NewLayoutWriter(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLayoutWriter error: %v", err)
+	}
+
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	add := func(dgst string, platform *v1.Platform, tag string) {
+		t.Helper()
+		d := v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest.Digest("sha256:" + strings.Repeat(dgst, 64)), Platform: platform}
+		if tag != "" {
+			d.Annotations = map[string]string{v1.AnnotationRefName: tag}
+		}
+		if err := lw.AddManifest(d); err != nil {
+			t.Fatalf("AddManifest error: %v", err)
+		}
+	}
+	add("a", amd64, "t")
+	add("b", arm64, "t")
+	add("c", amd64, "t") // replaces a
+	add("d", amd64, "other")
+	add("d", amd64, "other") // same digest, no duplicate
+
+	var idx v1.Index
+	if err := readJSONFile(filepath.Join(lw.Path, v1.ImageIndexFile), &idx); err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	var got []string
+	for _, d := range idx.Manifests {
+		got = append(got, d.Digest.Encoded()[:1])
+	}
+	if strings.Join(got, "") != "bcd" {
+		t.Fatalf("unexpected index entries %v", got)
+	}
+}
+
+func TestNewLayoutWriter_RejectsUnknownVersion(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, v1.ImageLayoutFile), []byte(`{"imageLayoutVersion":"2.0.0"}`), 0o644); err != nil {
+		t.Fatalf("write layout: %v", err)
+	}
+	if _, err := NewLayoutWriter(base); err == nil {
+		t.Fatalf("expected error for unsupported layout version")
+	}
+}
+
+func TestLayoutWriter_PutBlob(t *testing.T) {
+	lw, err := NewLayoutWriter(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLayoutWriter error: %v", err)
+	}
+
+	content := "blob"
+	for _, algo := range []digest.Algorithm{digest.SHA256, digest.SHA512} {
+		desc := v1.Descriptor{MediaType: "application/octet-stream", Digest: algo.FromString(content), Size: int64(len(content))}
+		if lw.HasBlob(desc) {
+			t.Fatalf("HasBlob(%s) before PutBlob", algo)
+		}
+		if err := lw.PutBlob(strings.NewReader(content), desc); err != nil {
+			t.Fatalf("PutBlob(%s) error: %v", algo, err)
+		}
+		if !lw.HasBlob(desc) {
+			t.Fatalf("HasBlob(%s) after PutBlob", algo)
+		}
+	}
+
+	bad := v1.Descriptor{Digest: digest.FromString("other"), Size: int64(len(content))}
+	if err := lw.PutBlob(strings.NewReader(content), bad); !errors.Is(err, utils.ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got %v", err)
+	}
+	if lw.HasBlob(bad) {
+		t.Fatalf("mismatching blob must not be stored")
+	}
+}
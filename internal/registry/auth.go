@@ -0,0 +1,156 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A parsed WWW-Authenticate challenge, e.g.
+// Bearer realm="https://auth.example.com/token",service="registry",scope="repository:a:pull"
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// Parses the first challenge of a WWW-Authenticate header
+func parseChallenge(header string) (challenge, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if scheme == "" {
+		return challenge{}, false
+	}
+	c := challenge{scheme: strings.ToLower(scheme), params: make(map[string]string)}
+
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			// Quoted value, which may contain commas and escaped quotes
+			var b strings.Builder
+			i := 1
+			for ; i < len(after) && after[i] != '"'; i++ {
+				if after[i] == '\\' && i+1 < len(after) {
+					i++
+				}
+				b.WriteByte(after[i])
+			}
+			value = b.String()
+			after = after[min(i+1, len(after)):]
+		} else {
+			value, after, _ = strings.Cut(after, ",")
+			after = "," + after
+		}
+		c.params[key] = strings.TrimSpace(value)
+
+		_, rest, _ = strings.Cut(after, ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return c, true
+}
+
+// The response of a token server; registries use either field
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// Returns the Authorization header that answers the challenge in resp
+func (c *Client) authorize(ctx context.Context, resp *http.Response) (string, error) {
+	ch, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok {
+		return "", fmt.Errorf("registry %s requires authentication but sent no challenge", c.ref.Registry)
+	}
+
+	switch ch.scheme {
+	case "basic":
+		if c.opts.Username == "" {
+			return "", fmt.Errorf("registry %s requires a username and password", c.ref.Registry)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		token, err := c.fetchToken(ctx, ch)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	default:
+		return "", fmt.Errorf("registry %s uses unsupported authentication scheme %q", c.ref.Registry, ch.scheme)
+	}
+}
+
+// Requests a bearer token from the realm of a challenge, anonymously or with the
+// configured credentials
+func (c *Client) fetchToken(ctx context.Context, ch challenge) (string, error) {
+	realm := ch.params["realm"]
+	u, err := url.Parse(realm)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("registry %s sent an invalid token realm %q", c.ref.Registry, realm)
+	}
+	q := u.Query()
+	if service := ch.params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := ch.params["scope"]
+	if scope == "" {
+		scope = "repository:" + c.ref.Repository + ":pull"
+		if c.push {
+			scope += ",push"
+		}
+	}
+	for _, s := range strings.Fields(scope) {
+		q.Add("scope", s)
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.opts.Username != "" {
+		req.SetBasicAuth(c.opts.Username, c.opts.Password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("request token from %s: %w", u.Host, responseError(resp))
+	}
+
+	var tr tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", fmt.Errorf("parse token response: %w", err)
+	}
+	if tr.Token != "" {
+		return tr.Token, nil
+	}
+	if tr.AccessToken != "" {
+		return tr.AccessToken, nil
+	}
+	return "", fmt.Errorf("token server %s returned no token", u.Host)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"testing"
+)
+
+func TestParseChallenge(t *testing.T) {
+	c, ok := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a:pull,push"`)
+	if !ok || c.scheme != "bearer" {
+		t.Fatalf("unexpected challenge %+v", c)
+	}
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:a:pull,push",
+	}
+	for k, v := range want {
+		if c.params[k] != v {
+			t.Errorf("param %s = %q, want %q", k, c.params[k], v)
+		}
+	}
+
+	c, ok = parseChallenge(`Basic realm=fake, charset="UTF-8"`)
+	if !ok || c.scheme != "basic" || c.params["realm"] != "fake" || c.params["charset"] != "UTF-8" {
+		t.Fatalf("unexpected challenge %+v", c)
+	}
+
+	if _, ok := parseChallenge(""); ok {
+		t.Fatalf("expected no challenge for an empty header")
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Manifests larger than this are rejected, as the distribution spec recommends
+const maxManifestSize = 4 << 20
+
+type Options struct {
+	// Credentials for basic auth, or for requesting bearer tokens. Empty is anonymous.
+	Username string
+	Password string
+	// Talk to the registry over http instead of https
+	PlainHTTP bool
+	// Defaults to http.DefaultClient
+	HTTPClient *http.Client
+}
+
+// Talks the OCI distribution protocol to one repository of a registry
+type Client struct {
+	ref  Reference
+	opts Options
+	http *http.Client
+
+	// Request tokens that allow pushing as well as pulling
+	push bool
+
+	mu sync.Mutex
+	// Authorization header that last succeeded, sent with every request
+	auth string
+}
+
+func NewClient(ref Reference, opts Options) *Client {
+	hc := opts.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return &Client{ref: ref, opts: opts, http: hc}
+}
+
+// Returns the URL of an API path of the repository, e.g. "manifests/latest"
+func (c *Client) url(p string) string {
+	scheme := "https"
+	if c.opts.PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, c.ref.Registry, c.ref.Repository, p)
+}
+
+// Sends req, answering an authentication challenge once if the registry asks for one.
+// Request bodies must be rewindable through req.GetBody.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	auth := c.auth
+	c.mu.Unlock()
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	auth, err = c.authorize(req.Context(), resp)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("%s %s: cannot resend request body after authentication", req.Method, req.URL)
+		}
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", auth)
+	resp, err = c.http.Do(retry)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		c.mu.Lock()
+		c.auth = auth
+		c.mu.Unlock()
+	}
+	return resp, nil
+}
+
+// An error response of the distribution API
+type errorResponse struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// Describes an unexpected response, including the error messages the registry sent
+func responseError(resp *http.Response) error {
+	var er errorResponse
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(body, &er) == nil && len(er.Errors) > 0 {
+		msgs := make([]string, len(er.Errors))
+		for i, e := range er.Errors {
+			msgs[i] = strings.TrimSpace(e.Code + " " + e.Message)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.Join(msgs, "; "))
+	}
+	return fmt.Errorf("%s", resp.Status)
+}
+
+// Fetches the manifest or index for ref (a tag or digest). Returns its content and a
+// descriptor whose digest is checked against a digest ref and the Docker-Content-Digest
+// header.
+func (c *Client) FetchManifest(ctx context.Context, ref string) ([]byte, v1.Descriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("manifests/"+ref), nil)
+	if err != nil {
+		return nil, v1.Descriptor{}, err
+	}
+	req.Header.Set("Accept", v1.MediaTypeImageIndex+", "+v1.MediaTypeImageManifest)
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, v1.Descriptor{}, fmt.Errorf("fetch manifest %s: %w", ref, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, v1.Descriptor{}, fmt.Errorf("fetch manifest %s: %w", ref, responseError(resp))
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, v1.Descriptor{}, fmt.Errorf("fetch manifest %s: %w", ref, err)
+	}
+	if len(b) > maxManifestSize {
+		return nil, v1.Descriptor{}, fmt.Errorf("manifest %s exceeds %d bytes", ref, maxManifestSize)
+	}
+
+	// Hash with the algorithm of the digest the manifest is expected to have
+	expected, err := digest.Parse(ref)
+	if err != nil {
+		if expected, err = digest.Parse(resp.Header.Get("Docker-Content-Digest")); err != nil {
+			expected = ""
+		}
+	}
+	algo := digest.Canonical
+	if expected != "" {
+		algo = expected.Algorithm()
+	}
+	desc := v1.Descriptor{
+		MediaType: manifestMediaType(resp.Header.Get("Content-Type"), b),
+		Digest:    algo.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	if expected != "" && desc.Digest != expected {
+		return nil, v1.Descriptor{}, fmt.Errorf("manifest %s: %w: got %s", ref, utils.ErrDigestMismatch, desc.Digest)
+	}
+	return b, desc, nil
+}
+
+// Returns the media type of a manifest, preferring the one in its content
+func manifestMediaType(contentType string, b []byte) string {
+	var m struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(b, &m) == nil && m.MediaType != "" {
+		return m.MediaType
+	}
+	mt, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(mt)
+}
+
+// Opens the blob for desc. Reading it to EOF fails if it does not match the size and
+// digest in desc.
+func (c *Client) FetchBlob(ctx context.Context, desc v1.Descriptor) (io.ReadCloser, error) {
+	body, err := c.openBlob(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	vr, err := utils.NewVerifiedReader(body, desc)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{vr, body}, nil
+}
+
+// Opens the unverified content of the blob for desc
+func (c *Client) openBlob(ctx context.Context, desc v1.Descriptor) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("blobs/"+desc.Digest.String()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch blob %s: %w", desc.Digest, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("fetch blob %s: %w", desc.Digest, responseError(resp))
+	}
+	return resp.Body, nil
+}
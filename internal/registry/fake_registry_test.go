@@ -0,0 +1,373 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	// Registers the lxc image type the fake registry serves
+	_ "github.com/PextraCloud/pce-osi/pkg/pextra-oci/lxc"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Authentication the fake registry asks for
+const (
+	authNone   = ""
+	authBasic  = "basic"
+	authBearer = "bearer"
+)
+
+const (
+	testUser     = "user"
+	testPassword = "secret"
+	testToken    = "token-123"
+	// Handed out for scopes that include push
+	testPushToken = "token-456"
+)
+
+type fakeManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// A blob in another repository of the registry
+type fakeMount struct {
+	repo    string
+	content []byte
+}
+
+// A minimal in-memory registry serving one repository over the distribution API
+type fakeRegistry struct {
+	t    *testing.T
+	repo string
+	auth string
+	// Bearer challenges leave out the scope, as some registries do
+	omitScope bool
+
+	mu        sync.Mutex
+	manifests map[string]fakeManifest // by tag and digest
+	blobs     map[digest.Digest][]byte
+	blobGets  int
+	// Served instead of the real content, to test verification
+	corrupt map[digest.Digest][]byte
+
+	// Upload sessions by ID
+	uploads    map[string]*bytes.Buffer
+	nextUpload int
+	// Blobs that other repositories of the registry have
+	mountable map[digest.Digest]fakeMount
+	// Smallest chunk accepted, announced as OCI-Chunk-Min-Length
+	minChunk int64
+	// Requests seen, e.g. "HEAD blob", "PATCH", "PUT blob", "mount"
+	requests map[string]int
+	// Content-Type of every manifest PUT, by tag or digest
+	manifestTypes map[string]string
+}
+
+// Starts a TLS registry for repo and returns it with a reference prefix, e.g.
+// "127.0.0.1:1234/pextra/debian"
+func newFakeRegistry(t *testing.T, repo, auth string) (*fakeRegistry, *httptest.Server) {
+	r := &fakeRegistry{
+		t:         t,
+		repo:      repo,
+		auth:      auth,
+		manifests: make(map[string]fakeManifest),
+		blobs:     make(map[digest.Digest][]byte),
+		corrupt:   make(map[digest.Digest][]byte),
+
+		uploads:       make(map[string]*bytes.Buffer),
+		mountable:     make(map[digest.Digest]fakeMount),
+		requests:      make(map[string]int),
+		manifestTypes: make(map[string]string),
+	}
+	srv := httptest.NewTLSServer(r)
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func (r *fakeRegistry) addBlob(b []byte) digest.Digest {
+	d := digest.FromBytes(b)
+	r.mu.Lock()
+	r.blobs[d] = b
+	r.mu.Unlock()
+	return d
+}
+
+func (r *fakeRegistry) addManifest(v any, mediaType string, tags ...string) v1.Descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	desc := v1.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := fakeManifest{mediaType: mediaType, content: b}
+	r.manifests[desc.Digest.String()] = m
+	for _, tag := range tags {
+		r.manifests[tag] = m
+	}
+	return desc
+}
+
+// Adds a single-layer Pextra LXC image for platform and returns its manifest descriptor
+func (r *fakeRegistry) addLxcImage(platform v1.Platform, layer string, tags ...string) v1.Descriptor {
+	layerDesc := v1.Descriptor{MediaType: pextraoci.MediaTypePextraImageLayerLxc, Size: int64(len(layer))}
+	layerDesc.Digest = r.addBlob([]byte(layer))
+
+	config, err := json.Marshal(v1.Image{Platform: platform, RootFS: v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{layerDesc.Digest}}})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	configDesc := v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: r.addBlob(config), Size: int64(len(config))}
+
+	manifest := v1.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   v1.MediaTypeImageManifest,
+		Config:      configDesc,
+		Layers:      []v1.Descriptor{layerDesc},
+		Annotations: map[string]string{pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeLxc},
+	}
+	desc := r.addManifest(manifest, v1.MediaTypeImageManifest, tags...)
+	desc.Platform = &platform
+	return desc
+}
+
+func (r *fakeRegistry) authorized(req *http.Request) bool {
+	switch r.auth {
+	case authBasic:
+		user, pass, ok := req.BasicAuth()
+		return ok && user == testUser && pass == testPassword
+	case authBearer:
+		auth := req.Header.Get("Authorization")
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			return auth == "Bearer "+testPushToken
+		}
+		return auth == "Bearer "+testToken || auth == "Bearer "+testPushToken
+	}
+	return true
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	if !r.authorized(req) {
+		switch r.auth {
+		case authBasic:
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		case authBearer:
+			actions := "pull"
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				actions = "pull,push"
+			}
+			if r.omitScope {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="fake"`, req.Host))
+			} else {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="fake",scope="repository:%s:%s"`, req.Host, r.repo, actions))
+			}
+		}
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v2/"+r.repo+"/")
+	if !ok {
+		writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository not found")
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case strings.HasPrefix(rest, "manifests/") && req.Method == http.MethodGet:
+		m, ok := r.manifests[strings.TrimPrefix(rest, "manifests/")]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.content).String())
+		w.Write(m.content)
+	case strings.HasPrefix(rest, "blobs/") && req.Method == http.MethodGet:
+		d := digest.Digest(strings.TrimPrefix(rest, "blobs/"))
+		b, ok := r.blobs[d]
+		if !ok {
+			writeRegistryError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown")
+			return
+		}
+		if c, ok := r.corrupt[d]; ok {
+			b = c
+		}
+		r.blobGets++
+		w.Write(b)
+	case strings.HasPrefix(rest, "blobs/") && req.Method == http.MethodHead:
+		r.requests["HEAD blob"]++
+		b, ok := r.blobs[digest.Digest(strings.TrimPrefix(rest, "blobs/"))]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+	case rest == "blobs/uploads/" && req.Method == http.MethodPost:
+		r.startUpload(w, req)
+	case strings.HasPrefix(rest, "blobs/uploads/"):
+		r.serveUpload(w, req, strings.TrimPrefix(rest, "blobs/uploads/"))
+	case strings.HasPrefix(rest, "manifests/") && req.Method == http.MethodPut:
+		r.putManifest(w, req, strings.TrimPrefix(rest, "manifests/"))
+	default:
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported")
+	}
+}
+
+func (r *fakeRegistry) startUpload(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if mount := digest.Digest(q.Get("mount")); mount != "" {
+		r.requests["mount"]++
+		if m, ok := r.mountable[mount]; ok && m.repo == q.Get("from") {
+			r.blobs[mount] = m.content
+			w.Header().Set("Location", "/v2/"+r.repo+"/blobs/"+mount.String())
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+	}
+
+	r.nextUpload++
+	id := fmt.Sprint(r.nextUpload)
+	r.uploads[id] = &bytes.Buffer{}
+	// Relative locations must be resolved by the client
+	w.Header().Set("Location", "/v2/"+r.repo+"/blobs/uploads/"+id+"?state=s"+id)
+	if r.minChunk > 0 {
+		w.Header().Set("OCI-Chunk-Min-Length", fmt.Sprint(r.minChunk))
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string) {
+	buf, ok := r.uploads[id]
+	if !ok || req.URL.Query().Get("state") != "s"+id {
+		writeRegistryError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload unknown")
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Errorf("read upload body: %v", err)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPatch:
+		r.requests["PATCH"]++
+		var start, end int
+		if _, err := fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end); err != nil || start != buf.Len() || end != start+len(body)-1 {
+			writeRegistryError(w, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "bad range")
+			return
+		}
+		buf.Write(body)
+		w.Header().Set("Location", "/v2/"+r.repo+"/blobs/uploads/"+id+"?state=s"+id)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		r.requests["PUT blob"]++
+		buf.Write(body)
+		d := digest.Digest(req.URL.Query().Get("digest"))
+		if digest.FromBytes(buf.Bytes()) != d {
+			writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+			return
+		}
+		r.blobs[d] = bytes.Clone(buf.Bytes())
+		delete(r.uploads, id)
+		w.Header().Set("Location", "/v2/"+r.repo+"/blobs/"+d.String())
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeRegistryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "unsupported")
+	}
+}
+
+func (r *fakeRegistry) putManifest(w http.ResponseWriter, req *http.Request, ref string) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		r.t.Errorf("read manifest body: %v", err)
+		return
+	}
+	var m struct {
+		MediaType string          `json:"mediaType"`
+		Config    v1.Descriptor   `json:"config"`
+		Layers    []v1.Descriptor `json:"layers"`
+		Manifests []v1.Descriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil || m.MediaType != req.Header.Get("Content-Type") {
+		writeRegistryError(w, http.StatusBadRequest, "MANIFEST_INVALID", "media type mismatch")
+		return
+	}
+	// Everything a manifest refers to must have been pushed first
+	for _, d := range append(append([]v1.Descriptor{m.Config}, m.Layers...), m.Manifests...) {
+		_, isBlob := r.blobs[d.Digest]
+		_, isManifest := r.manifests[d.Digest.String()]
+		if d.Digest != "" && !isBlob && !isManifest {
+			writeRegistryError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "unknown "+d.Digest.String())
+			return
+		}
+	}
+	d := digest.FromBytes(body)
+	if dg, err := digest.Parse(ref); err == nil && dg != d {
+		writeRegistryError(w, http.StatusBadRequest, "DIGEST_INVALID", "digest mismatch")
+		return
+	}
+
+	mm := fakeManifest{mediaType: m.MediaType, content: body}
+	r.manifests[ref] = mm
+	r.manifests[d.String()] = mm
+	r.manifestTypes[ref] = req.Header.Get("Content-Type")
+	w.Header().Set("Docker-Content-Digest", d.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (r *fakeRegistry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Query().Get("scope"), "repository:"+r.repo+":") {
+		writeRegistryError(w, http.StatusBadRequest, "DENIED", "unexpected scope")
+		return
+	}
+	// The fake token server only hands out tokens to known users
+	if user, pass, ok := req.BasicAuth(); !ok || user != testUser || pass != testPassword {
+		writeRegistryError(w, http.StatusUnauthorized, "UNAUTHORIZED", "bad credentials")
+		return
+	}
+	token := testToken
+	if strings.HasSuffix(req.URL.Query().Get("scope"), ":pull,push") {
+		token = testPushToken
+	}
+	json.NewEncoder(w).Encode(map[string]string{"access_token": token})
+}
+
+func writeRegistryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q,"message":%q}]}`, code, message)
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type PullOptions struct {
+	Options
+	// Platform to select from multi-platform indexes; nil selects the host platform
+	Platform *v1.Platform
+	// Ref name to record in index.json. Defaults to the tag of the reference.
+	Tag string
+}
+
+type PullResult struct {
+	// The manifest descriptor as recorded in index.json
+	Descriptor v1.Descriptor
+	// Blobs downloaded, and blobs skipped because the layout already had them
+	Fetched, Skipped int
+}
+
+// Pulls the Pextra image ref from its registry into the image layout at layoutDir,
+// creating the layout if needed. Indexes are resolved to the manifest for
+// opts.Platform; every fetched blob is verified against its descriptor before it is
+// stored.
+func Pull(ctx context.Context, ref Reference, layoutDir string, opts PullOptions) (*PullResult, error) {
+	c := NewClient(ref, opts.Options)
+
+	raw, desc, err := c.FetchManifest(ctx, ref.Ref())
+	if err != nil {
+		return nil, err
+	}
+	var platform *v1.Platform
+	var imageType string
+	for depth := 0; desc.MediaType == v1.MediaTypeImageIndex; depth++ {
+		if depth >= oci.MaxIndexDepth {
+			return nil, fmt.Errorf("nested index %s exceeds the maximum depth of %d", desc.Digest, oci.MaxIndexDepth)
+		}
+		var idx v1.Index
+		if err := json.Unmarshal(raw, &idx); err != nil {
+			return nil, fmt.Errorf("parse index %s: %w", desc.Digest, err)
+		}
+		child, err := oci.MatchPlatform(idx.Manifests, opts.Platform)
+		if err != nil {
+			return nil, fmt.Errorf("index %s: %w", desc.Digest, err)
+		}
+		if child.Platform != nil {
+			platform = child.Platform
+		}
+		if t := child.Annotations[pextraoci.AnnotationPextraImageType]; t != "" {
+			imageType = t
+		}
+
+		if raw, desc, err = c.FetchManifest(ctx, child.Digest.String()); err != nil {
+			return nil, err
+		}
+		if desc.Size != child.Size {
+			return nil, fmt.Errorf("manifest %s: %w: has %d bytes, index says %d", child.Digest, utils.ErrSizeMismatch, desc.Size, child.Size)
+		}
+	}
+	if desc.MediaType != v1.MediaTypeImageManifest {
+		return nil, fmt.Errorf("unsupported manifest mediaType %q", desc.MediaType)
+	}
+
+	var manifest v1.Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", desc.Digest, err)
+	}
+	if t := manifest.Annotations[pextraoci.AnnotationPextraImageType]; t != "" {
+		imageType = t
+	}
+	if imageType == "" {
+		return nil, fmt.Errorf("%s is not a Pextra image (no %s annotation)", ref, pextraoci.AnnotationPextraImageType)
+	}
+	h, ok := pextraoci.LookupHandler(imageType)
+	if !ok {
+		return nil, fmt.Errorf("manifest %s: unknown %s %q", desc.Digest, pextraoci.AnnotationPextraImageType, imageType)
+	}
+	if errs := h.Validate(&manifest); len(errs) > 0 {
+		return nil, fmt.Errorf("manifest %s: %w", desc.Digest, errors.Join(errs...))
+	}
+	if manifest.Config.MediaType != v1.MediaTypeImageConfig {
+		return nil, fmt.Errorf("unsupported config mediaType %q", manifest.Config.MediaType)
+	}
+
+	lw, err := oci.NewLayoutWriter(layoutDir)
+	if err != nil {
+		return nil, err
+	}
+	res := &PullResult{}
+	for _, blob := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+		if lw.HasBlob(blob) {
+			res.Skipped++
+			continue
+		}
+		if err := fetchBlob(ctx, c, lw, blob); err != nil {
+			return nil, err
+		}
+		res.Fetched++
+	}
+
+	if platform == nil {
+		var config v1.Image
+		b, err := os.ReadFile(utils.BlobPath(lw.Path, manifest.Config.Digest.String()))
+		if err == nil {
+			err = json.Unmarshal(b, &config)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("load config %s: %w", manifest.Config.Digest, err)
+		}
+		platform = &config.Platform
+	}
+
+	// The manifest goes last, so that the layout never refers to missing blobs
+	if err := lw.PutBlob(bytes.NewReader(raw), desc); err != nil {
+		return nil, err
+	}
+	desc.Platform = platform
+	desc.Annotations = map[string]string{pextraoci.AnnotationPextraImageType: imageType}
+	tag := opts.Tag
+	if tag == "" {
+		tag = ref.Tag
+	}
+	if tag != "" {
+		desc.Annotations[v1.AnnotationRefName] = tag
+	}
+	if err := lw.AddManifest(desc); err != nil {
+		return nil, err
+	}
+	res.Descriptor = desc
+	return res, nil
+}
+
+func fetchBlob(ctx context.Context, c *Client, lw *oci.LayoutWriter, desc v1.Descriptor) error {
+	body, err := c.openBlob(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// PutBlob verifies the content while it is stored
+	return lw.PutBlob(body, desc)
+}
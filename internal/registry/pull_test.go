@@ -0,0 +1,200 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	amd64 = v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 = v1.Platform{OS: "linux", Architecture: "arm64"}
+)
+
+// Parses a reference to the repository of the fake registry
+func fakeRef(t *testing.T, srv *httptest.Server, repo, ref string) Reference {
+	t.Helper()
+	r, err := ParseReference(strings.TrimPrefix(srv.URL, "https://") + "/" + repo + ref)
+	if err != nil {
+		t.Fatalf("ParseReference error: %v", err)
+	}
+	return r
+}
+
+// Opens the layout at p, checks that it is valid and selects an image from it
+func selectImage(t *testing.T, p string, opts pextraoci.SelectOptions) *pextraoci.Image {
+	t.Helper()
+	layout, err := pextraoci.Open(p)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	t.Cleanup(func() { layout.Close() })
+	if res, err := layout.Validate(); err != nil || len(res.Problems) != 0 {
+		t.Fatalf("expected valid layout, got %+v (err=%v)", res, err)
+	}
+	img, err := layout.Select(opts)
+	if err != nil {
+		t.Fatalf("Select error: %v", err)
+	}
+	return img
+}
+
+func TestPull(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "pextra/debian", authNone)
+	want := reg.addLxcImage(amd64, "rootfs", "12")
+	layout := filepath.Join(t.TempDir(), "layout")
+	opts := PullOptions{Options: Options{HTTPClient: srv.Client()}, Platform: &amd64}
+
+	res, err := Pull(context.Background(), fakeRef(t, srv, "pextra/debian", ":12"), layout, opts)
+	if err != nil {
+		t.Fatalf("Pull error: %v", err)
+	}
+	if res.Descriptor.Digest != want.Digest || res.Fetched != 2 || res.Skipped != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	img := selectImage(t, layout, pextraoci.SelectOptions{Platform: &amd64, Tag: "12"})
+	if img.Descriptor.Digest != want.Digest || img.Descriptor.Platform.Architecture != "amd64" {
+		t.Fatalf("unexpected selected descriptor %+v", img.Descriptor)
+	}
+
+	// Pulling again only fetches the manifest
+	gets := reg.blobGets
+	res, err = Pull(context.Background(), fakeRef(t, srv, "pextra/debian", ":12"), layout, opts)
+	if err != nil {
+		t.Fatalf("second Pull error: %v", err)
+	}
+	if res.Fetched != 0 || res.Skipped != 2 || reg.blobGets != gets {
+		t.Fatalf("expected all blobs to be skipped, got %+v (%d new blob requests)", res, reg.blobGets-gets)
+	}
+}
+
+func TestPull_Auth(t *testing.T) {
+	for _, auth := range []string{authBasic, authBearer} {
+		t.Run(auth, func(t *testing.T) {
+			reg, srv := newFakeRegistry(t, "pextra/debian", auth)
+			reg.addLxcImage(amd64, "rootfs", "12")
+			ref := fakeRef(t, srv, "pextra/debian", ":12")
+
+			anon := PullOptions{Options: Options{HTTPClient: srv.Client()}, Platform: &amd64}
+			if _, err := Pull(context.Background(), ref, filepath.Join(t.TempDir(), "anon"), anon); err == nil {
+				t.Fatalf("expected anonymous pull to fail")
+			}
+
+			opts := anon
+			opts.Username, opts.Password = testUser, testPassword
+			if _, err := Pull(context.Background(), ref, filepath.Join(t.TempDir(), "layout"), opts); err != nil {
+				t.Fatalf("Pull error: %v", err)
+			}
+		})
+	}
+}
+
+func TestPull_ResolvesIndex(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "pextra/debian", authNone)
+	amd := reg.addLxcImage(amd64, "rootfs-amd64")
+	arm := reg.addLxcImage(arm64, "rootfs-arm64")
+	nested := reg.addManifest(v1.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: v1.MediaTypeImageIndex, Manifests: []v1.Descriptor{arm}}, v1.MediaTypeImageIndex)
+	reg.addManifest(v1.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: v1.MediaTypeImageIndex, Manifests: []v1.Descriptor{amd, nested}}, v1.MediaTypeImageIndex, "12")
+
+	for _, tc := range []struct {
+		platform v1.Platform
+		want     v1.Descriptor
+	}{{amd64, amd}, {arm64, arm}} {
+		layout := filepath.Join(t.TempDir(), "layout")
+		opts := PullOptions{Options: Options{HTTPClient: srv.Client()}, Platform: &tc.platform}
+		res, err := Pull(context.Background(), fakeRef(t, srv, "pextra/debian", ":12"), layout, opts)
+		if err != nil {
+			t.Fatalf("Pull(%s) error: %v", tc.platform.Architecture, err)
+		}
+		if res.Descriptor.Digest != tc.want.Digest || res.Descriptor.Platform.Architecture != tc.platform.Architecture {
+			t.Fatalf("Pull(%s) selected %s (%+v), want %s", tc.platform.Architecture, res.Descriptor.Digest, res.Descriptor.Platform, tc.want.Digest)
+		}
+	}
+
+	riscv := v1.Platform{OS: "linux", Architecture: "riscv64"}
+	opts := PullOptions{Options: Options{HTTPClient: srv.Client()}, Platform: &riscv}
+	if _, err := Pull(context.Background(), fakeRef(t, srv, "pextra/debian", ":12"), t.TempDir(), opts); err == nil || !strings.Contains(err.Error(), "no manifest matches platform") {
+		t.Fatalf("expected a platform mismatch error, got %v", err)
+	}
+}
+
+func TestPull_ByDigestWithTag(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "pextra/debian", authNone)
+	want := reg.addLxcImage(amd64, "rootfs")
+	layout := filepath.Join(t.TempDir(), "layout")
+	opts := PullOptions{Options: Options{HTTPClient: srv.Client()}, Platform: &amd64, Tag: "pinned"}
+
+	res, err := Pull(context.Background(), fakeRef(t, srv, "pextra/debian", "@"+want.Digest.String()), layout, opts)
+	if err != nil {
+		t.Fatalf("Pull error: %v", err)
+	}
+	if res.Descriptor.Annotations[v1.AnnotationRefName] != "pinned" {
+		t.Fatalf("expected ref name pinned, got %v", res.Descriptor.Annotations)
+	}
+}
+
+func TestPull_RejectsCorruptBlob(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "pextra/debian", authNone)
+	reg.addLxcImage(amd64, "rootfs", "12")
+	layer := reg.addBlob([]byte("rootfs"))
+	reg.corrupt[layer] = []byte("ROOTFS")
+	layout := filepath.Join(t.TempDir(), "layout")
+	opts := PullOptions{Options: Options{HTTPClient: srv.Client()}, Platform: &amd64}
+
+	_, err := Pull(context.Background(), fakeRef(t, srv, "pextra/debian", ":12"), layout, opts)
+	if !errors.Is(err, utils.ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got %v", err)
+	}
+	if _, err := os.Stat(utils.BlobPath(layout, layer.String())); !os.IsNotExist(err) {
+		t.Fatalf("expected the corrupt blob not to be stored, got %v", err)
+	}
+	l, err := pextraoci.Open(layout)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer l.Close()
+	images, err := l.List(pextraoci.ListOptions{})
+	if err != nil || len(images) != 0 {
+		t.Fatalf("expected no images in the layout, got %v (err=%v)", images, err)
+	}
+}
+
+func TestPull_RejectsNonPextraImage(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "library/alpine", authNone)
+	config := reg.addBlob([]byte("{}"))
+	reg.addManifest(v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: config, Size: 2},
+	}, v1.MediaTypeImageManifest, "latest")
+
+	opts := PullOptions{Options: Options{HTTPClient: srv.Client()}, Platform: &amd64}
+	_, err := Pull(context.Background(), fakeRef(t, srv, "library/alpine", ""), t.TempDir(), opts)
+	if err == nil || !strings.Contains(err.Error(), "not a Pextra image") {
+		t.Fatalf("expected a non-Pextra image error, got %v", err)
+	}
+}
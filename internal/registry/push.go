@@ -0,0 +1,198 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type PushOptions struct {
+	Options
+	// Repositories on the same registry to mount existing blobs from instead of
+	// uploading them
+	MountFrom []string
+	// Blobs larger than this many bytes are uploaded in chunks; zero uploads every blob
+	// in one request
+	ChunkSize int64
+}
+
+type PushResult struct {
+	// What the tag refers to: the manifest of a single image, or an index of all of them
+	Descriptor v1.Descriptor
+	// Blobs uploaded, mounted from another repository, and skipped because the
+	// registry already had them
+	Uploaded, Mounted, Skipped int
+}
+
+// A manifest to push, with its exact content from the layout
+type pushManifest struct {
+	desc     v1.Descriptor
+	raw      []byte
+	manifest v1.Manifest
+}
+
+// Pushes the Pextra images of a local layout to ref, which must name a tag. image
+// selects the images by ref name and digest; all of them are pushed if it names
+// neither. A single image is tagged directly; several are pushed by digest and tagged
+// through a new image index listing them by platform.
+func Push(ctx context.Context, image oci.ImageReference, ref Reference, opts PushOptions) (*PushResult, error) {
+	if ref.Digest != "" {
+		return nil, fmt.Errorf("cannot push to %s: the target must be a tag, not a digest", ref)
+	}
+
+	src, err := oci.OpenSource(image.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	images, err := pextraoci.NewLayout(src).List(pextraoci.ListOptions{Tag: image.Tag})
+	if err != nil {
+		return nil, err
+	}
+	if image.Digest != "" {
+		images = slices.DeleteFunc(images, func(s oci.ImageSummary) bool {
+			return s.Digest != image.Digest && !slices.Contains(s.Via, image.Digest)
+		})
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("no Pextra images to push in %s", image)
+	}
+
+	var manifests []pushManifest
+	for _, img := range images {
+		if slices.ContainsFunc(manifests, func(m pushManifest) bool { return m.desc.Digest == img.Digest }) {
+			continue // listed under several ref names
+		}
+		m, err := readPushManifest(src, img)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m)
+	}
+
+	c := NewClient(ref, opts.Options)
+	c.push = true
+	res := &PushResult{}
+	for _, m := range manifests {
+		for _, blob := range append([]v1.Descriptor{m.manifest.Config}, m.manifest.Layers...) {
+			if err := pushBlob(ctx, c, src, blob, opts, res); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(manifests) == 1 {
+		m := manifests[0]
+		if err := c.PutManifest(ctx, ref.Tag, m.desc.MediaType, m.raw); err != nil {
+			return nil, err
+		}
+		res.Descriptor = m.desc
+		return res, nil
+	}
+
+	idx := v1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: make([]v1.Descriptor, 0, len(manifests)),
+	}
+	for _, m := range manifests {
+		if err := c.PutManifest(ctx, m.desc.Digest.String(), m.desc.MediaType, m.raw); err != nil {
+			return nil, err
+		}
+		idx.Manifests = append(idx.Manifests, m.desc)
+	}
+	raw, err := json.Marshal(idx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.PutManifest(ctx, ref.Tag, v1.MediaTypeImageIndex, raw); err != nil {
+		return nil, err
+	}
+	res.Descriptor = v1.Descriptor{MediaType: v1.MediaTypeImageIndex, Digest: digest.FromBytes(raw), Size: int64(len(raw))}
+	return res, nil
+}
+
+// Reads the manifest of img exactly as stored, so that its digest does not change
+func readPushManifest(src oci.Source, img oci.ImageSummary) (pushManifest, error) {
+	f, err := src.Open(oci.BlobName(img.Digest))
+	if err != nil {
+		return pushManifest{}, fmt.Errorf("load manifest %s: %w", img.Digest, err)
+	}
+	raw, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return pushManifest{}, fmt.Errorf("load manifest %s: %w", img.Digest, err)
+	}
+	if got := img.Digest.Algorithm().FromBytes(raw); got != img.Digest {
+		return pushManifest{}, fmt.Errorf("manifest %s: %w: hashes to %s", img.Digest, utils.ErrDigestMismatch, got)
+	}
+
+	m := pushManifest{raw: raw}
+	if err := json.Unmarshal(raw, &m.manifest); err != nil {
+		return pushManifest{}, fmt.Errorf("parse manifest %s: %w", img.Digest, err)
+	}
+	m.desc = v1.Descriptor{
+		MediaType:   v1.MediaTypeImageManifest,
+		Digest:      img.Digest,
+		Size:        int64(len(raw)),
+		Platform:    img.Platform,
+		Annotations: map[string]string{pextraoci.AnnotationPextraImageType: img.ImageType},
+	}
+	return m, nil
+}
+
+// Makes the blob for desc available in the repository: skipped if the registry has it,
+// mounted if another repository has it, and uploaded otherwise
+func pushBlob(ctx context.Context, c *Client, src oci.Source, desc v1.Descriptor, opts PushOptions, res *PushResult) error {
+	exists, err := c.BlobExists(ctx, desc)
+	if err != nil {
+		return err
+	}
+	if exists {
+		res.Skipped++
+		return nil
+	}
+
+	for _, from := range opts.MountFrom {
+		mounted, err := c.MountBlob(ctx, desc, from)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			res.Mounted++
+			return nil
+		}
+	}
+
+	open := func() (io.ReadCloser, error) { return oci.OpenBlob(src, desc) }
+	if err := c.UploadBlob(ctx, desc, open, opts.ChunkSize); err != nil {
+		return err
+	}
+	res.Uploaded++
+	return nil
+}
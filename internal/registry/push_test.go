@@ -0,0 +1,192 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Writes a layout with debian-12 for amd64 and arm64, whose layers are layer+arch
+func writePushLayout(t *testing.T, layer string) (string, map[string]v1.Descriptor) {
+	t.Helper()
+	base := filepath.Join(t.TempDir(), "layout")
+	lw, err := oci.NewLayoutWriter(base)
+	if err != nil {
+		t.Fatalf("NewLayoutWriter error: %v", err)
+	}
+
+	images := map[string]v1.Descriptor{}
+	for _, platform := range []v1.Platform{amd64, arm64} {
+		l, err := lw.WriteBlob(strings.NewReader(layer+platform.Architecture), pextraoci.MediaTypePextraImageLayerLxcZstd)
+		if err != nil {
+			t.Fatalf("WriteBlob error: %v", err)
+		}
+		desc, err := lw.WriteImage(pextraoci.PextraImageTypeLxc, &v1.Image{Platform: platform}, []v1.Descriptor{l}, "debian-12")
+		if err != nil {
+			t.Fatalf("WriteImage error: %v", err)
+		}
+		images[platform.Architecture] = desc
+	}
+	return base, images
+}
+
+func TestPush_SingleImage(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "pextra/debian", authNone)
+	layout, images := writePushLayout(t, "rootfs")
+	image := oci.ImageReference{Path: layout, Tag: "debian-12", Digest: images["amd64"].Digest}
+	opts := PushOptions{Options: Options{HTTPClient: srv.Client()}}
+
+	res, err := Push(context.Background(), image, fakeRef(t, srv, "pextra/debian", ":12"), opts)
+	if err != nil {
+		t.Fatalf("Push error: %v", err)
+	}
+	if res.Descriptor.Digest != images["amd64"].Digest || res.Uploaded != 2 || res.Mounted != 0 || res.Skipped != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if reg.manifestTypes["12"] != v1.MediaTypeImageManifest {
+		t.Fatalf("expected the manifest to be tagged directly, got %q", reg.manifestTypes["12"])
+	}
+
+	// The image pulls back unchanged
+	pulled := filepath.Join(t.TempDir(), "pulled")
+	pres, err := Pull(context.Background(), fakeRef(t, srv, "pextra/debian", ":12"), pulled, PullOptions{Options: opts.Options, Platform: &amd64})
+	if err != nil {
+		t.Fatalf("Pull error: %v", err)
+	}
+	if pres.Descriptor.Digest != images["amd64"].Digest {
+		t.Fatalf("pulled %s, want %s", pres.Descriptor.Digest, images["amd64"].Digest)
+	}
+	img := selectImage(t, pulled, pextraoci.SelectOptions{Platform: &amd64})
+	if mt := img.Manifest.Layers[0].MediaType; mt != pextraoci.MediaTypePextraImageLayerLxcZstd {
+		t.Fatalf("layer media type changed to %s", mt)
+	}
+
+	// Pushing again only checks the blobs
+	res, err = Push(context.Background(), image, fakeRef(t, srv, "pextra/debian", ":12"), opts)
+	if err != nil {
+		t.Fatalf("second Push error: %v", err)
+	}
+	if res.Uploaded != 0 || res.Skipped != 2 {
+		t.Fatalf("expected all blobs to be skipped, got %+v", res)
+	}
+}
+
+func TestPush_Index(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "pextra/debian", authNone)
+	layout, images := writePushLayout(t, "rootfs")
+	image := oci.ImageReference{Path: layout, Tag: "debian-12"}
+	opts := PushOptions{Options: Options{HTTPClient: srv.Client()}}
+
+	res, err := Push(context.Background(), image, fakeRef(t, srv, "pextra/debian", ":12"), opts)
+	if err != nil {
+		t.Fatalf("Push error: %v", err)
+	}
+	if res.Descriptor.MediaType != v1.MediaTypeImageIndex || res.Uploaded != 4 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if reg.manifestTypes["12"] != v1.MediaTypeImageIndex {
+		t.Fatalf("expected an index to be tagged, got %q", reg.manifestTypes["12"])
+	}
+	var idx v1.Index
+	if err := json.Unmarshal(reg.manifests["12"].content, &idx); err != nil {
+		t.Fatalf("parse pushed index: %v", err)
+	}
+	for _, d := range idx.Manifests {
+		if d.Annotations[pextraoci.AnnotationPextraImageType] != pextraoci.PextraImageTypeLxc {
+			t.Errorf("index entry %s lacks the image type annotation: %v", d.Digest, d.Annotations)
+		}
+	}
+
+	for _, platform := range []v1.Platform{amd64, arm64} {
+		pulled := filepath.Join(t.TempDir(), "pulled")
+		pres, err := Pull(context.Background(), fakeRef(t, srv, "pextra/debian", ":12"), pulled, PullOptions{Options: opts.Options, Platform: &platform})
+		if err != nil {
+			t.Fatalf("Pull(%s) error: %v", platform.Architecture, err)
+		}
+		if want := images[platform.Architecture].Digest; pres.Descriptor.Digest != want {
+			t.Fatalf("Pull(%s) selected %s, want %s", platform.Architecture, pres.Descriptor.Digest, want)
+		}
+	}
+}
+
+func TestPush_MountsAndChunks(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "pextra/debian", authNone)
+	layout, images := writePushLayout(t, strings.Repeat("x", 100))
+	image := oci.ImageReference{Path: layout, Digest: images["amd64"].Digest}
+
+	// The config is available from another repository, the layer is not
+	img := selectImage(t, layout, pextraoci.SelectOptions{Platform: &amd64})
+	config := img.Manifest.Config
+	reg.mountable[config.Digest] = fakeMount{repo: "pextra/base", content: []byte("{}")}
+	reg.minChunk = 40
+
+	opts := PushOptions{Options: Options{HTTPClient: srv.Client()}, MountFrom: []string{"pextra/other", "pextra/base"}, ChunkSize: 16}
+	res, err := Push(context.Background(), image, fakeRef(t, srv, "pextra/debian", ":12"), opts)
+	if err != nil {
+		t.Fatalf("Push error: %v", err)
+	}
+	if res.Mounted != 1 || res.Uploaded != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	// The config mounts from the second repository, the layer from neither
+	if reg.requests["mount"] != 4 || len(reg.uploads) != 0 {
+		t.Fatalf("unexpected mounts %d with %d sessions left open", reg.requests["mount"], len(reg.uploads))
+	}
+	// 105 bytes in chunks of at least 40
+	if reg.requests["PATCH"] != 3 {
+		t.Fatalf("expected 3 chunks, got %d", reg.requests["PATCH"])
+	}
+	layer := img.Manifest.Layers[0]
+	if got := string(reg.blobs[layer.Digest]); got != strings.Repeat("x", 100)+"amd64" {
+		t.Fatalf("unexpected uploaded layer %q", got)
+	}
+}
+
+func TestPush_Auth(t *testing.T) {
+	reg, srv := newFakeRegistry(t, "pextra/debian", authBearer)
+	layout, _ := writePushLayout(t, "rootfs")
+	opts := PushOptions{Options: Options{HTTPClient: srv.Client(), Username: testUser, Password: testPassword}}
+
+	for _, omitScope := range []bool{false, true} {
+		reg.omitScope = omitScope
+		if _, err := Push(context.Background(), oci.ImageReference{Path: layout}, fakeRef(t, srv, "pextra/debian", ":12"), opts); err != nil {
+			t.Fatalf("Push error (challenge without scope: %v): %v", omitScope, err)
+		}
+	}
+}
+
+func TestPush_Errors(t *testing.T) {
+	_, srv := newFakeRegistry(t, "pextra/debian", authNone)
+	layout, images := writePushLayout(t, "rootfs")
+	opts := PushOptions{Options: Options{HTTPClient: srv.Client()}}
+
+	_, err := Push(context.Background(), oci.ImageReference{Path: layout}, fakeRef(t, srv, "pextra/debian", "@"+images["amd64"].Digest.String()), opts)
+	if err == nil || !strings.Contains(err.Error(), "must be a tag") {
+		t.Fatalf("expected a digest target error, got %v", err)
+	}
+	_, err = Push(context.Background(), oci.ImageReference{Path: layout, Tag: "alma-9"}, fakeRef(t, srv, "pextra/debian", ":12"), opts)
+	if err == nil || !strings.Contains(err.Error(), "no Pextra images to push") {
+		t.Fatalf("expected a no images error, got %v", err)
+	}
+}
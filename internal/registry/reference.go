@@ -0,0 +1,106 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Grammar from the OCI distribution spec
+var (
+	repositoryRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagRegexp        = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+// Tag used when a reference names neither a tag nor a digest
+const defaultTag = "latest"
+
+// An image in a registry, e.g. registry.example.com/pextra/debian:12
+type Reference struct {
+	// Registry host, with an optional port
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+}
+
+// Returns the tag or digest to request the manifest by; the digest wins if both are set
+func (r Reference) Ref() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
+
+// Parses a reference in the form REGISTRY/REPOSITORY[:TAG][@DIGEST]. The registry host is
+// required, as there is no default registry. Without tag and digest the tag is "latest".
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	rest := s
+	if name, dgst, ok := strings.Cut(rest, "@"); ok {
+		d, err := digest.Parse(dgst)
+		if err != nil {
+			return Reference{}, fmt.Errorf("invalid digest in reference %q: %w", s, err)
+		}
+		ref.Digest = d
+		rest = name
+	}
+
+	host, repo, ok := strings.Cut(rest, "/")
+	if !ok || !isRegistryHost(host) {
+		return Reference{}, fmt.Errorf("invalid reference %q: must start with a registry host, e.g. registry.example.com/repo:tag", s)
+	}
+	ref.Registry = host
+
+	// A colon after the last slash separates the tag
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		ref.Tag = repo[i+1:]
+		repo = repo[:i]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("invalid tag %q in reference %q", ref.Tag, s)
+		}
+	}
+	if !repositoryRegexp.MatchString(repo) {
+		return Reference{}, fmt.Errorf("invalid repository %q in reference %q", repo, s)
+	}
+	ref.Repository = repo
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = defaultTag
+	}
+	return ref, nil
+}
+
+// Reports whether the first component of a reference is a registry host rather than
+// part of the repository, following the Docker convention
+func isRegistryHost(s string) bool {
+	return s != "" && (strings.ContainsAny(s, ".:") || s == "localhost")
+}
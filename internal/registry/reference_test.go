@@ -0,0 +1,69 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseReference(t *testing.T) {
+	dgst := digest.FromString("x")
+	cases := []struct {
+		in   string
+		want Reference
+	}{
+		{"registry.example.com/pextra/debian:12", Reference{Registry: "registry.example.com", Repository: "pextra/debian", Tag: "12"}},
+		{"registry.example.com/debian", Reference{Registry: "registry.example.com", Repository: "debian", Tag: "latest"}},
+		{"localhost:5000/a/b/c:v1.0", Reference{Registry: "localhost:5000", Repository: "a/b/c", Tag: "v1.0"}},
+		{"localhost/debian@" + dgst.String(), Reference{Registry: "localhost", Repository: "debian", Digest: dgst}},
+		{"127.0.0.1:5000/debian:12@" + dgst.String(), Reference{Registry: "127.0.0.1:5000", Repository: "debian", Tag: "12", Digest: dgst}},
+	}
+	for _, tc := range cases {
+		got, err := ParseReference(tc.in)
+		if err != nil {
+			t.Fatalf("ParseReference(%q) error: %v", tc.in, err)
+		}
+		if got != tc.want {
+			t.Errorf("ParseReference(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"debian:12",                           // no registry host
+		"pextra/debian:12",                    // first component is not a host
+		"registry.example.com/Debian:12",      // uppercase repository
+		"registry.example.com/debian:",        // empty tag
+		"registry.example.com/debian@sha256:", // bad digest
+		"registry.example.com/",
+	} {
+		if _, err := ParseReference(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestReference_Ref(t *testing.T) {
+	dgst := digest.FromString("x")
+	r := Reference{Registry: "r.example.com", Repository: "a", Tag: "12", Digest: dgst}
+	if r.Ref() != dgst.String() {
+		t.Fatalf("expected the digest to win, got %s", r.Ref())
+	}
+	if r.String() != "r.example.com/a:12@"+dgst.String() {
+		t.Fatalf("unexpected String() %s", r.String())
+	}
+}
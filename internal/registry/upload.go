@@ -0,0 +1,244 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Opens the content of a blob to upload; called again when a request must be resent
+type BlobOpener func() (io.ReadCloser, error)
+
+// Reports whether the registry already has the blob for desc
+func (c *Client) BlobExists(ctx context.Context, desc v1.Descriptor) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.url("blobs/"+desc.Digest.String()), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return false, fmt.Errorf("check blob %s: %w", desc.Digest, err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("check blob %s: %s", desc.Digest, resp.Status)
+	}
+}
+
+// An upload session started with POST
+type uploadSession struct {
+	location *url.URL
+	// Smallest chunk the registry accepts, from OCI-Chunk-Min-Length
+	minChunk int64
+}
+
+// Starts an upload, asking the registry to mount the blob from the repository from
+// instead if from is set. Returns a nil session if the blob was mounted.
+func (c *Client) startUpload(ctx context.Context, desc v1.Descriptor, from string) (*uploadSession, error) {
+	u := c.url("blobs/uploads/")
+	if from != "" {
+		u += "?" + url.Values{"mount": {desc.Digest.String()}, "from": {from}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("start upload of %s: %w", desc.Digest, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		if from != "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("start upload of %s: registry created the blob without content", desc.Digest)
+	case http.StatusAccepted:
+	default:
+		return nil, fmt.Errorf("start upload of %s: %w", desc.Digest, responseError(resp))
+	}
+
+	loc, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("start upload of %s: %w", desc.Digest, err)
+	}
+	s := &uploadSession{location: loc}
+	if v := resp.Header.Get("OCI-Chunk-Min-Length"); v != "" {
+		s.minChunk, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return s, nil
+}
+
+// Mounts the blob for desc from the repository from on the same registry. Reports false
+// if the registry could not mount it.
+func (c *Client) MountBlob(ctx context.Context, desc v1.Descriptor, from string) (bool, error) {
+	s, err := c.startUpload(ctx, desc, from)
+	if err != nil {
+		return false, err
+	}
+	if s == nil {
+		return true, nil
+	}
+	// The registry opened an upload session instead; cancel it, ignoring errors as
+	// sessions expire anyway
+	if req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.location.String(), nil); err == nil {
+		if resp, err := c.do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	return false, nil
+}
+
+// Uploads the blob for desc, in one request if chunkSize is zero or the blob fits into
+// one chunk, and in chunks of chunkSize bytes otherwise
+func (c *Client) UploadBlob(ctx context.Context, desc v1.Descriptor, open BlobOpener, chunkSize int64) error {
+	s, err := c.startUpload(ctx, desc, "")
+	if err != nil {
+		return err
+	}
+	if chunkSize > 0 && chunkSize < s.minChunk {
+		chunkSize = s.minChunk
+	}
+	if chunkSize <= 0 || desc.Size <= chunkSize {
+		return c.putMonolithic(ctx, desc, s, open)
+	}
+	return c.putChunked(ctx, desc, s, open, chunkSize)
+}
+
+func (c *Client) putMonolithic(ctx context.Context, desc v1.Descriptor, s *uploadSession, open BlobOpener) error {
+	body, err := open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, finishURL(s.location, desc), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = desc.Size
+	req.GetBody = open
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return c.finishUpload(req, desc)
+}
+
+func (c *Client) putChunked(ctx context.Context, desc v1.Descriptor, s *uploadSession, open BlobOpener, chunkSize int64) error {
+	r, err := open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	loc := s.location
+	buf := make([]byte, chunkSize)
+	var offset int64
+	for offset < desc.Size {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("read blob %s: %w", desc.Digest, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("read blob %s: ended after %d of %d bytes", desc.Digest, offset, desc.Size)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPatch, loc.String(), bytes.NewReader(buf[:n]))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(n)-1))
+		resp, err := c.do(req)
+		if err != nil {
+			return fmt.Errorf("upload blob %s: %w", desc.Digest, err)
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			defer resp.Body.Close()
+			return fmt.Errorf("upload blob %s: %w", desc.Digest, responseError(resp))
+		}
+		resp.Body.Close()
+		if loc, err = resp.Location(); err != nil {
+			return fmt.Errorf("upload blob %s: %w", desc.Digest, err)
+		}
+		offset += int64(n)
+	}
+	// Reading past the end checks the digest of what was sent
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("read blob %s: %w", desc.Digest, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, finishURL(loc, desc), http.NoBody)
+	if err != nil {
+		return err
+	}
+	return c.finishUpload(req, desc)
+}
+
+func (c *Client) finishUpload(req *http.Request, desc v1.Descriptor) error {
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("upload blob %s: %w", desc.Digest, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upload blob %s: %w", desc.Digest, responseError(resp))
+	}
+	return nil
+}
+
+// Returns the URL that completes an upload session with the digest of the blob
+func finishURL(loc *url.URL, desc v1.Descriptor) string {
+	u := *loc
+	q := u.Query()
+	q.Set("digest", desc.Digest.String())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Uploads a manifest or index under ref (a tag or digest) with its media type
+func (c *Client) PutManifest(ctx context.Context, ref string, mediaType string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url("manifests/"+ref), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("push manifest %s: %w", ref, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("push manifest %s: %w", ref, responseError(resp))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+// Package spec defines the names of the Pextra extensions to the OCI image specification,
+// documented in PEXTRA_OCI_EXTENSIONS.md. They are re-exported by pkg/pextra-oci.
+package spec
+
+const (
+	AnnotationPextraImageType = "org.pextra.image.type"
+	PextraImageTypeQemu       = "qemu"
+	PextraImageTypeLxc        = "lxc"
+
+	// QEMU (qcow2)
+	MediaTypePextraImageLayerQcow2 = "application/vnd.pextra.image.layer.v1.qcow2"
+	AnnotationPextraQemuFileName   = "org.pextra.qcow2.fileName"
+	AnnotationPextraQemuFlatten    = "org.pextra.qcow2.flatten"
+	// Boot order of a qcow2 layer's disk (1 boots first) and the bus it is attached to
+	AnnotationPextraQemuBootIndex = "org.pextra.qcow2.bootIndex"
+	AnnotationPextraQemuBus       = "org.pextra.qcow2.bus"
+	// Defaults for how a flattened qcow2 layer is written: disk format, compression,
+	// preallocation, qcow2 cluster size and qcow2 compatibility level
+	AnnotationPextraQemuDiskFormat    = "org.pextra.qcow2.diskFormat"
+	AnnotationPextraQemuCompress      = "org.pextra.qcow2.compress"
+	AnnotationPextraQemuPreallocation = "org.pextra.qcow2.preallocation"
+	AnnotationPextraQemuClusterSize   = "org.pextra.qcow2.clusterSize"
+	AnnotationPextraQemuCompat        = "org.pextra.qcow2.compat"
+	// Recommended VM settings, on the manifest
+	AnnotationPextraQemuMachine   = "org.pextra.qemu.machine"
+	AnnotationPextraQemuFirmware  = "org.pextra.qemu.firmware"
+	AnnotationPextraQemuCPUs      = "org.pextra.qemu.cpus"
+	AnnotationPextraQemuMemoryMiB = "org.pextra.qemu.memoryMiB"
+	AnnotationPextraQemuNICModel  = "org.pextra.qemu.nicModel"
+
+	// LXC
+	MediaTypePextraImageLayerLxc     = "application/vnd.pextra.image.layer.v1.lxc.tar"
+	MediaTypePextraImageLayerLxcGzip = "application/vnd.pextra.image.layer.v1.lxc.tar+gzip"
+	MediaTypePextraImageLayerLxcZstd = "application/vnd.pextra.image.layer.v1.lxc.tar+zstd"
+	// Prefix of manifest annotations that become cgroup v2 settings of the generated
+	// container config, e.g. org.pextra.lxc.cgroup2.memory.max
+	AnnotationPextraLxcCgroup2Prefix = "org.pextra.lxc.cgroup2."
+)
@@ -0,0 +1,62 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// Size of the blocks CopySparse checks for zeros
+const sparseBlockSize = 64 << 10
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// Copies r to f from its current offset and returns the number of bytes copied. Blocks
+// of zeros are skipped over instead of written, so that they become holes on
+// filesystems that support them.
+func CopySparse(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, sparseBlockSize)
+	var n int64
+	for {
+		m, err := io.ReadFull(r, buf)
+		if m > 0 {
+			var werr error
+			if bytes.Equal(buf[:m], zeroBlock[:m]) {
+				_, werr = f.Seek(int64(m), io.SeekCurrent)
+			} else {
+				_, werr = f.Write(buf[:m])
+			}
+			if werr != nil {
+				return n, werr
+			}
+			n += int64(m)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	// A hole at the end is only part of the file once it is extended over it
+	end, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return n, err
+	}
+	return n, f.Truncate(end)
+}
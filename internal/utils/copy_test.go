@@ -0,0 +1,41 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopySparse(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0}, 3*sparseBlockSize), []byte("data")...)
+	data = append(data, make([]byte, 2*sparseBlockSize+5)...)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "copy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := CopySparse(f, bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("CopySparse = %d, %v; want %d", n, err, len(data))
+	}
+	if got, _ := os.ReadFile(f.Name()); !bytes.Equal(got, data) {
+		t.Fatalf("copy differs from the original (%d bytes, want %d)", len(got), len(data))
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Parses a platform string in the form os[(osversion)]/arch[/variant], e.g. linux/arm64/v8
+// or windows(10.0.17763)/amd64
+func ParsePlatform(s string) (*v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("invalid platform %q (want os/arch[/variant])", s)
+	}
+	for _, p := range parts {
+		if p == "" {
+			return nil, fmt.Errorf("invalid platform %q (want os/arch[/variant])", s)
+		}
+	}
+
+	p := &v1.Platform{
+		OS:           strings.ToLower(parts[0]),
+		Architecture: strings.ToLower(parts[1]),
+	}
+	if name, version, ok := strings.Cut(parts[0], "("); ok {
+		version, ok = strings.CutSuffix(version, ")")
+		if !ok || name == "" || version == "" {
+			return nil, fmt.Errorf("invalid platform %q (want os(osversion)/arch[/variant])", s)
+		}
+		p.OS = strings.ToLower(name)
+		p.OSVersion = version
+	}
+	if len(parts) == 3 {
+		p.Variant = strings.ToLower(parts[2])
+	}
+	return p, nil
+}
+
+// Formats a platform as os[(osversion)]/arch[/variant], the inverse of ParsePlatform
+func FormatPlatform(p *v1.Platform) string {
+	s := p.OS
+	if p.OSVersion != "" {
+		s += "(" + p.OSVersion + ")"
+	}
+	s += "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Returns the platform of the running binary
+func HostPlatform() *v1.Platform {
+	return &v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+}
+
+// Returns a copy of p with lowercased names, common architecture aliases resolved to
+// their GOARCH names and the baseline variant filled in for amd64, arm and arm64
+func NormalizePlatform(p v1.Platform) v1.Platform {
+	p.OS = strings.ToLower(p.OS)
+	p.Architecture = strings.ToLower(p.Architecture)
+	p.Variant = strings.ToLower(p.Variant)
+
+	switch p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "i386":
+		p.Architecture = "386"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture = "arm"
+		p.Variant = "v7"
+	case "armel":
+		p.Architecture = "arm"
+		p.Variant = "v6"
+	}
+
+	switch p.Architecture {
+	case "amd64":
+		if p.Variant == "" {
+			p.Variant = "v1"
+		}
+	case "arm64":
+		if p.Variant == "" || p.Variant == "8" {
+			p.Variant = "v8"
+		}
+	case "arm":
+		switch p.Variant {
+		case "":
+			p.Variant = "v7"
+		case "5", "6", "7", "8":
+			p.Variant = "v" + p.Variant
+		}
+	}
+	return p
+}
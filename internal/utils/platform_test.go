@@ -0,0 +1,81 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	t.Run("os_arch", func(t *testing.T) {
+		got, err := ParsePlatform("linux/amd64")
+		if err != nil {
+			t.Fatalf("ParsePlatform error: %v", err)
+		}
+		if want := (&v1.Platform{OS: "linux", Architecture: "amd64"}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v want %+v", got, want)
+		}
+	})
+	t.Run("variant", func(t *testing.T) {
+		got, err := ParsePlatform("Linux/ARM64/v8")
+		if err != nil {
+			t.Fatalf("ParsePlatform error: %v", err)
+		}
+		if want := (&v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v want %+v", got, want)
+		}
+	})
+	t.Run("os_version", func(t *testing.T) {
+		got, err := ParsePlatform("windows(10.0.17763)/amd64")
+		if err != nil {
+			t.Fatalf("ParsePlatform error: %v", err)
+		}
+		if want := (&v1.Platform{OS: "windows", OSVersion: "10.0.17763", Architecture: "amd64"}); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v want %+v", got, want)
+		}
+		if s := FormatPlatform(got); s != "windows(10.0.17763)/amd64" {
+			t.Fatalf("FormatPlatform = %q", s)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		for _, s := range []string{"", "linux", "linux/", "/amd64", "linux/arm/v7/extra", "linux(/amd64", "(1.0)/amd64", "linux()/amd64"} {
+			if _, err := ParsePlatform(s); err == nil {
+				t.Errorf("expected error for %q", s)
+			}
+		}
+	})
+}
+
+func TestNormalizePlatform(t *testing.T) {
+	cases := []struct {
+		in, want v1.Platform
+	}{
+		{v1.Platform{OS: "Linux", Architecture: "x86_64"}, v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v1"}},
+		{v1.Platform{OS: "linux", Architecture: "aarch64"}, v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{v1.Platform{OS: "linux", Architecture: "arm64", Variant: "8"}, v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{v1.Platform{OS: "linux", Architecture: "arm"}, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{v1.Platform{OS: "linux", Architecture: "armel"}, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}, v1.Platform{OS: "linux", Architecture: "amd64", Variant: "v3"}},
+	}
+	for _, tc := range cases {
+		if got := NormalizePlatform(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("NormalizePlatform(%+v) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
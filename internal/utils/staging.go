@@ -0,0 +1,219 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Returned by NewStagedDir for targets that are mount points
+var ErrMountPoint = errors.New("output directory is a mount point and cannot be replaced")
+
+// Returned by NewStagedDir for targets that exist and are not empty directories, unless
+// they are to be replaced
+var ErrOutputExists = errors.New("output exists and is not empty")
+
+// A directory that is built next to its target and then renamed into place, so that
+// the target only ever holds complete output
+type StagedDir struct {
+	// Where to write the output
+	Path   string
+	target string
+}
+
+// Creates a staging directory for target in the same parent directory, so that it is
+// on the same filesystem. A target that is a symlink is resolved first. Fails with
+// ErrMountPoint if target is a mount point, which cannot be replaced, and with
+// ErrOutputExists if it is anything but an empty directory and replace is not set.
+func NewStagedDir(target string, replace bool) (*StagedDir, error) {
+	if p, err := filepath.EvalSymlinks(target); err == nil {
+		target = p
+	}
+	target = filepath.Clean(target)
+	parent := filepath.Dir(target)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create parent directory: %w", err)
+	}
+	if fi, err := os.Lstat(target); err == nil {
+		if pfi, err := os.Stat(parent); err == nil && !sameDevice(fi, pfi) {
+			return nil, fmt.Errorf("%s: %w", target, ErrMountPoint)
+		}
+		if !replace && !isEmptyDir(target, fi) {
+			return nil, fmt.Errorf("%s: %w", target, ErrOutputExists)
+		}
+	}
+	p, err := os.MkdirTemp(parent, "."+filepath.Base(target)+".pce-oci-staging-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	if err := os.Chmod(p, 0755); err != nil {
+		os.RemoveAll(p)
+		return nil, err
+	}
+	return &StagedDir{Path: p, target: target}, nil
+}
+
+func isEmptyDir(p string, fi fs.FileInfo) bool {
+	if !fi.IsDir() {
+		return false
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	return err == io.EOF
+}
+
+// Replaces the target with the staging directory. Previous contents of the target are
+// moved aside first and only removed once the staging directory is in place; if that
+// fails, they are moved back.
+func (s *StagedDir) Commit() error {
+	old := ""
+	if _, err := os.Lstat(s.target); err == nil {
+		old = s.Path + ".old"
+		if err := os.Rename(s.target, old); err != nil {
+			return fmt.Errorf("failed to move %s aside: %w", s.target, err)
+		}
+	}
+	if err := os.Rename(s.Path, s.target); err != nil {
+		if old != "" {
+			os.Rename(old, s.target)
+		}
+		return fmt.Errorf("failed to move output into %s: %w", s.target, err)
+	}
+	if old != "" {
+		if err := os.RemoveAll(old); err != nil {
+			return fmt.Errorf("output is in place, but the previous contents of %s remain at %s: %w", s.target, old, err)
+		}
+	}
+	return nil
+}
+
+// Removes the staging directory; a no-op after a successful Commit
+func (s *StagedDir) Discard() {
+	os.RemoveAll(s.Path)
+}
+
+// Files that are built in a staging directory inside their target directory and then
+// moved into it, replacing files of the same name and leaving other files alone
+type StagedFiles struct {
+	// Where to write the files
+	Path       string
+	dir        string
+	createdDir bool
+}
+
+// Creates dir if needed, and a staging directory in it
+func NewStagedFiles(dir string) (*StagedFiles, error) {
+	_, statErr := os.Lstat(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	s := &StagedFiles{dir: dir, createdDir: errors.Is(statErr, fs.ErrNotExist)}
+	p, err := os.MkdirTemp(dir, ".pce-oci-staging-")
+	if err != nil {
+		s.Discard()
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	s.Path = p
+	return s, nil
+}
+
+// Moves the named files into the target directory, restoring the replaced files on failure
+func (s *StagedFiles) Commit(names []string) (err error) {
+	old := filepath.Join(s.Path, ".pce-oci-replaced")
+	type move struct {
+		name     string
+		replaced bool
+	}
+	var moved []move
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(moved) - 1; i >= 0; i-- {
+			m := moved[i]
+			os.Rename(filepath.Join(s.dir, m.name), filepath.Join(s.Path, m.name))
+			if m.replaced {
+				os.Rename(filepath.Join(old, m.name), filepath.Join(s.dir, m.name))
+			}
+		}
+	}()
+
+	for _, name := range names {
+		m := move{name: name}
+		target := filepath.Join(s.dir, name)
+		if _, err := os.Lstat(target); err == nil {
+			if err := os.MkdirAll(old, 0700); err != nil {
+				return err
+			}
+			if err := os.Rename(target, filepath.Join(old, name)); err != nil {
+				return fmt.Errorf("failed to move %s aside: %w", target, err)
+			}
+			m.replaced = true
+		}
+		if err := os.Rename(filepath.Join(s.Path, name), target); err != nil {
+			if m.replaced {
+				os.Rename(filepath.Join(old, name), target)
+			}
+			return fmt.Errorf("failed to move %s into place: %w", name, err)
+		}
+		moved = append(moved, m)
+	}
+	// The files are in place; a staging directory left behind is harmless
+	os.RemoveAll(s.Path)
+	s.createdDir = false
+	return nil
+}
+
+// Removes the staging directory, and the target directory if NewStagedFiles created it
+// and nothing was committed; a no-op after a successful Commit
+func (s *StagedFiles) Discard() {
+	if s.Path != "" {
+		os.RemoveAll(s.Path)
+	}
+	if s.createdDir {
+		os.Remove(s.dir)
+	}
+}
+
+// Writes data to path through a temporary file in the same directory, so that path
+// holds either its old content or all of data
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, p, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", p, err)
+	}
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read %s: %v", p, err)
+	}
+	return string(b)
+}
+
+func TestStagedDir(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "rootfs")
+	writeFile(t, filepath.Join(target, "old"), "old")
+
+	// Only an empty target is replaced without asking
+	if _, err := NewStagedDir(target, false); !errors.Is(err, ErrOutputExists) {
+		t.Fatalf("expected ErrOutputExists, got %v", err)
+	}
+	empty := filepath.Join(filepath.Dir(target), "empty")
+	if err := os.Mkdir(empty, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStagedDir(empty, false)
+	if err != nil {
+		t.Fatalf("NewStagedDir error for an empty directory: %v", err)
+	}
+	s.Discard()
+	os.Remove(empty)
+
+	// Discarding leaves the target alone
+	s, err = NewStagedDir(target, true)
+	if err != nil {
+		t.Fatalf("NewStagedDir error: %v", err)
+	}
+	writeFile(t, filepath.Join(s.Path, "new"), "new")
+	s.Discard()
+	if readFile(t, filepath.Join(target, "old")) != "old" {
+		t.Fatalf("target changed")
+	}
+
+	// Committing replaces it
+	s, err = NewStagedDir(target, true)
+	if err != nil {
+		t.Fatalf("NewStagedDir error: %v", err)
+	}
+	writeFile(t, filepath.Join(s.Path, "new"), "new")
+	if err := s.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	s.Discard()
+	if readFile(t, filepath.Join(target, "new")) != "new" {
+		t.Fatalf("staged content not in place")
+	}
+	if _, err := os.Stat(filepath.Join(target, "old")); !os.IsNotExist(err) {
+		t.Fatalf("previous content not replaced: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(target)); len(entries) != 1 {
+		t.Fatalf("expected only the target to remain, got %v", entries)
+	}
+}
+
+func TestStagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.qcow2"), "old a")
+	writeFile(t, filepath.Join(dir, "vm.conf"), "conf")
+
+	s, err := NewStagedFiles(dir)
+	if err != nil {
+		t.Fatalf("NewStagedFiles error: %v", err)
+	}
+	writeFile(t, filepath.Join(s.Path, "a.qcow2"), "new a")
+	writeFile(t, filepath.Join(s.Path, "b.qcow2"), "new b")
+
+	// A missing file fails the commit and puts back what was moved
+	if err := s.Commit([]string{"a.qcow2", "b.qcow2", "c.qcow2"}); err == nil {
+		t.Fatalf("expected an error for a file that was not staged")
+	}
+	if readFile(t, filepath.Join(dir, "a.qcow2")) != "old a" {
+		t.Fatalf("replaced file not restored")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.qcow2")); !os.IsNotExist(err) {
+		t.Fatalf("moved file not taken back: %v", err)
+	}
+
+	if err := s.Commit([]string{"a.qcow2", "b.qcow2"}); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+	s.Discard()
+	if readFile(t, filepath.Join(dir, "a.qcow2")) != "new a" || readFile(t, filepath.Join(dir, "b.qcow2")) != "new b" || readFile(t, filepath.Join(dir, "vm.conf")) != "conf" {
+		t.Fatalf("unexpected directory contents")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Fatalf("expected the staging directory to be removed, got %v", entries)
+	}
+
+	// A directory created for the files is removed again when they are discarded
+	created := filepath.Join(t.TempDir(), "vm")
+	s, err = NewStagedFiles(created)
+	if err != nil {
+		t.Fatalf("NewStagedFiles error: %v", err)
+	}
+	s.Discard()
+	if _, err := os.Stat(created); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %s to be removed: %v", created, err)
+	}
+}
@@ -16,8 +16,11 @@ limitations under the License.
 package utils
 
 import (
+	"fmt"
 	"path/filepath"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -46,3 +49,23 @@ func GetLayersByMediaType(layers []v1.Descriptor, mediaTypes ...string) []v1.Des
 	}
 	return filtered
 }
+
+var sizePattern = regexp.MustCompile(`^(\d+)(?:([KMGT])(?:I?B)?|B)?$`)
+
+// Parses a size in bytes with an optional binary unit suffix K, M, G or T (case
+// insensitive, optionally followed by "iB" or "B"), e.g. "512M" or "2GiB"
+func ParseSize(s string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.ToUpper(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	shift := 10 * (strings.Index("KMGT", m[2]) + 1)
+	if m[2] == "" {
+		shift = 0
+	}
+	if err != nil || n > (1<<63-1)>>shift {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+	return n << shift, nil
+}
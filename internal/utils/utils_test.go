@@ -99,3 +99,27 @@ func types(d []v1.Descriptor) []string {
 	}
 	return out
 }
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{
+		"0":    0,
+		"4096": 4096,
+		"100B": 100,
+		"512k": 512 << 10,
+		"512M": 512 << 20,
+		"2G":   2 << 30,
+		"2GiB": 2 << 30,
+		"2gb":  2 << 30,
+		"1T":   1 << 40,
+	} {
+		got, err := ParseSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "G", "-1M", "1.5G", "1X", "1P", "1iB", "9223372036854775807K"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) succeeded, want error", in)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	_ "crypto/sha256" // register digest algorithms with go-digest
+	_ "crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	ErrDigestMismatch = errors.New("digest mismatch")
+	ErrSizeMismatch   = errors.New("size mismatch")
+)
+
+type verifiedReader struct {
+	r        io.Reader
+	digester digest.Digester
+	desc     v1.Descriptor
+	n        int64
+	err      error
+}
+
+// Wraps r so that reading it to EOF checks the content against the size and digest in desc.
+// Reads never return more than desc.Size bytes; a longer or shorter stream, or a digest
+// mismatch, is reported as an error in place of io.EOF.
+func NewVerifiedReader(r io.Reader, desc v1.Descriptor) (io.Reader, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %w", desc.Digest, err)
+	}
+	return &verifiedReader{
+		// One extra byte lets us tell "exactly Size" apart from "too long"
+		r:        io.LimitReader(r, desc.Size+1),
+		digester: desc.Digest.Algorithm().Digester(),
+		desc:     desc,
+	}, nil
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+
+	n, err := v.r.Read(p)
+	if v.n+int64(n) > v.desc.Size {
+		v.err = fmt.Errorf("%w: blob %s is larger than its descriptor size %d", ErrSizeMismatch, v.desc.Digest, v.desc.Size)
+		return 0, v.err
+	}
+	v.n += int64(n)
+	v.digester.Hash().Write(p[:n])
+
+	if err == io.EOF {
+		if v.n != v.desc.Size {
+			err = fmt.Errorf("%w: blob %s has %d bytes, descriptor says %d", ErrSizeMismatch, v.desc.Digest, v.n, v.desc.Size)
+		} else if got := v.digester.Digest(); got != v.desc.Digest {
+			err = fmt.Errorf("%w: blob %s hashes to %s", ErrDigestMismatch, v.desc.Digest, got)
+		}
+	}
+	if err != nil {
+		v.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestNewVerifiedReader(t *testing.T) {
+	content := []byte("hello pextra")
+	good := v1.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))}
+
+	t.Run("sha256_ok", func(t *testing.T) {
+		vr, err := NewVerifiedReader(bytes.NewReader(content), good)
+		if err != nil {
+			t.Fatalf("NewVerifiedReader error: %v", err)
+		}
+		got, err := io.ReadAll(vr)
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("content mismatch: got %q", got)
+		}
+	})
+	t.Run("sha512_ok", func(t *testing.T) {
+		d := v1.Descriptor{Digest: digest.SHA512.FromBytes(content), Size: int64(len(content))}
+		vr, err := NewVerifiedReader(bytes.NewReader(content), d)
+		if err != nil {
+			t.Fatalf("NewVerifiedReader error: %v", err)
+		}
+		if _, err := io.Copy(io.Discard, vr); err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+	})
+	t.Run("digest_mismatch", func(t *testing.T) {
+		vr, _ := NewVerifiedReader(bytes.NewReader([]byte("hello PEXTRA")), good)
+		if _, err := io.Copy(io.Discard, vr); !errors.Is(err, ErrDigestMismatch) {
+			t.Fatalf("expected ErrDigestMismatch, got %v", err)
+		}
+	})
+	t.Run("too_long", func(t *testing.T) {
+		vr, _ := NewVerifiedReader(bytes.NewReader(append(content, '!')), good)
+		got, err := io.ReadAll(vr)
+		if !errors.Is(err, ErrSizeMismatch) {
+			t.Fatalf("expected ErrSizeMismatch, got %v", err)
+		}
+		if int64(len(got)) > good.Size {
+			t.Fatalf("read %d bytes past descriptor size %d", len(got), good.Size)
+		}
+	})
+	t.Run("too_short", func(t *testing.T) {
+		vr, _ := NewVerifiedReader(bytes.NewReader(content[:4]), good)
+		if _, err := io.Copy(io.Discard, vr); !errors.Is(err, ErrSizeMismatch) {
+			t.Fatalf("expected ErrSizeMismatch, got %v", err)
+		}
+	})
+	t.Run("invalid_digest", func(t *testing.T) {
+		if _, err := NewVerifiedReader(bytes.NewReader(content), v1.Descriptor{Digest: "md5:abc"}); err == nil {
+			t.Fatalf("expected error for unsupported digest")
+		}
+	})
+}
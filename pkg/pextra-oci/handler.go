@@ -0,0 +1,127 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pextraoci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Implements one Pextra image type. Handlers register themselves with Register from an
+// init function of their package, so importing the package (e.g. lxc or qemu) is what
+// makes its image type known to Select, List, Validate and Extract.
+type Handler interface {
+	// Value of the org.pextra.image.type annotation the handler implements
+	Type() string
+	// Layer media types the handler extracts
+	MediaTypes() []string
+	// Checks a manifest of this type against the type's rules
+	Validate(manifest *v1.Manifest) []error
+	// Extracts img, which is of this type, into outputDir
+	Extract(ctx context.Context, img *Image, outputDir string, opts ExtractOptions) (*ExtractResult, error)
+	// Type-specific facts about a layer, shown when inspecting an image (e.g. the
+	// file name of a qcow2 layer); nil if there are none
+	DescribeLayer(layer v1.Descriptor) map[string]any
+}
+
+// Options for Extract
+type ExtractOptions struct {
+	// Options for specific image types, by type name. Each handler documents the value
+	// it expects.
+	TypeOptions map[string]any
+	// Receives byte progress per layer; nil disables progress reporting
+	Progress ProgressFunc
+	// Write into the output directory directly instead of building the output next to
+	// it and moving it into place once complete. Needed when the output directory is a
+	// mount point or there is no space for a second copy; a failed extraction then
+	// leaves partial output behind.
+	InPlace bool
+	// Replace an existing LXC root filesystem directory or image file, such as the
+	// output of an earlier extraction; without it, extraction fails rather than replace
+	// anything but an empty directory
+	Replace bool
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[string]Handler)
+)
+
+// Makes the image type of h known. Panics if the type is empty or already registered.
+func Register(h Handler) {
+	name := h.Type()
+	if name == "" {
+		panic("pextraoci: Register of a handler without an image type")
+	}
+
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	if _, dup := handlers[name]; dup {
+		panic("pextraoci: Register called twice for image type " + name)
+	}
+	handlers[name] = h
+}
+
+// Returns the handler registered for imageType
+func LookupHandler(imageType string) (Handler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	h, ok := handlers[imageType]
+	return h, ok
+}
+
+// The registered image types with their validators, for selection and validation
+func imageTypes() oci.ImageTypes {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	types := make(oci.ImageTypes, len(handlers))
+	for name, h := range handlers {
+		types[name] = h.Validate
+	}
+	return types
+}
+
+// Returns the registered image types, sorted
+func ImageTypes() []string {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+	types := make([]string, 0, len(handlers))
+	for name := range handlers {
+		types = append(types, name)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// Extracts img into outputDir with the handler registered for its type. The manifest
+// must pass the handler's validation first.
+func Extract(ctx context.Context, img *Image, outputDir string, opts ExtractOptions) (*ExtractResult, error) {
+	h, ok := LookupHandler(img.Type)
+	if !ok {
+		return nil, fmt.Errorf("unsupported Pextra image type %q (registered: %s)", img.Type, strings.Join(ImageTypes(), ", "))
+	}
+	if errs := h.Validate(img.Manifest); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s image: %w", img.Type, errors.Join(errs...))
+	}
+	return h.Extract(ctx, img, outputDir, opts)
+}
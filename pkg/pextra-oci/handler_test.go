@@ -0,0 +1,107 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pextraoci
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Stands in for the lxc package, which imports this one and cannot be imported here
+type testHandler struct {
+	name      string
+	extracted []string
+}
+
+func (h *testHandler) Type() string { return h.name }
+
+func (h *testHandler) MediaTypes() []string { return []string{MediaTypePextraImageLayerLxc} }
+
+func (h *testHandler) Validate(m *v1.Manifest) []error {
+	if len(m.Layers) == 0 {
+		return []error{errors.New("no layers")}
+	}
+	return nil
+}
+
+func (h *testHandler) Extract(_ context.Context, img *Image, outputDir string, _ ExtractOptions) (*ExtractResult, error) {
+	h.extracted = append(h.extracted, outputDir)
+	return &ExtractResult{ImageType: h.name, OutputDir: outputDir, Layers: img.Manifest.Layers}, nil
+}
+
+func (h *testHandler) DescribeLayer(v1.Descriptor) map[string]any { return nil }
+
+var testLxcHandler = &testHandler{name: PextraImageTypeLxc}
+
+func init() {
+	Register(testLxcHandler)
+}
+
+func TestRegister(t *testing.T) {
+	if h, ok := LookupHandler(PextraImageTypeLxc); !ok || h != testLxcHandler {
+		t.Fatalf("LookupHandler(lxc) = %v, %v", h, ok)
+	}
+	if _, ok := LookupHandler(PextraImageTypeQemu); ok {
+		t.Fatalf("expected no qemu handler")
+	}
+	if !slices.Equal(ImageTypes(), []string{PextraImageTypeLxc}) {
+		t.Fatalf("unexpected image types %v", ImageTypes())
+	}
+
+	for _, h := range []Handler{&testHandler{name: PextraImageTypeLxc}, &testHandler{}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected Register(%q) to panic", h.Type())
+				}
+			}()
+			Register(h)
+		}()
+	}
+}
+
+func TestExtract_Dispatches(t *testing.T) {
+	base, _ := writeTestLayout(t)
+	layout, err := Open(base)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer layout.Close()
+	img, err := layout.Select(SelectOptions{Platform: amd64})
+	if err != nil {
+		t.Fatalf("Select error: %v", err)
+	}
+
+	res, err := Extract(context.Background(), img, "out", ExtractOptions{})
+	if err != nil || res.ImageType != PextraImageTypeLxc || !slices.Contains(testLxcHandler.extracted, "out") {
+		t.Fatalf("unexpected result %+v (err=%v)", res, err)
+	}
+
+	extracted := len(testLxcHandler.extracted)
+	img.Manifest.Layers = nil
+	if _, err := Extract(context.Background(), img, "out", ExtractOptions{}); err == nil || len(testLxcHandler.extracted) != extracted {
+		t.Fatalf("expected an invalid manifest not to be extracted (err=%v)", err)
+	}
+
+	img.Type = PextraImageTypeQemu
+	if _, err := Extract(context.Background(), img, "out", ExtractOptions{}); err == nil {
+		t.Fatalf("expected an error for an image type without handler")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pextraoci
+
+import (
+	"io"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// A Pextra image selected from a layout
+type Image struct {
+	// The layout the image was selected from; it must stay open while the image is used
+	Layout *Layout
+	// Pextra image type, e.g. PextraImageTypeLxc
+	Type string
+	// Descriptor of the selected manifest, with the platform and annotations from the
+	// index it was found in
+	Descriptor      v1.Descriptor
+	SelectionReason string
+	LayoutVersion   string
+	// The top-level index of the layout
+	Index    *v1.Index
+	Manifest *v1.Manifest
+	Config   *v1.Image
+}
+
+// Opens a blob of the image for reading, verified like Layout.OpenBlob
+func (img *Image) OpenBlob(desc v1.Descriptor) (io.ReadCloser, error) {
+	return img.Layout.OpenBlob(desc)
+}
+
+// What extracting an image produced
+type ExtractResult struct {
+	ImageType string
+	OutputDir string
+	// Layers applied (LXC) or flattened (QEMU), in the order they were processed
+	Layers []v1.Descriptor
+	// Layers of the image type that were left out, e.g. qcow2 layers that are not
+	// marked for flattening
+	Skipped []v1.Descriptor
+	// Files created in OutputDir, relative to it; empty when the image is extracted as a
+	// root filesystem
+	Files []string
+	// Path of the runtime config generated for the image, e.g. an LXC container config;
+	// empty if none was written
+	ConfigFile string
+	// Problems that did not stop the extraction, e.g. device nodes that could not be
+	// created without root
+	Warnings []string
+}
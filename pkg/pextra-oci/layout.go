@@ -0,0 +1,129 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pextraoci reads Pextra-specific OCI images. Open a layout, then List the
+// images in it or Select one to inspect, read blobs from or Extract.
+//
+// Image types are implemented by handlers that register themselves when their package
+// is imported, e.g. pkg/pextra-oci/lxc and pkg/pextra-oci/qemu. Images of types
+// without a handler are not selected.
+package pextraoci
+
+import (
+	"io"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type (
+	// Read access to the files of a layout, wherever it is stored
+	Source = oci.Source
+	// Points at images in a layout: LAYOUT, LAYOUT:TAG, LAYOUT@DIGEST or LAYOUT:TAG@DIGEST
+	ImageReference = oci.ImageReference
+	// Narrows down which manifest Select picks
+	SelectOptions = oci.SelectOptions
+	// Filters for List; zero values match everything
+	ListOptions = oci.ListOptions
+	// Summary of one Pextra image in a layout
+	ImageSummary = oci.ImageSummary
+	// A problem found by Validate and where it was found
+	ValidationProblem = oci.ValidationProblem
+	// Problems found by Validate and the number of Pextra images it checked
+	ValidationResult = oci.ValidationResult
+)
+
+// Returned (wrapped) when a blob does not match the size or digest of its descriptor
+var (
+	ErrDigestMismatch = utils.ErrDigestMismatch
+	ErrSizeMismatch   = utils.ErrSizeMismatch
+)
+
+// An open OCI image layout
+type Layout struct {
+	src Source
+}
+
+// Opens the layout at path: a layout directory, an OCI archive (tar, optionally gzip or
+// zstd compressed) or "-" for an archive read from stdin. Archives on stdin are read as
+// a stream; files are spilled to temporary storage when read out of order.
+func Open(path string) (*Layout, error) {
+	src, err := oci.OpenSource(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Layout{src: src}, nil
+}
+
+// Wraps an already opened source, e.g. to share it with other code
+func NewLayout(src Source) *Layout {
+	return &Layout{src: src}
+}
+
+// Parses an image reference such as "debian.tar:12"; see ImageReference
+func ParseImageReference(s string) (ImageReference, error) {
+	return oci.ParseImageReference(s)
+}
+
+// Where the layout is read from
+func (l *Layout) Source() Source { return l.src }
+
+// Describes the layout in messages, e.g. its directory
+func (l *Layout) String() string { return l.src.String() }
+
+// Releases the layout and its temporary files. Images selected from it can no longer
+// be read afterwards.
+func (l *Layout) Close() error { return l.src.Close() }
+
+// Lists every Pextra image in the layout, including those in nested indexes, in index
+// order
+func (l *Layout) List(opts ListOptions) ([]ImageSummary, error) {
+	return oci.ListSourceImages(l.src, opts, imageTypes())
+}
+
+// Selects one Pextra image by ref name, digest and platform. A nil platform selects
+// the host platform. A manifest pinned by digest is verified before it is used.
+func (l *Layout) Select(opts SelectOptions) (*Image, error) {
+	img, err := oci.SelectSourceImage(l.src, opts, imageTypes())
+	if err != nil {
+		return nil, err
+	}
+	return &Image{
+		Layout:          l,
+		Type:            img.PextraImageType,
+		Descriptor:      *img.SelectedDescriptor,
+		SelectionReason: img.SelectionReason,
+		LayoutVersion:   img.LayoutVersion,
+		Index:           img.Index,
+		Manifest:        img.Manifest,
+		Config:          img.Config,
+	}, nil
+}
+
+// Opens the blob for desc. Reading it to EOF fails with ErrSizeMismatch or
+// ErrDigestMismatch if the content does not match desc, so callers must not trust
+// the data until they have read it all.
+func (l *Layout) OpenBlob(desc v1.Descriptor) (io.ReadCloser, error) {
+	return oci.OpenBlob(l.src, desc)
+}
+
+// Checks every blob reachable from index.json against its descriptor and every Pextra
+// manifest against the Pextra OCI extension rules. The error is only set when the
+// layout cannot be read at all.
+func (l *Layout) Validate() (*ValidationResult, error) {
+	return oci.ValidateSource(l.src, imageTypes())
+}
@@ -0,0 +1,228 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pextraoci
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	amd64 = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 = &v1.Platform{OS: "linux", Architecture: "arm64"}
+)
+
+// Writes a layout with debian-12 for amd64 and arm64, whose layers hold the
+// architecture name and whose configs carry a creation date
+func writeTestLayout(t *testing.T) (string, map[string]v1.Descriptor) {
+	t.Helper()
+	base := filepath.Join(t.TempDir(), "layout")
+	lw, err := oci.NewLayoutWriter(base)
+	if err != nil {
+		t.Fatalf("NewLayoutWriter error: %v", err)
+	}
+
+	images := map[string]v1.Descriptor{}
+	for _, p := range []*v1.Platform{amd64, arm64} {
+		layer, err := lw.WriteBlob(strings.NewReader(p.Architecture), MediaTypePextraImageLayerLxc)
+		if err != nil {
+			t.Fatalf("WriteBlob error: %v", err)
+		}
+		created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+		desc, err := lw.WriteImage(PextraImageTypeLxc, &v1.Image{Created: &created, Platform: *p}, []v1.Descriptor{layer}, "debian-12")
+		if err != nil {
+			t.Fatalf("WriteImage error: %v", err)
+		}
+		images[p.Architecture] = desc
+	}
+	return base, images
+}
+
+func TestLayout_ListAndSelect(t *testing.T) {
+	base, images := writeTestLayout(t)
+	layout, err := Open(base)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer layout.Close()
+
+	list, err := layout.List(ListOptions{Platform: arm64})
+	if err != nil || len(list) != 1 || list[0].Digest != images["arm64"].Digest {
+		t.Fatalf("List: got %+v (err=%v)", list, err)
+	}
+
+	img, err := layout.Select(SelectOptions{Platform: arm64, Tag: "debian-12"})
+	if err != nil {
+		t.Fatalf("Select error: %v", err)
+	}
+	if img.Descriptor.Digest != images["arm64"].Digest || img.Type != PextraImageTypeLxc || img.Config.Architecture != "arm64" {
+		t.Fatalf("unexpected image %+v", img)
+	}
+
+	img, err = layout.Select(SelectOptions{Digest: images["amd64"].Digest})
+	if err != nil || img.Descriptor.Digest != images["amd64"].Digest {
+		t.Fatalf("Select by digest: got %+v (err=%v)", img, err)
+	}
+	if _, err := layout.Select(SelectOptions{Tag: "alma-9"}); err == nil {
+		t.Fatalf("expected an error for an unknown tag")
+	}
+
+	res, err := layout.Validate()
+	if err != nil || len(res.Problems) != 0 || res.PextraImages != 2 {
+		t.Fatalf("expected valid layout, got %+v (err=%v)", res, err)
+	}
+}
+
+func TestLayout_List(t *testing.T) {
+	base, images := writeTestLayout(t)
+	layout, err := Open(base)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer layout.Close()
+
+	got, err := layout.List(ListOptions{})
+	if err != nil {
+		t.Fatalf("List error: %v", err)
+	}
+	var names []string
+	for _, img := range got {
+		names = append(names, img.RefName+"/"+img.Platform.Architecture)
+		if img.Digest != images[img.Platform.Architecture].Digest || img.ImageType != PextraImageTypeLxc {
+			t.Errorf("unexpected summary %+v", img)
+		}
+		if img.Layers != 1 || img.Size != int64(len(img.Platform.Architecture)) {
+			t.Errorf("%s: layers/size = %d/%d", img.Platform.Architecture, img.Layers, img.Size)
+		}
+		if img.Created == nil {
+			t.Errorf("%s: expected a creation date from the config", img.Platform.Architecture)
+		}
+	}
+	if strings.Join(names, ",") != "debian-12/amd64,debian-12/arm64" {
+		t.Fatalf("unexpected images %v", names)
+	}
+
+	got, err = layout.List(ListOptions{Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}})
+	if err != nil || len(got) != 1 || got[0].Digest != images["arm64"].Digest {
+		t.Fatalf("platform filter: got %+v (err=%v)", got, err)
+	}
+	got, err = layout.List(ListOptions{ImageType: PextraImageTypeQemu})
+	if err != nil || len(got) != 0 {
+		t.Fatalf("type filter: got %+v (err=%v)", got, err)
+	}
+	got, err = layout.List(ListOptions{Tag: "alma-9"})
+	if err != nil || len(got) != 0 {
+		t.Fatalf("tag filter: got %+v (err=%v)", got, err)
+	}
+}
+
+func TestLayout_ListNestedIndex(t *testing.T) {
+	base := t.TempDir()
+	lw, err := oci.NewLayoutWriter(base)
+	if err != nil {
+		t.Fatalf("NewLayoutWriter error: %v", err)
+	}
+	layer, err := lw.WriteBlob(strings.NewReader("amd64"), MediaTypePextraImageLayerLxc)
+	if err != nil {
+		t.Fatalf("WriteBlob error: %v", err)
+	}
+	md, err := lw.WriteImage(PextraImageTypeLxc, &v1.Image{Platform: *amd64}, []v1.Descriptor{layer}, "")
+	if err != nil {
+		t.Fatalf("WriteImage error: %v", err)
+	}
+
+	// Move the manifest into a nested index that carries the platform and ref name
+	md.Platform = nil
+	nested, err := lw.WriteJSONBlob(v1.Index{MediaType: v1.MediaTypeImageIndex, Manifests: []v1.Descriptor{md}}, v1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatalf("WriteJSONBlob error: %v", err)
+	}
+	nested.Platform = amd64
+	nested.Annotations = map[string]string{v1.AnnotationRefName: "nested"}
+	idx := v1.Index{MediaType: v1.MediaTypeImageIndex, Manifests: []v1.Descriptor{nested}}
+	idx.SchemaVersion = 2
+	b, _ := json.Marshal(idx)
+	if err := os.WriteFile(filepath.Join(base, v1.ImageIndexFile), b, 0o644); err != nil {
+		t.Fatalf("write index: %v", err)
+	}
+
+	layout, err := Open(base)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer layout.Close()
+	got, err := layout.List(ListOptions{})
+	if err != nil {
+		t.Fatalf("List error: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected one image, got %+v", got)
+	}
+	img := got[0]
+	if img.RefName != "nested" || img.Platform == nil || img.Platform.Architecture != "amd64" {
+		t.Fatalf("expected ref name and platform from the nested index, got %+v", img)
+	}
+	if len(img.Via) != 1 || img.Via[0] != nested.Digest {
+		t.Fatalf("unexpected via %v", img.Via)
+	}
+}
+
+func TestImage_OpenBlobVerifies(t *testing.T) {
+	base, _ := writeTestLayout(t)
+	layout, err := Open(base)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer layout.Close()
+	img, err := layout.Select(SelectOptions{Platform: amd64})
+	if err != nil {
+		t.Fatalf("Select error: %v", err)
+	}
+
+	layer := img.Manifest.Layers[0]
+	r, err := img.OpenBlob(layer)
+	if err != nil {
+		t.Fatalf("OpenBlob error: %v", err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "amd64" {
+		t.Fatalf("unexpected blob %q (err=%v)", b, err)
+	}
+
+	// Same size, different content
+	if err := os.WriteFile(utils.BlobPath(base, layer.Digest.String()), []byte("AMD64"), 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	r, err = img.OpenBlob(layer)
+	if err != nil {
+		t.Fatalf("OpenBlob error: %v", err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PAX records written by GNU tar and star for POSIX ACLs, and the xattrs they map to
+const (
+	paxACLAccess  = "SCHILY.acl.access"
+	paxACLDefault = "SCHILY.acl.default"
+
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+
+	xattrCapability = "security.capability"
+)
+
+// Tags and layout of the Linux posix_acl xattr format (see linux/posix_acl_xattr.h)
+const (
+	aclVersion = 2
+
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclUndefinedID = 0xffffffff
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// Parses the text form of an ACL as stored by tar, e.g. "user::rw-,user:bob:r--:1000,group::r--".
+// Entries are separated by ',' or newlines. Named entries need a numeric id, either as the
+// qualifier or as the trailing field that tar appends.
+func parseACLText(text string) ([]aclEntry, error) {
+	var entries []aclEntry
+	for _, raw := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if i := strings.IndexByte(raw, '#'); i >= 0 {
+			raw = raw[:i]
+		}
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		fields := strings.Split(raw, ":")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("invalid ACL entry %q", raw)
+		}
+
+		var e aclEntry
+		qualified := fields[1] != ""
+		switch fields[0] {
+		case "user", "u":
+			e.tag = aclUserObj
+			if qualified {
+				e.tag = aclUser
+			}
+		case "group", "g":
+			e.tag = aclGroupObj
+			if qualified {
+				e.tag = aclGroup
+			}
+		case "mask", "m":
+			e.tag = aclMask
+		case "other", "o":
+			e.tag = aclOther
+		default:
+			return nil, fmt.Errorf("invalid ACL tag in %q", raw)
+		}
+
+		perm, err := parseACLPerm(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL entry %q: %w", raw, err)
+		}
+		e.perm = perm
+
+		e.id = aclUndefinedID
+		if e.tag == aclUser || e.tag == aclGroup {
+			idField := fields[1]
+			if len(fields) == 4 {
+				idField = fields[3]
+			}
+			id, err := strconv.ParseUint(idField, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("ACL entry %q has no numeric id", raw)
+			}
+			e.id = uint32(id)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func parseACLPerm(s string) (uint16, error) {
+	var perm uint16
+	for _, c := range s {
+		switch c {
+		case 'r':
+			perm |= 4
+		case 'w':
+			perm |= 2
+		case 'x':
+			perm |= 1
+		case '-':
+		default:
+			return 0, fmt.Errorf("invalid permission %q", s)
+		}
+	}
+	return perm, nil
+}
+
+// Encodes ACL entries in the posix_acl xattr format. The kernel expects entries
+// ordered by tag, then by id.
+func encodeACL(entries []aclEntry) []byte {
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b aclEntry) int {
+		if a.tag != b.tag {
+			return int(a.tag) - int(b.tag)
+		}
+		switch {
+		case a.id < b.id:
+			return -1
+		case a.id > b.id:
+			return 1
+		}
+		return 0
+	})
+
+	b := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, e := range sorted {
+		b = binary.LittleEndian.AppendUint16(b, e.tag)
+		b = binary.LittleEndian.AppendUint16(b, e.perm)
+		b = binary.LittleEndian.AppendUint32(b, e.id)
+	}
+	return b
+}
+
+// Decodes an ACL in the posix_acl xattr format
+func decodeACL(b []byte) ([]aclEntry, error) {
+	if len(b) < 4 || binary.LittleEndian.Uint32(b) != aclVersion || (len(b)-4)%8 != 0 {
+		return nil, fmt.Errorf("invalid ACL xattr")
+	}
+	var entries []aclEntry
+	for b = b[4:]; len(b) > 0; b = b[8:] {
+		entries = append(entries, aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParseACLText(t *testing.T) {
+	// GNU tar stores named entries with the id appended as a fourth field
+	got, err := parseACLText("user::rwx,user:bob:r--:1000,group::r-x,group:1001:rw-,mask::rwx,other::---")
+	if err != nil {
+		t.Fatalf("parseACLText error: %v", err)
+	}
+	want := []aclEntry{
+		{aclUserObj, 7, aclUndefinedID},
+		{aclUser, 4, 1000},
+		{aclGroupObj, 5, aclUndefinedID},
+		{aclGroup, 6, 1001},
+		{aclMask, 7, aclUndefinedID},
+		{aclOther, 0, aclUndefinedID},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseACLText mismatch\ngot:  %v\nwant: %v", got, want)
+	}
+
+	for _, bad := range []string{"user:bob:r--", "user::rwz", "nobody::r--", "user"} {
+		if _, err := parseACLText(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestEncodeACL(t *testing.T) {
+	b := encodeACL([]aclEntry{
+		{aclOther, 4, aclUndefinedID},
+		{aclUser, 6, 1000},
+		{aclUserObj, 7, aclUndefinedID},
+	})
+
+	var want bytes.Buffer
+	for _, v := range []any{
+		uint32(aclVersion),
+		uint16(aclUserObj), uint16(7), uint32(aclUndefinedID),
+		uint16(aclUser), uint16(6), uint32(1000),
+		uint16(aclOther), uint16(4), uint32(aclUndefinedID),
+	} {
+		binary.Write(&want, binary.LittleEndian, v)
+	}
+	if !bytes.Equal(b, want.Bytes()) {
+		t.Fatalf("encodeACL = %x, want %x", b, want.Bytes())
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type BuildOptions struct {
+	// Directory holding the root filesystem to package
+	RootfsDir string
+	// One of CompressionNone, CompressionGzip or CompressionZstd
+	Compression string
+	Platform    v1.Platform
+	// Optional ref name for the image in index.json
+	Tag string
+}
+
+// Packages opts.RootfsDir as a single-layer Pextra LXC image into the image layout at
+// layoutDir, creating the layout if needed. Returns the manifest descriptor.
+func Build(layoutDir string, opts BuildOptions) (v1.Descriptor, error) {
+	if fi, err := os.Stat(opts.RootfsDir); err != nil || !fi.IsDir() {
+		return v1.Descriptor{}, fmt.Errorf("not a directory: %s", opts.RootfsDir)
+	}
+	mediaType, err := LayerMediaType(opts.Compression)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	lw, err := oci.NewLayoutWriter(layoutDir)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	// Stream tar -> compressor -> blob, computing the diff ID on the way
+	pr, pw := io.Pipe()
+	var diffID digest.Digest
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		diffID, err = writeLayer(pw, opts.RootfsDir, opts.Compression)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	layer, err := lw.WriteBlob(pr, mediaType)
+	pr.CloseWithError(err) // unblocks the writer if the blob could not be stored
+	if werr := <-done; werr != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to create layer from %s: %w", opts.RootfsDir, werr)
+	}
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	created := time.Now().UTC()
+	config := &v1.Image{
+		Created:  &created,
+		Platform: opts.Platform,
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{diffID},
+		},
+		History: []v1.History{{
+			Created:   &created,
+			CreatedBy: "pce-oci build lxc",
+		}},
+	}
+	return lw.WriteImage(pextraoci.PextraImageTypeLxc, config, []v1.Descriptor{layer}, opts.Tag)
+}
+
+// Writes rootfs as a (compressed) tar stream to w and returns the digest of the uncompressed tar
+func writeLayer(w io.Writer, rootfs, compression string) (digest.Digest, error) {
+	cw, err := newCompressor(w, compression)
+	if err != nil {
+		return "", err
+	}
+
+	diffID := digest.Canonical.Digester()
+	cmd := exec.Command("tar", buildTarCreateArgs(rootfs)...)
+	cmd.Stdout = io.MultiWriter(diffID.Hash(), cw)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("tar failed: %w", err)
+	}
+	if err := cw.Close(); err != nil {
+		return "", err
+	}
+	return diffID.Digest(), nil
+}
+
+// Preserves the metadata that the layer extractor restores (ownership, xattrs, ACLs, SELinux labels)
+func buildTarCreateArgs(rootfs string) []string {
+	return []string{
+		"-C", rootfs, "-c",
+		"--format=posix",
+		"--numeric-owner",
+		"--sort=name",
+		"--xattrs", "--xattrs-include=*",
+		"--acls",
+		"--selinux",
+		"-f", "-", ".",
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBuild_RoundTrip(t *testing.T) {
+	requireTar(t)
+
+	rootfs := t.TempDir()
+	mkfile(t, filepath.Join(rootfs, "etc", "motd"))
+	if err := os.Symlink("motd", filepath.Join(rootfs, "etc", "motd.link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	layout := filepath.Join(t.TempDir(), "layout")
+	desc, err := Build(layout, BuildOptions{
+		RootfsDir:   rootfs,
+		Compression: CompressionGzip,
+		Platform:    v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		Tag:         "test",
+	})
+	if err != nil {
+		t.Fatalf("Build error: %v", err)
+	}
+	if desc.Annotations[pextraoci.AnnotationPextraImageType] != pextraoci.PextraImageTypeLxc {
+		t.Fatalf("missing image type annotation: %v", desc.Annotations)
+	}
+
+	img := selectImage(t, layout, pextraoci.SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}})
+	layer := img.Manifest.Layers[0]
+	if layer.MediaType != pextraoci.MediaTypePextraImageLayerLxcGzip {
+		t.Fatalf("unexpected layer media type %s", layer.MediaType)
+	}
+
+	// diff_id must be the digest of the uncompressed layer
+	f, err := os.Open(utils.BlobPath(layout, layer.Digest.String()))
+	if err != nil {
+		t.Fatalf("open layer: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	diffID, err := digest.FromReader(zr)
+	if err != nil {
+		t.Fatalf("hash layer: %v", err)
+	}
+	if got := img.Config.RootFS.DiffIDs; len(got) != 1 || got[0] != diffID {
+		t.Fatalf("diff_ids %v, want [%s]", got, diffID)
+	}
+	if img.Config.Variant != "v8" {
+		t.Fatalf("expected platform variant in config, got %+v", img.Config.Platform)
+	}
+
+	out := t.TempDir()
+	if err := New(img.Manifest.Layers, layout, out).FlattenLxcLayers(); err != nil {
+		t.Fatalf("FlattenLxcLayers error: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(out, "etc", "motd.link")); err != nil || target != "motd" {
+		t.Fatalf("symlink not preserved: %q (err=%v)", target, err)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	requireTar(t)
+
+	rootfs := t.TempDir()
+	mkfile(t, filepath.Join(rootfs, "etc", "motd"))
+	layoutDir := filepath.Join(t.TempDir(), "layout")
+	if _, err := Build(layoutDir, BuildOptions{RootfsDir: rootfs, Compression: CompressionZstd, Platform: v1.Platform{OS: "linux", Architecture: "amd64"}}); err != nil {
+		t.Fatalf("Build error: %v", err)
+	}
+
+	layout, err := pextraoci.Open(layoutDir)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer layout.Close()
+	img, err := layout.Select(pextraoci.SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}})
+	if err != nil {
+		t.Fatalf("Select error: %v", err)
+	}
+
+	out := filepath.Join(t.TempDir(), "rootfs")
+	res, err := Extract(context.Background(), img, out)
+	if err != nil {
+		t.Fatalf("Extract error: %v", err)
+	}
+	if res.ImageType != pextraoci.PextraImageTypeLxc || res.OutputDir != out || len(res.Layers) != 1 || res.Layers[0].Digest != img.Manifest.Layers[0].Digest {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(out, "etc", "motd")); err != nil {
+		t.Fatalf("expected extracted file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	out = filepath.Join(t.TempDir(), "rootfs")
+	if _, err := Extract(ctx, img, out); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("expected the output directory to be removed, stat err=%v", err)
+	}
+}
+
+func TestBuild_Errors(t *testing.T) {
+	if _, err := Build(t.TempDir(), BuildOptions{RootfsDir: filepath.Join(t.TempDir(), "missing"), Compression: CompressionNone}); err == nil {
+		t.Fatalf("expected error for missing rootfs")
+	}
+	if _, err := Build(t.TempDir(), BuildOptions{RootfsDir: t.TempDir(), Compression: "lz4"}); err == nil {
+		t.Fatalf("expected error for unsupported compression")
+	}
+}
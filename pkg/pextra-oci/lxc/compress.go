@@ -0,0 +1,81 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// Returns the LXC layer media type for the given compression
+func LayerMediaType(compression string) (string, error) {
+	switch compression {
+	case CompressionNone:
+		return pextraoci.MediaTypePextraImageLayerLxc, nil
+	case CompressionGzip:
+		return pextraoci.MediaTypePextraImageLayerLxcGzip, nil
+	case CompressionZstd:
+		return pextraoci.MediaTypePextraImageLayerLxcZstd, nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q (want %s, %s or %s)", compression, CompressionZstd, CompressionGzip, CompressionNone)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Wraps w in a compressor. Closing the returned writer flushes it but does not close w.
+func newCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+// Returns a reader for the uncompressed tar stream of an LXC layer with the given media type
+func newDecompressor(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	switch mediaType {
+	case pextraoci.MediaTypePextraImageLayerLxc:
+		return io.NopCloser(r), nil
+	case pextraoci.MediaTypePextraImageLayerLxcGzip:
+		return gzip.NewReader(r)
+	case pextraoci.MediaTypePextraImageLayerLxcZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported LXC layer media type: %s", mediaType)
+	}
+}
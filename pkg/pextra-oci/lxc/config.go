@@ -0,0 +1,274 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// File name of the container config written next to the root filesystem, as in
+// /var/lib/lxc/NAME/config
+const ContainerConfigName = "config"
+
+// First line of the container configs pce-oci writes
+const configHeader = "# LXC container config generated by pce-oci from the image config\n"
+
+// Returned by Flatten when the default container config path holds a file that
+// pce-oci did not write
+var ErrConfigExists = errors.New("file exists and is not a container config written by pce-oci")
+
+// lxc.arch values of GOARCH values; other architectures are left to LXC to detect
+var lxcArchs = map[string]string{
+	"386":     "i686",
+	"amd64":   "amd64",
+	"arm":     "armhf",
+	"arm64":   "arm64",
+	"ppc64le": "ppc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+}
+
+// cgroup v2 interface files, e.g. memory.max or cpuset.cpus
+var cgroup2KeyPattern = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_]+)+$`)
+
+// Generates the LXC container config for the lxc.rootfs.path rootfs, looking up user names in dir
+func containerConfig(img *v1.Image, annotations map[string]string, rootfs, dir string, ids IDMap) ([]byte, error) {
+	var b bytes.Buffer
+	var errs []error
+	set := func(key, value string) {
+		if strings.ContainsAny(value, "\r\n") {
+			errs = append(errs, fmt.Errorf("%s: value %q contains a line break", key, value))
+			return
+		}
+		fmt.Fprintf(&b, "%s = %s\n", key, value)
+	}
+
+	b.WriteString(configHeader)
+	set("lxc.rootfs.path", rootfs)
+	if arch, ok := lxcArchs[img.Architecture]; ok {
+		set("lxc.arch", arch)
+	}
+	for _, m := range []struct {
+		kind   string
+		ranges []IDMapping
+	}{{"u", ids.UIDs}, {"g", ids.GIDs}} {
+		for _, r := range m.ranges {
+			set("lxc.idmap", fmt.Sprintf("%s %d %d %d", m.kind, r.ContainerID, r.HostID, r.Size))
+		}
+	}
+
+	cfg := img.Config
+	if args := append(slices.Clone(cfg.Entrypoint), cfg.Cmd...); len(args) > 0 {
+		cmd, err := quoteInitCmd(args)
+		if err != nil {
+			return nil, err
+		}
+		set("lxc.init.cmd", cmd)
+	}
+	if cfg.WorkingDir != "" {
+		set("lxc.init.cwd", cfg.WorkingDir)
+	}
+	if cfg.User != "" {
+		uid, gid, err := resolveUser(dir, cfg.User)
+		if err != nil {
+			return nil, err
+		}
+		set("lxc.init.uid", strconv.Itoa(uid))
+		set("lxc.init.gid", strconv.Itoa(gid))
+	}
+	for _, env := range cfg.Env {
+		set("lxc.environment", env)
+	}
+	if cfg.StopSignal != "" {
+		set("lxc.signal.stop", cfg.StopSignal)
+	}
+
+	cgroups, cgroupErrs := cgroup2Settings(annotations)
+	errs = append(errs, cgroupErrs...)
+	for _, key := range slices.Sorted(maps.Keys(cgroups)) {
+		set("lxc.cgroup2."+key, cgroups[key])
+	}
+
+	// Kept for reference; LXC has no settings for these
+	comment := strings.NewReplacer("\r", `\r`, "\n", `\n`)
+	for _, key := range slices.Sorted(maps.Keys(cfg.Labels)) {
+		fmt.Fprintf(&b, "# label %s\n", comment.Replace(key+"="+cfg.Labels[key]))
+	}
+	if len(cfg.ExposedPorts) > 0 {
+		ports := slices.Sorted(maps.Keys(cfg.ExposedPorts))
+		fmt.Fprintf(&b, "# exposed ports %s\n", comment.Replace(strings.Join(ports, " ")))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Joins args into an lxc.init.cmd value. LXC splits it at whitespace outside of single
+// or double quotes and has no escapes, so an argument cannot contain both quote characters.
+func quoteInitCmd(args []string) (string, error) {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		switch {
+		case arg != "" && !strings.ContainsAny(arg, " \t'\""):
+			quoted[i] = arg
+		case !strings.Contains(arg, "'"):
+			quoted[i] = "'" + arg + "'"
+		case !strings.Contains(arg, `"`):
+			quoted[i] = `"` + arg + `"`
+		default:
+			return "", fmt.Errorf("lxc.init.cmd: argument %q contains both single and double quotes", arg)
+		}
+	}
+	return strings.Join(quoted, " "), nil
+}
+
+// Returns the cgroup2 settings of the manifest annotations, by cgroup v2 key, and the
+// problems with invalid ones
+func cgroup2Settings(annotations map[string]string) (map[string]string, []error) {
+	settings := make(map[string]string)
+	var errs []error
+	for name, value := range annotations {
+		key, ok := strings.CutPrefix(name, pextraoci.AnnotationPextraLxcCgroup2Prefix)
+		if !ok {
+			continue
+		}
+		if !cgroup2KeyPattern.MatchString(key) {
+			errs = append(errs, fmt.Errorf("annotation %s: %q is not a cgroup v2 key", name, key))
+			continue
+		}
+		if value == "" || strings.ContainsAny(value, "\r\n") {
+			errs = append(errs, fmt.Errorf("annotation %s: invalid value %q", name, value))
+			continue
+		}
+		settings[key] = value
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return settings, errs
+}
+
+// Resolves the user of an image config, "user[:group]" with names or numeric IDs, the
+// way OCI runtimes do: names are looked up in /etc/passwd and /etc/group of the root
+// filesystem at root, and a user without a group gets its primary group, or group 0
+// if it has no passwd entry.
+func resolveUser(root, user string) (uid, gid int, err error) {
+	name, group, hasGroup := strings.Cut(user, ":")
+
+	// name:x:uid:gid:...
+	passwd, err := readIDFile(root, "passwd")
+	if err != nil {
+		return 0, 0, err
+	}
+	uid, err = strconv.Atoi(name)
+	if err == nil {
+		if uid < 0 {
+			return 0, 0, fmt.Errorf("invalid user %q", user)
+		}
+		for _, fields := range passwd {
+			if len(fields) > 3 && fields[2] == name {
+				gid, _ = strconv.Atoi(fields[3])
+				break
+			}
+		}
+	} else {
+		found := false
+		for _, fields := range passwd {
+			if len(fields) > 3 && fields[0] == name {
+				uid, err = strconv.Atoi(fields[2])
+				if err != nil {
+					return 0, 0, fmt.Errorf("invalid uid of user %q in /etc/passwd: %w", name, err)
+				}
+				gid, _ = strconv.Atoi(fields[3])
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, 0, fmt.Errorf("user %q not found in /etc/passwd of the image", name)
+		}
+	}
+	if !hasGroup {
+		return uid, gid, nil
+	}
+
+	if gid, err = strconv.Atoi(group); err == nil {
+		if gid < 0 {
+			return 0, 0, fmt.Errorf("invalid group %q", user)
+		}
+		return uid, gid, nil
+	}
+	// name:x:gid:members
+	groups, err := readIDFile(root, "group")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, fields := range groups {
+		if len(fields) > 2 && fields[0] == group {
+			gid, err = strconv.Atoi(fields[2])
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid gid of group %q in /etc/group: %w", group, err)
+			}
+			return uid, gid, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("group %q not found in /etc/group of the image", group)
+}
+
+// Reads /etc/name of the root filesystem at root as colon-separated fields per line. A
+// missing file, or one that is not a regular file, reads as empty.
+func readIDFile(root, name string) ([][]string, error) {
+	etc, err := secureJoin(root, "etc", nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := filepath.Join(etc, name)
+	if fi, err := os.Lstat(p); err != nil || !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines [][]string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Split(line, ":"))
+	}
+	return lines, sc.Err()
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Creates a root filesystem with passwd and group files
+func writeIDFiles(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "root:x:0:0:root:/root:/bin/sh\n# comment\napp:x:1000:1001::/home/app:/bin/sh\n"
+	group := "root:x:0:\napp:x:1001:\nstaff:x:50:app\n"
+	if err := os.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(passwd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc", "group"), []byte(group), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestContainerConfig(t *testing.T) {
+	root := writeIDFiles(t)
+	img := &v1.Image{
+		Platform: v1.Platform{OS: "linux", Architecture: "arm64"},
+		Config: v1.ImageConfig{
+			Entrypoint:   []string{"/bin/sh", "-c"},
+			Cmd:          []string{"echo 'hello world'"},
+			WorkingDir:   "/srv",
+			User:         "app:staff",
+			Env:          []string{"PATH=/usr/bin:/bin", "GREETING=hello world"},
+			StopSignal:   "SIGQUIT",
+			Labels:       map[string]string{"org.opencontainers.image.title": "demo"},
+			ExposedPorts: map[string]struct{}{"80/tcp": {}, "53/udp": {}},
+		},
+	}
+	annotations := map[string]string{
+		pextraoci.AnnotationPextraLxcCgroup2Prefix + "memory.max": "512M",
+		pextraoci.AnnotationPextraLxcCgroup2Prefix + "cpu.max":    "50000 100000",
+		pextraoci.AnnotationPextraImageType:                       pextraoci.PextraImageTypeLxc,
+	}
+	ids := IDMap{UIDs: []IDMapping{{0, 100000, 65536}}, GIDs: []IDMapping{{0, 100000, 65536}}}
+
+	got, err := containerConfig(img, annotations, "dir:/var/lib/lxc/demo/rootfs", root, ids)
+	if err != nil {
+		t.Fatalf("containerConfig error: %v", err)
+	}
+	want := `# LXC container config generated by pce-oci from the image config
+lxc.rootfs.path = dir:/var/lib/lxc/demo/rootfs
+lxc.arch = arm64
+lxc.idmap = u 0 100000 65536
+lxc.idmap = g 0 100000 65536
+lxc.init.cmd = /bin/sh -c "echo 'hello world'"
+lxc.init.cwd = /srv
+lxc.init.uid = 1000
+lxc.init.gid = 50
+lxc.environment = PATH=/usr/bin:/bin
+lxc.environment = GREETING=hello world
+lxc.signal.stop = SIGQUIT
+lxc.cgroup2.cpu.max = 50000 100000
+lxc.cgroup2.memory.max = 512M
+# label org.opencontainers.image.title=demo
+# exposed ports 53/udp 80/tcp
+`
+	if string(got) != want {
+		t.Fatalf("unexpected config:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestContainerConfig_Invalid(t *testing.T) {
+	root := writeIDFiles(t)
+	for name, tc := range map[string]struct {
+		img         v1.ImageConfig
+		annotations map[string]string
+		wantErr     string
+	}{
+		"env line break":  {img: v1.ImageConfig{Env: []string{"A=1\nlxc.apparmor.profile=unconfined"}}, wantErr: "lxc.environment: value"},
+		"unknown user":    {img: v1.ImageConfig{User: "nobody"}, wantErr: `user "nobody" not found`},
+		"unquotable arg":  {img: v1.ImageConfig{Cmd: []string{`it's "quoted"`}}, wantErr: "both single and double quotes"},
+		"cgroup key":      {annotations: map[string]string{pextraoci.AnnotationPextraLxcCgroup2Prefix + "../memory": "1"}, wantErr: "is not a cgroup v2 key"},
+		"cgroup newline":  {annotations: map[string]string{pextraoci.AnnotationPextraLxcCgroup2Prefix + "pids.max": "1\nlxc.x=1"}, wantErr: "invalid value"},
+		"empty cgroup":    {annotations: map[string]string{pextraoci.AnnotationPextraLxcCgroup2Prefix + "pids.max": ""}, wantErr: "invalid value"},
+		"cgroup no dot":   {annotations: map[string]string{pextraoci.AnnotationPextraLxcCgroup2Prefix + "memory": "1"}, wantErr: "is not a cgroup v2 key"},
+		"stop line break": {img: v1.ImageConfig{StopSignal: "SIGTERM\n"}, wantErr: "lxc.signal.stop: value"},
+	} {
+		_, err := containerConfig(&v1.Image{Config: tc.img}, tc.annotations, "dir:/rootfs", root, IDMap{})
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: expected error containing %q, got %v", name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestQuoteInitCmd(t *testing.T) {
+	got, err := quoteInitCmd([]string{"/init", "", "a b", `say "hi"`, "it's"})
+	if err != nil {
+		t.Fatalf("quoteInitCmd error: %v", err)
+	}
+	if want := `/init '' 'a b' 'say "hi"' "it's"`; got != want {
+		t.Fatalf("quoteInitCmd = %s, want %s", got, want)
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	root := writeIDFiles(t)
+	for user, want := range map[string][2]int{
+		"app":       {1000, 1001},
+		"1000":      {1000, 1001},
+		"2000":      {2000, 0},
+		"app:staff": {1000, 50},
+		"app:7":     {1000, 7},
+		"3000:4000": {3000, 4000},
+		"root":      {0, 0},
+	} {
+		uid, gid, err := resolveUser(root, user)
+		if err != nil {
+			t.Errorf("resolveUser(%q) error: %v", user, err)
+			continue
+		}
+		if uid != want[0] || gid != want[1] {
+			t.Errorf("resolveUser(%q) = %d:%d, want %d:%d", user, uid, gid, want[0], want[1])
+		}
+	}
+
+	for _, user := range []string{"nobody", "app:nogroup", "-1"} {
+		if _, _, err := resolveUser(root, user); err == nil {
+			t.Errorf("resolveUser(%q): expected an error", user)
+		}
+	}
+	// Without an /etc, only numeric IDs resolve
+	if uid, gid, err := resolveUser(t.TempDir(), "5"); err != nil || uid != 5 || gid != 0 {
+		t.Errorf("resolveUser without /etc = %d:%d, %v", uid, gid, err)
+	}
+}
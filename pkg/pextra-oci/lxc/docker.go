@@ -0,0 +1,344 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Files of a `docker save` archive
+const (
+	dockerManifestFile     = "manifest.json"
+	dockerRepositoriesFile = "repositories"
+)
+
+type ImportOptions struct {
+	// Layer compression for the imported image: CompressionNone, CompressionGzip or
+	// CompressionZstd. Empty keeps the compression of each layer in the archive.
+	Compression string
+	// Imports only the image with this repository tag (e.g. "debian:12"). Empty imports
+	// every image in the archive.
+	Image string
+	// Ref name for the imported image in index.json. Defaults to its repository tags.
+	// Requires the archive (or Image) to select a single image.
+	Tag string
+}
+
+// An image entry of a Docker archive manifest.json
+type dockerManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Imports the images of a `docker save` archive (a tar file, optionally compressed, an
+// extracted directory or "-" for stdin) into the image layout at layoutDir as Pextra
+// LXC images. Returns the manifest descriptors of the imported images.
+func ImportDockerArchive(archivePath, layoutDir string, opts ImportOptions) ([]v1.Descriptor, error) {
+	if opts.Compression != "" {
+		if _, err := LayerMediaType(opts.Compression); err != nil {
+			return nil, err
+		}
+	}
+
+	src, err := oci.OpenSource(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	entries, err := readDockerManifest(src)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Image != "" {
+		entries = slices.DeleteFunc(entries, func(e dockerManifestEntry) bool {
+			return !slices.Contains(e.RepoTags, opts.Image)
+		})
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("no image tagged %q in %s", opts.Image, src)
+		}
+	}
+	if opts.Tag != "" && len(entries) != 1 {
+		return nil, fmt.Errorf("%s holds %d images; select one to tag it %q", src, len(entries), opts.Tag)
+	}
+
+	lw, err := oci.NewLayoutWriter(layoutDir)
+	if err != nil {
+		return nil, err
+	}
+	var out []v1.Descriptor
+	for _, e := range entries {
+		tags := e.RepoTags
+		if opts.Tag != "" {
+			tags = []string{opts.Tag}
+		}
+		desc, err := importDockerImage(src, lw, e, tags, opts.Compression)
+		if err != nil {
+			name := e.Config
+			if len(e.RepoTags) > 0 {
+				name = e.RepoTags[0]
+			}
+			return nil, fmt.Errorf("import %s: %w", name, err)
+		}
+		out = append(out, desc)
+	}
+	return out, nil
+}
+
+// Reads the image list of a Docker archive. Archives written before manifest.json was
+// introduced only have the legacy repositories file and per-layer json files.
+func readDockerManifest(src oci.Source) ([]dockerManifestEntry, error) {
+	var entries []dockerManifestEntry
+	err := readSourceJSON(src, dockerManifestFile, &entries)
+	if errors.Is(err, fs.ErrNotExist) {
+		return readLegacyDockerManifest(src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", dockerManifestFile, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s lists no images", dockerManifestFile)
+	}
+	return entries, nil
+}
+
+// A layer json file of a legacy Docker archive, which doubles as the image config of
+// the top layer
+type dockerLegacyLayer struct {
+	Parent string `json:"parent"`
+}
+
+func readLegacyDockerManifest(src oci.Source) ([]dockerManifestEntry, error) {
+	// repositories maps repository -> tag -> top layer ID
+	var repos map[string]map[string]string
+	if err := readSourceJSON(src, dockerRepositoriesFile, &repos); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("not a Docker archive: no %s or %s in %s", dockerManifestFile, dockerRepositoriesFile, src)
+		}
+		return nil, fmt.Errorf("parse %s: %w", dockerRepositoriesFile, err)
+	}
+
+	tagsByTop := map[string][]string{}
+	for repo, tags := range repos {
+		for tag, id := range tags {
+			tagsByTop[id] = append(tagsByTop[id], repo+":"+tag)
+		}
+	}
+	tops := make([]string, 0, len(tagsByTop))
+	for id := range tagsByTop {
+		tops = append(tops, id)
+	}
+	sort.Strings(tops)
+
+	var entries []dockerManifestEntry
+	for _, top := range tops {
+		e := dockerManifestEntry{Config: path.Join(top, "json"), RepoTags: tagsByTop[top]}
+		sort.Strings(e.RepoTags)
+		seen := map[string]bool{}
+		for id := top; id != ""; {
+			if seen[id] {
+				return nil, fmt.Errorf("layer %s refers back to itself", id)
+			}
+			seen[id] = true
+			var layer dockerLegacyLayer
+			if err := readSourceJSON(src, path.Join(id, "json"), &layer); err != nil {
+				return nil, fmt.Errorf("read layer %s: %w", id, err)
+			}
+			e.Layers = append([]string{path.Join(id, "layer.tar")}, e.Layers...)
+			id = layer.Parent
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%s lists no images", dockerRepositoriesFile)
+	}
+	return entries, nil
+}
+
+func importDockerImage(src oci.Source, lw *oci.LayoutWriter, e dockerManifestEntry, tags []string, compression string) (v1.Descriptor, error) {
+	// Docker image configs are a superset of the OCI image config; unknown fields
+	// (Hostname, Healthcheck, ...) are dropped
+	var config v1.Image
+	if err := readSourceJSON(src, e.Config, &config); err != nil {
+		return v1.Descriptor{}, fmt.Errorf("read config %s: %w", e.Config, err)
+	}
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+	if config.OS != "linux" {
+		return v1.Descriptor{}, fmt.Errorf("unsupported image OS %q (LXC images must be linux)", config.OS)
+	}
+	if len(config.RootFS.DiffIDs) != 0 && len(config.RootFS.DiffIDs) != len(e.Layers) {
+		return v1.Descriptor{}, fmt.Errorf("config lists %d layers, manifest %d", len(config.RootFS.DiffIDs), len(e.Layers))
+	}
+
+	layers := make([]v1.Descriptor, 0, len(e.Layers))
+	diffIDs := make([]digest.Digest, 0, len(e.Layers))
+	for i, name := range e.Layers {
+		layer, diffID, err := importDockerLayer(src, lw, name, compression)
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("layer %s: %w", name, err)
+		}
+		if len(config.RootFS.DiffIDs) != 0 && config.RootFS.DiffIDs[i] != diffID {
+			return v1.Descriptor{}, fmt.Errorf("layer %s: diff ID %s does not match config (%s)", name, diffID, config.RootFS.DiffIDs[i])
+		}
+		layers = append(layers, layer)
+		diffIDs = append(diffIDs, diffID)
+	}
+	config.RootFS = v1.RootFS{Type: "layers", DiffIDs: diffIDs}
+
+	var tag string
+	if len(tags) > 0 {
+		tag = tags[0]
+	}
+	desc, err := lw.WriteImage(pextraoci.PextraImageTypeLxc, &config, layers, tag)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	for _, t := range tags[min(1, len(tags)):] {
+		d := desc
+		d.Annotations = map[string]string{pextraoci.AnnotationPextraImageType: pextraoci.PextraImageTypeLxc, v1.AnnotationRefName: t}
+		if err := lw.AddManifest(d); err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+	return desc, nil
+}
+
+// Copies one Docker layer into the layout as an LXC layer, keeping or changing its
+// compression. Returns the layer descriptor and the digest of the uncompressed tar.
+func importDockerLayer(src oci.Source, lw *oci.LayoutWriter, name, compression string) (v1.Descriptor, digest.Digest, error) {
+	f, err := src.Open(name)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	current, err := sniffCompression(br)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	if compression == "" {
+		compression = current
+	}
+	mediaType, err := LayerMediaType(compression)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	currentType, err := LayerMediaType(current)
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+
+	// Stream layer -> (recompress) -> blob, computing the diff ID on the way
+	pr, pw := io.Pipe()
+	var diffID digest.Digest
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		diffID, err = convertLayer(pw, br, currentType, compression, compression == current)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	layer, err := lw.WriteBlob(pr, mediaType)
+	pr.CloseWithError(err) // unblocks the converter if the blob could not be stored
+	if cerr := <-done; cerr != nil {
+		return v1.Descriptor{}, "", cerr
+	}
+	if err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	return layer, diffID, nil
+}
+
+// Writes the layer in r (of media type mediaType) to w with the given compression and
+// returns the digest of the uncompressed tar. With keep the bytes are copied unchanged.
+func convertLayer(w io.Writer, r io.Reader, mediaType, compression string, keep bool) (digest.Digest, error) {
+	diffID := digest.Canonical.Digester()
+	if keep {
+		r = io.TeeReader(r, w)
+	}
+	dr, err := newDecompressor(r, mediaType)
+	if err != nil {
+		return "", err
+	}
+	defer dr.Close()
+
+	out := io.Writer(io.Discard)
+	var cw io.WriteCloser
+	if !keep {
+		if cw, err = newCompressor(w, compression); err != nil {
+			return "", err
+		}
+		out = cw
+	}
+	if _, err := io.Copy(io.MultiWriter(diffID.Hash(), out), dr); err != nil {
+		return "", err
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			return "", err
+		}
+	}
+	if keep {
+		// Copy anything after the end of the compressed stream as well
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return "", err
+		}
+	}
+	return diffID.Digest(), nil
+}
+
+// Detects the compression of a layer from its first bytes
+func sniffCompression(br *bufio.Reader) (string, error) {
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd, nil
+	default:
+		return CompressionNone, nil
+	}
+}
+
+func readSourceJSON(src oci.Source, name string, v any) error {
+	f, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
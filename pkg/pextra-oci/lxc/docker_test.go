@@ -0,0 +1,228 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layers of a small Docker image: the second one removes /etc/old and replaces /opt
+func dockerTestLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		buildTar(t, []tarEntry{
+			{Name: "etc/", Type: tar.TypeDir},
+			{Name: "etc/hostname", Content: []byte("box\n")},
+			{Name: "etc/old", Content: []byte("old\n")},
+			{Name: "opt/", Type: tar.TypeDir},
+			{Name: "opt/a", Content: []byte("a\n")},
+		}),
+		buildTar(t, []tarEntry{
+			{Name: "etc/", Type: tar.TypeDir},
+			{Name: "etc/" + WhiteoutPrefix + "old"},
+			{Name: "opt/", Type: tar.TypeDir},
+			{Name: "opt/" + OpaqueDirMarker},
+			{Name: "opt/b", Content: []byte("b\n")},
+		}),
+	}
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Writes a docker save archive in the manifest.json format. A second image shares the
+// first layer through a symlink, like docker save does for repeated layers.
+func writeDockerArchive(t *testing.T) string {
+	t.Helper()
+	layers := dockerTestLayers(t)
+	config := map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]any{"Env": []string{"PATH=/usr/bin"}, "Cmd": []string{"/bin/sh"}, "Hostname": "ignored"},
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": []digest.Digest{digest.FromBytes(layers[0]), digest.FromBytes(layers[1])}},
+	}
+	baseConfig := map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]any{"type": "layers", "diff_ids": []digest.Digest{digest.FromBytes(layers[0])}},
+	}
+	manifest := []dockerManifestEntry{
+		{Config: "app.json", RepoTags: []string{"example/app:1", "example/app:latest"}, Layers: []string{"l1/layer.tar", "l2/layer.tar"}},
+		{Config: "base.json", RepoTags: []string{"example/base:1"}, Layers: []string{"l3/layer.tar"}},
+	}
+
+	p := filepath.Join(t.TempDir(), "image.tar")
+	writeUncompressedTar(t, p, []tarEntry{
+		{Name: "l1/", Type: tar.TypeDir},
+		{Name: "l1/layer.tar", Content: layers[0]},
+		{Name: "l2/", Type: tar.TypeDir},
+		{Name: "l2/layer.tar", Content: layers[1]},
+		{Name: "l3/", Type: tar.TypeDir},
+		{Name: "app.json", Content: mustJSON(t, config)},
+		{Name: "base.json", Content: mustJSON(t, baseConfig)},
+		{Name: dockerManifestFile, Content: mustJSON(t, manifest)},
+	})
+
+	// writeUncompressedTar has no link targets, so append the shared layer by hand
+	appendTarSymlink(t, p, "l3/layer.tar", "../l1/layer.tar")
+	return p
+}
+
+func appendTarSymlink(t *testing.T, archive, name, target string) {
+	t.Helper()
+	f, err := os.OpenFile(archive, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Overwrite the two zero blocks that end the archive
+	if _, err := f.Seek(-2*512, 2); err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target, Mode: 0777}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportDockerArchive(t *testing.T) {
+	archive := writeDockerArchive(t)
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+
+	for _, compression := range []string{"", CompressionZstd} {
+		t.Run("compression="+compression, func(t *testing.T) {
+			layout := filepath.Join(t.TempDir(), "layout")
+			descs, err := ImportDockerArchive(archive, layout, ImportOptions{Compression: compression})
+			if err != nil {
+				t.Fatalf("ImportDockerArchive error: %v", err)
+			}
+			if len(descs) != 2 {
+				t.Fatalf("expected 2 images, got %d", len(descs))
+			}
+			for _, tag := range []string{"example/app:1", "example/app:latest"} {
+				img := selectImage(t, layout, pextraoci.SelectOptions{Platform: amd64, Tag: tag})
+				if img.Descriptor.Digest != descs[0].Digest {
+					t.Fatalf("tag %s selects %s, want %s", tag, img.Descriptor.Digest, descs[0].Digest)
+				}
+			}
+
+			img := selectImage(t, layout, pextraoci.SelectOptions{Platform: amd64, Tag: "example/app:1"})
+			wantType := pextraoci.MediaTypePextraImageLayerLxc
+			if compression == CompressionZstd {
+				wantType = pextraoci.MediaTypePextraImageLayerLxcZstd
+			}
+			for _, l := range img.Manifest.Layers {
+				if l.MediaType != wantType {
+					t.Fatalf("unexpected layer media type %s", l.MediaType)
+				}
+			}
+			if img.Type != pextraoci.PextraImageTypeLxc || img.Config.Config.Env[0] != "PATH=/usr/bin" {
+				t.Fatalf("unexpected image %s with config %+v", img.Type, img.Config.Config)
+			}
+
+			out := t.TempDir()
+			if err := NewFromSource(img.Manifest.Layers, img.Layout.Source(), out).FlattenLxcLayers(); err != nil {
+				t.Fatalf("FlattenLxcLayers error: %v", err)
+			}
+			assertContent(t, filepath.Join(out, "etc", "hostname"), "box\n")
+			assertMissing(t, filepath.Join(out, "etc", "old"))
+			assertMissing(t, filepath.Join(out, "opt", "a"))
+			assertContent(t, filepath.Join(out, "opt", "b"), "b\n")
+		})
+	}
+}
+
+func TestImportDockerArchive_SelectAndTag(t *testing.T) {
+	archive := writeDockerArchive(t)
+	layout := filepath.Join(t.TempDir(), "layout")
+
+	if _, err := ImportDockerArchive(archive, layout, ImportOptions{Tag: "base"}); err == nil {
+		t.Fatalf("expected an error tagging several images with one name")
+	}
+	if _, err := ImportDockerArchive(archive, layout, ImportOptions{Image: "example/missing:1"}); err == nil {
+		t.Fatalf("expected an error for a missing image")
+	}
+
+	descs, err := ImportDockerArchive(archive, layout, ImportOptions{Image: "example/base:1", Tag: "base"})
+	if err != nil {
+		t.Fatalf("ImportDockerArchive error: %v", err)
+	}
+	l, err := pextraoci.Open(layout)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer l.Close()
+	images, err := l.List(pextraoci.ListOptions{})
+	if err != nil {
+		t.Fatalf("List error: %v", err)
+	}
+	if len(descs) != 1 || len(images) != 1 || images[0].RefName != "base" || images[0].Layers != 1 {
+		t.Fatalf("unexpected images %+v", images)
+	}
+}
+
+func TestImportDockerArchive_Legacy(t *testing.T) {
+	layers := dockerTestLayers(t)
+	p := filepath.Join(t.TempDir(), "legacy.tar")
+	writeUncompressedTar(t, p, []tarEntry{
+		{Name: "aaa/json", Content: []byte(`{"id":"aaa","os":"linux","architecture":"amd64"}`)},
+		{Name: "aaa/layer.tar", Content: layers[0]},
+		{Name: "bbb/json", Content: []byte(`{"id":"bbb","parent":"aaa","os":"linux","architecture":"amd64","config":{"Cmd":["/bin/sh"]}}`)},
+		{Name: "bbb/layer.tar", Content: layers[1]},
+		{Name: dockerRepositoriesFile, Content: []byte(`{"example/old":{"1":"bbb"}}`)},
+	})
+
+	layout := filepath.Join(t.TempDir(), "layout")
+	if _, err := ImportDockerArchive(p, layout, ImportOptions{}); err != nil {
+		t.Fatalf("ImportDockerArchive error: %v", err)
+	}
+	img := selectImage(t, layout, pextraoci.SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}, Tag: "example/old:1"})
+	want := []digest.Digest{digest.FromBytes(layers[0]), digest.FromBytes(layers[1])}
+	if len(img.Config.RootFS.DiffIDs) != 2 || img.Config.RootFS.DiffIDs[0] != want[0] || img.Config.RootFS.DiffIDs[1] != want[1] {
+		t.Fatalf("unexpected diff IDs %v", img.Config.RootFS.DiffIDs)
+	}
+}
+
+func TestImportDockerArchive_DiffIDMismatch(t *testing.T) {
+	layers := dockerTestLayers(t)
+	config := map[string]any{"os": "linux", "architecture": "amd64", "rootfs": map[string]any{"type": "layers", "diff_ids": []digest.Digest{digest.FromString("other")}}}
+	p := filepath.Join(t.TempDir(), "image.tar")
+	writeUncompressedTar(t, p, []tarEntry{
+		{Name: "l1/layer.tar", Content: layers[0]},
+		{Name: "config.json", Content: mustJSON(t, config)},
+		{Name: dockerManifestFile, Content: mustJSON(t, []dockerManifestEntry{{Config: "config.json", Layers: []string{"l1/layer.tar"}}})},
+	})
+
+	if _, err := ImportDockerArchive(p, filepath.Join(t.TempDir(), "layout"), ImportOptions{}); err == nil {
+		t.Fatalf("expected a diff ID mismatch error")
+	}
+}
@@ -0,0 +1,467 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+)
+
+// Applies the entries of one layer onto a root filesystem directory in a single pass
+type layerApplier struct {
+	root string
+	// Skip ownership changes and device nodes, which need privileges
+	rootless bool
+	// Maps the IDs in the layer to the IDs files are owned by
+	ids IDMap
+	// Receives the metadata that cannot be applied without root, for packing the root
+	// filesystem into an image; nil if it is not kept
+	meta rootfsMetadata
+	// Host paths written by the current layer; opaque directories keep these
+	created map[string]struct{}
+	// Directory metadata is restored after all entries, like tar --delay-directory-restore
+	dirs []delayedDir
+	// Entries, or parts of them, that were skipped
+	warnings []string
+}
+
+type delayedDir struct {
+	path string
+	hdr  *tar.Header
+}
+
+func newLayerApplier(root string) *layerApplier {
+	return &layerApplier{
+		root:     root,
+		rootless: os.Geteuid() != 0,
+		created:  make(map[string]struct{}),
+	}
+}
+
+// Reads the uncompressed tar stream r and applies it onto a.root: whiteouts and opaque
+// directories remove lower-layer content, unsafe entries are skipped and everything
+// else is extracted with numeric ownership, permissions, xattrs and ACLs.
+func (a *layerApplier) apply(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.applyEntry(hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+
+	for i := len(a.dirs) - 1; i >= 0; i-- {
+		d := a.dirs[i]
+		if err := a.setMetadata(d.path, d.hdr); err != nil {
+			return fmt.Errorf("%s: %w", d.hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+func (a *layerApplier) applyEntry(hdr *tar.Header, r io.Reader) error {
+	rel, ok := sanitizeEntryName(hdr.Name)
+	if !ok {
+		return nil // excluded for safety
+	}
+
+	base := path.Base(rel)
+	if base == OpaqueDirMarker {
+		if err := applyOpaqueDir(a.root, path.Dir(rel), a.created); err != nil {
+			return err
+		}
+		a.forget(path.Dir(rel), a.created)
+		return nil
+	}
+	if name, ok := strings.CutPrefix(base, WhiteoutPrefix); ok {
+		if dir, err := secureJoin(a.root, path.Dir(rel), nil); err == nil {
+			a.dropDelayed(filepath.Join(dir, name))
+		}
+		if err := applyWhiteout(a.root, path.Join(path.Dir(rel), name)); err != nil {
+			return err
+		}
+		a.forget(path.Join(path.Dir(rel), name), nil)
+		return nil
+	}
+
+	if rel == "." {
+		// The archive root maps onto the output directory itself
+		if hdr.Typeflag == tar.TypeDir {
+			a.dirs = append(a.dirs, delayedDir{a.root, hdr})
+			return a.record(a.root, hdr)
+		}
+		return nil
+	}
+
+	parent, err := secureJoin(a.root, path.Dir(rel), a.makeParentDir)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(parent, base)
+	if hdr.Typeflag != tar.TypeDir {
+		// Whatever the entry replaces keeps no delayed metadata, so that it is not
+		// applied through a symlink taking the place of a directory
+		a.dropDelayed(target)
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := a.makeDir(target, hdr); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		if err := a.writeFile(target, hdr, r); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := removeExisting(target); err != nil {
+			return err
+		}
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+		if err := a.setMetadata(target, hdr); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		if err := a.makeHardlink(target, hdr); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if hdr.Typeflag != tar.TypeFifo && a.rootless && a.meta != nil {
+			// An empty file stands in for the node until the image is packed
+			placeholder := *hdr
+			placeholder.Typeflag, placeholder.Size = tar.TypeReg, 0
+			if err := a.writeFile(target, &placeholder, bytes.NewReader(nil)); err != nil {
+				return err
+			}
+			break
+		}
+		if hdr.Typeflag != tar.TypeFifo && a.rootless {
+			a.warn("skipping device node %s (requires root)", hdr.Name)
+			return nil
+		}
+		if err := removeExisting(target); err != nil {
+			return err
+		}
+		if err := mknod(target, hdr); err != nil {
+			// Device nodes cannot be created in a user namespace either
+			if hdr.Typeflag != tar.TypeFifo && errors.Is(err, os.ErrPermission) {
+				a.warn("skipping device node %s: %v", hdr.Name, err)
+				return nil
+			}
+			return err
+		}
+		if err := a.setMetadata(target, hdr); err != nil {
+			return err
+		}
+	default:
+		// Global headers and other non-file entries carry nothing to extract
+		return nil
+	}
+
+	a.markCreated(target)
+	if hdr.Typeflag == tar.TypeLink {
+		return nil // recorded by makeHardlink
+	}
+	return a.record(target, hdr)
+}
+
+// Records the metadata of hdr for the entry at target, if metadata is kept
+func (a *layerApplier) record(target string, hdr *tar.Header) error {
+	if a.meta == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(a.root, target)
+	if err != nil {
+		return err
+	}
+	return a.meta.record(filepath.ToSlash(rel), hdr, a.ids)
+}
+
+// Drops the kept metadata of what a whiteout removed, rel and everything below it, or,
+// with keep, of what an opaque marker removed: what is below rel and not in keep
+func (a *layerApplier) forget(rel string, keep map[string]struct{}) {
+	if a.meta == nil {
+		return
+	}
+	dir, err := secureJoin(a.root, path.Dir(rel), nil)
+	if err != nil {
+		return
+	}
+	resolved, err := filepath.Rel(a.root, filepath.Join(dir, path.Base(rel)))
+	if err != nil {
+		return
+	}
+	resolved = filepath.ToSlash(resolved)
+	a.meta.remove(resolved, func(p string) bool {
+		if keep == nil {
+			return false
+		}
+		_, ok := keep[filepath.Join(a.root, filepath.FromSlash(p))]
+		return ok || p == resolved
+	})
+}
+
+func (a *layerApplier) warn(format string, args ...any) {
+	a.warnings = append(a.warnings, fmt.Sprintf(format, args...))
+}
+
+// Records target and its parent directories as written by the current layer, so that
+// an opaque marker later in the same layer does not remove them
+func (a *layerApplier) markCreated(target string) {
+	for p := target; p != a.root && p != filepath.Dir(p); p = filepath.Dir(p) {
+		if _, ok := a.created[p]; ok {
+			return
+		}
+		a.created[p] = struct{}{}
+	}
+}
+
+func (a *layerApplier) makeDir(target string, hdr *tar.Header) error {
+	fi, err := os.Lstat(target)
+	switch {
+	case err == nil && fi.IsDir():
+		// Keep the directory and its content; metadata is updated below
+	case err == nil && fi.Mode()&os.ModeSymlink != 0 && a.isDirSymlink(target):
+		// Like tar --keep-directory-symlink: e.g. /lib -> usr/lib stays a symlink
+		return nil
+	case err == nil:
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+		fallthrough
+	case os.IsNotExist(err):
+		if err := os.Mkdir(target, 0700); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	a.dirs = append(a.dirs, delayedDir{target, hdr})
+	return nil
+}
+
+// Drops the delayed metadata of target and of the directories below it
+func (a *layerApplier) dropDelayed(target string) {
+	a.dirs = slices.DeleteFunc(a.dirs, func(d delayedDir) bool {
+		rel, err := filepath.Rel(target, d.path)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	})
+}
+
+// Creates a parent directory that the layer has no entry for. With an ID map, it is
+// owned by the container's root, as it would be when extracting in a user namespace.
+func (a *layerApplier) makeParentDir(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	return a.ids.ownByRoot(dir)
+}
+
+// Reports whether the symlink at target resolves to a directory inside the root
+func (a *layerApplier) isDirSymlink(target string) bool {
+	rel, err := filepath.Rel(a.root, target)
+	if err != nil {
+		return false
+	}
+	resolved, err := secureJoin(a.root, filepath.ToSlash(rel), nil)
+	if err != nil {
+		return false
+	}
+	fi, err := os.Stat(resolved)
+	return err == nil && fi.IsDir()
+}
+
+func (a *layerApplier) writeFile(target string, hdr *tar.Header, r io.Reader) error {
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL|oNoFollow, 0600)
+	if err != nil {
+		return err
+	}
+	// Holes in sparse files, which archive/tar expands to zeros, stay holes on disk
+	n, err := utils.CopySparse(f, r)
+	if err == nil && n != hdr.Size {
+		err = fmt.Errorf("short read: got %d of %d bytes", n, hdr.Size)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return a.setMetadata(target, hdr)
+}
+
+func (a *layerApplier) makeHardlink(target string, hdr *tar.Header) error {
+	linkRel, ok := sanitizeEntryName(hdr.Linkname)
+	if !ok || linkRel == "." {
+		return nil // excluded for safety, like the entry names
+	}
+	linkDir, err := secureJoin(a.root, path.Dir(linkRel), nil)
+	if err != nil {
+		return fmt.Errorf("hardlink target %s: %w", hdr.Linkname, err)
+	}
+	source := filepath.Join(linkDir, path.Base(linkRel))
+	if source == target {
+		return nil
+	}
+
+	if err := removeExisting(target); err != nil {
+		return err
+	}
+	if err := os.Link(source, target); err != nil {
+		return err
+	}
+	if a.meta != nil {
+		from, err := filepath.Rel(a.root, source)
+		if err != nil {
+			return err
+		}
+		to, err := filepath.Rel(a.root, target)
+		if err != nil {
+			return err
+		}
+		a.meta.link(filepath.ToSlash(from), filepath.ToSlash(to))
+	}
+	return nil
+}
+
+// Removes whatever exists at target so a new entry can take its place
+func removeExisting(target string) error {
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return os.RemoveAll(target)
+	}
+	return os.Remove(target)
+}
+
+// Reports whether err is the lack of support of a filesystem or platform, such as
+// ENOTSUP from setting an xattr
+func isNotSupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported)
+}
+
+// Applies ownership, permissions, xattrs, ACLs and times from hdr to target, with IDs
+// mapped through a.ids
+func (a *layerApplier) setMetadata(target string, hdr *tar.Header) error {
+	isLink := hdr.Typeflag == tar.TypeSymlink
+
+	if !a.rootless {
+		uid, err := a.ids.UID(hdr.Uid)
+		if err != nil {
+			return err
+		}
+		gid, err := a.ids.GID(hdr.Gid)
+		if err != nil {
+			return err
+		}
+		if err := os.Lchown(target, uid, gid); err != nil {
+			return err
+		}
+	}
+	// chown clears setuid/setgid bits, so permissions come after it. Symlink modes are fixed.
+	if !isLink {
+		if err := lchmod(target, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.PAXRecords {
+		name, data, err := xattrFromPAX(key, value)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		if data, err = a.ids.shiftXattr(name, data); err != nil {
+			return err
+		}
+		if err := lsetxattr(target, name, data); err != nil {
+			// Unprivileged users cannot set trusted.* or security.* attributes, and
+			// symlinks cannot carry user.* ones; tar only warns about these too.
+			if errors.Is(err, os.ErrPermission) || isNotSupported(err) {
+				if a.meta != nil {
+					continue // recorded for the image
+				}
+				a.warn("cannot set xattr %s on %s: %v", name, hdr.Name, err)
+				continue
+			}
+			return fmt.Errorf("set xattr %s: %w", name, err)
+		}
+	}
+
+	return lutimes(target, hdr.AccessTime, hdr.ModTime)
+}
+
+// Maps a PAX record to the xattr it encodes. Returns an empty name for other records.
+func xattrFromPAX(key, value string) (string, []byte, error) {
+	switch key {
+	case paxACLAccess, paxACLDefault:
+		entries, err := parseACLText(value)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(entries) == 0 {
+			return "", nil, nil
+		}
+		name := xattrACLAccess
+		if key == paxACLDefault {
+			name = xattrACLDefault
+		}
+		return name, encodeACL(entries), nil
+	case paxSELinux:
+		return "security.selinux", []byte(value), nil
+	}
+	if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+		return name, []byte(value), nil
+	}
+	return "", nil, nil
+}
+
+// PAX record names used by GNU tar for xattrs and SELinux labels
+const (
+	paxXattrPrefix = "SCHILY.xattr."
+	paxSELinux     = "RHT.security.selinux"
+)
@@ -0,0 +1,183 @@
+//go:build integration
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Exercises the privileged parts of extraction: ownership, setuid bits, device nodes,
+// xattrs and ACLs
+func TestApply_PrivilegedMetadata(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	now := time.Now()
+	for _, h := range []*tar.Header{
+		{Name: "usr/bin/su", Typeflag: tar.TypeReg, Mode: 04755, Uid: 0, Gid: 0, ModTime: now},
+		{Name: "home/bob/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000, ModTime: now},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: now},
+		{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600, ModTime: now},
+		{
+			Name: "srv/data", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 1000, ModTime: now,
+			Format: tar.FormatPAX,
+			PAXRecords: map[string]string{
+				"SCHILY.xattr.user.origin": "test",
+				paxACLAccess:               "user::rw-,user:bob:r--:1001,group::r--,mask::r--,other::---",
+			},
+		},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	root := t.TempDir()
+	if err := newLayerApplier(root).apply(&buf); err != nil {
+		t.Fatalf("apply error: %v", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(root, "usr", "bin", "su"))
+	if err != nil || fi.Mode()&os.ModeSetuid == 0 {
+		t.Fatalf("expected setuid bit on usr/bin/su (err=%v)", err)
+	}
+
+	fi, err = os.Stat(filepath.Join(root, "home", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 1000 || st.Gid != 1000 {
+		t.Fatalf("home/bob owner = %d:%d, want 1000:1000", st.Uid, st.Gid)
+	}
+
+	fi, err = os.Stat(filepath.Join(root, "dev", "null"))
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		t.Fatalf("expected dev/null to be a char device (err=%v)", err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); unix.Major(st.Rdev) != 1 || unix.Minor(st.Rdev) != 3 {
+		t.Fatalf("dev/null rdev = %d:%d, want 1:3", unix.Major(st.Rdev), unix.Minor(st.Rdev))
+	}
+	if fi, err := os.Stat(filepath.Join(root, "run", "fifo")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("expected run/fifo to be a fifo (err=%v)", err)
+	}
+
+	data := filepath.Join(root, "srv", "data")
+	val := make([]byte, 64)
+	n, err := unix.Getxattr(data, "user.origin", val)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			t.Skip("filesystem does not support user xattrs")
+		}
+		t.Fatal(err)
+	}
+	if string(val[:n]) != "test" {
+		t.Fatalf("user.origin = %q, want %q", val[:n], "test")
+	}
+	if _, err := unix.Getxattr(data, xattrACLAccess, nil); err != nil {
+		t.Fatalf("expected an access ACL on srv/data: %v", err)
+	}
+}
+
+func TestApply_IDMap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	caps := make([]byte, vfsCapSize2)
+	binary.LittleEndian.PutUint32(caps, vfsCapRevision2|1)
+	binary.LittleEndian.PutUint32(caps[4:], 0x2000) // CAP_NET_RAW
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	now := time.Now()
+	for _, h := range []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0755, ModTime: now},
+		{Name: "usr/bin/su", Typeflag: tar.TypeReg, Mode: 04755, ModTime: now},
+		{
+			Name: "usr/bin/ping", Typeflag: tar.TypeReg, Mode: 0755, ModTime: now,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{paxXattrPrefix + xattrCapability: string(caps)},
+		},
+		{Name: "home/bob/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000, ModTime: now},
+		{
+			Name: "srv/data", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 1000, ModTime: now,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{paxACLAccess: "user::rw-,user:bob:r--:1001,group::r--,mask::r--,other::---"},
+		},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	root := t.TempDir()
+	a := newLayerApplier(root)
+	a.ids = IDMap{UIDs: []IDMapping{{0, 100000, 65536}}, GIDs: []IDMapping{{0, 200000, 65536}}}
+	if err := a.apply(&buf); err != nil {
+		t.Fatalf("apply error: %v", err)
+	}
+
+	for name, want := range map[string][2]uint32{".": {100000, 200000}, "usr/bin": {100000, 200000}, "usr/bin/su": {100000, 200000}, "home/bob": {101000, 201000}} {
+		fi, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st := fi.Sys().(*syscall.Stat_t); st.Uid != want[0] || st.Gid != want[1] {
+			t.Errorf("%s owner = %d:%d, want %d:%d", name, st.Uid, st.Gid, want[0], want[1])
+		}
+		if name == "usr/bin/su" && fi.Mode()&os.ModeSetuid == 0 {
+			t.Errorf("expected setuid bit on usr/bin/su")
+		}
+	}
+
+	val := make([]byte, 64)
+	n, err := unix.Getxattr(filepath.Join(root, "srv", "data"), xattrACLAccess, val)
+	if err != nil {
+		if err == unix.ENOTSUP {
+			t.Skip("filesystem does not support ACLs")
+		}
+		t.Fatal(err)
+	}
+	entries, err := decodeACL(val[:n])
+	if err != nil || !slices.Contains(entries, aclEntry{aclUser, 4, 101001}) {
+		t.Fatalf("expected a shifted named user entry, got %v (err=%v)", entries, err)
+	}
+
+	n, err = unix.Getxattr(filepath.Join(root, "usr", "bin", "ping"), xattrCapability, val)
+	if err != nil {
+		t.Fatalf("expected file capabilities on usr/bin/ping: %v", err)
+	}
+	if n != vfsCapSize3 || binary.LittleEndian.Uint32(val[vfsCapSize2:]) != 100000 {
+		t.Fatalf("unexpected file capabilities %x", val[:n])
+	}
+}
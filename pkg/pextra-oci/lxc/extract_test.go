@@ -0,0 +1,353 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+)
+
+// Builds an in-memory tar stream. Regular file headers get their size from content.
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.Name, Mode: e.Mode, Typeflag: e.Type, ModTime: time.Unix(1700000000, 0)}
+		if h.Typeflag == 0 {
+			h.Typeflag = tar.TypeReg
+			h.Size = int64(len(e.Content))
+		}
+		if h.Mode == 0 {
+			h.Mode = 0644
+			if h.Typeflag == tar.TypeDir {
+				h.Mode = 0755
+			}
+		}
+		if h.Typeflag == tar.TypeSymlink || h.Typeflag == tar.TypeLink {
+			h.Linkname = string(e.Content)
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("write header %s: %v", e.Name, err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(e.Content); err != nil {
+				t.Fatalf("write content %s: %v", e.Name, err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func applyLayers(t *testing.T, root string, layers ...[]tarEntry) {
+	t.Helper()
+	for i, entries := range layers {
+		if err := newLayerApplier(root).apply(bytes.NewReader(buildTar(t, entries))); err != nil {
+			t.Fatalf("apply layer %d: %v", i, err)
+		}
+	}
+}
+
+func assertContent(t *testing.T, p, want string) {
+	t.Helper()
+	got, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("read %s: %v", p, err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s = %q, want %q", p, got, want)
+	}
+}
+
+func assertMissing(t *testing.T, p string) {
+	t.Helper()
+	if _, err := os.Lstat(p); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got err=%v", p, err)
+	}
+}
+
+func TestApply_WhiteoutsAndOpaqueDirs(t *testing.T) {
+	root := t.TempDir()
+	applyLayers(t, root,
+		[]tarEntry{
+			{Name: "./", Type: tar.TypeDir},
+			{Name: "etc/", Type: tar.TypeDir},
+			{Name: "etc/keep", Content: []byte("keep")},
+			{Name: "etc/gone", Content: []byte("gone")},
+			{Name: "var/", Type: tar.TypeDir},
+			{Name: "var/old", Content: []byte("old")},
+			{Name: "var/sub/old", Content: []byte("old")},
+		},
+		[]tarEntry{
+			{Name: "etc/.wh.gone"},
+			{Name: "etc/.wh.never-existed"},
+			// The marker comes after entries of the same layer, which must survive it
+			{Name: "var/sub/new", Content: []byte("new")},
+			{Name: "var/" + OpaqueDirMarker},
+		},
+	)
+
+	assertContent(t, filepath.Join(root, "etc", "keep"), "keep")
+	assertMissing(t, filepath.Join(root, "etc", "gone"))
+	assertMissing(t, filepath.Join(root, "var", "old"))
+	assertMissing(t, filepath.Join(root, "var", "sub", "old"))
+	assertContent(t, filepath.Join(root, "var", "sub", "new"), "new")
+
+	for _, p := range []string{"etc/.wh.gone", "var/" + OpaqueDirMarker} {
+		assertMissing(t, filepath.Join(root, p))
+	}
+}
+
+func TestApply_SkipsUnsafeEntries(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	mkdirAll(t, root)
+
+	applyLayers(t, root, []tarEntry{
+		{Name: "/abs", Content: []byte("x")},
+		{Name: "../escape", Content: []byte("x")},
+		{Name: "dir/../evil", Content: []byte("x")},
+		{Name: "link-out", Type: tar.TypeLink, Content: []byte("../escape")},
+		{Name: "safe", Content: []byte("ok")},
+	})
+
+	assertContent(t, filepath.Join(root, "safe"), "ok")
+	for _, p := range []string{filepath.Join(parent, "escape"), filepath.Join(root, "evil"), filepath.Join(root, "abs"), filepath.Join(root, "link-out")} {
+		assertMissing(t, p)
+	}
+}
+
+func TestApply_SymlinksCannotEscapeRoot(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	mkdirAll(t, root)
+
+	applyLayers(t, root,
+		[]tarEntry{
+			{Name: "abs", Type: tar.TypeSymlink, Content: []byte(parent)},
+			{Name: "rel", Type: tar.TypeSymlink, Content: []byte("../..")},
+		},
+		[]tarEntry{
+			{Name: "abs/pwned", Content: []byte("x")},
+			{Name: "rel/pwned2", Content: []byte("x")},
+		},
+	)
+
+	assertMissing(t, filepath.Join(parent, "pwned"))
+	assertMissing(t, filepath.Join(filepath.Dir(parent), "pwned2"))
+	assertContent(t, filepath.Join(root, parent, "pwned"), "x")
+	assertContent(t, filepath.Join(root, "pwned2"), "x")
+
+	// The symlinks themselves are restored verbatim
+	if got, _ := os.Readlink(filepath.Join(root, "abs")); got != parent {
+		t.Fatalf("abs symlink = %q, want %q", got, parent)
+	}
+}
+
+func TestApply_WarnsAboutSkippedDeviceNodes(t *testing.T) {
+	root := t.TempDir()
+	a := newLayerApplier(root)
+	a.rootless = true
+	if err := a.apply(bytes.NewReader(buildTar(t, []tarEntry{
+		{Name: "dev/", Type: tar.TypeDir},
+		{Name: "dev/null", Type: tar.TypeChar, Mode: 0666},
+		{Name: "etc/hostname", Content: []byte("box")},
+	}))); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	if len(a.warnings) != 1 || !strings.Contains(a.warnings[0], "dev/null") {
+		t.Fatalf("unexpected warnings %q", a.warnings)
+	}
+	assertMissing(t, filepath.Join(root, "dev", "null"))
+	assertContent(t, filepath.Join(root, "etc", "hostname"), "box")
+}
+
+func TestApply_DelayedDirectoryReplacedBySymlink(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	mkdirAll(t, root)
+	outside := filepath.Join(parent, "shadow")
+	if err := os.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mkdirAll(t, filepath.Join(parent, "etc", "sub"))
+	if err := os.Chmod(filepath.Join(parent, "etc", "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata of a/ and b/sub/ would be restored through the symlinks that replace them
+	applyLayers(t, root, []tarEntry{
+		{Name: "a/", Type: tar.TypeDir, Mode: 0777},
+		{Name: "b/", Type: tar.TypeDir, Mode: 0777},
+		{Name: "b/sub/", Type: tar.TypeDir, Mode: 0777},
+		{Name: "a", Type: tar.TypeSymlink, Content: []byte(outside)},
+		{Name: "b", Type: tar.TypeSymlink, Content: []byte(filepath.Join(parent, "etc"))},
+	})
+
+	for p, want := range map[string]os.FileMode{outside: 0600, filepath.Join(parent, "etc", "sub"): 0700} {
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != want {
+			t.Fatalf("%s mode = %v, want %v", p, fi.Mode().Perm(), want)
+		}
+	}
+}
+
+func TestApply_KeepsDirectorySymlinks(t *testing.T) {
+	root := t.TempDir()
+	applyLayers(t, root,
+		[]tarEntry{
+			{Name: "usr/lib/", Type: tar.TypeDir},
+			{Name: "lib", Type: tar.TypeSymlink, Content: []byte("usr/lib")},
+		},
+		[]tarEntry{
+			{Name: "lib/", Type: tar.TypeDir},
+			{Name: "lib/libc.so", Content: []byte("elf")},
+		},
+	)
+
+	fi, err := os.Lstat(filepath.Join(root, "lib"))
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("expected lib to stay a symlink (err=%v)", err)
+	}
+	assertContent(t, filepath.Join(root, "usr", "lib", "libc.so"), "elf")
+}
+
+func TestApply_ReplacesAcrossLayers(t *testing.T) {
+	root := t.TempDir()
+	applyLayers(t, root,
+		[]tarEntry{
+			{Name: "a/", Type: tar.TypeDir},
+			{Name: "a/child", Content: []byte("x")},
+			{Name: "b", Content: []byte("file")},
+		},
+		[]tarEntry{
+			{Name: "a", Content: []byte("now a file")},
+			{Name: "b/", Type: tar.TypeDir},
+		},
+	)
+
+	assertContent(t, filepath.Join(root, "a"), "now a file")
+	if fi, err := os.Stat(filepath.Join(root, "b")); err != nil || !fi.IsDir() {
+		t.Fatalf("expected b to be a directory (err=%v)", err)
+	}
+}
+
+func TestApply_HardlinksAndMetadata(t *testing.T) {
+	root := t.TempDir()
+	applyLayers(t, root, []tarEntry{
+		{Name: "bin/", Type: tar.TypeDir, Mode: 0750},
+		{Name: "bin/tool", Content: []byte("#!/bin/sh\n"), Mode: 0755},
+		{Name: "bin/alias", Type: tar.TypeLink, Content: []byte("bin/tool")},
+	})
+
+	a, err := os.Stat(filepath.Join(root, "bin", "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(root, "bin", "alias"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Fatal("expected bin/alias to be a hardlink of bin/tool")
+	}
+	if a.Mode().Perm() != 0755 {
+		t.Fatalf("bin/tool mode = %v, want 0755", a.Mode().Perm())
+	}
+	if !a.ModTime().Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("bin/tool mtime = %v", a.ModTime())
+	}
+
+	// Directory metadata is restored after its content was written
+	d, err := os.Stat(filepath.Join(root, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Mode().Perm() != 0750 || !d.ModTime().Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("bin mode/mtime = %v/%v", d.Mode().Perm(), d.ModTime())
+	}
+}
+
+func TestApply_SparseFile(t *testing.T) {
+	root := t.TempDir()
+	content := make([]byte, 1<<20)
+	copy(content[300000:], "data")
+	applyLayers(t, root, []tarEntry{{Name: "disk.img", Content: content}})
+
+	got, err := os.ReadFile(filepath.Join(root, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("sparse file content mismatch")
+	}
+}
+
+func TestApply_CompressedLayers(t *testing.T) {
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			mediaType, err := LayerMediaType(compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			cw, err := newCompressor(&buf, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cw.Write(buildTar(t, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})); err != nil {
+				t.Fatal(err)
+			}
+			if err := cw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			dr, err := newDecompressor(&buf, mediaType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dr.Close()
+			root := t.TempDir()
+			if err := newLayerApplier(root).apply(dr); err != nil {
+				t.Fatalf("apply %s layer: %v", compression, err)
+			}
+			if _, err := io.Copy(io.Discard, dr); err != nil {
+				t.Fatal(err)
+			}
+			assertContent(t, filepath.Join(root, "etc", "hostname"), "box\n")
+		})
+	}
+
+	if _, err := newDecompressor(bytes.NewReader(nil), pextraoci.MediaTypePextraImageLayerLxc+"+bzip2"); err == nil {
+		t.Fatal("expected an error for an unsupported media type")
+	}
+}
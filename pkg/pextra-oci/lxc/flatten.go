@@ -16,64 +16,287 @@ limitations under the License.
 package lxc
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
-	"os/exec"
+	"path/filepath"
 
+	"github.com/PextraCloud/pce-osi/internal/oci"
 	"github.com/PextraCloud/pce-osi/internal/utils"
 	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// Applies the LXC layers to OutputDir; see Flatten
 func (c *LxcConfig) FlattenLxcLayers() error {
+	_, err := c.Flatten(context.Background())
+	return err
+}
+
+// Applies the LXC layers in order to a staging directory next to OutputDir, and then
+// replaces OutputDir with it; an OutputDir that is not an empty directory is only
+// replaced with Replace. If extraction fails, OutputDir is left untouched. With
+// InPlace, the layers are applied onto OutputDir directly; see flattenInPlace. With an
+// image Format, OutputDir is replaced with an image instead; see flattenImage. With an
+// ImageConfig, the container config is written to ConfigPath before OutputDir is
+// replaced; at the default path, it only replaces a config pce-oci wrote (see
+// ErrConfigExists).
+func (c *LxcConfig) Flatten(ctx context.Context) (*pextraoci.ExtractResult, error) {
+	filteredLayers := utils.GetLayersByMediaType(c.Layers, layerMediaTypes...)
+	if len(filteredLayers) == 0 {
+		return nil, fmt.Errorf("no LXC layers found in image")
+	}
+	if err := c.checkFormat(); err != nil {
+		return nil, err
+	}
+	if err := c.checkConfigPath(); err != nil {
+		return nil, err
+	}
+	if !c.IDMap.IsIdentity() && !c.IDsMapped && os.Geteuid() != 0 {
+		return nil, errors.New("mapping IDs requires root, e.g. in a user namespace set up with the ID map")
+	}
+	if c.InPlace {
+		return c.flattenInPlace(ctx, filteredLayers)
+	}
+	if c.packed() {
+		return c.flattenImage(ctx, filteredLayers)
+	}
+
+	staged, err := utils.NewStagedDir(c.OutputDir, c.Replace)
+	if err != nil {
+		return nil, err
+	}
+	defer staged.Discard()
+	res, err := c.applyLayers(ctx, filteredLayers, staged.Path, nil)
+	if err != nil {
+		return nil, err
+	}
+	config, err := c.containerConfig(staged.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.writeContainerConfig(config, res); err != nil {
+		return nil, err
+	}
+	if err := staged.Commit(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Applies the layers onto OutputDir, which is created if it does not exist. A failed
+// extraction leaves what was applied so far; when ctx is done, OutputDir is removed if
+// it was created here.
+func (c *LxcConfig) flattenInPlace(ctx context.Context, layers []v1.Descriptor) (*pextraoci.ExtractResult, error) {
+	_, statErr := os.Lstat(c.OutputDir)
 	if err := os.MkdirAll(c.OutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
 	}
+	res, err := c.applyLayers(ctx, layers, c.OutputDir, nil)
+	if err != nil && ctx.Err() != nil && errors.Is(statErr, fs.ErrNotExist) {
+		os.RemoveAll(c.OutputDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config, err := c.containerConfig(c.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.writeContainerConfig(config, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
 
-	filteredLayers := utils.GetLayersByMediaType(c.Layers, pextraoci.MediaTypePextraImageLayerLxc, pextraoci.MediaTypePextraImageLayerLxcGzip, pextraoci.MediaTypePextraImageLayerLxcZstd)
-	if len(filteredLayers) == 0 {
-		return fmt.Errorf("no LXC layers found in image")
+// Applies the layers to a root filesystem in a staging directory next to OutputDir and
+// packs it into a Format image, which then replaces the file at OutputDir. Without
+// root, the metadata that cannot be applied on disk is kept for packing.
+func (c *LxcConfig) flattenImage(ctx context.Context, layers []v1.Descriptor) (*pextraoci.ExtractResult, error) {
+	if fi, err := os.Stat(c.OutputDir); err == nil && fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory; %s images are written to a file", c.OutputDir, c.Format)
+	}
+	if err := checkPackTools(c.Format); err != nil {
+		return nil, err
+	}
+	staged, err := utils.NewStagedDir(c.OutputDir, c.Replace)
+	if err != nil {
+		return nil, err
+	}
+	defer staged.Discard()
+	rootfs := filepath.Join(staged.Path, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return nil, err
+	}
+
+	var meta rootfsMetadata
+	if os.Geteuid() != 0 {
+		meta = make(rootfsMetadata)
+	}
+	res, err := c.applyLayers(ctx, layers, rootfs, meta)
+	if err != nil {
+		return nil, err
+	}
+	config, err := c.containerConfig(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	image := filepath.Join(staged.Path, "image")
+	if err := packRootfs(ctx, c.Format, rootfs, meta, image, c.ImageSize, c.Compression); err != nil {
+		return nil, fmt.Errorf("failed to pack %s image: %w", c.Format, err)
 	}
+	if err := c.writeContainerConfig(config, res); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(image, c.OutputDir); err != nil {
+		return nil, fmt.Errorf("failed to move image into place: %w", err)
+	}
+	return res, nil
+}
 
-	// Extract each layer
-	var total int
-	for _, layer := range filteredLayers {
-		digest := layer.Digest.String()
-		layerPath := utils.BlobPath(c.ImgPath, digest)
+// Generates the container config from ImageConfig, with user names looked up in the
+// root filesystem in dir; nil without an image config
+func (c *LxcConfig) containerConfig(dir string) ([]byte, error) {
+	if c.ImageConfig == nil {
+		return nil, nil
+	}
+	rootfs, err := filepath.Abs(c.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+	// LXC mounts image files through a loop device
+	kind := "dir:"
+	if c.packed() {
+		kind = "loop:"
+	}
+	config, err := containerConfig(c.ImageConfig, c.Annotations, kind+rootfs, dir, c.IDMap)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate container config: %w", err)
+	}
+	return config, nil
+}
 
-		if err := c.flattenLxcLayer(layerPath, digest, layer.MediaType); err != nil {
-			return fmt.Errorf("failed to flatten LXC layer %s: %w", digest, err)
-		}
-		total++
+// Where the container config is written: ConfigPath, or ContainerConfigName next to
+// OutputDir
+func (c *LxcConfig) configPath() (string, error) {
+	if c.ConfigPath != "" {
+		return c.ConfigPath, nil
+	}
+	rootfs, err := filepath.Abs(c.OutputDir)
+	if err != nil {
+		return "", err
 	}
+	return filepath.Join(filepath.Dir(rootfs), ContainerConfigName), nil
+}
 
-	fmt.Printf("Extracted %d LXC layers into directory %s\n", total, c.OutputDir)
+// Fails with ErrConfigExists if the container config would replace a file at the
+// default path that pce-oci did not write. A ConfigPath that is set is written
+// regardless.
+func (c *LxcConfig) checkConfigPath() error {
+	if c.ImageConfig == nil || c.ConfigPath != "" {
+		return nil
+	}
+	path, err := c.configPath()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, len(configHeader))
+	if _, err := io.ReadFull(f, head); err != nil || string(head) != configHeader {
+		return fmt.Errorf("%s: %w", path, ErrConfigExists)
+	}
 	return nil
 }
 
-func (c *LxcConfig) flattenLxcLayer(layerPath, digest, mediaType string) error {
-	// Plan and apply whiteouts before extraction
-	opqDirs, whiteouts, err := planWhiteouts(layerPath, mediaType)
+// Writes config, if any, to ConfigPath and records it in res
+func (c *LxcConfig) writeContainerConfig(config []byte, res *pextraoci.ExtractResult) error {
+	if config == nil {
+		return nil
+	}
+	if err := c.checkConfigPath(); err != nil {
+		return err
+	}
+	path, err := c.configPath()
 	if err != nil {
-		return fmt.Errorf("failed to list whiteouts for %s: %w", digest, err)
+		return err
 	}
-	if err := applyOpaqueDirs(c.OutputDir, opqDirs); err != nil {
-		return fmt.Errorf("failed to apply opaque dirs for %s: %w", digest, err)
+	if err := utils.WriteFileAtomic(path, config, 0644); err != nil {
+		return fmt.Errorf("failed to write container config: %w", err)
+	}
+	res.ConfigFile = path
+	return nil
+}
+
+// Applies the layers in order to the root filesystem in dir, keeping the metadata that
+// cannot be applied on disk in meta if it is not nil
+func (c *LxcConfig) applyLayers(ctx context.Context, layers []v1.Descriptor, dir string, meta rootfsMetadata) (*pextraoci.ExtractResult, error) {
+	res := &pextraoci.ExtractResult{ImageType: pextraoci.PextraImageTypeLxc, OutputDir: c.OutputDir}
+	// A "./" entry in a layer overrides this
+	if err := c.shiftedIDs().ownByRoot(dir); err != nil {
+		return nil, err
 	}
-	if err := applyWhiteouts(c.OutputDir, whiteouts); err != nil {
-		return fmt.Errorf("failed to apply whiteouts for %s: %w", digest, err)
+	progress := pextraoci.NewProgressTracker(c.Progress, pextraoci.ProgressPhaseExtract, layers)
+	for _, layer := range layers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		warnings, err := c.flattenLxcLayer(ctx, layer, dir, meta, progress)
+		if err != nil {
+			return nil, fmt.Errorf("failed to flatten LXC layer %s: %w", layer.Digest, err)
+		}
+		res.Layers = append(res.Layers, layer)
+		res.Warnings = append(res.Warnings, warnings...)
 	}
+	return res, nil
+}
 
-	args, err := buildTarArgs(layerPath, c.OutputDir, mediaType)
+// Verifies, decompresses and applies one layer blob to dir, returning warnings for skipped entries
+func (c *LxcConfig) flattenLxcLayer(ctx context.Context, layer v1.Descriptor, dir string, meta rootfsMetadata, progress *pextraoci.ProgressTracker) ([]string, error) {
+	blob, err := oci.OpenBlob(c.source(), layer)
 	if err != nil {
-		return fmt.Errorf("failed to build tar args for %s: %w", digest, err)
+		return nil, fmt.Errorf("failed to open layer blob: %w", err)
 	}
+	defer blob.Close()
+	vr := progress.Reader(utils.NewContextReader(ctx, blob), layer)
 
-	cmd := exec.Command("tar", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to extract layer %s: %w", digest, err)
+	dr, err := newDecompressor(vr, layer.MediaType)
+	if err != nil {
+		return nil, err
 	}
+	defer dr.Close()
 
-	return nil
+	applier := newLayerApplier(filepath.Clean(dir))
+	applier.ids = c.shiftedIDs()
+	applier.meta = meta
+	if err := applier.apply(dr); err != nil {
+		return nil, err
+	}
+
+	// The tar reader stops at the end-of-archive marker; consume any padding and the
+	// rest of the blob so that it is verified in full.
+	if _, err := io.Copy(io.Discard, dr); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, vr); err != nil {
+		return nil, err
+	}
+	return applier.warnings, nil
+}
+
+// The ID map to shift the IDs of extracted files by
+func (c *LxcConfig) shiftedIDs() IDMap {
+	if c.IDsMapped {
+		return IDMap{}
+	}
+	return c.IDMap
 }
@@ -0,0 +1,313 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Writes a tar layer into the blobs of img and returns its descriptor
+func writeLayerBlob(t *testing.T, img string, entries []tarEntry) v1.Descriptor {
+	t.Helper()
+	tmp := filepath.Join(t.TempDir(), "layer.tar")
+	writeUncompressedTar(t, tmp, entries)
+	b, err := os.ReadFile(tmp)
+	if err != nil {
+		t.Fatalf("read layer: %v", err)
+	}
+
+	desc := v1.Descriptor{
+		MediaType: pextraoci.MediaTypePextraImageLayerLxc,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	p := utils.BlobPath(img, desc.Digest.String())
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("mkdir blobs dir: %v", err)
+	}
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	return desc
+}
+
+func TestFlattenLxcLayers_Extracts(t *testing.T) {
+	img := t.TempDir()
+	out := t.TempDir()
+	desc := writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})
+
+	if err := New([]v1.Descriptor{desc}, img, out).FlattenLxcLayers(); err != nil {
+		t.Fatalf("FlattenLxcLayers error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "etc", "hostname"))
+	if err != nil || string(got) != "box\n" {
+		t.Fatalf("unexpected extracted content %q (err=%v)", got, err)
+	}
+}
+
+func TestFlattenLxcLayers_FromArchive(t *testing.T) {
+	img := t.TempDir()
+	out := t.TempDir()
+	desc := writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})
+
+	// Wrap the blob into an uncompressed OCI archive, which is read in place
+	b, err := os.ReadFile(utils.BlobPath(img, desc.Digest.String()))
+	if err != nil {
+		t.Fatalf("read blob: %v", err)
+	}
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	writeUncompressedTar(t, archive, []tarEntry{{Name: oci.BlobName(desc.Digest), Content: b}})
+	src, err := oci.OpenSource(archive)
+	if err != nil {
+		t.Fatalf("OpenSource error: %v", err)
+	}
+	defer src.Close()
+
+	if err := NewFromSource([]v1.Descriptor{desc}, src, out).FlattenLxcLayers(); err != nil {
+		t.Fatalf("FlattenLxcLayers error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(out, "etc", "hostname"))
+	if err != nil || string(got) != "box\n" {
+		t.Fatalf("unexpected extracted content %q (err=%v)", got, err)
+	}
+}
+
+func TestFlattenLxcLayers_DigestMismatch(t *testing.T) {
+	img := t.TempDir()
+	out := t.TempDir()
+	desc := writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})
+
+	// Tamper with the blob without changing its size
+	p := utils.BlobPath(img, desc.Digest.String())
+	b, _ := os.ReadFile(p)
+	copy(b[512:], "BOX\n")
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+
+	// Layers are verified while they stream, so the mismatch is only reported once
+	// the whole blob has been read
+	err := New([]v1.Descriptor{desc}, img, out).FlattenLxcLayers()
+	if !errors.Is(err, utils.ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got %v", err)
+	}
+}
+
+func TestFlatten_Progress(t *testing.T) {
+	img := t.TempDir()
+	layers := []v1.Descriptor{
+		writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}}),
+		writeLayerBlob(t, img, []tarEntry{{Name: "etc/motd", Content: []byte("hello\n")}}),
+	}
+
+	var last pextraoci.ProgressEvent
+	done := map[digest.Digest]int64{}
+	c := New(layers, img, t.TempDir())
+	c.Progress = func(e pextraoci.ProgressEvent) {
+		if e.Phase != pextraoci.ProgressPhaseExtract || e.Done < done[e.Layer] || e.OverallDone < last.OverallDone {
+			t.Errorf("unexpected event %+v after %+v", e, last)
+		}
+		done[e.Layer] = e.Done
+		last = e
+	}
+	if _, err := c.Flatten(context.Background()); err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+
+	for _, l := range layers {
+		if done[l.Digest] != l.Size {
+			t.Errorf("layer %s: %d of %d bytes reported", l.Digest, done[l.Digest], l.Size)
+		}
+	}
+	if total := layers[0].Size + layers[1].Size; last.OverallDone != total || last.OverallTotal != total {
+		t.Errorf("unexpected last event %+v", last)
+	}
+}
+
+func TestFlatten_CancelMidLayer(t *testing.T) {
+	img := t.TempDir()
+	desc := writeLayerBlob(t, img, []tarEntry{{Name: "etc/big", Content: make([]byte, 1<<20)}})
+
+	existing := t.TempDir()
+	for _, out := range []string{filepath.Join(t.TempDir(), "rootfs"), existing} {
+		ctx, cancel := context.WithCancel(context.Background())
+		c := New([]v1.Descriptor{desc}, img, out)
+		c.Progress = func(e pextraoci.ProgressEvent) {
+			if e.Done > 0 {
+				cancel()
+			}
+		}
+		if _, err := c.Flatten(ctx); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		cancel()
+
+		// Only directories created by Flatten are removed
+		_, err := os.Stat(out)
+		if out == existing && err != nil {
+			t.Fatalf("existing output directory removed: %v", err)
+		}
+		if out != existing && !os.IsNotExist(err) {
+			t.Fatalf("expected the output directory to be removed, stat err=%v", err)
+		}
+	}
+}
+
+func TestFlatten_FailureKeepsOutputDir(t *testing.T) {
+	img := t.TempDir()
+	good := writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})
+	bad := writeLayerBlob(t, img, []tarEntry{{Name: "etc/motd", Content: []byte("hello\n")}})
+	p := utils.BlobPath(img, bad.Digest.String())
+	b, _ := os.ReadFile(p)
+	copy(b[512:], "HELLO\n")
+	if err := os.WriteFile(p, b, 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+
+	for _, inPlace := range []bool{false, true} {
+		parent := t.TempDir()
+		out := filepath.Join(parent, "rootfs")
+		mkfile(t, filepath.Join(out, "etc", "previous"))
+
+		c := New([]v1.Descriptor{good, bad}, img, out)
+		c.InPlace = inPlace
+		c.Replace = true
+		if _, err := c.Flatten(context.Background()); !errors.Is(err, utils.ErrDigestMismatch) {
+			t.Fatalf("expected ErrDigestMismatch, got %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(out, "etc", "previous")); err != nil {
+			t.Fatalf("previous content removed (in place: %v): %v", inPlace, err)
+		}
+		_, err := os.Stat(filepath.Join(out, "etc", "hostname"))
+		if inPlace != (err == nil) {
+			t.Fatalf("in place: %v, stat of the first layer's file: %v", inPlace, err)
+		}
+		if entries, _ := os.ReadDir(parent); len(entries) != 1 {
+			t.Fatalf("expected no staging directory to remain, got %v", entries)
+		}
+	}
+}
+
+func TestFlatten_ReplacesOutputDir(t *testing.T) {
+	img := t.TempDir()
+	desc := writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})
+	out := t.TempDir()
+	mkfile(t, filepath.Join(out, "etc", "previous"))
+
+	c := New([]v1.Descriptor{desc}, img, out)
+	if _, err := c.Flatten(context.Background()); !errors.Is(err, utils.ErrOutputExists) {
+		t.Fatalf("expected ErrOutputExists without Replace, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "etc", "previous")); err != nil {
+		t.Fatalf("previous content removed without Replace: %v", err)
+	}
+
+	c.Replace = true
+	if _, err := c.Flatten(context.Background()); err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "etc", "hostname")); err != nil {
+		t.Fatalf("expected extracted file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "etc", "previous")); !os.IsNotExist(err) {
+		t.Fatalf("expected previous content to be replaced: %v", err)
+	}
+}
+
+func TestFlatten_WritesContainerConfig(t *testing.T) {
+	img := t.TempDir()
+	desc := writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})
+
+	for _, inPlace := range []bool{false, true} {
+		parent := t.TempDir()
+		out := filepath.Join(parent, "rootfs")
+		c := New([]v1.Descriptor{desc}, img, out)
+		c.InPlace = inPlace
+		c.ImageConfig = &v1.Image{Config: v1.ImageConfig{Cmd: []string{"/sbin/init"}}}
+		res, err := c.Flatten(context.Background())
+		if err != nil {
+			t.Fatalf("Flatten error: %v", err)
+		}
+
+		want := filepath.Join(parent, ContainerConfigName)
+		if res.ConfigFile != want {
+			t.Fatalf("ConfigFile = %q, want %q", res.ConfigFile, want)
+		}
+		b, err := os.ReadFile(want)
+		if err != nil {
+			t.Fatalf("expected container config: %v", err)
+		}
+		if !strings.Contains(string(b), "lxc.rootfs.path = dir:"+out+"\n") || !strings.Contains(string(b), "lxc.init.cmd = /sbin/init\n") {
+			t.Fatalf("unexpected container config:\n%s", b)
+		}
+	}
+}
+
+func TestFlatten_KeepsForeignContainerConfig(t *testing.T) {
+	img := t.TempDir()
+	desc := writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})
+	parent := t.TempDir()
+	out := filepath.Join(parent, "rootfs")
+	config := filepath.Join(parent, ContainerConfigName)
+	if err := os.WriteFile(config, []byte("unrelated\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New([]v1.Descriptor{desc}, img, out)
+	c.ImageConfig = &v1.Image{Config: v1.ImageConfig{Cmd: []string{"/sbin/init"}}}
+	if _, err := c.Flatten(context.Background()); !errors.Is(err, ErrConfigExists) {
+		t.Fatalf("expected ErrConfigExists, got %v", err)
+	}
+	if b, _ := os.ReadFile(config); string(b) != "unrelated\n" {
+		t.Fatalf("config was overwritten: %q", b)
+	}
+	if _, err := os.Lstat(out); err == nil {
+		t.Fatal("expected nothing to be extracted")
+	}
+
+	// A config pce-oci wrote is replaced
+	if err := os.WriteFile(config, []byte(configHeader+"lxc.init.cmd = /old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Flatten(context.Background()); err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	if b, _ := os.ReadFile(config); !strings.Contains(string(b), "lxc.init.cmd = /sbin/init\n") {
+		t.Fatalf("config was not replaced:\n%s", b)
+	}
+
+	// A config that cannot be written leaves the root filesystem untouched
+	c.OutputDir = filepath.Join(parent, "other")
+	c.ConfigPath = filepath.Join(parent, "missing", ContainerConfigName)
+	if _, err := c.Flatten(context.Background()); err == nil {
+		t.Fatal("expected an error for an unwritable config path")
+	}
+	if _, err := os.Lstat(c.OutputDir); err == nil {
+		t.Fatal("expected nothing to be extracted")
+	}
+}
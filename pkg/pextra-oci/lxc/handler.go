@@ -0,0 +1,85 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Layer media types of LXC images
+var layerMediaTypes = []string{
+	pextraoci.MediaTypePextraImageLayerLxc,
+	pextraoci.MediaTypePextraImageLayerLxcGzip,
+	pextraoci.MediaTypePextraImageLayerLxcZstd,
+}
+
+func init() {
+	pextraoci.Register(handler{})
+}
+
+// Implements the lxc image type for pextraoci
+type handler struct{}
+
+func (handler) Type() string { return pextraoci.PextraImageTypeLxc }
+
+func (handler) MediaTypes() []string { return slices.Clone(layerMediaTypes) }
+
+// Every layer must be an LXC layer, and cgroup2 annotations must be valid
+func (handler) Validate(manifest *v1.Manifest) []error {
+	var errs []error
+	for i, l := range manifest.Layers {
+		if !slices.Contains(layerMediaTypes, l.MediaType) {
+			errs = append(errs, fmt.Errorf("layers[%d]: unknown LXC layer mediaType %q", i, l.MediaType))
+		}
+	}
+	_, cgroupErrs := cgroup2Settings(manifest.Annotations)
+	return append(errs, cgroupErrs...)
+}
+
+func (handler) Extract(ctx context.Context, img *pextraoci.Image, outputDir string, opts pextraoci.ExtractOptions) (*pextraoci.ExtractResult, error) {
+	c := NewFromSource(img.Manifest.Layers, img.Layout.Source(), outputDir)
+	c.Progress = opts.Progress
+	c.InPlace = opts.InPlace
+	c.Replace = opts.Replace
+	c.ImageConfig = img.Config
+	if c.ImageConfig == nil {
+		c.ImageConfig = &v1.Image{}
+	}
+	c.Annotations = img.Manifest.Annotations
+	switch o := opts.TypeOptions[pextraoci.PextraImageTypeLxc].(type) {
+	case nil:
+	case ExtractOptions:
+		c.IDMap = o.IDMap
+		c.IDsMapped = o.IDsMapped
+		c.ConfigPath = o.ConfigPath
+		c.Format = o.Format
+		c.ImageSize = o.ImageSize
+		c.Compression = o.Compression
+		if o.NoConfig {
+			c.ImageConfig = nil
+		}
+	default:
+		return nil, fmt.Errorf("unexpected LXC options of type %T", o)
+	}
+	return c.Flatten(ctx)
+}
+
+func (handler) DescribeLayer(v1.Descriptor) map[string]any { return nil }
@@ -0,0 +1,53 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"strings"
+	"testing"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestHandler_Registered(t *testing.T) {
+	if h, ok := pextraoci.LookupHandler(pextraoci.PextraImageTypeLxc); !ok || h != (handler{}) {
+		t.Fatalf("expected the lxc handler to be registered, got %v", h)
+	}
+}
+
+func TestHandler_Validate(t *testing.T) {
+	m := &v1.Manifest{Layers: []v1.Descriptor{
+		{MediaType: pextraoci.MediaTypePextraImageLayerLxcZstd},
+		{MediaType: v1.MediaTypeImageLayerGzip},
+	}}
+	errs := handler{}.Validate(m)
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "layers[1]: ") {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	m = &v1.Manifest{
+		Annotations: map[string]string{
+			pextraoci.AnnotationPextraLxcCgroup2Prefix + "memory.max": "1G",
+			pextraoci.AnnotationPextraLxcCgroup2Prefix + "memory":     "1G",
+		},
+		Layers: []v1.Descriptor{{MediaType: pextraoci.MediaTypePextraImageLayerLxc}},
+	}
+	errs = handler{}.Validate(m)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), pextraoci.AnnotationPextraLxcCgroup2Prefix+"memory:") {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
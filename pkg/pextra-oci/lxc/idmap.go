@@ -0,0 +1,206 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Maps a range of IDs in a container to IDs on the host, like a line of
+// /proc/<pid>/uid_map
+type IDMapping struct {
+	ContainerID uint32
+	HostID      uint32
+	Size        uint32
+}
+
+// Maps the user and group IDs recorded in an image to the IDs files are owned by on
+// disk, e.g. to shift a root filesystem into the subordinate ID range of an
+// unprivileged container. An empty map leaves IDs unchanged.
+type IDMap struct {
+	UIDs []IDMapping
+	GIDs []IDMapping
+}
+
+// Parses ID mappings of the form [u:|g:]CONTAINER:HOST:SIZE, e.g. "0:100000:65536".
+// Mappings without a prefix apply to both user and group IDs.
+func ParseIDMap(specs []string) (IDMap, error) {
+	var m IDMap
+	for _, spec := range specs {
+		uids, gids := true, true
+		rest := spec
+		if p, r, ok := strings.Cut(spec, ":"); ok && (p == "u" || p == "g") {
+			uids, gids = p == "u", p == "g"
+			rest = r
+		}
+
+		fields := strings.Split(rest, ":")
+		if len(fields) != 3 {
+			return IDMap{}, fmt.Errorf("invalid ID mapping %q: want [u:|g:]CONTAINER:HOST:SIZE", spec)
+		}
+		var v [3]uint32
+		for i, f := range fields {
+			n, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return IDMap{}, fmt.Errorf("invalid ID mapping %q: %w", spec, err)
+			}
+			v[i] = uint32(n)
+		}
+		mapping := IDMapping{ContainerID: v[0], HostID: v[1], Size: v[2]}
+		if mapping.Size == 0 || uint64(mapping.ContainerID)+uint64(mapping.Size) > 1<<32 || uint64(mapping.HostID)+uint64(mapping.Size) > 1<<32 {
+			return IDMap{}, fmt.Errorf("invalid ID mapping %q: range out of bounds", spec)
+		}
+		if uids {
+			m.UIDs = append(m.UIDs, mapping)
+		}
+		if gids {
+			m.GIDs = append(m.GIDs, mapping)
+		}
+	}
+	for _, ranges := range [][]IDMapping{m.UIDs, m.GIDs} {
+		if err := checkOverlap(ranges); err != nil {
+			return IDMap{}, err
+		}
+	}
+	return m, nil
+}
+
+// Like the kernel, rejects mappings whose container or host ranges overlap
+func checkOverlap(ranges []IDMapping) error {
+	overlaps := func(start1, start2, size1, size2 uint32) bool {
+		return uint64(start1) < uint64(start2)+uint64(size2) && uint64(start2) < uint64(start1)+uint64(size1)
+	}
+	for i, a := range ranges {
+		for _, b := range ranges[:i] {
+			if overlaps(a.ContainerID, b.ContainerID, a.Size, b.Size) || overlaps(a.HostID, b.HostID, a.Size, b.Size) {
+				return fmt.Errorf("ID mappings %d:%d:%d and %d:%d:%d overlap", b.ContainerID, b.HostID, b.Size, a.ContainerID, a.HostID, a.Size)
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether the map leaves every ID unchanged
+func (m IDMap) IsIdentity() bool {
+	return len(m.UIDs) == 0 && len(m.GIDs) == 0
+}
+
+// Returns the host user ID for the container user ID id
+func (m IDMap) UID(id int) (int, error) {
+	return mapID(m.UIDs, id, "uid")
+}
+
+// Returns the host group ID for the container group ID id
+func (m IDMap) GID(id int) (int, error) {
+	return mapID(m.GIDs, id, "gid")
+}
+
+func mapID(ranges []IDMapping, id int, kind string) (int, error) {
+	if len(ranges) == 0 {
+		return id, nil
+	}
+	for _, r := range ranges {
+		if id >= int(r.ContainerID) && int64(id) < int64(r.ContainerID)+int64(r.Size) {
+			return int(r.HostID) + id - int(r.ContainerID), nil
+		}
+	}
+	return 0, fmt.Errorf("%s %d is not covered by the ID map", kind, id)
+}
+
+// Makes the container's root the owner of path, which was created for the container
+// without an owner of its own, e.g. the root filesystem directory. Does nothing for the
+// identity map or if it does not map root.
+func (m IDMap) ownByRoot(path string) error {
+	if m.IsIdentity() {
+		return nil
+	}
+	uid, uerr := m.UID(0)
+	gid, gerr := m.GID(0)
+	if uerr != nil || gerr != nil {
+		return nil
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+// Layout of the security.capability xattr (see linux/capability.h). Revision 3 adds
+// the ID of the user namespace root the capabilities apply to.
+const (
+	vfsCapRevisionMask = 0xff000000
+	vfsCapRevision2    = 0x02000000
+	vfsCapRevision3    = 0x03000000
+	vfsCapSize2        = 20
+	vfsCapSize3        = 24
+)
+
+// Shifts the IDs recorded in the value of xattr name: the qualifiers of named ACL
+// entries, and the namespace root of file capabilities. Capabilities without a root
+// (revision 2) are tied to the mapped container root, as the kernel does when they are
+// set from inside a user namespace.
+func (m IDMap) shiftXattr(name string, data []byte) ([]byte, error) {
+	if m.IsIdentity() {
+		return data, nil
+	}
+	switch name {
+	case xattrACLAccess, xattrACLDefault:
+		entries, err := decodeACL(data)
+		if err != nil {
+			return nil, err
+		}
+		for i, e := range entries {
+			var id int
+			switch e.tag {
+			case aclUser:
+				id, err = m.UID(int(e.id))
+			case aclGroup:
+				id, err = m.GID(int(e.id))
+			default:
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			entries[i].id = uint32(id)
+		}
+		return encodeACL(entries), nil
+	case xattrCapability:
+		if len(m.UIDs) == 0 || len(data) < 4 {
+			return data, nil
+		}
+		magic := binary.LittleEndian.Uint32(data)
+		var rootID uint32
+		switch {
+		case magic&vfsCapRevisionMask == vfsCapRevision2 && len(data) == vfsCapSize2:
+		case magic&vfsCapRevisionMask == vfsCapRevision3 && len(data) == vfsCapSize3:
+			rootID = binary.LittleEndian.Uint32(data[vfsCapSize2:])
+		default:
+			return data, nil
+		}
+		hostRoot, err := m.UID(int(rootID))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		out := make([]byte, vfsCapSize3)
+		copy(out, data[:vfsCapSize2])
+		binary.LittleEndian.PutUint32(out, magic&^vfsCapRevisionMask|vfsCapRevision3)
+		binary.LittleEndian.PutUint32(out[vfsCapSize2:], uint32(hostRoot))
+		return out, nil
+	}
+	return data, nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParseIDMap(t *testing.T) {
+	m, err := ParseIDMap([]string{"0:100000:65536", "u:65536:1000:1", "g:65536:2000:1"})
+	if err != nil {
+		t.Fatalf("ParseIDMap error: %v", err)
+	}
+	want := IDMap{
+		UIDs: []IDMapping{{0, 100000, 65536}, {65536, 1000, 1}},
+		GIDs: []IDMapping{{0, 100000, 65536}, {65536, 2000, 1}},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("got %+v, want %+v", m, want)
+	}
+
+	for _, bad := range [][]string{
+		{"0:100000"},
+		{"x:0:100000:65536"},
+		{"0:100000:0"},
+		{"0:-1:10"},
+		{"0:4294967295:2"},
+		{"0:100000:65536", "1000:200000:10"},
+		{"0:100000:65536", "u:70000:100010:10"},
+	} {
+		if _, err := ParseIDMap(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestIDMap_Lookup(t *testing.T) {
+	m := IDMap{UIDs: []IDMapping{{0, 100000, 65536}}}
+	if id, err := m.UID(1000); err != nil || id != 101000 {
+		t.Fatalf("UID(1000) = %d, %v", id, err)
+	}
+	if _, err := m.UID(65536); err == nil {
+		t.Fatalf("expected an error for an unmapped uid")
+	}
+	// Without group mappings, group IDs are left alone
+	if id, err := m.GID(1000); err != nil || id != 1000 {
+		t.Fatalf("GID(1000) = %d, %v", id, err)
+	}
+}
+
+func TestIDMap_ShiftXattr(t *testing.T) {
+	m := IDMap{UIDs: []IDMapping{{0, 100000, 65536}}, GIDs: []IDMapping{{0, 200000, 65536}}}
+
+	acl := encodeACL([]aclEntry{{aclUserObj, 6, aclUndefinedID}, {aclUser, 4, 1000}, {aclGroup, 4, 1001}, {aclOther, 0, aclUndefinedID}})
+	got, err := m.shiftXattr(xattrACLAccess, acl)
+	if err != nil {
+		t.Fatalf("shiftXattr error: %v", err)
+	}
+	want := encodeACL([]aclEntry{{aclUserObj, 6, aclUndefinedID}, {aclUser, 4, 101000}, {aclGroup, 4, 201001}, {aclOther, 0, aclUndefinedID}})
+	if !bytes.Equal(got, want) {
+		t.Fatalf("shifted ACL = %x, want %x", got, want)
+	}
+
+	// Revision 2 capabilities become revision 3 ones owned by the mapped root
+	caps := make([]byte, vfsCapSize2)
+	binary.LittleEndian.PutUint32(caps, vfsCapRevision2|1)
+	binary.LittleEndian.PutUint32(caps[4:], 0x2000) // CAP_NET_RAW
+	got, err = m.shiftXattr(xattrCapability, caps)
+	if err != nil {
+		t.Fatalf("shiftXattr error: %v", err)
+	}
+	if len(got) != vfsCapSize3 || binary.LittleEndian.Uint32(got) != vfsCapRevision3|1 ||
+		binary.LittleEndian.Uint32(got[4:]) != 0x2000 || binary.LittleEndian.Uint32(got[vfsCapSize2:]) != 100000 {
+		t.Fatalf("unexpected shifted capabilities %x", got)
+	}
+	// Revision 3 capabilities keep their root, shifted
+	binary.LittleEndian.PutUint32(got[vfsCapSize2:], 1000)
+	if again, err := m.shiftXattr(xattrCapability, got); err != nil || binary.LittleEndian.Uint32(again[vfsCapSize2:]) != 101000 {
+		t.Fatalf("unexpected shifted capabilities %x (err=%v)", again, err)
+	}
+
+	if got, _ := (IDMap{}).shiftXattr(xattrACLAccess, acl); !bytes.Equal(got, acl) {
+		t.Fatalf("expected the identity map to leave xattrs alone")
+	}
+	if _, err := m.shiftXattr(xattrACLAccess, encodeACL([]aclEntry{{aclUser, 4, 70000}})); err == nil {
+		t.Fatalf("expected an error for an unmapped ACL qualifier")
+	}
+}
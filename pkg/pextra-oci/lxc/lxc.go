@@ -16,13 +16,64 @@ limitations under the License.
 package lxc
 
 import (
+	"context"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type LxcConfig struct {
-	Layers    []v1.Descriptor
-	ImgPath   string
+	Layers  []v1.Descriptor
+	ImgPath string
+	// Where blobs are read from; a directory source for ImgPath if nil
+	Source oci.Source
+	// Where to write the root filesystem: a directory, or the image file for Format
 	OutputDir string
+	// Root filesystem format: FormatDir (the default) or a filesystem image format
+	Format string
+	// Size of an ext4 image in bytes; 0 sizes it to fit the root filesystem
+	ImageSize int64
+	// Compression of a squashfs or erofs image, e.g. "zstd"; the mkfs default if empty
+	Compression string
+	// Receives progress events while layers are applied; may be nil
+	Progress pextraoci.ProgressFunc
+	// Apply the layers onto OutputDir directly instead of replacing it once they are
+	// all applied. Saves space and a copy of the root filesystem, but a failed
+	// extraction leaves a partial root filesystem behind.
+	InPlace bool
+	// Replace an OutputDir that is not an empty directory, e.g. the root filesystem of
+	// an earlier extraction; without it, Flatten fails with utils.ErrOutputExists
+	Replace bool
+	// Shifts the owners of extracted files, and the IDs in their ACLs and file
+	// capabilities; needs root
+	IDMap IDMap
+	// IDMap is applied already, by the user namespace the process runs in, so it only
+	// goes into the container config
+	IDsMapped bool
+	// Image config and manifest annotations to generate the LXC container config from;
+	// no container config is written without an image config
+	ImageConfig *v1.Image
+	Annotations map[string]string
+	// Where to write the container config; defaults to ContainerConfigName next to
+	// OutputDir
+	ConfigPath string
+}
+
+// Options of LXC extraction, passed to pextraoci.Extract as
+// ExtractOptions.TypeOptions[pextraoci.PextraImageTypeLxc]
+type ExtractOptions struct {
+	IDMap     IDMap
+	IDsMapped bool
+	// Where to write the container config; defaults to ContainerConfigName next to the
+	// output directory
+	ConfigPath string
+	// Do not write a container config
+	NoConfig bool
+	// Root filesystem format and image options; see LxcConfig
+	Format      string
+	ImageSize   int64
+	Compression string
 }
 
 func New(layers []v1.Descriptor, imgPath, outputDir string) *LxcConfig {
@@ -32,3 +83,25 @@ func New(layers []v1.Descriptor, imgPath, outputDir string) *LxcConfig {
 		OutputDir: outputDir,
 	}
 }
+
+// Like New, but reads the blobs from src, e.g. an OCI archive
+func NewFromSource(layers []v1.Descriptor, src oci.Source, outputDir string) *LxcConfig {
+	return &LxcConfig{
+		Layers:    layers,
+		ImgPath:   src.String(),
+		Source:    src,
+		OutputDir: outputDir,
+	}
+}
+
+// Extracts the root filesystem of an LXC image into outputDir
+func Extract(ctx context.Context, img *pextraoci.Image, outputDir string) (*pextraoci.ExtractResult, error) {
+	return NewFromSource(img.Manifest.Layers, img.Layout.Source(), outputDir).Flatten(ctx)
+}
+
+func (c *LxcConfig) source() oci.Source {
+	if c.Source != nil {
+		return c.Source
+	}
+	return oci.NewDirSource(c.ImgPath)
+}
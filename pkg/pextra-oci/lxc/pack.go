@@ -0,0 +1,527 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+)
+
+// Root filesystem formats of LXC extraction
+const (
+	// A directory tree, the default
+	FormatDir = "dir"
+	// Filesystem images, written to a single file
+	FormatExt4     = "ext4"
+	FormatSquashfs = "squashfs"
+	FormatErofs    = "erofs"
+)
+
+// Compression algorithms of the image formats that are compressed; erofs also takes a
+// level, as in "lz4hc,12"
+var imageCompressions = map[string][]string{
+	FormatSquashfs: {"gzip", "lz4", "lzo", "xz", "zstd"},
+	FormatErofs:    {"deflate", "lz4", "lz4hc", "lzma", "zstd"},
+}
+
+// Tools that pack each image format, and where they come from
+var packTools = map[string][]string{
+	FormatExt4:     {"mke2fs", "debugfs"},
+	FormatSquashfs: {"sqfstar"},
+	FormatErofs:    {"mkfs.erofs"},
+}
+
+const packToolsHint = "e2fsprogs for ext4, squashfs-tools 4.6 or later for squashfs, erofs-utils 1.7 or later for erofs"
+
+// Reports whether the root filesystem is packed into an image
+func (c *LxcConfig) packed() bool {
+	return c.Format != "" && c.Format != FormatDir
+}
+
+// Checks the root filesystem format options of c
+func (c *LxcConfig) checkFormat() error {
+	switch c.Format {
+	case "", FormatDir:
+		if c.ImageSize != 0 || c.Compression != "" {
+			return errors.New("image size and compression only apply to filesystem images")
+		}
+		return nil
+	case FormatExt4, FormatSquashfs, FormatErofs:
+	default:
+		return fmt.Errorf("unsupported root filesystem format %q (want dir, ext4, squashfs or erofs)", c.Format)
+	}
+	if c.InPlace {
+		return fmt.Errorf("%s images cannot be written in place", c.Format)
+	}
+	if !c.IDMap.IsIdentity() {
+		return fmt.Errorf("mapping IDs is not supported for %s images", c.Format)
+	}
+	if c.ImageSize < 0 || c.ImageSize != 0 && c.Format != FormatExt4 {
+		return fmt.Errorf("%s images cannot be given a size; they are sized to fit", c.Format)
+	}
+	if c.Compression != "" {
+		algs, ok := imageCompressions[c.Format]
+		if !ok {
+			return fmt.Errorf("%s images are not compressed", c.Format)
+		}
+		alg, _, hasLevel := strings.Cut(c.Compression, ",")
+		if !slices.Contains(algs, alg) || hasLevel && c.Format != FormatErofs {
+			return fmt.Errorf("unsupported %s compression %q (want %s)", c.Format, c.Compression, strings.Join(algs, ", "))
+		}
+	}
+	return nil
+}
+
+// Metadata of an entry of a root filesystem that an unprivileged user cannot apply on
+// disk
+type entryMeta struct {
+	uid, gid int
+	// Permission bits, including setuid, setgid and sticky
+	mode   int64
+	xattrs map[string][]byte
+	// Device nodes are empty regular files on disk; these describe the node
+	typeflag           byte
+	devmajor, devminor int64
+}
+
+// Metadata of the entries of a root filesystem built without root, by path relative to
+// its root ("." for the root itself). Packing the root filesystem into an image applies
+// it, so that the image has the ownership, device nodes and xattrs of the layers.
+type rootfsMetadata map[string]*entryMeta
+
+// Records the metadata of hdr, with IDs mapped through ids, for the entry at rel
+func (m rootfsMetadata) record(rel string, hdr *tar.Header, ids IDMap) error {
+	uid, err := ids.UID(hdr.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := ids.GID(hdr.Gid)
+	if err != nil {
+		return err
+	}
+	e := &entryMeta{uid: uid, gid: gid, mode: hdr.Mode & 07777}
+	if hdr.Typeflag == tar.TypeChar || hdr.Typeflag == tar.TypeBlock {
+		e.typeflag, e.devmajor, e.devminor = hdr.Typeflag, hdr.Devmajor, hdr.Devminor
+	}
+	for key, value := range hdr.PAXRecords {
+		name, data, err := xattrFromPAX(key, value)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		if data, err = ids.shiftXattr(name, data); err != nil {
+			return err
+		}
+		if e.xattrs == nil {
+			e.xattrs = make(map[string][]byte)
+		}
+		e.xattrs[name] = data
+	}
+	m[rel] = e
+	return nil
+}
+
+// Gives the hardlink at to the metadata of the file at from
+func (m rootfsMetadata) link(from, to string) {
+	if e, ok := m[from]; ok {
+		m[to] = e
+	} else {
+		delete(m, to)
+	}
+}
+
+// Drops the metadata of rel and everything below it, except the paths keep reports
+func (m rootfsMetadata) remove(rel string, keep func(rel string) bool) {
+	for p := range m {
+		if (p == rel || rel == "." || strings.HasPrefix(p, rel+"/")) && !keep(p) {
+			delete(m, p)
+		}
+	}
+}
+
+// Calls fn for every entry of the root filesystem in dir, parents before their content,
+// with a tar header describing the entry as it goes into an image: named relative to
+// dir ("./" for dir itself), with numeric ownership and xattrs, and as a hardlink for
+// every path of a file but the first. With meta, ownership, permissions, xattrs and
+// device nodes come from it instead of the disk, and entries it has nothing for are
+// owned by root.
+func walkRootfs(dir string, meta rootfsMetadata, fn func(hdr *tar.Header, path string) error) error {
+	links := make(map[[2]uint64]string)
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		linkname := ""
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, linkname)
+		if err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		hdr.Name, hdr.Format = rel, tar.FormatPAX
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		// Names of the build host mean nothing in the image
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		if id, nlink := inode(fi); fi.Mode().IsRegular() && nlink > 1 {
+			if first, ok := links[id]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, first, 0
+			} else {
+				links[id] = rel
+			}
+		}
+
+		var xattrs map[string][]byte
+		if meta == nil {
+			if xattrs, err = lgetxattrs(p); err != nil {
+				return err
+			}
+		} else {
+			hdr.Uid, hdr.Gid = 0, 0
+			if e, ok := meta[rel]; ok {
+				hdr.Uid, hdr.Gid, xattrs = e.uid, e.gid, e.xattrs
+				hdr.Mode = e.mode
+				if e.typeflag != 0 && hdr.Typeflag == tar.TypeReg {
+					hdr.Typeflag, hdr.Size = e.typeflag, 0
+					hdr.Devmajor, hdr.Devminor = e.devmajor, e.devminor
+				}
+			}
+		}
+		for name, data := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[paxXattrPrefix+name] = string(data)
+		}
+		return fn(hdr, p)
+	})
+}
+
+// Writes the root filesystem in dir to w as a tar stream; see walkRootfs
+func writeRootfsTar(w io.Writer, dir string, meta rootfsMetadata) error {
+	tw := tar.NewWriter(w)
+	err := walkRootfs(dir, meta, func(hdr *tar.Header, p string) error {
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || hdr.Size == 0 {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Fails if a tool to pack format is missing, before any layers are applied
+func checkPackTools(format string) error {
+	for _, tool := range packTools[format] {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s images need %s, which was not found (%s)", format, tool, packToolsHint)
+		}
+	}
+	return nil
+}
+
+// Packs the root filesystem in dir into a new image file of format at image. Without
+// root, the files in dir are made readable to their owner first, and meta supplies the
+// metadata that is not on disk.
+func packRootfs(ctx context.Context, format, dir string, meta rootfsMetadata, image string, size int64, compression string) error {
+	if meta != nil {
+		if err := makeReadable(dir); err != nil {
+			return err
+		}
+	}
+
+	root, err := rootHeader(dir, meta)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case FormatExt4:
+		return packExt4(ctx, dir, meta, image, size)
+	case FormatSquashfs:
+		args := []string{
+			"-root-mode", strconv.FormatInt(root.Mode&07777, 8),
+			"-root-uid", strconv.Itoa(root.Uid),
+			"-root-gid", strconv.Itoa(root.Gid),
+		}
+		if compression != "" {
+			args = append(args, "-comp", compression)
+		}
+		return packTar(ctx, dir, meta, "sqfstar", append(args, image)...)
+	case FormatErofs:
+		args := []string{"--tar=f"}
+		if compression != "" {
+			args = append(args, "-z"+compression)
+		}
+		return packTar(ctx, dir, meta, "mkfs.erofs", append(args, image, "/dev/stdin")...)
+	}
+	return fmt.Errorf("unsupported root filesystem format %q", format)
+}
+
+// Returns the header walkRootfs describes the root directory of dir with
+func rootHeader(dir string, meta rootfsMetadata) (*tar.Header, error) {
+	var root *tar.Header
+	err := walkRootfs(dir, meta, func(hdr *tar.Header, _ string) error {
+		root = hdr
+		return filepath.SkipAll
+	})
+	return root, err
+}
+
+// Runs an mkfs tool that reads the root filesystem in dir as a tar stream on stdin
+func packTar(ctx context.Context, dir string, meta rootfsMetadata, name string, args ...string) error {
+	cmd := utils.CommandContext(ctx, name, args...)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	werr := writeRootfsTar(stdin, dir, meta)
+	stdin.Close()
+	// A tool that fails stops reading, so its error explains a failed write
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(out.String()))
+	}
+	if werr != nil {
+		return fmt.Errorf("writing root filesystem to %s: %w", name, werr)
+	}
+	return nil
+}
+
+// Builds an ext4 image from dir with mke2fs -d, which copies content, permissions,
+// xattrs and device nodes, and then sets what it does not copy with debugfs. Without a
+// size, the image is sized to fit, with room for metadata but little free space.
+func packExt4(ctx context.Context, dir string, meta rootfsMetadata, image string, size int64) error {
+	var entries, used int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		entries++
+		used += 4096
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			used += (fi.Size() + 4095) &^ 4095
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	inodes := entries + entries/4 + 64
+	if size == 0 {
+		// A fifth more for bitmaps, extent trees and the journal, plus the inode tables
+		// and room for the journal of a small image
+		size = (used + used/5 + inodes*256 + 16<<20 + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+
+	out, err := utils.CommandContext(ctx, "mke2fs", "-t", "ext4", "-q", "-F", "-m", "0",
+		"-N", strconv.FormatInt(inodes, 10), "-d", dir,
+		image, strconv.FormatInt(size/1024, 10)+"k").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mke2fs: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	work, err := os.MkdirTemp(filepath.Dir(image), ".debugfs-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(work)
+	var script bytes.Buffer
+	if err := writeDebugfsScript(&script, dir, meta, work); err != nil {
+		return err
+	}
+	scriptPath := filepath.Join(work, "script")
+	if err := os.WriteFile(scriptPath, script.Bytes(), 0600); err != nil {
+		return err
+	}
+	cmd := utils.CommandContext(ctx, "debugfs", "-w", "-f", scriptPath, image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("debugfs: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	// debugfs reports failed commands on stderr only, after its version banner
+	for line := range strings.Lines(stderr.String()) {
+		if !strings.HasPrefix(line, "debugfs ") {
+			return fmt.Errorf("debugfs: %s", strings.TrimSpace(stderr.String()))
+		}
+	}
+	return nil
+}
+
+// Writes the debugfs commands that give an ext4 image built from dir with mke2fs -d
+// the metadata mke2fs does not copy: the owner and permissions of the root directory
+// and, with meta, everything meta has over the disk. Xattr values are written to files
+// in valueDir.
+func writeDebugfsScript(w io.Writer, dir string, meta rootfsMetadata, valueDir string) error {
+	values := 0
+	return walkRootfs(dir, meta, func(hdr *tar.Header, _ string) error {
+		name := "/" + strings.TrimSuffix(hdr.Name, "/")
+		if name == "/." {
+			name = "/"
+		} else if meta == nil {
+			return filepath.SkipAll
+		}
+		if strings.ContainsAny(name, "\r\n") {
+			return fmt.Errorf("%q: names with line breaks cannot be written to ext4 images", hdr.Name)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			return nil // the file was set up at its first path
+		}
+
+		q := debugfsQuote(name)
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeChar, tar.TypeBlock:
+			// Replaces the empty file that stood in for the node
+			kind := 'c'
+			if hdr.Typeflag == tar.TypeBlock {
+				kind = 'b'
+			}
+			fmt.Fprintf(w, "rm %s\ncd %s\nmknod %s %c %d %d\ncd /\n",
+				q, debugfsQuote(path.Dir(name)), debugfsQuote(path.Base(name)), kind, hdr.Devmajor, hdr.Devminor)
+		}
+		fmt.Fprintf(w, "sif %s mode 0%o\n", q, unixMode(mode))
+		fmt.Fprintf(w, "sif %s uid %d\nsif %s gid %d\n", q, hdr.Uid, q, hdr.Gid)
+
+		for _, key := range slices.Sorted(maps.Keys(hdr.PAXRecords)) {
+			xattr, ok := strings.CutPrefix(key, paxXattrPrefix)
+			if !ok {
+				continue
+			}
+			values++
+			value := filepath.Join(valueDir, strconv.Itoa(values))
+			if err := os.WriteFile(value, []byte(hdr.PAXRecords[key]), 0600); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "ea_set -f %s %s %s\n", debugfsQuote(value), q, debugfsQuote(xattr))
+		}
+		return nil
+	})
+}
+
+// Quotes s as one argument of a debugfs command
+func debugfsQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// Converts mode to the st_mode bits of its file type and permissions
+func unixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+	switch {
+	case mode.IsDir():
+		m |= 040000
+	case mode&fs.ModeSymlink != 0:
+		m |= 0120000
+	case mode&fs.ModeCharDevice != 0:
+		m |= 020000
+	case mode&fs.ModeDevice != 0:
+		m |= 060000
+	case mode&fs.ModeNamedPipe != 0:
+		m |= 010000
+	case mode&fs.ModeSocket != 0:
+		m |= 0140000
+	default:
+		m |= 0100000
+	}
+	return m
+}
+
+// Gives the owner read access to every file and full access to every directory in
+// dir, so that an unprivileged user can pack and then remove them. The image gets the
+// recorded permissions instead.
+func makeReadable(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		want := fs.FileMode(0400)
+		switch {
+		case d.IsDir():
+			want = 0700
+		case !d.Type().IsRegular():
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().Perm()&want == want {
+			return nil
+		}
+		return os.Chmod(p, fi.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)|want)
+	})
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Applies layers of headers onto a new root filesystem the way an unprivileged user
+// does, keeping the metadata for packing, and returns the root and the metadata
+func applyRootless(t *testing.T, layers ...[]*tar.Header) (string, rootfsMetadata) {
+	t.Helper()
+	root := t.TempDir()
+	meta := make(rootfsMetadata)
+	for i, hdrs := range layers {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, h := range hdrs {
+			h.ModTime = time.Unix(1700000000, 0)
+			if err := tw.WriteHeader(h); err != nil {
+				t.Fatal(err)
+			}
+			if h.Typeflag == tar.TypeReg {
+				tw.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+			}
+		}
+		tw.Close()
+
+		a := newLayerApplier(root)
+		a.rootless = true
+		a.meta = meta
+		if err := a.apply(&buf); err != nil {
+			t.Fatalf("apply layer %d: %v", i, err)
+		}
+	}
+	return root, meta
+}
+
+// security.capability value (VFS_CAP_REVISION_2) granting cap_net_raw
+const capNetRaw = "\x01\x00\x00\x02\x00\x20\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+// Two layers with what an unprivileged user cannot extract, and a whiteout and an
+// opaque directory that remove entries of the first
+var rootlessLayers = [][]*tar.Header{
+	{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0750},
+		{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0, Gid: 42, Size: 3},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		{
+			Name: "usr/bin/ping", Typeflag: tar.TypeReg, Mode: 04755, Size: 1,
+			PAXRecords: map[string]string{"SCHILY.xattr.security.capability": capNetRaw},
+		},
+		{Name: "usr/bin/ping6", Typeflag: tar.TypeLink, Linkname: "usr/bin/ping"},
+		{Name: "home/bob/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000},
+		{Name: "tmp/gone", Typeflag: tar.TypeReg, Mode: 0644, Uid: 5},
+		{Name: "opt/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 3},
+		{Name: "opt/old", Typeflag: tar.TypeReg, Mode: 0644, Uid: 6},
+	},
+	{
+		{Name: "tmp/.wh.gone", Typeflag: tar.TypeReg},
+		{Name: "opt/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "opt/new", Typeflag: tar.TypeReg, Mode: 0644, Uid: 7},
+	},
+}
+
+func TestLayerApplier_KeepsMetadata(t *testing.T) {
+	root, meta := applyRootless(t, rootlessLayers...)
+
+	for _, p := range []string{"tmp/gone", "opt/old"} {
+		if _, ok := meta[p]; ok {
+			t.Errorf("metadata of removed %s kept", p)
+		}
+	}
+	if e := meta["opt/new"]; e == nil || e.uid != 7 {
+		t.Errorf("opt/new metadata = %+v, want uid 7", e)
+	}
+	// The opaque directory itself stays
+	if e := meta["opt"]; e == nil || e.uid != 3 {
+		t.Errorf("opt metadata = %+v, want uid 3", e)
+	}
+	if e := meta["."]; e == nil || e.mode != 0750 {
+		t.Errorf("root metadata = %+v, want mode 0750", e)
+	}
+	if e := meta["dev/null"]; e == nil || e.typeflag != tar.TypeChar || e.devmajor != 1 || e.devminor != 3 {
+		t.Errorf("dev/null metadata = %+v, want char device 1:3", e)
+	}
+	if meta["usr/bin/ping6"] != meta["usr/bin/ping"] || string(meta["usr/bin/ping"].xattrs["security.capability"]) != capNetRaw {
+		t.Errorf("usr/bin/ping metadata = %+v, ping6 = %+v", meta["usr/bin/ping"], meta["usr/bin/ping6"])
+	}
+	// The node is an empty file on disk until the image is packed
+	if fi, err := os.Lstat(filepath.Join(root, "dev", "null")); err != nil || !fi.Mode().IsRegular() || fi.Size() != 0 {
+		t.Fatalf("expected an empty placeholder for dev/null (err=%v)", err)
+	}
+}
+
+func TestWriteRootfsTar(t *testing.T) {
+	root, meta := applyRootless(t, rootlessLayers...)
+	if err := makeReadable(root); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := writeRootfsTar(&buf, root, meta); err != nil {
+		t.Fatalf("writeRootfsTar error: %v", err)
+	}
+	got := make(map[string]*tar.Header)
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = hdr
+		names = append(names, hdr.Name)
+	}
+
+	want := []string{"./", "dev/", "dev/null", "etc/", "etc/shadow", "home/", "home/bob/", "opt/", "opt/new", "tmp/", "usr/", "usr/bin/", "usr/bin/ping", "usr/bin/ping6"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("entries = %v, want %v", names, want)
+	}
+	if h := got["./"]; h.Mode != 0750 || h.Uid != 0 {
+		t.Errorf("root = mode %o uid %d, want 0750 and 0", h.Mode, h.Uid)
+	}
+	if h := got["dev/null"]; h.Typeflag != tar.TypeChar || h.Devmajor != 1 || h.Devminor != 3 || h.Mode != 0666 {
+		t.Errorf("dev/null = type %c %d:%d mode %o, want a 1:3 char device with mode 0666", h.Typeflag, h.Devmajor, h.Devminor, h.Mode)
+	}
+	if h := got["etc/shadow"]; h.Mode != 0 || h.Gid != 42 || h.Size != 3 {
+		t.Errorf("etc/shadow = mode %o gid %d size %d, want 0, 42 and 3", h.Mode, h.Gid, h.Size)
+	}
+	if h := got["home/bob/"]; h.Uid != 1000 || h.Gid != 1000 || h.Mode != 0700 {
+		t.Errorf("home/bob = %d:%d mode %o, want 1000:1000 and 0700", h.Uid, h.Gid, h.Mode)
+	}
+	if h := got["usr/"]; h.Uid != 0 || h.Gid != 0 {
+		t.Errorf("implicit usr = %d:%d, want 0:0", h.Uid, h.Gid)
+	}
+	if h := got["usr/bin/ping"]; h.Mode != 04755 || h.PAXRecords["SCHILY.xattr.security.capability"] != capNetRaw {
+		t.Errorf("usr/bin/ping = mode %o, records %q", h.Mode, h.PAXRecords)
+	}
+	if h := got["usr/bin/ping6"]; h.Typeflag != tar.TypeLink || h.Linkname != "usr/bin/ping" {
+		t.Errorf("usr/bin/ping6 = type %c to %q, want a hardlink to usr/bin/ping", h.Typeflag, h.Linkname)
+	}
+}
+
+func TestPackRootfs_Ext4(t *testing.T) {
+	for _, tool := range []string{"mke2fs", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not found")
+		}
+	}
+	root, meta := applyRootless(t, rootlessLayers...)
+	image := filepath.Join(t.TempDir(), "rootfs.ext4")
+	if err := packRootfs(context.Background(), FormatExt4, root, meta, image, 0, ""); err != nil {
+		t.Fatalf("packRootfs error: %v", err)
+	}
+
+	debugfs := func(request string) string {
+		out, err := exec.Command("debugfs", "-R", request, image).CombinedOutput()
+		if err != nil {
+			t.Fatalf("debugfs %s: %v: %s", request, err, out)
+		}
+		return string(out)
+	}
+	for request, want := range map[string][]string{
+		"stat /":                {"Mode:  0750", "User:     0   Group:     0"},
+		"stat /dev/null":        {"Type: character special", "Mode:  0666", "Device major/minor number: 01:03"},
+		"stat /etc/shadow":      {"Mode:  0000", "Group:    42", "Size: 3"},
+		"stat /home/bob":        {"Mode:  0700", "User:  1000   Group:  1000"},
+		"stat /usr/bin/ping":    {"Mode:  04755", "Links: 2"},
+		"ea_list /usr/bin/ping": {"security.capability (20)"},
+		"stat /opt/new":         {"User:     7"},
+	} {
+		out := debugfs(request)
+		for _, w := range want {
+			if !strings.Contains(out, w) {
+				t.Errorf("debugfs %s: missing %q in\n%s", request, w, out)
+			}
+		}
+	}
+}
+
+// Puts fake sqfstar and mkfs.erofs on PATH that write their arguments and the tar
+// stream on stdin to the image path, the argument before the last for mkfs.erofs
+func fakeTarMkfs(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir := t.TempDir()
+	for name, script := range map[string]string{
+		"sqfstar":    "#!/bin/sh\nfor out; do :; done\necho \"$@\" > \"$out.args\"\ncat > \"$out\"\n",
+		"mkfs.erofs": "#!/bin/sh\neval out=\\${$(($# - 1))}\necho \"$@\" > \"$out.args\"\ncat > \"$out\"\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatalf("write fake %s: %v", name, err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestPackRootfs_TarFormats(t *testing.T) {
+	fakeTarMkfs(t)
+	root, meta := applyRootless(t, rootlessLayers...)
+
+	for _, tc := range []struct {
+		format, compression, wantArgs string
+	}{
+		{FormatSquashfs, "zstd", "-root-mode 750 -root-uid 0 -root-gid 0 -comp zstd IMAGE"},
+		{FormatErofs, "lz4hc,12", "--tar=f -zlz4hc,12 IMAGE /dev/stdin"},
+	} {
+		image := filepath.Join(t.TempDir(), "rootfs."+tc.format)
+		if err := packRootfs(context.Background(), tc.format, root, meta, image, 0, tc.compression); err != nil {
+			t.Fatalf("%s: packRootfs error: %v", tc.format, err)
+		}
+		args, err := os.ReadFile(image + ".args")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.ReplaceAll(strings.TrimSpace(string(args)), image, "IMAGE"); got != tc.wantArgs {
+			t.Errorf("%s: args = %q, want %q", tc.format, got, tc.wantArgs)
+		}
+		f, err := os.Open(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := tar.NewReader(f).Next()
+		f.Close()
+		if err != nil || hdr.Name != "./" {
+			t.Errorf("%s: expected a tar stream starting with the root, got %v (err=%v)", tc.format, hdr, err)
+		}
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		c       LxcConfig
+		wantErr string
+	}{
+		{name: "default"},
+		{name: "dir", c: LxcConfig{Format: FormatDir}},
+		{name: "ext4 with size", c: LxcConfig{Format: FormatExt4, ImageSize: 1 << 30}},
+		{name: "squashfs", c: LxcConfig{Format: FormatSquashfs, Compression: "xz"}},
+		{name: "erofs with level", c: LxcConfig{Format: FormatErofs, Compression: "lz4hc,12"}},
+		{name: "unknown", c: LxcConfig{Format: "btrfs"}, wantErr: "unsupported root filesystem format"},
+		{name: "dir with size", c: LxcConfig{ImageSize: 1}, wantErr: "only apply to filesystem images"},
+		{name: "in place", c: LxcConfig{Format: FormatExt4, InPlace: true}, wantErr: "in place"},
+		{name: "ID map", c: LxcConfig{Format: FormatExt4, IDMap: IDMap{UIDs: []IDMapping{{0, 100000, 65536}}}}, wantErr: "mapping IDs"},
+		{name: "squashfs size", c: LxcConfig{Format: FormatSquashfs, ImageSize: 1}, wantErr: "sized to fit"},
+		{name: "ext4 compression", c: LxcConfig{Format: FormatExt4, Compression: "zstd"}, wantErr: "not compressed"},
+		{name: "squashfs level", c: LxcConfig{Format: FormatSquashfs, Compression: "zstd,3"}, wantErr: "unsupported squashfs compression"},
+		{name: "unknown compression", c: LxcConfig{Format: FormatErofs, Compression: "brotli"}, wantErr: "unsupported erofs compression"},
+	} {
+		err := tc.c.checkFormat()
+		if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+			t.Errorf("%s: checkFormat() = %v, want %q", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestFlatten_Ext4Image(t *testing.T) {
+	for _, tool := range []string{"mke2fs", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skip(tool + " not found")
+		}
+	}
+	img := t.TempDir()
+	desc := writeLayerBlob(t, img, []tarEntry{{Name: "etc/hostname", Content: []byte("box\n")}})
+
+	parent := t.TempDir()
+	out := filepath.Join(parent, "rootfs.ext4")
+	c := New([]v1.Descriptor{desc}, img, out)
+	c.Format = FormatExt4
+	c.ImageConfig = &v1.Image{}
+	res, err := c.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	if fi, err := os.Stat(out); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("expected an image file at %s (err=%v)", out, err)
+	}
+	if b, err := exec.Command("debugfs", "-R", "cat /etc/hostname", out).Output(); err != nil || string(b) != "box\n" {
+		t.Fatalf("etc/hostname in image = %q (err=%v)", b, err)
+	}
+	b, err := os.ReadFile(res.ConfigFile)
+	if err != nil || !strings.Contains(string(b), "lxc.rootfs.path = loop:"+out+"\n") {
+		t.Fatalf("unexpected container config (err=%v):\n%s", err, b)
+	}
+	// Only the image and the config are left behind
+	if ents, _ := os.ReadDir(parent); len(ents) != 2 {
+		t.Fatalf("unexpected files next to the image: %v", ents)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !unix
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"archive/tar"
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+const oNoFollow = 0
+
+func mknod(target string, hdr *tar.Header) error {
+	return &os.PathError{Op: "mknod", Path: target, Err: errors.ErrUnsupported}
+}
+
+// Sets the permissions of target, unless it is a symlink
+func lchmod(target string, mode os.FileMode) error {
+	fi, err := os.Lstat(target)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	return os.Chmod(target, mode)
+}
+
+// Sets access and modification times, unless target is a symlink
+func lutimes(target string, atime, mtime time.Time) error {
+	fi, err := os.Lstat(target)
+	if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+		return err
+	}
+	if atime.IsZero() {
+		atime = mtime
+	}
+	return os.Chtimes(target, atime, mtime)
+}
+
+// Without inode numbers, hardlinks are not detected
+func inode(fi fs.FileInfo) (id [2]uint64, nlink uint64) {
+	return id, 1
+}
@@ -16,216 +16,147 @@ limitations under the License.
 package lxc
 
 import (
-	"bufio"
 	"fmt"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
-
-	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"syscall"
 )
 
 const (
 	OpaqueDirMarker = ".wh..wh..opq"
 	WhiteoutPrefix  = ".wh."
+
+	// Upper bound on symlinks followed while resolving a single path
+	maxSymlinkHops = 255
 )
 
-// Scans a tar archive for whiteout entries and opaque directory markers.
-func planWhiteouts(layerPath, mediaType string) (map[string]struct{}, []string, error) {
-	args := []string{"-t"}
-	switch mediaType {
-	case pextraoci.MediaTypePextraImageLayerLxc:
-		// no-op
-	case pextraoci.MediaTypePextraImageLayerLxcGzip:
-		args = append(args, "--gzip")
-	case pextraoci.MediaTypePextraImageLayerLxcZstd:
-		args = append(args, "--zstd")
-	default:
-		return nil, nil, fmt.Errorf("unsupported LXC layer media type: %s", mediaType)
+// Cleans an archive entry name into a relative, slash-separated path. Entries that are
+// absolute or contain '..' components are unsafe and reported as not ok.
+func sanitizeEntryName(name string) (string, bool) {
+	p := strings.TrimPrefix(name, "./")
+	if p == "" || p == "." || p == "./" {
+		return ".", true
 	}
-	args = append(args, "-f", layerPath)
-
-	cmd := exec.Command("tar", args...)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, nil, err
+	if strings.HasPrefix(p, "/") {
+		return "", false
 	}
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		return nil, nil, err
+	if slices.Contains(strings.Split(p, "/"), "..") {
+		return "", false
 	}
+	return path.Clean(p), true
+}
 
-	opqDirs := make(map[string]struct{})
-	var whiteouts []string
-
-	sc := bufio.NewScanner(stdout)
-	for sc.Scan() {
-		p := strings.TrimSpace(sc.Text())
-		if p == "" {
+// Resolves the relative path rel to a host path under root, following symlinks as if root
+// were the filesystem root, so that no symlink in the archive can point outside of it.
+// Missing directories are created with mkdir when it is set; otherwise an fs.ErrNotExist
+// error is returned for them.
+func secureJoin(root, rel string, mkdir func(path string) error) (string, error) {
+	cur := root
+	parts := strings.Split(rel, "/")
+	hops := 0
+
+	for len(parts) > 0 {
+		p := parts[0]
+		parts = parts[1:]
+
+		switch p {
+		case "", ".":
 			continue
-		}
-		p = strings.TrimPrefix(p, "./")
-		p = filepath.Clean(p)
-
-		base := filepath.Base(p)
-		if base == OpaqueDirMarker {
-			dir := filepath.Dir(p)
-			if dir == "." {
-				dir = ""
+		case "..":
+			if cur != root {
+				cur = filepath.Dir(cur)
 			}
-			opqDirs[dir] = struct{}{}
 			continue
 		}
-		if after, ok := strings.CutPrefix(base, WhiteoutPrefix); ok {
-			target := filepath.Join(filepath.Dir(p), after)
-			whiteouts = append(whiteouts, target)
-		}
-	}
-	if err := sc.Err(); err != nil {
-		_ = cmd.Wait()
-		return nil, nil, err
-	}
-	if err := cmd.Wait(); err != nil {
-		return nil, nil, err
-	}
-	return opqDirs, whiteouts, nil
-}
 
-// Returns archive entries that should be excluded for safety (absolute paths or with '..' components)
-func planSanitizedExcludes(layerPath, mediaType string) ([]string, error) {
-	args := []string{"-t"}
-	switch mediaType {
-	case pextraoci.MediaTypePextraImageLayerLxc:
-		// no-op
-	case pextraoci.MediaTypePextraImageLayerLxcGzip:
-		args = append(args, "--gzip")
-	case pextraoci.MediaTypePextraImageLayerLxcZstd:
-		args = append(args, "--zstd")
-	default:
-		return nil, fmt.Errorf("unsupported LXC layer media type: %s", mediaType)
-	}
-	args = append(args, "-f", layerPath)
-
-	cmd := exec.Command("tar", args...)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, err
-	}
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		return nil, err
-	}
-
-	var excludes []string
-	sc := bufio.NewScanner(stdout)
-	for sc.Scan() {
-		raw := strings.TrimSpace(sc.Text())
-		if raw == "" {
+		next := filepath.Join(cur, p)
+		fi, err := os.Lstat(next)
+		if os.IsNotExist(err) && mkdir != nil {
+			if err := mkdir(next); err != nil {
+				return "", err
+			}
+			cur = next
 			continue
 		}
-		p := strings.TrimPrefix(raw, "./")
+		if err != nil {
+			return "", err
+		}
 
-		// Absolute paths are unsafe
-		if strings.HasPrefix(p, "/") {
-			excludes = append(excludes, raw)
+		if fi.Mode()&os.ModeSymlink != 0 {
+			hops++
+			if hops > maxSymlinkHops {
+				return "", &os.PathError{Op: "resolve", Path: rel, Err: syscall.ELOOP}
+			}
+			target, err := os.Readlink(next)
+			if err != nil {
+				return "", err
+			}
+			if strings.HasPrefix(target, "/") {
+				cur = root
+			}
+			parts = append(strings.Split(target, "/"), parts...)
 			continue
 		}
-		// '..' component is unsafe
-		parts := strings.Split(p, "/")
-		unsafe := slices.Contains(parts, "..")
-		if unsafe {
-			excludes = append(excludes, raw)
+		if !fi.IsDir() {
+			return "", &os.PathError{Op: "resolve", Path: rel, Err: syscall.ENOTDIR}
 		}
+		cur = next
 	}
-	if err := sc.Err(); err != nil {
-		_ = cmd.Wait()
-		return nil, err
+	return cur, nil
+}
+
+// Removes the path named by a whiteout entry. Missing paths are ignored.
+func applyWhiteout(root, rel string) error {
+	dir, err := secureJoin(root, path.Dir(rel), nil)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	if err := cmd.Wait(); err != nil {
-		return nil, err
+	if err != nil {
+		return err
 	}
 
-	return excludes, nil
+	target := filepath.Join(dir, path.Base(rel))
+	if err := os.RemoveAll(target); err != nil {
+		return fmt.Errorf("removing %s: %w", target, err)
+	}
+	return nil
 }
 
-// Removes specific files/dirs listed by whiteout entries
-func applyWhiteouts(root string, paths []string) error {
-	for _, rel := range paths {
-		target := filepath.Join(root, rel)
-		if err := os.RemoveAll(target); err != nil && !os.IsNotExist(err) {
-			return fmt.Errorf("removing %s: %w", target, err)
-		}
+// Removes everything under the opaque directory rel that was not created by the current
+// layer, i.e. all content from lower layers.
+func applyOpaqueDir(root, rel string, created map[string]struct{}) error {
+	dir, err := secureJoin(root, rel, nil)
+	if os.IsNotExist(err) {
+		return nil
 	}
-	return nil
+	if err != nil {
+		return err
+	}
+	return pruneDir(dir, created)
 }
 
-// Removes all existing entries under each opaque directory.
-func applyOpaqueDirs(root string, opq map[string]struct{}) error {
-	for rel := range opq {
-		dir := filepath.Join(root, rel)
-		ents, err := os.ReadDir(dir)
-		if err != nil {
-			if os.IsNotExist(err) {
-				continue
+func pruneDir(dir string, keep map[string]struct{}) error {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("reading dir %s: %w", dir, err)
+	}
+	for _, e := range ents {
+		p := filepath.Join(dir, e.Name())
+		if _, ok := keep[p]; !ok {
+			if err := os.RemoveAll(p); err != nil {
+				return fmt.Errorf("removing %s: %w", p, err)
 			}
-			return fmt.Errorf("reading dir %s: %w", dir, err)
+			continue
 		}
-		for _, e := range ents {
-			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
-				return fmt.Errorf("removing %s: %w", filepath.Join(dir, e.Name()), err)
+		// Directories from this layer may still hold lower-layer entries
+		if e.IsDir() {
+			if err := pruneDir(p, keep); err != nil {
+				return err
 			}
 		}
 	}
 	return nil
 }
-
-func buildTarArgs(layerPath, outputDir, mediaType string) ([]string, error) {
-	unsafe, err := planSanitizedExcludes(layerPath, mediaType)
-	if err != nil {
-		return nil, fmt.Errorf("failed to analyze paths for %s: %w", layerPath, err)
-	}
-
-	args := []string{"-C", outputDir, "-x"}
-	switch mediaType {
-	case pextraoci.MediaTypePextraImageLayerLxc:
-		// no-op
-	case pextraoci.MediaTypePextraImageLayerLxcGzip:
-		args = append(args, "--gzip")
-	case pextraoci.MediaTypePextraImageLayerLxcZstd:
-		args = append(args, "--zstd")
-	default:
-		return nil, fmt.Errorf("unsupported LXC layer media type: %s", mediaType)
-	}
-
-	args = append(args,
-		"--numeric-owner",
-		"--same-permissions",
-		"--delay-directory-restore",
-		"--keep-directory-symlink",
-		"--overwrite",
-		"--xattrs", "--xattrs-include=*",
-		"--acls",
-		"--selinux",
-	)
-
-	// Avoid changing ownership if not running as root
-	if os.Geteuid() != 0 {
-		args = append(args, "--no-same-owner")
-	}
-
-	// Exclude whiteout markers and unsafe entries from extraction
-	args = append(args,
-		fmt.Sprintf("--exclude=%s*", WhiteoutPrefix),
-		fmt.Sprintf("--exclude=*/%s*", WhiteoutPrefix),
-		fmt.Sprintf("--exclude=%s", OpaqueDirMarker),
-		fmt.Sprintf("--exclude=*/%s", OpaqueDirMarker),
-	)
-	for _, p := range unsafe {
-		args = append(args, "--exclude="+p)
-	}
-	args = append(args, "-f", layerPath)
-
-	return args, nil
-}
@@ -17,12 +17,12 @@ package lxc
 
 import (
 	"archive/tar"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"reflect"
-	"slices"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -36,6 +36,24 @@ func requireTar(t testing.TB) {
 	}
 }
 
+// Opens the layout at p, checks that it is valid and selects an image from it
+func selectImage(t *testing.T, p string, opts pextraoci.SelectOptions) *pextraoci.Image {
+	t.Helper()
+	layout, err := pextraoci.Open(p)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	t.Cleanup(func() { layout.Close() })
+	if res, err := layout.Validate(); err != nil || len(res.Problems) != 0 {
+		t.Fatalf("expected valid layout, got %+v (err=%v)", res, err)
+	}
+	img, err := layout.Select(opts)
+	if err != nil {
+		t.Fatalf("Select error: %v", err)
+	}
+	return img
+}
+
 type tarEntry struct {
 	Name    string
 	Mode    int64
@@ -90,90 +108,84 @@ func writeUncompressedTar(t *testing.T, path string, entries []tarEntry) {
 	}
 }
 
-func TestPlanWhiteouts_Uncompressed(t *testing.T) {
-	requireTar(t)
-
-	tmp := t.TempDir()
-	tarPath := filepath.Join(tmp, "lxc.tar")
-
-	entries := []tarEntry{
-		{Name: "regular.txt"},
-		{Name: "dira/", Type: tar.TypeDir},
-		{Name: filepath.Join("dira", OpaqueDirMarker)},
-		{Name: filepath.Join("dirb", ".wh.fileA")},
-		{Name: filepath.Join("dirb", "sub", ".wh.fileB")},
+func TestSanitizeEntryName(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"./", ".", true},
+		{".", ".", true},
+		{"./etc/hostname", "etc/hostname", true},
+		{"usr/lib/", "usr/lib", true},
+		{"a//b", "a/b", true},
+		{"/abs/file", "", false},
+		{"../../etc/passwd", "", false},
+		{"dir/../evil", "", false},
+	}
+	for _, tc := range cases {
+		got, ok := sanitizeEntryName(tc.name)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("sanitizeEntryName(%q) = %q, %v; want %q, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
 	}
-	writeUncompressedTar(t, tarPath, entries)
+}
 
-	opq, wh, err := planWhiteouts(tarPath, pextraoci.MediaTypePextraImageLayerLxc)
-	if err != nil {
-		t.Fatalf("planWhiteouts error: %v", err)
+func TestSecureJoin_SymlinksStayInRoot(t *testing.T) {
+	root := t.TempDir()
+	mkdirAll(t, filepath.Join(root, "usr", "lib"))
+	if err := os.Symlink("usr/lib", filepath.Join(root, "lib")); err != nil {
+		t.Fatal(err)
 	}
-
-	if _, ok := opq["dira"]; !ok {
-		t.Fatalf("expected opaque dir 'dira' to be present: %v", opq)
+	if err := os.Symlink("/etc", filepath.Join(root, "abs")); err != nil {
+		t.Fatal(err)
 	}
-	wantWh := []string{
-		filepath.Join("dirb", "fileA"),
-		filepath.Join("dirb", "sub", "fileB"),
+	if err := os.Symlink("../../../../..", filepath.Join(root, "up")); err != nil {
+		t.Fatal(err)
 	}
-	// order-insensitive compare
-	gotWh := append([]string(nil), wh...)
-	if !sameStringSet(gotWh, wantWh) {
-		t.Fatalf("whiteouts mismatch\ngot:  %v\nwant: %v", gotWh, wantWh)
+	if err := os.Symlink("loop", filepath.Join(root, "loop")); err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestPlanSanitizedExcludes_Uncompressed(t *testing.T) {
-	requireTar(t)
-
-	tmp := t.TempDir()
-	tarPath := filepath.Join(tmp, "bad.tar")
 
-	entries := []tarEntry{
-		{Name: "/abs/file"},
-		{Name: "../../etc/passwd"},
-		{Name: "dir/../evil"},
-		{Name: "safe/file"},
+	mkdir := func(dir string) error { return os.Mkdir(dir, 0755) }
+	cases := map[string]string{
+		"lib":     filepath.Join(root, "usr", "lib"),
+		"abs":     filepath.Join(root, "etc"),
+		"up":      root,
+		"up/tmp":  filepath.Join(root, "tmp"),
+		"lib/../": filepath.Join(root, "usr"),
 	}
-	writeUncompressedTar(t, tarPath, entries)
-
-	ex, err := planSanitizedExcludes(tarPath, pextraoci.MediaTypePextraImageLayerLxc)
-	if err != nil {
-		t.Fatalf("planSanitizedExcludes error: %v", err)
+	for rel, want := range cases {
+		got, err := secureJoin(root, rel, mkdir)
+		if err != nil {
+			t.Fatalf("secureJoin(%q): %v", rel, err)
+		}
+		if got != want {
+			t.Errorf("secureJoin(%q) = %q, want %q", rel, got, want)
+		}
 	}
 
-	// raw lines are expected
-	expect := map[string]bool{
-		"/abs/file":        true,
-		"../../etc/passwd": true,
-		"dir/../evil":      true,
-		"safe/file":        false,
+	if _, err := secureJoin(root, "loop/x", nil); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("expected ELOOP for a symlink loop, got %v", err)
 	}
-	for k, want := range expect {
-		found := slices.Contains(ex, k)
-		if want && !found {
-			t.Errorf("expected exclude to include %q; got %v", k, ex)
-		}
-		if !want && found {
-			t.Errorf("did not expect exclude to include %q; got %v", k, ex)
-		}
+	mkfile(t, filepath.Join(root, "file"))
+	if _, err := secureJoin(root, "file/x", mkdir); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("expected ENOTDIR below a file, got %v", err)
+	}
+	if _, err := secureJoin(root, "missing/x", nil); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist without mkdir, got %v", err)
 	}
 }
 
-func TestApplyWhiteouts(t *testing.T) {
+func TestApplyWhiteout(t *testing.T) {
 	root := t.TempDir()
-	// create paths
 	mkfile(t, filepath.Join(root, "a", "b.txt"))
 	mkfile(t, filepath.Join(root, "c", "d", "e"))
 
-	paths := []string{
-		filepath.Join("a", "b.txt"),
-		"c",
-	}
-
-	if err := applyWhiteouts(root, paths); err != nil {
-		t.Fatalf("applyWhiteouts error: %v", err)
+	for _, rel := range []string{"a/b.txt", "c", "missing/x"} {
+		if err := applyWhiteout(root, rel); err != nil {
+			t.Fatalf("applyWhiteout(%q): %v", rel, err)
+		}
 	}
 
 	if _, err := os.Stat(filepath.Join(root, "a", "b.txt")); !os.IsNotExist(err) {
@@ -184,85 +196,37 @@ func TestApplyWhiteouts(t *testing.T) {
 	}
 }
 
-func TestApplyOpaqueDirs(t *testing.T) {
+func TestApplyOpaqueDir(t *testing.T) {
 	root := t.TempDir()
-	mkdirAll(t, filepath.Join(root, "x"))
 	mkfile(t, filepath.Join(root, "x", "foo"))
 	mkfile(t, filepath.Join(root, "x", "bar"))
-
-	// y does not exist, should be skipped
-	opq := map[string]struct{}{
-		"x":     {},
-		"y/sub": {},
-	}
-
-	if err := applyOpaqueDirs(root, opq); err != nil {
-		t.Fatalf("applyOpaqueDirs error: %v", err)
-	}
-
-	ents, err := os.ReadDir(filepath.Join(root, "x"))
-	if err != nil {
-		t.Fatalf("readdir x: %v", err)
-	}
-	if len(ents) != 0 {
-		t.Fatalf("expected x to be empty after opq, got %d entries", len(ents))
-	}
-}
-
-func TestBuildTarArgs_Uncompressed(t *testing.T) {
-	requireTar(t)
-
-	tmp := t.TempDir()
-	outDir := filepath.Join(tmp, "out")
-	if err := os.MkdirAll(outDir, 0o755); err != nil {
-		t.Fatalf("mkdir out: %v", err)
-	}
-	layer := filepath.Join(tmp, "layer.tar")
-	writeUncompressedTar(t, layer, []tarEntry{
-		{Name: "/abs/file"},
-		{Name: "dir/../evil"},
-		{Name: "ok"},
-	})
-
-	args, err := buildTarArgs(layer, outDir, pextraoci.MediaTypePextraImageLayerLxc)
-	if err != nil {
-		t.Fatalf("buildTarArgs error: %v", err)
-	}
-
-	assertHas := func(flag string) {
-		if !slices.Contains(args, flag) {
-			t.Fatalf("expected args to include %q; got %v", flag, args)
+	mkfile(t, filepath.Join(root, "x", "sub", "old"))
+	mkfile(t, filepath.Join(root, "x", "sub", "new"))
+
+	created := map[string]struct{}{
+		filepath.Join(root, "x", "bar"):        {},
+		filepath.Join(root, "x", "sub"):        {},
+		filepath.Join(root, "x", "sub", "new"): {},
+	}
+	if err := applyOpaqueDir(root, "x", created); err != nil {
+		t.Fatalf("applyOpaqueDir error: %v", err)
+	}
+	// Missing directories are skipped
+	if err := applyOpaqueDir(root, "y/sub", created); err != nil {
+		t.Fatalf("applyOpaqueDir(missing) error: %v", err)
+	}
+
+	for p, want := range map[string]bool{
+		"x/foo":     false,
+		"x/bar":     true,
+		"x/sub/old": false,
+		"x/sub/new": true,
+	} {
+		_, err := os.Lstat(filepath.Join(root, p))
+		if got := err == nil; got != want {
+			t.Errorf("%s exists = %v, want %v", p, got, want)
 		}
 	}
-	assertHas("-C")
-	assertHas(outDir)
-	assertHas("-x")
-	assertHas("--numeric-owner")
-	assertHas("--same-permissions")
-	assertHas("--delay-directory-restore")
-	assertHas("--keep-directory-symlink")
-	assertHas("--overwrite")
-	assertHas("--xattrs")
-	assertHas("--xattrs-include=*")
-	assertHas("--acls")
-	assertHas("--selinux")
-	assertHas("--exclude=" + WhiteoutPrefix + "*")
-	assertHas("--exclude=*/" + WhiteoutPrefix + "*")
-	assertHas("--exclude=" + OpaqueDirMarker)
-	assertHas("--exclude=*/" + OpaqueDirMarker)
-	assertHas("--exclude=/abs/file")
-	assertHas("--exclude=dir/../evil")
-
-	if os.Geteuid() != 0 {
-		assertHas("--no-same-owner")
-	} else if slices.Contains(args, "--no-same-owner") {
-		t.Fatalf("did not expect --no-same-owner when running as root")
-	}
-
-	// last pair should be "-f", layer
-	if len(args) < 2 || args[len(args)-2] != "-f" || args[len(args)-1] != layer {
-		t.Fatalf("expected final args to be ['-f', %q], got %v", layer, args[len(args)-2:])
-	}
 }
 
 // helpers
@@ -283,18 +247,3 @@ func mkdirAll(t *testing.T, p string) {
 		t.Fatalf("mkdirall: %v", err)
 	}
 }
-
-func sameStringSet(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	ma := map[string]int{}
-	mb := map[string]int{}
-	for _, x := range a {
-		ma[x]++
-	}
-	for _, x := range b {
-		mb[x]++
-	}
-	return reflect.DeepEqual(ma, mb)
-}
@@ -0,0 +1,32 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"errors"
+	"os"
+)
+
+func lsetxattr(target, name string, data []byte) error {
+	return &os.PathError{Op: "lsetxattr", Path: target, Err: errors.ErrUnsupported}
+}
+
+// Without xattr support, files read as having none
+func lgetxattrs(target string) (map[string][]byte, error) {
+	return nil, nil
+}
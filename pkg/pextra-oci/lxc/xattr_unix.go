@@ -0,0 +1,65 @@
+//go:build linux || darwin || freebsd || netbsd
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lxc
+
+import (
+	"bytes"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func lsetxattr(target, name string, data []byte) error {
+	if err := unix.Lsetxattr(target, name, data, 0); err != nil {
+		return &os.PathError{Op: "lsetxattr", Path: target, Err: err}
+	}
+	return nil
+}
+
+// Returns the xattrs of target without following symlinks; none where the filesystem
+// does not support them
+func lgetxattrs(target string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(target, nil)
+	if isNotSupported(err) || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: target, Err: err}
+	}
+	names := make([]byte, size)
+	if size, err = unix.Llistxattr(target, names); err != nil {
+		return nil, &os.PathError{Op: "llistxattr", Path: target, Err: err}
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(target, string(name), nil)
+		if err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: target, Err: err}
+		}
+		data := make([]byte, size)
+		if size, err = unix.Lgetxattr(target, string(name), data); err != nil {
+			return nil, &os.PathError{Op: "lgetxattr", Path: target, Err: err}
+		}
+		xattrs[string(name)] = data[:size]
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pextraoci
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Phases reported in progress events
+const (
+	// Reading a blob to check it against its digest
+	ProgressPhaseVerify = "verify"
+	// Copying a blob out of an archive, or an unflattened qcow2 layer into place
+	ProgressPhaseCopy = "copy"
+	// Applying an LXC layer to the root filesystem
+	ProgressPhaseExtract = "extract"
+	// Converting a qcow2 layer and its backing chain into a standalone image
+	ProgressPhaseFlatten = "flatten"
+)
+
+// Byte progress of one layer in one phase, and of all layers in that phase
+type ProgressEvent struct {
+	Phase string        `json:"phase"`
+	Layer digest.Digest `json:"layer"`
+	// Bytes of the layer processed so far, out of Total (the size of its descriptor).
+	// For the flatten phase, Total is the size of the layer and its backing chain, and
+	// Done is the progress qemu-img reports scaled to it.
+	Done  int64 `json:"done"`
+	Total int64 `json:"total"`
+	// Sums over every layer of the phase
+	OverallDone  int64 `json:"overallDone"`
+	OverallTotal int64 `json:"overallTotal"`
+}
+
+// Receives progress events. It is called from the extracting goroutine and should
+// return quickly; events arrive for every read, so it may need to throttle output.
+type ProgressFunc func(ProgressEvent)
+
+// Tracks the progress of one phase over a set of layers and reports it to a
+// ProgressFunc. Handlers use it to implement ExtractOptions.Progress. A tracker with
+// a nil ProgressFunc does nothing.
+type ProgressTracker struct {
+	fn      ProgressFunc
+	phase   string
+	done    map[digest.Digest]int64
+	total   int64
+	overall int64
+}
+
+// Starts tracking phase over layers
+func NewProgressTracker(fn ProgressFunc, phase string, layers []v1.Descriptor) *ProgressTracker {
+	t := &ProgressTracker{fn: fn, phase: phase, done: make(map[digest.Digest]int64)}
+	for _, l := range layers {
+		t.total += l.Size
+	}
+	return t
+}
+
+// Sets the bytes processed of layer to done
+func (t *ProgressTracker) Update(layer v1.Descriptor, done int64) {
+	if t.fn == nil {
+		return
+	}
+	done = min(max(done, 0), layer.Size)
+	t.overall += done - t.done[layer.Digest]
+	t.done[layer.Digest] = done
+	t.fn(ProgressEvent{
+		Phase:        t.phase,
+		Layer:        layer.Digest,
+		Done:         done,
+		Total:        layer.Size,
+		OverallDone:  t.overall,
+		OverallTotal: t.total,
+	})
+}
+
+// Marks layer as processed completely
+func (t *ProgressTracker) Finish(layer v1.Descriptor) {
+	t.Update(layer, layer.Size)
+}
+
+// Wraps r, which reads layer, so that every read updates the progress of layer
+func (t *ProgressTracker) Reader(r io.Reader, layer v1.Descriptor) io.Reader {
+	if t.fn == nil {
+		return r
+	}
+	t.Update(layer, 0)
+	return &progressReader{r: r, t: t, layer: layer}
+}
+
+type progressReader struct {
+	r     io.Reader
+	t     *ProgressTracker
+	layer v1.Descriptor
+	n     int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.t.Update(r.layer, r.n)
+	}
+	return n, err
+}
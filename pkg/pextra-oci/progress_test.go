@@ -0,0 +1,63 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pextraoci
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestProgressTracker(t *testing.T) {
+	a := v1.Descriptor{Digest: digest.FromString("a"), Size: 10}
+	b := v1.Descriptor{Digest: digest.FromString("b"), Size: 30}
+
+	var events []ProgressEvent
+	tr := NewProgressTracker(func(e ProgressEvent) { events = append(events, e) }, ProgressPhaseExtract, []v1.Descriptor{a, b})
+
+	if _, err := io.Copy(io.Discard, tr.Reader(strings.NewReader(strings.Repeat("x", 10)), a)); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	tr.Update(b, 15)
+	tr.Update(b, 45) // clamped to the layer size
+	tr.Finish(b)
+
+	if len(events) < 5 {
+		t.Fatalf("expected at least 5 events, got %+v", events)
+	}
+	if first := events[0]; first.Done != 0 || first.Layer != a.Digest || first.Phase != ProgressPhaseExtract {
+		t.Fatalf("unexpected first event %+v", first)
+	}
+	want := []ProgressEvent{
+		{Phase: ProgressPhaseExtract, Layer: a.Digest, Done: 10, Total: 10, OverallDone: 10, OverallTotal: 40},
+		{Phase: ProgressPhaseExtract, Layer: b.Digest, Done: 15, Total: 30, OverallDone: 25, OverallTotal: 40},
+		{Phase: ProgressPhaseExtract, Layer: b.Digest, Done: 30, Total: 30, OverallDone: 40, OverallTotal: 40},
+		{Phase: ProgressPhaseExtract, Layer: b.Digest, Done: 30, Total: 30, OverallDone: 40, OverallTotal: 40},
+	}
+	if got := events[len(events)-4:]; !slices.Equal(got, want) {
+		t.Fatalf("got events %+v, want %+v", got, want)
+	}
+
+	// Without a ProgressFunc, readers are passed through
+	r := strings.NewReader("")
+	if got := NewProgressTracker(nil, ProgressPhaseCopy, []v1.Descriptor{a}).Reader(r, a); got != io.Reader(r) {
+		t.Fatalf("expected the reader to be passed through")
+	}
+}
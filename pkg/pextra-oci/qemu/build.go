@@ -0,0 +1,234 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type BuildOptions struct {
+	// Top-level qcow2 disks; their backing chains are discovered automatically
+	Disks    []string
+	Platform v1.Platform
+	// Optional ref name for the image in index.json
+	Tag string
+}
+
+// Subset of `qemu-img info --output=json` used to follow backing chains
+type imageInfo struct {
+	Filename            string `json:"filename"`
+	Format              string `json:"format"`
+	BackingFilename     string `json:"backing-filename"`
+	FullBackingFilename string `json:"full-backing-filename"`
+}
+
+// A qcow2 file to be stored as a layer
+type layerPlan struct {
+	Path     string
+	FileName string
+	// File name of the backing image inside the image, empty if there is none
+	BackingFileName string
+	// Whether the backing reference in the file header differs from BackingFileName
+	Rebase bool
+	Top    bool
+}
+
+// Packages qcow2 disks and their backing chains as a Pextra QEMU image into the image layout
+// at layoutDir, creating the layout if needed. Returns the manifest descriptor.
+func Build(layoutDir string, opts BuildOptions) (v1.Descriptor, error) {
+	if len(opts.Disks) == 0 {
+		return v1.Descriptor{}, fmt.Errorf("no disks given")
+	}
+
+	var chains [][]imageInfo
+	for _, disk := range opts.Disks {
+		abs, err := filepath.Abs(disk)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		chain, err := backingChain(abs)
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("failed to inspect %s: %w", disk, err)
+		}
+		chains = append(chains, chain)
+	}
+	plan, err := planLayers(chains)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	lw, err := oci.NewLayoutWriter(layoutDir)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	tempDir, err := os.MkdirTemp("", "pce-oci-qemu-build-")
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	var layers []v1.Descriptor
+	var diffIDs []digest.Digest
+	for _, p := range plan {
+		desc, err := writeQcow2Layer(lw, tempDir, p)
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("failed to add %s: %w", p.Path, err)
+		}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, desc.Digest) // layers are stored uncompressed
+	}
+
+	created := time.Now().UTC()
+	config := &v1.Image{
+		Created:  &created,
+		Platform: opts.Platform,
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+		History: []v1.History{{
+			Created:   &created,
+			CreatedBy: "pce-oci build qemu",
+		}},
+	}
+	return lw.WriteImage(pextraoci.PextraImageTypeQemu, config, layers, opts.Tag)
+}
+
+// Orders the images of all chains so that backing files come before their overlays,
+// and names them by their base name as required for one-level backing references.
+// Each chain starts with the top image, as reported by qemu-img.
+func planLayers(chains [][]imageInfo) ([]layerPlan, error) {
+	var plan []layerPlan
+	byPath := make(map[string]int)
+	byName := make(map[string]string)
+
+	for _, chain := range chains {
+		for i := len(chain) - 1; i >= 0; i-- {
+			info := chain[i]
+			if info.Format != "qcow2" {
+				return nil, fmt.Errorf("%s: unsupported format %q (only qcow2 is supported)", info.Filename, info.Format)
+			}
+
+			path := filepath.Clean(info.Filename)
+			if idx, ok := byPath[path]; ok {
+				plan[idx].Top = plan[idx].Top || i == 0
+				continue
+			}
+
+			name := filepath.Base(path)
+			if other, ok := byName[name]; ok {
+				return nil, fmt.Errorf("%s and %s share the file name %q", other, path, name)
+			}
+			byName[name] = path
+
+			p := layerPlan{Path: path, FileName: name, Top: i == 0}
+			if i+1 < len(chain) {
+				p.BackingFileName = filepath.Base(filepath.Clean(chain[i+1].Filename))
+				p.Rebase = info.BackingFilename != p.BackingFileName
+			}
+			byPath[path] = len(plan)
+			plan = append(plan, p)
+		}
+	}
+	return plan, nil
+}
+
+// Runs qemu-img info on path and returns its backing chain, top image first
+func backingChain(path string) ([]imageInfo, error) {
+	out, err := exec.Command("qemu-img", "info", "--output=json", "--backing-chain", path).Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("qemu-img info: %w: %s", err, ee.Stderr)
+		}
+		return nil, fmt.Errorf("qemu-img info: %w", err)
+	}
+	return parseBackingChain(out)
+}
+
+func parseBackingChain(data []byte) ([]imageInfo, error) {
+	var chain []imageInfo
+	if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, fmt.Errorf("parse qemu-img info output: %w", err)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("qemu-img info returned no images")
+	}
+	return chain, nil
+}
+
+// Stores the qcow2 file of p as a layer, pointing its backing reference at the one-level
+// file name first if needed. The original file is never modified.
+func writeQcow2Layer(lw *oci.LayoutWriter, tempDir string, p layerPlan) (v1.Descriptor, error) {
+	src := p.Path
+	if p.Rebase {
+		src = filepath.Join(tempDir, p.FileName)
+		if err := copyFile(p.Path, src); err != nil {
+			return v1.Descriptor{}, err
+		}
+		// -u only rewrites the header; the backing file does not need to exist at that name
+		cmd := exec.Command("qemu-img", "rebase", "-u", "-f", "qcow2", "-F", "qcow2", "-b", p.BackingFileName, src)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return v1.Descriptor{}, fmt.Errorf("qemu-img rebase: %w", err)
+		}
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	defer f.Close()
+
+	desc, err := lw.WriteBlob(f, pextraoci.MediaTypePextraImageLayerQcow2)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc.Annotations = map[string]string{pextraoci.AnnotationPextraQemuFileName: p.FileName}
+	if p.Top {
+		desc.Annotations[pextraoci.AnnotationPextraQemuFlatten] = "true"
+	}
+	return desc, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := utils.CopySparse(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,86 @@
+//go:build integration
+
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBuild_WithBackingChain(t *testing.T) {
+	requireQemuImg(t)
+
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "a"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "b"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	base := filepath.Join(src, "a", "base.qcow2")
+	top := filepath.Join(src, "b", "disk0.qcow2")
+	if out, err := exec.Command("qemu-img", "create", "-f", "qcow2", base, "1M").CombinedOutput(); err != nil {
+		t.Skipf("qemu-img create: %v; out=%s", err, out)
+	}
+	if out, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", "../a/base.qcow2", top).CombinedOutput(); err != nil {
+		t.Skipf("qemu-img create overlay: %v; out=%s", err, out)
+	}
+
+	layout := filepath.Join(t.TempDir(), "layout")
+	if _, err := Build(layout, BuildOptions{Disks: []string{top}, Platform: v1.Platform{OS: "linux", Architecture: "amd64"}}); err != nil {
+		t.Fatalf("Build error: %v", err)
+	}
+	l, err := pextraoci.Open(layout)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer l.Close()
+	if res, err := l.Validate(); err != nil || len(res.Problems) != 0 {
+		t.Fatalf("expected valid layout, got %+v (err=%v)", res, err)
+	}
+	img, err := l.Select(pextraoci.SelectOptions{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}})
+	if err != nil {
+		t.Fatalf("Select error: %v", err)
+	}
+	layers := img.Manifest.Layers
+	if len(layers) != 2 ||
+		layers[0].Annotations[pextraoci.AnnotationPextraQemuFileName] != "base.qcow2" ||
+		layers[1].Annotations[pextraoci.AnnotationPextraQemuFileName] != "disk0.qcow2" ||
+		layers[1].Annotations[pextraoci.AnnotationPextraQemuFlatten] != "true" {
+		t.Fatalf("unexpected layers: %+v", layers)
+	}
+
+	// The source overlay keeps its original backing reference
+	chain, err := backingChain(top)
+	if err != nil || chain[0].BackingFilename != "../a/base.qcow2" {
+		t.Fatalf("source disk was modified: %+v (err=%v)", chain, err)
+	}
+
+	out := t.TempDir()
+	if err := New(layers, layout, out).FlattenQemuLayers(); err != nil {
+		t.Fatalf("FlattenQemuLayers error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(out, "disk0.qcow2")); err != nil {
+		t.Fatalf("expected flattened disk: %v", err)
+	}
+}
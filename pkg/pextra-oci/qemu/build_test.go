@@ -0,0 +1,89 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBackingChain(t *testing.T) {
+	out := []byte(`[
+		{"filename": "/b/top.qcow2", "format": "qcow2", "backing-filename": "../a/base.qcow2", "full-backing-filename": "/a/base.qcow2"},
+		{"filename": "/a/base.qcow2", "format": "qcow2"}
+	]`)
+	chain, err := parseBackingChain(out)
+	if err != nil {
+		t.Fatalf("parseBackingChain error: %v", err)
+	}
+	want := []imageInfo{
+		{Filename: "/b/top.qcow2", Format: "qcow2", BackingFilename: "../a/base.qcow2", FullBackingFilename: "/a/base.qcow2"},
+		{Filename: "/a/base.qcow2", Format: "qcow2"},
+	}
+	if !reflect.DeepEqual(chain, want) {
+		t.Fatalf("got %+v want %+v", chain, want)
+	}
+
+	if _, err := parseBackingChain([]byte(`[]`)); err == nil {
+		t.Fatalf("expected error for empty chain")
+	}
+	if _, err := parseBackingChain([]byte(`{`)); err == nil {
+		t.Fatalf("expected error for invalid JSON")
+	}
+}
+
+func TestPlanLayers(t *testing.T) {
+	base := imageInfo{Filename: "/a/base.qcow2", Format: "qcow2"}
+	disk0 := imageInfo{Filename: "/b/disk0.qcow2", Format: "qcow2", BackingFilename: "../a/base.qcow2"}
+	data := imageInfo{Filename: "/b/data.qcow2", Format: "qcow2", BackingFilename: "base.qcow2"}
+
+	plan, err := planLayers([][]imageInfo{
+		{disk0, base},
+		{data, base},
+	})
+	if err != nil {
+		t.Fatalf("planLayers error: %v", err)
+	}
+	want := []layerPlan{
+		{Path: "/a/base.qcow2", FileName: "base.qcow2"},
+		{Path: "/b/disk0.qcow2", FileName: "disk0.qcow2", BackingFileName: "base.qcow2", Rebase: true, Top: true},
+		{Path: "/b/data.qcow2", FileName: "data.qcow2", BackingFileName: "base.qcow2", Top: true},
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Fatalf("got %+v\nwant %+v", plan, want)
+	}
+}
+
+func TestPlanLayers_Errors(t *testing.T) {
+	t.Run("name_conflict", func(t *testing.T) {
+		_, err := planLayers([][]imageInfo{
+			{{Filename: "/a/disk.qcow2", Format: "qcow2"}},
+			{{Filename: "/b/disk.qcow2", Format: "qcow2"}},
+		})
+		if err == nil {
+			t.Fatalf("expected error for conflicting file names")
+		}
+	})
+	t.Run("raw_backing", func(t *testing.T) {
+		_, err := planLayers([][]imageInfo{{
+			{Filename: "/a/disk.qcow2", Format: "qcow2", BackingFilename: "base.img"},
+			{Filename: "/a/base.img", Format: "raw"},
+		}})
+		if err == nil {
+			t.Fatalf("expected error for non-qcow2 backing file")
+		}
+	})
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// What is done with qcow2 layers that are not flattened
+const (
+	// Leave them out of the output directory
+	UnflattenedSkip = "skip"
+	// Place them in the output directory under their file name, with their backing files
+	// pointing at the disks of their backing layers there
+	UnflattenedCopy = "copy"
+)
+
+// Magic of qcow2 images, "QFI\xfb"
+const qcow2Magic = 0x514649fb
+
+// Reads the backing file name from the header of the qcow2 image at p; empty if it has
+// no backing file
+func readBackingFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// magic, version, backing_file_offset and backing_file_size, all big-endian
+	var hdr [20]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil || binary.BigEndian.Uint32(hdr[0:]) != qcow2Magic {
+		return "", fmt.Errorf("%s is not a qcow2 image", filepath.Base(p))
+	}
+	offset := binary.BigEndian.Uint64(hdr[8:])
+	size := binary.BigEndian.Uint32(hdr[16:])
+	if offset == 0 || size == 0 {
+		return "", nil
+	}
+	if size > 1023 {
+		return "", fmt.Errorf("%s: backing file name of %d bytes is too long", filepath.Base(p), size)
+	}
+	name := make([]byte, size)
+	if _, err := f.ReadAt(name, int64(offset)); err != nil {
+		return "", fmt.Errorf("%s: failed to read backing file name: %w", filepath.Base(p), err)
+	}
+	return string(name), nil
+}
+
+// Places the unflattened layer of disk at outputPath. Layers copied out of an archive
+// are moved there from tempDir; local blobs are reflinked where the filesystem supports
+// it, and copied sparsely otherwise. A partially written outputPath is removed if it
+// fails.
+func (c *QemuConfig) placeLayer(ctx context.Context, disk extractedDisk, tempDir, outputPath string, progress *pextraoci.ProgressTracker) (err error) {
+	layer := disk.layer
+	srcPath, ok := c.source().LocalPath(oci.BlobName(layer.Digest))
+	if !ok {
+		return os.Rename(path.Join(tempDir, layer.Annotations[pextraoci.AnnotationPextraQemuFileName]), outputPath)
+	}
+
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Replaces the disk of an earlier extraction in place, as qemu-img convert does
+	if err := os.Remove(outputPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	out, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(outputPath)
+		}
+	}()
+	if utils.Reflink(out, in) == nil {
+		progress.Finish(layer)
+		return nil
+	}
+	_, err = utils.CopySparse(out, progress.Reader(utils.NewContextReader(ctx, in), layer))
+	return err
+}
+
+// Points the backing file of the placed layer of disk at outputPath to the disk its
+// backing layer is written as, with qemu-img rebase -u, unless it refers to it by that
+// name already. The backing layer is the one named like the base name of the backing
+// file. Sets disk.backing.
+func rebaseLayer(ctx context.Context, disk *extractedDisk, outputPath string, disks []extractedDisk) error {
+	backing, err := readBackingFile(outputPath)
+	if backing == "" || err != nil {
+		return err
+	}
+	base, ok := backingDisk(backing, disks)
+	if !ok {
+		return fmt.Errorf("backing file %q of %s is not a layer of the image", backing, disk.fileName)
+	}
+	disk.backing = base.fileName
+	if backing == base.fileName {
+		return nil
+	}
+
+	cmd := utils.CommandContext(ctx, "qemu-img", "rebase", "-u", "-b", base.fileName, "-F", base.opts.format(), outputPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("qemu-img rebase: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// The disk of the layer a backing file name refers to
+func backingDisk(backing string, disks []extractedDisk) (extractedDisk, bool) {
+	name := backingLayerName(backing)
+	for _, d := range disks {
+		if d.layer.Annotations[pextraoci.AnnotationPextraQemuFileName] == name {
+			return d, true
+		}
+	}
+	return extractedDisk{}, false
+}
+
+// File name of the layer a backing file name refers to: its base name
+func backingLayerName(backing string) string {
+	return path.Base(strings.ReplaceAll(backing, `\`, "/"))
+}
+
+// Returns layer with the size of its whole backing chain, which qemu-img reads to
+// flatten it. The chain is read from the layers in dir, named by their file names.
+func chainDescriptor(dir string, layer v1.Descriptor, layers []v1.Descriptor) v1.Descriptor {
+	chain := layer
+	for cur, n := layer, 1; n < len(layers); n++ {
+		backing, err := readBackingFile(path.Join(dir, cur.Annotations[pextraoci.AnnotationPextraQemuFileName]))
+		if backing == "" || err != nil {
+			break
+		}
+		i := slices.IndexFunc(layers, func(l v1.Descriptor) bool {
+			return l.Annotations[pextraoci.AnnotationPextraQemuFileName] == backingLayerName(backing)
+		})
+		if i < 0 {
+			break
+		}
+		cur = layers[i]
+		chain.Size += cur.Size
+	}
+	return chain
+}
+
+// The disks a VM boots: all but the backing files of placed layers
+func vmDisks(disks []extractedDisk) []extractedDisk {
+	backings := make(map[string]bool)
+	for _, d := range disks {
+		if d.backing != "" {
+			backings[d.backing] = true
+		}
+	}
+	var res []extractedDisk
+	for _, d := range disks {
+		if !backings[d.fileName] {
+			res = append(res, d)
+		}
+	}
+	return res
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// A qcow2 v3 header with the backing file name right after it, as qemu-img writes it
+func qcow2Image(backing string) string {
+	hdr := make([]byte, 104)
+	binary.BigEndian.PutUint32(hdr[0:], qcow2Magic)
+	binary.BigEndian.PutUint32(hdr[4:], 3)
+	if backing != "" {
+		binary.BigEndian.PutUint64(hdr[8:], uint64(len(hdr)))
+		binary.BigEndian.PutUint32(hdr[16:], uint32(len(backing)))
+	}
+	return string(hdr) + backing
+}
+
+// Like writeQcow2Blob, for a layer that is not flattened
+func writeUnflattenedBlob(t *testing.T, img, fileName, backing string) v1.Descriptor {
+	t.Helper()
+	desc := writeQcow2Blob(t, img, fileName, qcow2Image(backing))
+	delete(desc.Annotations, pextraoci.AnnotationPextraQemuFlatten)
+	return desc
+}
+
+func TestReadBackingFile(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"base.qcow2":    qcow2Image(""),
+		"overlay.qcow2": qcow2Image("/build/base.qcow2"),
+		"disk.raw":      "raw",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := readBackingFile(filepath.Join(dir, "base.qcow2")); got != "" || err != nil {
+		t.Fatalf("expected no backing file, got %q (err=%v)", got, err)
+	}
+	if got, err := readBackingFile(filepath.Join(dir, "overlay.qcow2")); got != "/build/base.qcow2" || err != nil {
+		t.Fatalf("got backing file %q (err=%v)", got, err)
+	}
+	if _, err := readBackingFile(filepath.Join(dir, "disk.raw")); err == nil || !strings.Contains(err.Error(), "not a qcow2 image") {
+		t.Fatalf("expected an error for a raw image, got %v", err)
+	}
+}
+
+func TestFlatten_Unflattened(t *testing.T) {
+	log := fakeQemuImg(t)
+	img := t.TempDir()
+	base := writeUnflattenedBlob(t, img, "base.qcow2", "")
+	app := writeUnflattenedBlob(t, img, "app.qcow2", "/build/base.qcow2")
+	root := writeQcow2Blob(t, img, "root.img", "root")
+	root.Annotations[pextraoci.AnnotationPextraQemuDiskFormat] = DiskFormatRaw
+	data := writeUnflattenedBlob(t, img, "data.qcow2", "root.img")
+	layers := []v1.Descriptor{base, app, root, data}
+
+	// Skipped by default
+	res, err := (&QemuConfig{Layers: layers, ImgPath: img, OutputDir: t.TempDir()}).Flatten(context.Background())
+	if err != nil || len(res.Skipped) != 3 || !slices.Equal(res.Files, []string{"root.raw"}) {
+		t.Fatalf("unexpected result %+v (err=%v)", res, err)
+	}
+
+	out := t.TempDir()
+	c := &QemuConfig{Layers: layers, ImgPath: img, OutputDir: out, Unflattened: UnflattenedCopy,
+		VMDefinition: VMDefinitionQemu, Architecture: "amd64"}
+	res, err = c.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	if want := []string{"root.raw", "base.qcow2", "app.qcow2", "data.qcow2", QemuScriptName}; !slices.Equal(res.Files, want) || len(res.Skipped) != 0 {
+		t.Fatalf("got files %v, skipped %v; want files %v", res.Files, res.Skipped, want)
+	}
+	if b, _ := os.ReadFile(filepath.Join(out, "app.qcow2")); string(b) != qcow2Image("/build/base.qcow2") {
+		t.Fatalf("unexpected app.qcow2 content %q", b)
+	}
+
+	b, _ := os.ReadFile(log)
+	var rebases []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if strings.HasPrefix(line, "rebase ") {
+			rebases = append(rebases, line)
+		}
+	}
+	// Layers are rebased in the staging directory, before they are moved into place
+	want := []string{"rebase -u -b base.qcow2 -F qcow2 /app.qcow2", "rebase -u -b root.raw -F raw /data.qcow2"}
+	if len(rebases) != len(want) {
+		t.Fatalf("got rebases %q, want %q", rebases, want)
+	}
+	for i := range want {
+		prefix, file, _ := strings.Cut(want[i], "/")
+		if !strings.HasPrefix(rebases[i], prefix) || filepath.Base(rebases[i]) != file {
+			t.Fatalf("got rebase %q, want %q", rebases[i], want[i])
+		}
+	}
+
+	c.InPlace = true
+	if _, err := c.Flatten(context.Background()); err != nil {
+		t.Fatalf("Flatten in place over an earlier extraction: %v", err)
+	}
+
+	// Backing files are not attached to the VM
+	script, _ := os.ReadFile(res.ConfigFile)
+	for name, attached := range map[string]bool{"app.qcow2": true, "data.qcow2": true, "base.qcow2": false, "root.raw": false} {
+		if got := strings.Contains(string(script), filepath.Join(out, name)); got != attached {
+			t.Errorf("%s attached: %v, want %v", name, got, attached)
+		}
+	}
+
+	orphan := writeUnflattenedBlob(t, img, "orphan.qcow2", "missing.qcow2")
+	c = &QemuConfig{Layers: []v1.Descriptor{orphan}, ImgPath: img, OutputDir: t.TempDir(), Unflattened: UnflattenedCopy}
+	if _, err := c.Flatten(context.Background()); err == nil || !strings.Contains(err.Error(), "is not a layer of the image") {
+		t.Fatalf("expected an error for a missing backing layer, got %v", err)
+	}
+	c.Unflattened = "link"
+	if _, err := c.Flatten(context.Background()); err == nil || !strings.Contains(err.Error(), "unsupported mode") {
+		t.Fatalf("expected an unsupported mode error, got %v", err)
+	}
+}
+
+func TestFlatten_ProgressCoversBackingChain(t *testing.T) {
+	fakeQemuImg(t)
+	img := t.TempDir()
+	base := writeUnflattenedBlob(t, img, "base.qcow2", "")
+	mid := writeUnflattenedBlob(t, img, "mid.qcow2", "base.qcow2")
+	app := writeQcow2Blob(t, img, "app.qcow2", qcow2Image("/build/mid.qcow2"))
+
+	var events []pextraoci.ProgressEvent
+	c := &QemuConfig{Layers: []v1.Descriptor{base, mid, app}, ImgPath: img, OutputDir: t.TempDir(),
+		Progress: func(e pextraoci.ProgressEvent) { events = append(events, e) }}
+	if _, err := c.Flatten(context.Background()); err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	want := base.Size + mid.Size + app.Size
+	var flattened bool
+	for _, e := range events {
+		if e.Phase != pextraoci.ProgressPhaseFlatten {
+			continue
+		}
+		flattened = true
+		if e.Layer != app.Digest || e.Total != want || e.OverallTotal != want {
+			t.Fatalf("unexpected flatten event %+v, want a total of %d", e, want)
+		}
+	}
+	if !flattened {
+		t.Fatalf("no flatten progress in %+v", events)
+	}
+}
+
+func TestFlatten_RejectsUnsafeFileNames(t *testing.T) {
+	log := fakeQemuImg(t)
+	img := t.TempDir()
+	parent := t.TempDir()
+	out := filepath.Join(parent, "a", "b", "out")
+	escaped := writeUnflattenedBlob(t, img, "../../../escaped.qcow2", "")
+	disk := writeQcow2Blob(t, img, "disk.qcow2", "disk")
+	dup := writeUnflattenedBlob(t, img, "disk.qcow2", "")
+	unnamed := writeUnflattenedBlob(t, img, "", "")
+
+	for _, layers := range [][]v1.Descriptor{{escaped, disk}, {disk, dup}, {unnamed, disk}} {
+		c := &QemuConfig{Layers: layers, ImgPath: img, OutputDir: out, Unflattened: UnflattenedCopy}
+		if _, err := c.Flatten(context.Background()); err == nil || !strings.Contains(err.Error(), "invalid QEMU image") {
+			t.Fatalf("expected a validation error, got %v", err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(parent, "escaped.qcow2")); err == nil {
+		t.Fatal("escaped.qcow2 was written outside the output directory")
+	}
+	if _, err := os.Lstat(out); err == nil {
+		t.Fatal("expected nothing to be written")
+	}
+	if b, _ := os.ReadFile(log); len(b) != 0 {
+		t.Fatalf("expected qemu-img not to run, got %q", b)
+	}
+}
+
+func TestFlatten_UnflattenedFromArchive(t *testing.T) {
+	fakeQemuImg(t)
+	img := t.TempDir()
+	base := writeUnflattenedBlob(t, img, "base.qcow2", "")
+
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("create archive: %v", err)
+	}
+	tw := tar.NewWriter(f)
+	content := qcow2Image("")
+	if err := tw.WriteHeader(&tar.Header{Name: oci.BlobName(base.Digest), Mode: 0o644, Size: int64(len(content))}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	f.Close()
+	src, err := oci.OpenSource(archive)
+	if err != nil {
+		t.Fatalf("OpenSource error: %v", err)
+	}
+	defer src.Close()
+
+	out := t.TempDir()
+	c := NewFromSource([]v1.Descriptor{base}, src, out)
+	c.Unflattened = UnflattenedCopy
+	if _, err := c.Flatten(context.Background()); err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(out, "base.qcow2")); string(b) != content {
+		t.Fatalf("unexpected base.qcow2 content %q", b)
+	}
+	if entries, _ := os.ReadDir(out); len(entries) != 1 {
+		t.Fatalf("expected only base.qcow2 in the output directory, got %v", entries)
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/PextraCloud/pce-osi/internal/utils"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Formats of the disk images flattened layers are written as
+const (
+	DiskFormatQcow2 = "qcow2"
+	DiskFormatRaw   = "raw"
+	DiskFormatVmdk  = "vmdk"
+	DiskFormatVhdx  = "vhdx"
+)
+
+// File name extensions of the disk formats
+var diskExtensions = map[string]string{
+	DiskFormatQcow2: ".qcow2",
+	DiskFormatRaw:   ".raw",
+	DiskFormatVmdk:  ".vmdk",
+	DiskFormatVhdx:  ".vhdx",
+}
+
+// Extensions of disk image file names that are replaced by that of the output format
+var replacedExtensions = []string{".qcow2", ".qcow", ".img", ".raw", ".vmdk", ".vhdx"}
+
+// Preallocation modes qemu-img supports per disk format
+var diskPreallocations = map[string][]string{
+	DiskFormatQcow2: {"off", "metadata", "falloc", "full"},
+	DiskFormatRaw:   {"off", "falloc", "full"},
+}
+
+// qcow2 compatibility levels: 0.10 for QEMU before 1.1, 1.1 (the default) for newer ones
+var qcow2Compats = []string{"0.10", "1.1"}
+
+// How a flattened layer is written; empty fields are left to qemu-img
+type DiskOptions struct {
+	// DiskFormatQcow2 (the default), DiskFormatRaw, DiskFormatVmdk or DiskFormatVhdx
+	Format string
+	// Compress the image; qcow2 and vmdk (as a streamOptimized image) only
+	Compress *bool
+	// Preallocation mode, e.g. "metadata" or "full"; qcow2 and raw only
+	Preallocation string
+	// Cluster size in bytes, a power of two from 512 bytes to 2 MiB; qcow2 only
+	ClusterSize int64
+	// Compatibility level, "0.10" or "1.1"; qcow2 only
+	Compat string
+}
+
+// A qcow2 layer and the disk it is written as
+type extractedDisk struct {
+	layer    v1.Descriptor
+	fileName string
+	opts     DiskOptions
+	// The layer is placed as it is instead of flattened
+	placed bool
+	// File name of the disk a placed layer is backed by, once it is rebased
+	backing string
+}
+
+// Reads the disk options of the annotations of a qcow2 layer
+func parseDiskOptions(layer v1.Descriptor) (DiskOptions, []error) {
+	var o DiskOptions
+	var errs []error
+	a := layer.Annotations
+	if v, ok := a[pextraoci.AnnotationPextraQemuDiskFormat]; ok {
+		o.Format = v
+	}
+	if v, ok := a[pextraoci.AnnotationPextraQemuCompress]; ok {
+		compress, err := strconv.ParseBool(v)
+		if err != nil || v != "true" && v != "false" {
+			errs = append(errs, fmt.Errorf("%s must be \"true\" or \"false\", got %q", pextraoci.AnnotationPextraQemuCompress, v))
+		} else {
+			o.Compress = &compress
+		}
+	}
+	if v, ok := a[pextraoci.AnnotationPextraQemuPreallocation]; ok {
+		o.Preallocation = v
+	}
+	if v, ok := a[pextraoci.AnnotationPextraQemuClusterSize]; ok {
+		size, err := utils.ParseSize(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", pextraoci.AnnotationPextraQemuClusterSize, err))
+		} else {
+			o.ClusterSize = size
+		}
+	}
+	if v, ok := a[pextraoci.AnnotationPextraQemuCompat]; ok {
+		o.Compat = v
+	}
+	if err := o.check(); err != nil {
+		errs = append(errs, err)
+	}
+	return o, errs
+}
+
+// Returns the options of a layer, o, with the fields set in over replaced. The settings
+// of o are for the format it names, so they are all dropped if over names another one.
+func (o DiskOptions) override(over DiskOptions) DiskOptions {
+	if over.Format != "" && over.Format != o.format() {
+		o = DiskOptions{}
+	}
+	o.Format = cmp.Or(over.Format, o.Format)
+	if over.Compress != nil {
+		o.Compress = over.Compress
+	}
+	o.Preallocation = cmp.Or(over.Preallocation, o.Preallocation)
+	o.ClusterSize = cmp.Or(over.ClusterSize, o.ClusterSize)
+	o.Compat = cmp.Or(over.Compat, o.Compat)
+	return o
+}
+
+// The disk format, qcow2 unless set
+func (o DiskOptions) format() string {
+	return cmp.Or(o.Format, DiskFormatQcow2)
+}
+
+func (o DiskOptions) compressed() bool {
+	return o.Compress != nil && *o.Compress
+}
+
+// Checks that o is a valid combination of options
+func (o DiskOptions) check() error {
+	format := o.format()
+	if _, ok := diskExtensions[format]; !ok {
+		return fmt.Errorf("unsupported disk format %q (want qcow2, raw, vmdk or vhdx)", o.Format)
+	}
+	if o.compressed() && format != DiskFormatQcow2 && format != DiskFormatVmdk {
+		return fmt.Errorf("%s disks cannot be compressed", format)
+	}
+	if o.Preallocation != "" {
+		modes, ok := diskPreallocations[format]
+		if !ok {
+			return fmt.Errorf("%s disks cannot be preallocated", format)
+		}
+		if !slices.Contains(modes, o.Preallocation) {
+			return fmt.Errorf("unsupported %s preallocation %q (want %s)", format, o.Preallocation, strings.Join(modes, ", "))
+		}
+		if o.compressed() && o.Preallocation != "off" {
+			return fmt.Errorf("compressed disks cannot be preallocated")
+		}
+	}
+	if o.ClusterSize != 0 {
+		if format != DiskFormatQcow2 {
+			return fmt.Errorf("cluster size only applies to qcow2 disks, not %s", format)
+		}
+		if o.ClusterSize < 512 || o.ClusterSize > 2<<20 || o.ClusterSize&(o.ClusterSize-1) != 0 {
+			return fmt.Errorf("cluster size %d is not a power of two from 512 bytes to 2 MiB", o.ClusterSize)
+		}
+	}
+	if o.Compat != "" {
+		if format != DiskFormatQcow2 {
+			return fmt.Errorf("compat only applies to qcow2 disks, not %s", format)
+		}
+		if !slices.Contains(qcow2Compats, o.Compat) {
+			return fmt.Errorf("unsupported qcow2 compat %q (want %s)", o.Compat, strings.Join(qcow2Compats, " or "))
+		}
+	}
+	return nil
+}
+
+// The qemu-img convert options that write a disk with o
+func (o DiskOptions) convertArgs() []string {
+	args := []string{"-O", o.format()}
+	var opts []string
+	if o.compressed() {
+		args = append(args, "-c")
+		if o.format() == DiskFormatVmdk {
+			opts = append(opts, "subformat=streamOptimized")
+		}
+	}
+	if o.Preallocation != "" {
+		opts = append(opts, "preallocation="+o.Preallocation)
+	}
+	if o.ClusterSize != 0 {
+		opts = append(opts, "cluster_size="+strconv.FormatInt(o.ClusterSize, 10))
+	}
+	if o.Compat != "" {
+		opts = append(opts, "compat="+o.Compat)
+	}
+	if len(opts) > 0 {
+		args = append(args, "-o", strings.Join(opts, ","))
+	}
+	return args
+}
+
+// File name of the disk written for a layer named name in format: name with its disk
+// format extension replaced, or with the extension appended if it has none. qcow2
+// disks keep their name, as the layer is a qcow2 image already.
+func diskFileName(name, format string) string {
+	if format == DiskFormatQcow2 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if slices.ContainsFunc(replacedExtensions, func(e string) bool { return strings.EqualFold(ext, e) }) {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name + diskExtensions[format]
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+)
+
+func TestParseDiskOptions(t *testing.T) {
+	opts, errs := parseDiskOptions(qcow2Layer(map[string]string{
+		pextraoci.AnnotationPextraQemuCompress:    "true",
+		pextraoci.AnnotationPextraQemuClusterSize: "64K",
+		pextraoci.AnnotationPextraQemuCompat:      "0.10",
+	}))
+	if len(errs) != 0 || !opts.compressed() || opts.ClusterSize != 64<<10 || opts.Compat != "0.10" || opts.format() != DiskFormatQcow2 {
+		t.Fatalf("unexpected options %+v (errs=%v)", opts, errs)
+	}
+
+	for annotations, want := range map[[2]string]string{
+		{pextraoci.AnnotationPextraQemuDiskFormat, "vdi"}:     "unsupported disk format",
+		{pextraoci.AnnotationPextraQemuCompress, "1"}:         pextraoci.AnnotationPextraQemuCompress,
+		{pextraoci.AnnotationPextraQemuClusterSize, "64X"}:    pextraoci.AnnotationPextraQemuClusterSize,
+		{pextraoci.AnnotationPextraQemuClusterSize, "3K"}:     "not a power of two",
+		{pextraoci.AnnotationPextraQemuPreallocation, "lazy"}: "unsupported qcow2 preallocation",
+		{pextraoci.AnnotationPextraQemuCompat, "2"}:           "unsupported qcow2 compat",
+	} {
+		_, errs := parseDiskOptions(qcow2Layer(map[string]string{annotations[0]: annotations[1]}))
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), want) {
+			t.Errorf("%s=%s: expected an error containing %q, got %v", annotations[0], annotations[1], want, errs)
+		}
+	}
+}
+
+func TestDiskOptions_Check(t *testing.T) {
+	yes := true
+	valid := []DiskOptions{
+		{},
+		{Format: DiskFormatRaw, Preallocation: "falloc"},
+		{Format: DiskFormatVmdk, Compress: &yes},
+		{Compress: &yes, Preallocation: "off", ClusterSize: 2 << 20, Compat: "1.1"},
+	}
+	for _, o := range valid {
+		if err := o.check(); err != nil {
+			t.Errorf("%+v: unexpected error %v", o, err)
+		}
+	}
+	invalid := map[string]DiskOptions{
+		"raw disks cannot be compressed":     {Format: DiskFormatRaw, Compress: &yes},
+		"vhdx disks cannot be preallocated":  {Format: DiskFormatVhdx, Preallocation: "full"},
+		"unsupported raw preallocation":      {Format: DiskFormatRaw, Preallocation: "metadata"},
+		"compressed disks cannot be":         {Compress: &yes, Preallocation: "full"},
+		"cluster size only applies to qcow2": {Format: DiskFormatVmdk, ClusterSize: 65536},
+		"not a power of two":                 {ClusterSize: 256},
+		"compat only applies to qcow2 disks": {Format: DiskFormatRaw, Compat: "1.1"},
+		"unsupported disk format \"qcow\"":   {Format: "qcow"},
+		"unsupported qcow2 compat \"1.0\"":   {Compat: "1.0"},
+		"vmdk disks cannot be preallocated":  {Format: DiskFormatVmdk, Preallocation: "off"},
+	}
+	for want, o := range invalid {
+		if err := o.check(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%+v: expected an error containing %q, got %v", o, want, err)
+		}
+	}
+}
+
+func TestDiskOptions_Override(t *testing.T) {
+	yes, no := true, false
+	layer := DiskOptions{Compress: &yes, ClusterSize: 65536}
+	if got := layer.override(DiskOptions{Compress: &no, Compat: "1.1"}); got.compressed() || got.ClusterSize != 65536 || got.Compat != "1.1" {
+		t.Fatalf("unexpected options %+v", got)
+	}
+	if got := layer.override(DiskOptions{Format: DiskFormatQcow2}); !got.compressed() || got.ClusterSize != 65536 {
+		t.Fatalf("expected the layer options to be kept for the same format, got %+v", got)
+	}
+	if got := layer.override(DiskOptions{Format: DiskFormatRaw}); got != (DiskOptions{Format: DiskFormatRaw}) {
+		t.Fatalf("expected the layer options to be dropped for another format, got %+v", got)
+	}
+}
+
+func TestDiskOptions_ConvertArgs(t *testing.T) {
+	yes := true
+	for _, tt := range []struct {
+		opts DiskOptions
+		want []string
+	}{
+		{DiskOptions{}, []string{"-O", "qcow2"}},
+		{DiskOptions{Compress: &yes, ClusterSize: 2 << 20, Compat: "0.10"}, []string{"-O", "qcow2", "-c", "-o", "cluster_size=2097152,compat=0.10"}},
+		{DiskOptions{Format: DiskFormatVmdk, Compress: &yes}, []string{"-O", "vmdk", "-c", "-o", "subformat=streamOptimized"}},
+		{DiskOptions{Format: DiskFormatRaw, Preallocation: "full"}, []string{"-O", "raw", "-o", "preallocation=full"}},
+	} {
+		if got := tt.opts.convertArgs(); !slices.Equal(got, tt.want) {
+			t.Errorf("%+v: got %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestDiskFileName(t *testing.T) {
+	for _, tt := range []struct{ name, format, want string }{
+		{"disk.qcow2", DiskFormatQcow2, "disk.qcow2"},
+		{"disk.img", DiskFormatQcow2, "disk.img"},
+		{"disk.qcow2", DiskFormatRaw, "disk.raw"},
+		{"disk.IMG", DiskFormatVmdk, "disk.vmdk"},
+		{"disk", DiskFormatVhdx, "disk.vhdx"},
+		{"disk.v2", DiskFormatRaw, "disk.v2.raw"},
+	} {
+		if got := diskFileName(tt.name, tt.format); got != tt.want {
+			t.Errorf("diskFileName(%q, %q) = %q, want %q", tt.name, tt.format, got, tt.want)
+		}
+	}
+}
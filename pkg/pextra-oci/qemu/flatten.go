@@ -16,59 +16,379 @@ limitations under the License.
 package qemu
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
 	"os"
-	"os/exec"
 	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/PextraCloud/pce-osi/internal/oci"
 	"github.com/PextraCloud/pce-osi/internal/utils"
 	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// Flattens the QEMU layers into OutputDir; see Flatten
 func (c *QemuConfig) FlattenQemuLayers() error {
-	if err := os.MkdirAll(c.OutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
-	}
+	_, err := c.Flatten(context.Background())
+	return err
+}
 
+// Flattens every qcow2 layer marked with flatten=true, together with its backing chain,
+// into a standalone disk in OutputDir named after the layer's file name. The disks are
+// moved into place, replacing files of the same name, once they have all been written;
+// see the fields of QemuConfig for the disk format and what else is written.
+func (c *QemuConfig) Flatten(ctx context.Context) (_ *pextraoci.ExtractResult, err error) {
 	layers := utils.GetLayersByMediaType(c.Layers, pextraoci.MediaTypePextraImageLayerQcow2)
 	if len(layers) == 0 {
-		return fmt.Errorf("no QEMU layers found in image")
+		return nil, fmt.Errorf("no QEMU layers found in image")
+	}
+	// File names become paths in OutputDir, so they are checked before any is built
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := c.vmDefinitionName(); err != nil {
+		return nil, err
+	}
+	disks, err := c.outputDisks(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	outDir := c.OutputDir
+	var staged *utils.StagedFiles
+	var written []string
+	if c.InPlace {
+		_, statErr := os.Lstat(c.OutputDir)
+		if err := os.MkdirAll(c.OutputDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create output directory: %w", err)
+		}
+		createdDir := errors.Is(statErr, fs.ErrNotExist)
+		defer func() {
+			if err == nil || ctx.Err() == nil {
+				return
+			}
+			if createdDir {
+				os.RemoveAll(c.OutputDir)
+				return
+			}
+			for _, p := range written {
+				os.Remove(p)
+			}
+		}()
+	} else {
+		if staged, err = utils.NewStagedFiles(c.OutputDir); err != nil {
+			return nil, err
+		}
+		defer staged.Discard()
+		outDir = staged.Path
+	}
+	commit := func(res *pextraoci.ExtractResult) (*pextraoci.ExtractResult, error) {
+		if err := c.writeVMDefinition(outDir, res, vmDisks(disks)); err != nil {
+			return nil, err
+		}
+		if staged != nil {
+			if err := staged.Commit(res.Files); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+
+	res := &pextraoci.ExtractResult{ImageType: pextraoci.PextraImageTypeQemu, OutputDir: c.OutputDir}
+	var flattened, placed []v1.Descriptor
+	for _, disk := range disks {
+		if disk.placed {
+			placed = append(placed, disk.layer)
+		} else {
+			flattened = append(flattened, disk.layer)
+		}
+	}
+	for _, layer := range layers {
+		if !isFlattened(layer) && c.Unflattened != UnflattenedCopy {
+			res.Skipped = append(res.Skipped, layer)
+		}
+	}
+
+	// qemu-img reads blobs by path, so they are verified up front (or while they are
+	// copied out of an archive). Any layer may be a backing file of a flattened one;
+	// nothing is read when nothing is written.
+	if len(disks) == 0 {
+		return commit(res)
+	}
+	src := c.source()
+	var local []v1.Descriptor
+	for _, layer := range layers {
+		if _, ok := src.LocalPath(oci.BlobName(layer.Digest)); ok {
+			local = append(local, layer)
+		}
+	}
+	verifyProgress := pextraoci.NewProgressTracker(c.Progress, pextraoci.ProgressPhaseVerify, local)
+	for _, layer := range local {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := verifyBlob(ctx, src, layer, verifyProgress); err != nil {
+			return nil, fmt.Errorf("failed to verify layer %s (%s): %w", layer.Digest, layer.Annotations[pextraoci.AnnotationPextraQemuFileName], err)
+		}
 	}
 
 	// Prepare temp directory for flattening
-	tempDir, err := c.tempDirWithOriginalFiles()
+	tempDir, err := c.tempDirWithOriginalFiles(ctx, outDir)
 	if err != nil {
-		return fmt.Errorf("failed to prepare temp directory: %w", err)
+		return nil, fmt.Errorf("failed to prepare temp directory: %w", err)
 	}
 	defer os.RemoveAll(tempDir)
 
-	// Flatten layers that have flatten annotation
-	var total int
-	for i := len(layers) - 1; i >= 0; i-- {
-		layer := layers[i]
-		flatten := layer.Annotations[pextraoci.AnnotationPextraQemuFlatten] == "true"
-		if !flatten {
+	// Flatten layers that have flatten annotation. qemu-img reads the whole backing chain
+	// of a layer, so its progress is scaled to the size of the chain.
+	chains := make(map[string]v1.Descriptor)
+	for _, layer := range flattened {
+		chains[layer.Digest.String()] = chainDescriptor(tempDir, layer, layers)
+	}
+	flattenProgress := pextraoci.NewProgressTracker(c.Progress, pextraoci.ProgressPhaseFlatten, slices.Collect(maps.Values(chains)))
+	for i := len(disks) - 1; i >= 0; i-- {
+		disk := disks[i]
+		layer := disk.layer
+		if disk.placed {
 			continue
 		}
 
 		digest := layer.Digest.String()
 		originalFileName := layer.Annotations[pextraoci.AnnotationPextraQemuFileName]
 		layerPath := path.Join(tempDir, originalFileName)
-		outputPath := path.Join(c.OutputDir, originalFileName)
+		outputPath := path.Join(outDir, disk.fileName)
 
-		if err := flattenQemuLayer(layerPath, outputPath); err != nil {
-			return fmt.Errorf("failed to flatten layer %s: %w", digest, err)
+		chain := chains[digest]
+		report := func(percent float64) {
+			flattenProgress.Update(chain, int64(percent/100*float64(chain.Size)))
+		}
+		if err := flattenQemuLayer(ctx, layerPath, outputPath, disk.opts, report); err != nil {
+			return nil, fmt.Errorf("failed to flatten layer %s: %w", digest, err)
 		}
-		total++
+		written = append(written, outputPath)
+		flattenProgress.Finish(chain)
+		res.Layers = append(res.Layers, layer)
+		res.Files = append(res.Files, disk.fileName)
 	}
 
-	fmt.Printf("Flattened %d/%d QEMU layers into directory %s\n", total, len(layers), c.OutputDir)
+	// Place the other layers once nothing reads them from tempDir any more
+	var localPlaced []v1.Descriptor
+	for _, layer := range placed {
+		if _, ok := src.LocalPath(oci.BlobName(layer.Digest)); ok {
+			localPlaced = append(localPlaced, layer)
+		}
+	}
+	copyProgress := pextraoci.NewProgressTracker(c.Progress, pextraoci.ProgressPhaseCopy, localPlaced)
+	for _, disk := range disks {
+		if !disk.placed {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		outputPath := path.Join(outDir, disk.fileName)
+		if err := c.placeLayer(ctx, disk, tempDir, outputPath, copyProgress); err != nil {
+			return nil, fmt.Errorf("failed to place layer %s (%s): %w", disk.layer.Digest, disk.fileName, err)
+		}
+		written = append(written, outputPath)
+		res.Layers = append(res.Layers, disk.layer)
+		res.Files = append(res.Files, disk.fileName)
+	}
+	for i := range disks {
+		if !disks[i].placed {
+			continue
+		}
+		if err := rebaseLayer(ctx, &disks[i], path.Join(outDir, disks[i].fileName), disks); err != nil {
+			return nil, fmt.Errorf("failed to rebase layer %s: %w", disks[i].layer.Digest, err)
+		}
+	}
+	return commit(res)
+}
+
+// Checks the layers and annotations the way the handler validates a manifest
+func (c *QemuConfig) validate() error {
+	errs := handler{}.Validate(&v1.Manifest{Layers: c.Layers, Annotations: c.Annotations})
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid QEMU image: %w", errors.Join(errs...))
+	}
 	return nil
 }
 
-func flattenQemuLayer(layerPath, outputPath string) error {
-	cmd := exec.Command("qemu-img", "convert", "-O", "qcow2", layerPath, outputPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// The disks written into OutputDir, in manifest order: those of the flattened layers
+// and, with UnflattenedCopy, the other layers as they are. Disk overrides the options of
+// the annotations of flattened layers; the result must be a valid combination, and every
+// disk must get a distinct file name.
+func (c *QemuConfig) outputDisks(layers []v1.Descriptor) ([]extractedDisk, error) {
+	switch c.Unflattened {
+	case "", UnflattenedSkip, UnflattenedCopy:
+	default:
+		return nil, fmt.Errorf("unsupported mode %q for unflattened layers (want %s or %s)", c.Unflattened, UnflattenedSkip, UnflattenedCopy)
+	}
+
+	var disks []extractedDisk
+	var errs []error
+	names := make(map[string]string)
+	add := func(disk extractedDisk) {
+		name := disk.layer.Annotations[pextraoci.AnnotationPextraQemuFileName]
+		if prev, dup := names[disk.fileName]; dup {
+			errs = append(errs, fmt.Errorf("layers %s and %s would both be written to %s", prev, name, disk.fileName))
+			return
+		}
+		names[disk.fileName] = name
+		disks = append(disks, disk)
+	}
+	for _, layer := range layers {
+		name := layer.Annotations[pextraoci.AnnotationPextraQemuFileName]
+		if !isFlattened(layer) {
+			if c.Unflattened == UnflattenedCopy {
+				add(extractedDisk{layer: layer, fileName: name, placed: true})
+			}
+			continue
+		}
+		opts, optErrs := parseDiskOptions(layer)
+		if len(optErrs) > 0 {
+			errs = append(errs, fmt.Errorf("layer %s: %w", name, errors.Join(optErrs...)))
+			continue
+		}
+		opts = opts.override(c.Disk)
+		if err := opts.check(); err != nil {
+			errs = append(errs, fmt.Errorf("layer %s: %w", name, err))
+			continue
+		}
+		add(extractedDisk{layer: layer, fileName: diskFileName(name, opts.format()), opts: opts})
+	}
+	return disks, errors.Join(errs...)
+}
+
+// Runs qemu-img convert, writing a disk with opts and passing the percentage it reports
+// to progress. A partially written outputPath is removed if the conversion fails.
+func flattenQemuLayer(ctx context.Context, layerPath, outputPath string, opts DiskOptions, progress func(percent float64)) (err error) {
+	defer func() {
+		if err != nil {
+			os.Remove(outputPath)
+		}
+	}()
+
+	args := append([]string{"convert", "-p"}, opts.convertArgs()...)
+	cmd := utils.CommandContext(ctx, "qemu-img", append(args, layerPath, outputPath)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("qemu-img convert: %w", err)
+	}
+	parseConvertProgress(stdout, progress)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("qemu-img convert: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// Matches the progress qemu-img prints with -p, e.g. "    (42.00/100%)"
+var convertProgressRe = regexp.MustCompile(`\((\d+(?:\.\d+)?)/100%\)`)
+
+// Reads the output of qemu-img convert -p until EOF and calls progress for every
+// percentage in it. The progress line is redrawn with carriage returns.
+func parseConvertProgress(r io.Reader, progress func(percent float64)) {
+	sc := bufio.NewScanner(r)
+	sc.Split(splitLines)
+	for sc.Scan() {
+		m := convertProgressRe.FindSubmatch(sc.Bytes())
+		if m == nil {
+			continue
+		}
+		if percent, err := strconv.ParseFloat(string(m[1]), 64); err == nil {
+			progress(percent)
+		}
+	}
+	// Drain the rest so that qemu-img never blocks on a full pipe
+	_, _ = io.Copy(io.Discard, r)
+}
+
+// Like bufio.ScanLines, but also ends lines at carriage returns
+func splitLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+func isFlattened(layer v1.Descriptor) bool {
+	return layer.Annotations[pextraoci.AnnotationPextraQemuFlatten] == "true"
+}
+
+// Writes the VM definition of kind VMDefinition, if any, into dir, where disks are
+// written. It refers to the disks at their final paths in OutputDir, and is added to
+// res.Files and res.ConfigFile.
+func (c *QemuConfig) writeVMDefinition(dir string, res *pextraoci.ExtractResult, disks []extractedDisk) error {
+	name, err := c.vmDefinitionName()
+	if name == "" || err != nil {
+		return err
+	}
+	if slices.Contains(res.Files, name) {
+		return fmt.Errorf("the VM definition %s has the same file name as a disk", name)
+	}
+
+	outputDir, err := filepath.Abs(c.OutputDir)
+	if err != nil {
+		return err
+	}
+	vmName := c.VMName
+	if vmName == "" {
+		vmName = filepath.Base(outputDir)
+	}
+	spec, err := newVMSpec(vmName, cmp.Or(c.Architecture, runtime.GOARCH), c.Annotations, disks, outputDir)
+	if err != nil {
+		return fmt.Errorf("failed to build VM definition: %w", err)
+	}
+
+	var data []byte
+	perm := os.FileMode(0644)
+	if c.VMDefinition == VMDefinitionQemu {
+		data, err = spec.qemuScript()
+		perm = 0755
+	} else {
+		data, err = spec.libvirtXML()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build VM definition: %w", err)
+	}
+	if err := utils.WriteFileAtomic(filepath.Join(dir, name), data, perm); err != nil {
+		return fmt.Errorf("failed to write VM definition: %w", err)
+	}
+	res.Files = append(res.Files, name)
+	res.ConfigFile = filepath.Join(c.OutputDir, name)
+	return nil
+}
+
+// File name of the VM definition of kind VMDefinition; empty if there is none
+func (c *QemuConfig) vmDefinitionName() (string, error) {
+	switch c.VMDefinition {
+	case "":
+		return "", nil
+	case VMDefinitionQemu:
+		return QemuScriptName, nil
+	case VMDefinitionLibvirt:
+		return LibvirtDomainName, nil
+	}
+	return "", fmt.Errorf("unsupported VM definition %q (want %s or %s)", c.VMDefinition, VMDefinitionQemu, VMDefinitionLibvirt)
 }
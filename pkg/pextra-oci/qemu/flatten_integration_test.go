@@ -18,13 +18,16 @@ limitations under the License.
 package qemu
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/PextraCloud/pce-osi/internal/utils"
 	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -42,9 +45,20 @@ func TestFlattenQemuLayers_WithQemuImg(t *testing.T) {
 	out := t.TempDir()
 
 	// Prepare a real qcow2 blob using qemu-img create
+	src := filepath.Join(t.TempDir(), "disk.qcow2")
+	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", src, "1M")
+	if outb, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("failed to create qcow2 blob: %v; out=%s", err, string(outb))
+	}
+	b, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatalf("read qcow2: %v", err)
+	}
+
 	desc := v1.Descriptor{
 		MediaType: pextraoci.MediaTypePextraImageLayerQcow2,
-		Digest:    v1.Descriptor{Digest: "sha256:cafebabe"}.Digest,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
 		Annotations: map[string]string{
 			pextraoci.AnnotationPextraQemuFileName: "disk.qcow2",
 			pextraoci.AnnotationPextraQemuFlatten:  "true",
@@ -55,9 +69,8 @@ func TestFlattenQemuLayers_WithQemuImg(t *testing.T) {
 	if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
 		t.Fatalf("mkdir blobs dir: %v", err)
 	}
-	cmd := exec.Command("qemu-img", "create", "-f", "qcow2", blob, "1M")
-	if outb, err := cmd.CombinedOutput(); err != nil {
-		t.Skipf("failed to create qcow2 blob: %v; out=%s", err, string(outb))
+	if err := os.WriteFile(blob, b, 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
 	}
 
 	cfg := &QemuConfig{Layers: []v1.Descriptor{desc}, ImgPath: img, OutputDir: out}
@@ -75,3 +88,53 @@ func TestFlattenQemuLayers_WithQemuImg(t *testing.T) {
 		t.Fatalf("expected non-empty output file")
 	}
 }
+
+func TestFlatten_UnflattenedWithQemuImg(t *testing.T) {
+	requireQemuImg(t)
+
+	// An overlay whose backing file is where it was built, and a base it is built on
+	img := t.TempDir()
+	work := t.TempDir()
+	var layers []v1.Descriptor
+	for _, args := range [][]string{
+		{"base.qcow2"},
+		{"overlay.qcow2", "-u", "-b", "/build/base.qcow2", "-F", "qcow2"},
+	} {
+		p := filepath.Join(work, args[0])
+		cmd := exec.Command("qemu-img", append(append([]string{"create", "-f", "qcow2"}, args[1:]...), p, "1M")...)
+		if outb, err := cmd.CombinedOutput(); err != nil {
+			t.Skipf("failed to create qcow2 blob: %v; out=%s", err, string(outb))
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("read qcow2: %v", err)
+		}
+		desc := v1.Descriptor{
+			MediaType:   pextraoci.MediaTypePextraImageLayerQcow2,
+			Digest:      digest.FromBytes(b),
+			Size:        int64(len(b)),
+			Annotations: map[string]string{pextraoci.AnnotationPextraQemuFileName: args[0]},
+		}
+		blob := utils.BlobPath(img, desc.Digest.String())
+		if err := os.MkdirAll(filepath.Dir(blob), 0o755); err != nil {
+			t.Fatalf("mkdir blobs dir: %v", err)
+		}
+		if err := os.WriteFile(blob, b, 0o644); err != nil {
+			t.Fatalf("write blob: %v", err)
+		}
+		layers = append(layers, desc)
+	}
+
+	out := t.TempDir()
+	cfg := &QemuConfig{Layers: layers, ImgPath: img, OutputDir: out, Unflattened: UnflattenedCopy}
+	if _, err := cfg.Flatten(context.Background()); err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	if backing, err := readBackingFile(filepath.Join(out, "overlay.qcow2")); backing != "base.qcow2" || err != nil {
+		t.Fatalf("got backing file %q (err=%v)", backing, err)
+	}
+	outb, err := exec.Command("qemu-img", "info", "--backing-chain", filepath.Join(out, "overlay.qcow2")).CombinedOutput()
+	if err != nil || !strings.Contains(string(outb), filepath.Join(out, "base.qcow2")) {
+		t.Fatalf("backing chain does not resolve in the output directory: %v; out=%s", err, outb)
+	}
+}
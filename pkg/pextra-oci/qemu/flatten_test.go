@@ -16,12 +16,19 @@ limitations under the License.
 package qemu
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/PextraCloud/pce-osi/internal/utils"
 	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -69,3 +76,263 @@ func TestFlattenQemuLayers_NoFlatten_NoOutput(t *testing.T) {
 		t.Fatalf("expected no output file when flatten=false; stat err=%v", err)
 	}
 }
+
+func TestFlattenQemuLayers_DigestMismatch(t *testing.T) {
+	img := t.TempDir()
+	out := t.TempDir()
+
+	desc := v1.Descriptor{
+		MediaType: pextraoci.MediaTypePextraImageLayerQcow2,
+		Digest:    digest.FromString("qcow2"),
+		Size:      5,
+		Annotations: map[string]string{
+			pextraoci.AnnotationPextraQemuFileName: "disk.qcow2",
+			pextraoci.AnnotationPextraQemuFlatten:  "true",
+		},
+	}
+	src := utils.BlobPath(img, desc.Digest.String())
+	if err := os.MkdirAll(filepath.Dir(src), 0o755); err != nil {
+		t.Fatalf("mkdir blobs dir: %v", err)
+	}
+	if err := os.WriteFile(src, []byte("QCOW2"), 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+
+	cfg := &QemuConfig{Layers: []v1.Descriptor{desc}, ImgPath: img, OutputDir: out}
+	err := cfg.FlattenQemuLayers()
+	if !errors.Is(err, utils.ErrDigestMismatch) {
+		t.Fatalf("expected ErrDigestMismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "disk.qcow2") {
+		t.Fatalf("expected error to name the layer, got %v", err)
+	}
+}
+
+func TestParseConvertProgress(t *testing.T) {
+	out := "    (0.00/100%)\r    (1.01/100%)\r    (50.00/100%)\r    (100.00/100%)\r\n"
+	var got []float64
+	parseConvertProgress(strings.NewReader(out), func(p float64) { got = append(got, p) })
+	want := []float64{0, 1.01, 50, 100}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// Puts a fake qemu-img on PATH that reports some progress, writes part of its output
+// file and then hangs, like a long conversion
+func fakeHangingQemuImg(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"for out; do :; done\n" +
+		"echo partial > \"$out\"\n" +
+		"printf '    (0.00/100%%)\\r    (10.00/100%%)\\r'\n" +
+		"sleep 30 &\n" +
+		"wait\n"
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake qemu-img: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestFlattenQemuLayer_Cancel(t *testing.T) {
+	fakeHangingQemuImg(t)
+
+	out := filepath.Join(t.TempDir(), "disk.qcow2")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var progress []float64
+	start := time.Now()
+	err := flattenQemuLayer(ctx, "in.qcow2", out, DiskOptions{}, func(p float64) {
+		progress = append(progress, p)
+		if p == 10 {
+			cancel()
+		}
+	})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("qemu-img was not killed (took %v)", d)
+	}
+	if len(progress) != 2 {
+		t.Fatalf("unexpected progress %v", progress)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("expected partial output to be removed, stat err=%v", err)
+	}
+}
+
+// Puts a fake qemu-img on PATH that copies its input to its output, and fails for
+// inputs named bad.qcow2; rebase does nothing. Returns the file its arguments are
+// appended to, one line per run.
+func fakeQemuImg(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	dir := t.TempDir()
+	log := filepath.Join(dir, "args")
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> '" + log + "'\n" +
+		"[ \"$1\" = rebase ] && exit 0\n" +
+		"for out; do :; done\n" +
+		"eval in=\\${$(($# - 1))}\n" +
+		"cat \"$in\" > \"$out\"\n" +
+		"case \"$in\" in */bad.qcow2) echo 'qemu-img: broken image' >&2; exit 1;; esac\n"
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0o755); err != nil {
+		t.Fatalf("write fake qemu-img: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+// Writes a flattened qcow2 layer blob holding content into img
+func writeQcow2Blob(t *testing.T, img, fileName, content string) v1.Descriptor {
+	t.Helper()
+	desc := v1.Descriptor{
+		MediaType: pextraoci.MediaTypePextraImageLayerQcow2,
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+		Annotations: map[string]string{
+			pextraoci.AnnotationPextraQemuFileName: fileName,
+			pextraoci.AnnotationPextraQemuFlatten:  "true",
+		},
+	}
+	p := utils.BlobPath(img, desc.Digest.String())
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("mkdir blobs dir: %v", err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	return desc
+}
+
+func TestFlatten_Staged(t *testing.T) {
+	fakeQemuImg(t)
+	img := t.TempDir()
+	good := writeQcow2Blob(t, img, "disk0.qcow2", "new disk0")
+	bad := writeQcow2Blob(t, img, "bad.qcow2", "bad")
+
+	for _, inPlace := range []bool{false, true} {
+		out := t.TempDir()
+		if err := os.WriteFile(filepath.Join(out, "disk0.qcow2"), []byte("old disk0"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		// Layers are flattened last to first, so disk0 is written before bad fails
+		c := &QemuConfig{Layers: []v1.Descriptor{bad, good}, ImgPath: img, OutputDir: out, InPlace: inPlace}
+		if _, err := c.Flatten(context.Background()); err == nil || !strings.Contains(err.Error(), "broken image") {
+			t.Fatalf("expected qemu-img error, got %v", err)
+		}
+		want := "old disk0"
+		if inPlace {
+			want = "new disk0"
+		}
+		if b, _ := os.ReadFile(filepath.Join(out, "disk0.qcow2")); string(b) != want {
+			t.Fatalf("in place: %v: disk0.qcow2 holds %q, want %q", inPlace, b, want)
+		}
+		entries, _ := os.ReadDir(out)
+		if len(entries) != 1 {
+			t.Fatalf("in place: %v: expected only disk0.qcow2 in the output directory, got %v", inPlace, entries)
+		}
+	}
+
+	out := t.TempDir()
+	res, err := (&QemuConfig{Layers: []v1.Descriptor{good}, ImgPath: img, OutputDir: out}).Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(out, "disk0.qcow2")); string(b) != "new disk0" || len(res.Files) != 1 {
+		t.Fatalf("unexpected output %q, result %+v", b, res)
+	}
+	if entries, _ := os.ReadDir(out); len(entries) != 1 {
+		t.Fatalf("expected the staging directory to be removed, got %v", entries)
+	}
+}
+
+func TestFlatten_VMDefinition(t *testing.T) {
+	fakeQemuImg(t)
+	img := t.TempDir()
+	disk := writeQcow2Blob(t, img, "disk0.qcow2", "disk0")
+
+	for _, inPlace := range []bool{false, true} {
+		out := t.TempDir()
+		c := &QemuConfig{Layers: []v1.Descriptor{disk}, ImgPath: img, OutputDir: out, InPlace: inPlace,
+			VMDefinition: VMDefinitionLibvirt, VMName: "vm", Architecture: "amd64"}
+		res, err := c.Flatten(context.Background())
+		if err != nil {
+			t.Fatalf("Flatten error: %v", err)
+		}
+		if want := filepath.Join(out, LibvirtDomainName); res.ConfigFile != want || len(res.Files) != 2 {
+			t.Fatalf("unexpected result %+v", res)
+		}
+		b, err := os.ReadFile(res.ConfigFile)
+		if err != nil || !strings.Contains(string(b), `<source file="`+filepath.Join(out, "disk0.qcow2")+`">`) {
+			t.Fatalf("unexpected domain XML (err=%v):\n%s", err, b)
+		}
+	}
+
+	c := &QemuConfig{Layers: []v1.Descriptor{disk}, ImgPath: img, OutputDir: t.TempDir(), VMDefinition: "vmware"}
+	if _, err := c.Flatten(context.Background()); err == nil || !strings.Contains(err.Error(), "unsupported VM definition") {
+		t.Fatalf("expected an unsupported VM definition error, got %v", err)
+	}
+}
+
+func TestFlatten_DiskFormat(t *testing.T) {
+	log := fakeQemuImg(t)
+	img := t.TempDir()
+	boot := writeQcow2Blob(t, img, "boot.qcow2", "boot")
+	boot.Annotations[pextraoci.AnnotationPextraQemuClusterSize] = "1M"
+	data := writeQcow2Blob(t, img, "data.img", "data")
+	data.Annotations[pextraoci.AnnotationPextraQemuDiskFormat] = DiskFormatRaw
+	data.Annotations[pextraoci.AnnotationPextraQemuPreallocation] = "full"
+
+	out := t.TempDir()
+	c := &QemuConfig{Layers: []v1.Descriptor{boot, data}, ImgPath: img, OutputDir: out,
+		VMDefinition: VMDefinitionQemu, Architecture: "amd64"}
+	res, err := c.Flatten(context.Background())
+	if err != nil {
+		t.Fatalf("Flatten error: %v", err)
+	}
+	if want := []string{"data.raw", "boot.qcow2", QemuScriptName}; !slices.Equal(res.Files, want) {
+		t.Fatalf("got files %v, want %v", res.Files, want)
+	}
+	if b, _ := os.ReadFile(filepath.Join(out, "data.raw")); string(b) != "data" {
+		t.Fatalf("data.raw holds %q", b)
+	}
+	b, _ := os.ReadFile(log)
+	args := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(args) != 2 || !strings.HasPrefix(args[0], "convert -p -O raw -o preallocation=full ") ||
+		!strings.HasPrefix(args[1], "convert -p -O qcow2 -o cluster_size=1048576 ") {
+		t.Fatalf("unexpected qemu-img arguments %q", args)
+	}
+	if b, _ := os.ReadFile(res.ConfigFile); !strings.Contains(string(b), ",format=raw,") {
+		t.Fatalf("expected the VM definition to use the raw disk, got:\n%s", b)
+	}
+
+	// data.qcow2 is only renamed when the run selects raw for every disk
+	data2 := writeQcow2Blob(t, img, "data.qcow2", "data2")
+	c = &QemuConfig{Layers: []v1.Descriptor{data2, data}, ImgPath: img, OutputDir: t.TempDir(),
+		Disk: DiskOptions{Format: DiskFormatRaw}}
+	if _, err := c.Flatten(context.Background()); err == nil || !strings.Contains(err.Error(), "both be written to") {
+		t.Fatalf("expected a file name clash, got %v", err)
+	}
+	c.Disk = DiskOptions{Format: DiskFormatVhdx, Preallocation: "full"}
+	if _, err := c.Flatten(context.Background()); err == nil || !strings.Contains(err.Error(), "cannot be preallocated") {
+		t.Fatalf("expected a preallocation error, got %v", err)
+	}
+	c.Disk = DiskOptions{ClusterSize: 64 << 10}
+	if _, err := c.Flatten(context.Background()); err == nil || !strings.Contains(err.Error(), "layer data.img: cluster size only applies to qcow2") {
+		t.Fatalf("expected a cluster size error for the raw disk, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func init() {
+	pextraoci.Register(handler{})
+}
+
+// Implements the qemu image type for pextraoci
+type handler struct{}
+
+func (handler) Type() string { return pextraoci.PextraImageTypeQemu }
+
+func (handler) MediaTypes() []string {
+	return []string{pextraoci.MediaTypePextraImageLayerQcow2}
+}
+
+// qcow2 layers need a unique one-level file name, a boolean flatten annotation, valid
+// VM settings and valid disk options, and the manifest valid VM settings; other layers
+// are left alone
+func (handler) Validate(manifest *v1.Manifest) []error {
+	settings, errs := parseVMSettings(manifest.Annotations)
+	fileNames := make(map[string]int)
+	bootIndexes := make(map[int]int)
+	for i, l := range manifest.Layers {
+		if l.MediaType != pextraoci.MediaTypePextraImageLayerQcow2 {
+			continue
+		}
+
+		name, ok := l.Annotations[pextraoci.AnnotationPextraQemuFileName]
+		switch {
+		case !ok || name == "":
+			errs = append(errs, fmt.Errorf("layers[%d]: missing %s annotation", i, pextraoci.AnnotationPextraQemuFileName))
+		case !isOneLevelFileName(name):
+			errs = append(errs, fmt.Errorf("layers[%d]: %s %q must be a single path component", i, pextraoci.AnnotationPextraQemuFileName, name))
+		default:
+			if prev, dup := fileNames[name]; dup {
+				errs = append(errs, fmt.Errorf("layers[%d]: %s %q already used by layers[%d]", i, pextraoci.AnnotationPextraQemuFileName, name, prev))
+			} else {
+				fileNames[name] = i
+			}
+		}
+
+		if flatten, ok := l.Annotations[pextraoci.AnnotationPextraQemuFlatten]; ok && flatten != "true" && flatten != "false" {
+			errs = append(errs, fmt.Errorf("layers[%d]: %s must be \"true\" or \"false\", got %q", i, pextraoci.AnnotationPextraQemuFlatten, flatten))
+		}
+
+		bus, bootIndex, diskErrs := parseDiskSettings(l)
+		_, optErrs := parseDiskOptions(l)
+		for _, err := range append(diskErrs, optErrs...) {
+			errs = append(errs, fmt.Errorf("layers[%d]: %w", i, err))
+		}
+		// The default machine depends on the architecture, which is checked when the VM
+		// definition is written
+		if _, ok := ideBus(settings.machine); bus == "ide" && settings.machine != "" && !ok {
+			errs = append(errs, fmt.Errorf("layers[%d]: machine %s has no IDE controller", i, settings.machine))
+		}
+		if prev, dup := bootIndexes[bootIndex]; dup && bootIndex > 0 {
+			errs = append(errs, fmt.Errorf("layers[%d]: %s %d already used by layers[%d]", i, pextraoci.AnnotationPextraQemuBootIndex, bootIndex, prev))
+		} else if bootIndex > 0 {
+			bootIndexes[bootIndex] = i
+		}
+	}
+	return errs
+}
+
+func (handler) Extract(ctx context.Context, img *pextraoci.Image, outputDir string, opts pextraoci.ExtractOptions) (*pextraoci.ExtractResult, error) {
+	c := NewFromSource(img.Manifest.Layers, img.Layout.Source(), outputDir)
+	c.Progress = opts.Progress
+	c.InPlace = opts.InPlace
+	c.Annotations = img.Manifest.Annotations
+	c.VMName = img.Descriptor.Annotations[v1.AnnotationRefName]
+	if img.Config != nil {
+		c.Architecture = img.Config.Architecture
+	}
+	switch o := opts.TypeOptions[pextraoci.PextraImageTypeQemu].(type) {
+	case nil:
+	case ExtractOptions:
+		c.VMDefinition = o.VMDefinition
+		c.Disk = o.Disk
+		c.Unflattened = o.Unflattened
+	default:
+		return nil, fmt.Errorf("unexpected QEMU options of type %T", o)
+	}
+	return c.Flatten(ctx)
+}
+
+// The file name, flatten flag, bus, boot index and disk format of qcow2 layers
+func (handler) DescribeLayer(layer v1.Descriptor) map[string]any {
+	if layer.MediaType != pextraoci.MediaTypePextraImageLayerQcow2 {
+		return nil
+	}
+	details := map[string]any{"flatten": isFlattened(layer)}
+	if name := layer.Annotations[pextraoci.AnnotationPextraQemuFileName]; name != "" {
+		details["fileName"] = name
+	}
+	if bus, bootIndex, errs := parseDiskSettings(layer); len(errs) == 0 {
+		if _, ok := layer.Annotations[pextraoci.AnnotationPextraQemuBus]; ok {
+			details["bus"] = bus
+		}
+		if bootIndex > 0 {
+			details["bootIndex"] = bootIndex
+		}
+	}
+	if opts, errs := parseDiskOptions(layer); len(errs) == 0 && opts.Format != "" {
+		details["diskFormat"] = opts.Format
+	}
+	return details
+}
+
+func isOneLevelFileName(name string) bool {
+	return name != "." && name != ".." && !strings.ContainsAny(name, `/\`) && !strings.ContainsRune(name, 0)
+}
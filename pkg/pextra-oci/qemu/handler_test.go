@@ -0,0 +1,107 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"strings"
+	"testing"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func qcow2Layer(annotations map[string]string) v1.Descriptor {
+	return v1.Descriptor{MediaType: pextraoci.MediaTypePextraImageLayerQcow2, Annotations: annotations}
+}
+
+func TestHandler_Validate(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		m := &v1.Manifest{Layers: []v1.Descriptor{
+			qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "base.qcow2"}),
+			qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "disk0.qcow2", pextraoci.AnnotationPextraQemuFlatten: "true"}),
+		}}
+		if errs := (handler{}).Validate(m); len(errs) != 0 {
+			t.Fatalf("expected no errors, got %v", errs)
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		m := &v1.Manifest{Layers: []v1.Descriptor{
+			qcow2Layer(nil),
+			qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "dir/disk.qcow2"}),
+			qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "disk0.qcow2"}),
+			qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "disk0.qcow2", pextraoci.AnnotationPextraQemuFlatten: "yes"}),
+		}}
+		errs := handler{}.Validate(m)
+		want := []string{"layers[0]: missing", "layers[1]: ", "layers[3]: " + pextraoci.AnnotationPextraQemuFileName, "layers[3]: " + pextraoci.AnnotationPextraQemuFlatten}
+		if len(errs) != len(want) {
+			t.Fatalf("expected %d errors, got %v", len(want), errs)
+		}
+		for i := range want {
+			if !strings.HasPrefix(errs[i].Error(), want[i]) {
+				t.Errorf("error %d: got %q, want prefix %q", i, errs[i], want[i])
+			}
+		}
+	})
+	t.Run("VM settings", func(t *testing.T) {
+		m := &v1.Manifest{
+			Annotations: map[string]string{
+				pextraoci.AnnotationPextraQemuFirmware:  "coreboot",
+				pextraoci.AnnotationPextraQemuMemoryMiB: "0",
+				pextraoci.AnnotationPextraQemuCPUs:      "2",
+				pextraoci.AnnotationPextraQemuMachine:   "virt",
+			},
+			Layers: []v1.Descriptor{
+				qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "a.qcow2", pextraoci.AnnotationPextraQemuBootIndex: "1"}),
+				qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "b.qcow2", pextraoci.AnnotationPextraQemuBootIndex: "1", pextraoci.AnnotationPextraQemuBus: "usb"}),
+				qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "c.qcow2", pextraoci.AnnotationPextraQemuDiskFormat: DiskFormatRaw, pextraoci.AnnotationPextraQemuCompress: "true"}),
+				qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "d.qcow2", pextraoci.AnnotationPextraQemuBus: "ide"}),
+			},
+		}
+		errs := handler{}.Validate(m)
+		want := []string{
+			"annotation " + pextraoci.AnnotationPextraQemuFirmware,
+			"annotation " + pextraoci.AnnotationPextraQemuMemoryMiB,
+			"layers[1]: " + pextraoci.AnnotationPextraQemuBus,
+			"layers[1]: " + pextraoci.AnnotationPextraQemuBootIndex + " 1 already used by layers[0]",
+			"layers[2]: raw disks cannot be compressed",
+			"layers[3]: machine virt has no IDE controller",
+		}
+		if len(errs) != len(want) {
+			t.Fatalf("expected %d errors, got %v", len(want), errs)
+		}
+		for i := range want {
+			if !strings.HasPrefix(errs[i].Error(), want[i]) {
+				t.Errorf("error %d: got %q, want prefix %q", i, errs[i], want[i])
+			}
+		}
+	})
+}
+
+func TestHandler_DescribeLayer(t *testing.T) {
+	got := handler{}.DescribeLayer(qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: "disk0.qcow2", pextraoci.AnnotationPextraQemuFlatten: "true"}))
+	if got["fileName"] != "disk0.qcow2" || got["flatten"] != true {
+		t.Fatalf("unexpected details %v", got)
+	}
+	if got := (handler{}).DescribeLayer(qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuDiskFormat: DiskFormatVmdk})); got["diskFormat"] != DiskFormatVmdk {
+		t.Fatalf("unexpected details %v", got)
+	}
+	if got := (handler{}).DescribeLayer(qcow2Layer(nil)); got["flatten"] != false || got["fileName"] != nil || got["diskFormat"] != nil {
+		t.Fatalf("unexpected details %v", got)
+	}
+	if got := (handler{}).DescribeLayer(v1.Descriptor{MediaType: v1.MediaTypeImageLayer}); got != nil {
+		t.Fatalf("expected no details for other layers, got %v", got)
+	}
+}
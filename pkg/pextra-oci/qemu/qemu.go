@@ -16,13 +16,50 @@ limitations under the License.
 package qemu
 
 import (
+	"context"
+
+	"github.com/PextraCloud/pce-osi/internal/oci"
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type QemuConfig struct {
-	Layers    []v1.Descriptor
-	ImgPath   string
+	Layers  []v1.Descriptor
+	ImgPath string
+	// Where blobs are read from; a directory source for ImgPath if nil
+	Source    oci.Source
 	OutputDir string
+	// Receives progress events while blobs are verified, copied and flattened; may be nil
+	Progress pextraoci.ProgressFunc
+	// Write the flattened images into OutputDir directly instead of moving them there
+	// once they have all been written
+	InPlace bool
+	// Kind of VM definition to write next to the images, VMDefinitionQemu or
+	// VMDefinitionLibvirt; none if empty
+	VMDefinition string
+	// Name of the VM; defaults to the base name of OutputDir
+	VMName string
+	// GOARCH value of the image and its manifest annotations, which the VM definition
+	// is built from; Architecture defaults to the host's
+	Architecture string
+	Annotations  map[string]string
+	// Disk format and qemu-img options of the flattened images, overriding those of the
+	// org.pextra.qcow2.* annotations of the layers
+	Disk DiskOptions
+	// What is done with layers that are not flattened, UnflattenedSkip (the default) or
+	// UnflattenedCopy
+	Unflattened string
+}
+
+// Options of QEMU extraction, passed to pextraoci.Extract as
+// ExtractOptions.TypeOptions[pextraoci.PextraImageTypeQemu]
+type ExtractOptions struct {
+	// See QemuConfig.VMDefinition
+	VMDefinition string
+	// See QemuConfig.Disk
+	Disk DiskOptions
+	// See QemuConfig.Unflattened
+	Unflattened string
 }
 
 func New(layers []v1.Descriptor, imgPath, outputDir string) *QemuConfig {
@@ -33,4 +70,24 @@ func New(layers []v1.Descriptor, imgPath, outputDir string) *QemuConfig {
 	}
 }
 
-// TODO copy over cdrom, and qcow2's that are "independent"
+// Like New, but reads the blobs from src, e.g. an OCI archive
+func NewFromSource(layers []v1.Descriptor, src oci.Source, outputDir string) *QemuConfig {
+	return &QemuConfig{
+		Layers:    layers,
+		ImgPath:   src.String(),
+		Source:    src,
+		OutputDir: outputDir,
+	}
+}
+
+// Flattens the qcow2 layers of a QEMU image marked for flattening into outputDir
+func Extract(ctx context.Context, img *pextraoci.Image, outputDir string) (*pextraoci.ExtractResult, error) {
+	return NewFromSource(img.Manifest.Layers, img.Layout.Source(), outputDir).Flatten(ctx)
+}
+
+func (c *QemuConfig) source() oci.Source {
+	if c.Source != nil {
+		return c.Source
+	}
+	return oci.NewDirSource(c.ImgPath)
+}
@@ -16,32 +16,84 @@ limitations under the License.
 package qemu
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path"
 
+	"github.com/PextraCloud/pce-osi/internal/oci"
 	"github.com/PextraCloud/pce-osi/internal/utils"
 	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func (c *QemuConfig) tempDirWithOriginalFiles() (string, error) {
-	tempDir, err := os.MkdirTemp("", "pce-oci-qemu-flatten-")
+// Creates a temporary directory in which every qcow2 layer appears under its original
+// file name, so that backing file references resolve. Blobs on the local filesystem are
+// symlinked; blobs from archives are copied out (and verified on the way). The
+// directory is created in parent.
+func (c *QemuConfig) tempDirWithOriginalFiles(ctx context.Context, parent string) (string, error) {
+	tempDir, err := os.MkdirTemp(parent, ".pce-oci-qemu-flatten-")
 	if err != nil {
 		return "", fmt.Errorf("failed to create temporary directory: %w", err)
 	}
 
-	for _, layer := range c.Layers {
+	src := c.source()
+	layers := utils.GetLayersByMediaType(c.Layers, pextraoci.MediaTypePextraImageLayerQcow2)
+	var archived []v1.Descriptor
+	for _, layer := range layers {
+		if _, ok := src.LocalPath(oci.BlobName(layer.Digest)); !ok {
+			archived = append(archived, layer)
+		}
+	}
+	progress := pextraoci.NewProgressTracker(c.Progress, pextraoci.ProgressPhaseCopy, archived)
+	for _, layer := range layers {
 		digest := layer.Digest.String()
-		originalFileName := layer.Annotations[pextraoci.AnnotationPextraQemuFileName] // TODO: validate that this exists earlier
-
-		srcPath := utils.BlobPath(c.ImgPath, digest)
+		originalFileName := layer.Annotations[pextraoci.AnnotationPextraQemuFileName]
 		destPath := path.Join(tempDir, originalFileName)
 
-		// Create a symlink to the original file
-		if err := os.Symlink(srcPath, destPath); err != nil {
-			return "", fmt.Errorf("failed to create symlink for layer %s: %w", digest, err)
+		if srcPath, ok := src.LocalPath(oci.BlobName(layer.Digest)); ok {
+			// Create a symlink to the original file
+			if err := os.Symlink(srcPath, destPath); err != nil {
+				os.RemoveAll(tempDir)
+				return "", fmt.Errorf("failed to create symlink for layer %s: %w", digest, err)
+			}
+			continue
+		}
+		if err := copyBlob(ctx, src, layer, destPath, progress); err != nil {
+			os.RemoveAll(tempDir)
+			return "", fmt.Errorf("failed to copy layer %s (%s): %w", digest, originalFileName, err)
 		}
 	}
 
 	return tempDir, nil
 }
+
+func copyBlob(ctx context.Context, src oci.Source, layer v1.Descriptor, destPath string, progress *pextraoci.ProgressTracker) error {
+	r, err := oci.OpenBlob(src, layer)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := utils.CopySparse(f, progress.Reader(utils.NewContextReader(ctx, r), layer)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Like oci.VerifyBlob, reporting the bytes read to progress and stopping when ctx is done
+func verifyBlob(ctx context.Context, src oci.Source, layer v1.Descriptor, progress *pextraoci.ProgressTracker) error {
+	r, err := oci.OpenBlob(src, layer)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(io.Discard, progress.Reader(utils.NewContextReader(ctx, r), layer))
+	return err
+}
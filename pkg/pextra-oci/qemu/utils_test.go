@@ -16,12 +16,16 @@ limitations under the License.
 package qemu
 
 import (
+	"archive/tar"
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/PextraCloud/pce-osi/internal/oci"
 	"github.com/PextraCloud/pce-osi/internal/utils"
 	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -55,7 +59,7 @@ func TestTempDirWithOriginalFiles_SymlinksCreated(t *testing.T) {
 	}
 
 	cfg := &QemuConfig{Layers: layers, ImgPath: img, OutputDir: out}
-	tmp, err := cfg.tempDirWithOriginalFiles()
+	tmp, err := cfg.tempDirWithOriginalFiles(context.Background(), out)
 	if err != nil {
 		t.Fatalf("tempDirWithOriginalFiles error: %v", err)
 	}
@@ -82,3 +86,53 @@ func TestTempDirWithOriginalFiles_SymlinksCreated(t *testing.T) {
 		}
 	}
 }
+
+func TestTempDirWithOriginalFiles_CopiesFromArchive(t *testing.T) {
+	content := []byte("qcow2")
+	layer := v1.Descriptor{
+		MediaType:   pextraoci.MediaTypePextraImageLayerQcow2,
+		Digest:      digest.FromBytes(content),
+		Size:        int64(len(content)),
+		Annotations: map[string]string{pextraoci.AnnotationPextraQemuFileName: "disk.qcow2"},
+	}
+
+	// Archive entries have no local path, so the blob must be copied out
+	archive := filepath.Join(t.TempDir(), "image.tar")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatalf("create archive: %v", err)
+	}
+	tw := tar.NewWriter(f)
+	if err := tw.WriteHeader(&tar.Header{Name: oci.BlobName(layer.Digest), Mode: 0o644, Size: layer.Size}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %v", err)
+	}
+	f.Close()
+
+	src, err := oci.OpenSource(archive)
+	if err != nil {
+		t.Fatalf("OpenSource error: %v", err)
+	}
+	defer src.Close()
+
+	cfg := NewFromSource([]v1.Descriptor{layer}, src, t.TempDir())
+	tmp, err := cfg.tempDirWithOriginalFiles(context.Background(), cfg.OutputDir)
+	if err != nil {
+		t.Fatalf("tempDirWithOriginalFiles error: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	p := filepath.Join(tmp, "disk.qcow2")
+	info, err := os.Lstat(p)
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("expected a regular file at %s (err=%v)", p, err)
+	}
+	if got, _ := os.ReadFile(p); string(got) != string(content) {
+		t.Fatalf("unexpected copied content %q", got)
+	}
+}
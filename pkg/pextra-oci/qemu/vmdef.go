@@ -0,0 +1,513 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"cmp"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Kinds of VM definition that can be written next to the extracted disks
+const (
+	// A shell script that runs qemu-system-* with the VM's command line
+	VMDefinitionQemu = "qemu"
+	// A libvirt domain XML file, e.g. for virsh define
+	VMDefinitionLibvirt = "libvirt"
+)
+
+// File names of the VM definitions in the output directory
+const (
+	QemuScriptName    = "vm.sh"
+	LibvirtDomainName = "domain.xml"
+)
+
+// Firmware values of the AnnotationPextraQemuFirmware annotation
+const (
+	FirmwareBIOS = "bios"
+	FirmwareUEFI = "uefi"
+)
+
+// Settings used when an image does not recommend any
+const (
+	defaultCPUs      = 1
+	defaultMemoryMiB = 1024
+	defaultNICModel  = "virtio"
+	defaultBus       = "virtio"
+)
+
+// How a GOARCH value is called by QEMU and libvirt, and what it boots with by default
+type vmArch struct {
+	// Suffix of the qemu-system-* binary
+	qemu    string
+	libvirt string
+	machine string
+	// UEFI firmware code for the QEMU command line, at the path the Debian and Ubuntu
+	// packages install it to; empty if there is none
+	uefiCode    string
+	defaultUEFI bool
+}
+
+var vmArchs = map[string]vmArch{
+	"386":     {qemu: "i386", libvirt: "i686", machine: "q35"},
+	"amd64":   {qemu: "x86_64", libvirt: "x86_64", machine: "q35", uefiCode: "/usr/share/OVMF/OVMF_CODE.fd"},
+	"arm64":   {qemu: "aarch64", libvirt: "aarch64", machine: "virt", uefiCode: "/usr/share/AAVMF/AAVMF_CODE.fd", defaultUEFI: true},
+	"ppc64le": {qemu: "ppc64", libvirt: "ppc64le", machine: "pseries"},
+	"riscv64": {qemu: "riscv64", libvirt: "riscv64", machine: "virt"},
+	"s390x":   {qemu: "s390x", libvirt: "s390x", machine: "s390-ccw-virtio"},
+}
+
+// QEMU devices of the NIC models of the AnnotationPextraQemuNICModel annotation, which
+// are named like libvirt's; "none" leaves the VM without a NIC
+var nicModels = map[string]string{
+	"virtio":  "virtio-net",
+	"e1000":   "e1000",
+	"e1000e":  "e1000e",
+	"rtl8139": "rtl8139",
+	"vmxnet3": "vmxnet3",
+	"none":    "",
+}
+
+// libvirt target device prefixes of the buses of the AnnotationPextraQemuBus annotation
+var diskBuses = map[string]string{
+	"virtio": "vd",
+	"scsi":   "sd",
+	"sata":   "sd",
+	"ide":    "hd",
+}
+
+// The AHCI controller of sata disks has this many ports
+const sataPorts = 6
+
+// The bus ide disks are attached to on machine: ide on the i440FX machines of x86, and
+// sata on q35, which has no IDE controller; false if the machine has neither
+func ideBus(machine string) (string, bool) {
+	switch {
+	case machine == "pc" || machine == "isapc" || strings.HasPrefix(machine, "pc-i440fx-"):
+		return "ide", true
+	case machine == "q35" || strings.HasPrefix(machine, "pc-q35-"):
+		return "sata", true
+	}
+	return "", false
+}
+
+var machinePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// VM settings recommended by the annotations of a QEMU image manifest; zero values
+// are not set
+type vmSettings struct {
+	machine   string
+	firmware  string
+	cpus      int
+	memoryMiB int
+	nicModel  string
+}
+
+// Reads the VM settings of a manifest's annotations
+func parseVMSettings(annotations map[string]string) (vmSettings, []error) {
+	var s vmSettings
+	var errs []error
+	positive := func(key string) int {
+		v, ok := annotations[key]
+		if !ok {
+			return 0
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			errs = append(errs, fmt.Errorf("annotation %s: %q is not a positive integer", key, v))
+			return 0
+		}
+		return n
+	}
+
+	if v, ok := annotations[pextraoci.AnnotationPextraQemuMachine]; ok {
+		if !machinePattern.MatchString(v) {
+			errs = append(errs, fmt.Errorf("annotation %s: invalid machine type %q", pextraoci.AnnotationPextraQemuMachine, v))
+		}
+		s.machine = v
+	}
+	if v, ok := annotations[pextraoci.AnnotationPextraQemuFirmware]; ok {
+		if v != FirmwareBIOS && v != FirmwareUEFI {
+			errs = append(errs, fmt.Errorf("annotation %s: must be %q or %q, got %q", pextraoci.AnnotationPextraQemuFirmware, FirmwareBIOS, FirmwareUEFI, v))
+		}
+		s.firmware = v
+	}
+	s.cpus = positive(pextraoci.AnnotationPextraQemuCPUs)
+	s.memoryMiB = positive(pextraoci.AnnotationPextraQemuMemoryMiB)
+	if v, ok := annotations[pextraoci.AnnotationPextraQemuNICModel]; ok {
+		if _, known := nicModels[v]; !known {
+			errs = append(errs, fmt.Errorf("annotation %s: unknown NIC model %q", pextraoci.AnnotationPextraQemuNICModel, v))
+		}
+		s.nicModel = v
+	}
+	return s, errs
+}
+
+// Reads the bus and boot index of a qcow2 layer; the boot index is 0 if the disk does
+// not boot
+func parseDiskSettings(layer v1.Descriptor) (bus string, bootIndex int, errs []error) {
+	bus = defaultBus
+	if v, ok := layer.Annotations[pextraoci.AnnotationPextraQemuBus]; ok {
+		if _, known := diskBuses[v]; !known {
+			errs = append(errs, fmt.Errorf("%s: unknown bus %q", pextraoci.AnnotationPextraQemuBus, v))
+		}
+		bus = v
+	}
+	if v, ok := layer.Annotations[pextraoci.AnnotationPextraQemuBootIndex]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			errs = append(errs, fmt.Errorf("%s: %q is not a positive integer", pextraoci.AnnotationPextraQemuBootIndex, v))
+		} else {
+			bootIndex = n
+		}
+	}
+	return bus, bootIndex, errs
+}
+
+// A VM made of the extracted disks of a QEMU image and the settings it recommends
+type vmSpec struct {
+	name      string
+	arch      vmArch
+	machine   string
+	firmware  string
+	cpus      int
+	memoryMiB int
+	nicModel  string
+	// Disks that boot come first, by boot index, followed by the others in manifest order
+	disks []vmDisk
+}
+
+type vmDisk struct {
+	path      string
+	format    string
+	bus       string
+	bootIndex int
+}
+
+// Builds the VM for an image of architecture goarch from its manifest annotations and
+// the disks extracted into dir, in manifest order
+func newVMSpec(name, goarch string, annotations map[string]string, disks []extractedDisk, dir string) (*vmSpec, error) {
+	arch, ok := vmArchs[goarch]
+	if !ok {
+		return nil, fmt.Errorf("no VM definition for architecture %q", goarch)
+	}
+	settings, errs := parseVMSettings(annotations)
+	s := &vmSpec{
+		name:      name,
+		arch:      arch,
+		machine:   cmp.Or(settings.machine, arch.machine),
+		firmware:  settings.firmware,
+		cpus:      cmp.Or(settings.cpus, defaultCPUs),
+		memoryMiB: cmp.Or(settings.memoryMiB, defaultMemoryMiB),
+		nicModel:  cmp.Or(settings.nicModel, defaultNICModel),
+	}
+	if s.firmware == "" {
+		s.firmware = FirmwareBIOS
+		if arch.defaultUEFI {
+			s.firmware = FirmwareUEFI
+		}
+	}
+
+	sata := 0
+	for _, disk := range disks {
+		bus, bootIndex, diskErrs := parseDiskSettings(disk.layer)
+		name := disk.fileName
+		for _, err := range diskErrs {
+			errs = append(errs, fmt.Errorf("disk %s: %w", name, err))
+		}
+		if bus == "ide" {
+			var ok bool
+			if bus, ok = ideBus(s.machine); !ok {
+				errs = append(errs, fmt.Errorf("disk %s: machine %s has no IDE controller", name, s.machine))
+			}
+		}
+		if bus == "sata" {
+			if sata++; sata > sataPorts {
+				errs = append(errs, fmt.Errorf("disk %s: more than %d sata disks", name, sataPorts))
+			}
+		}
+		s.disks = append(s.disks, vmDisk{path: filepath.Join(dir, name), format: disk.opts.format(), bus: bus, bootIndex: bootIndex})
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(s.disks, func(a, b vmDisk) int {
+		return cmp.Compare(bootOrder(a.bootIndex), bootOrder(b.bootIndex))
+	})
+	return s, nil
+}
+
+// Sorts disks without a boot index last
+func bootOrder(bootIndex int) int {
+	if bootIndex == 0 {
+		return int(^uint(0) >> 1)
+	}
+	return bootIndex
+}
+
+// The QEMU command line as groups of an option and its value
+func (s *vmSpec) qemuArgs() ([][]string, error) {
+	args := [][]string{
+		{"qemu-system-" + s.arch.qemu},
+		{"-name", s.name},
+		{"-machine", qemuOptValue(s.machine) + ",accel=kvm:tcg"},
+		{"-cpu", "max"},
+		{"-smp", strconv.Itoa(s.cpus)},
+		{"-m", strconv.Itoa(s.memoryMiB)},
+	}
+	if s.firmware == FirmwareUEFI {
+		if s.arch.uefiCode == "" {
+			return nil, fmt.Errorf("no UEFI firmware known for %s; use a libvirt VM definition instead", s.arch.qemu)
+		}
+		args = append(args, []string{"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=" + qemuOptValue(s.arch.uefiCode)})
+	}
+
+	buses := make(map[string]bool)
+	for _, d := range s.disks {
+		buses[d.bus] = true
+	}
+	if buses["scsi"] {
+		args = append(args, []string{"-device", "virtio-scsi,id=scsi0"})
+	}
+	if buses["sata"] {
+		args = append(args, []string{"-device", "ahci,id=sata0"})
+	}
+	sata := 0
+	for i, d := range s.disks {
+		id := "disk" + strconv.Itoa(i)
+		args = append(args, []string{"-drive", "file=" + qemuOptValue(d.path) + ",format=" + d.format + ",if=none,id=" + id})
+		var device string
+		switch d.bus {
+		case "virtio":
+			device = "virtio-blk,drive=" + id
+		case "scsi":
+			device = "scsi-hd,drive=" + id + ",bus=scsi0.0"
+		case "sata":
+			device = fmt.Sprintf("ide-hd,drive=%s,bus=sata0.%d", id, sata)
+			sata++
+		case "ide":
+			device = "ide-hd,drive=" + id
+		}
+		if d.bootIndex > 0 {
+			device += ",bootindex=" + strconv.Itoa(d.bootIndex)
+		}
+		args = append(args, []string{"-device", device})
+	}
+
+	if nic := nicModels[s.nicModel]; nic != "" {
+		args = append(args, []string{"-netdev", "user,id=net0"}, []string{"-device", nic + ",netdev=net0"})
+	}
+	return args, nil
+}
+
+// Escapes the commas of a value in a QEMU option list
+func qemuOptValue(v string) string {
+	return strings.ReplaceAll(v, ",", ",,")
+}
+
+// A shell script that runs the QEMU command line, with the arguments of the script
+// appended
+func (s *vmSpec) qemuScript() ([]byte, error) {
+	args, err := s.qemuArgs()
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, 0, len(args)+1)
+	for _, group := range args {
+		for i, arg := range group {
+			group[i] = shellQuote(arg)
+		}
+		lines = append(lines, strings.Join(group, " "))
+	}
+	lines = append(lines, `"$@"`)
+	return []byte("#!/bin/sh\n# QEMU command line generated by pce-oci; arguments are passed on to QEMU\nexec " +
+		strings.Join(lines, " \\\n\t") + "\n"), nil
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// libvirt domain XML, reduced to what the generated definitions use
+type libvirtDomain struct {
+	XMLName  xml.Name         `xml:"domain"`
+	Type     string           `xml:"type,attr"`
+	Name     string           `xml:"name"`
+	Memory   libvirtMemory    `xml:"memory"`
+	VCPU     int              `xml:"vcpu"`
+	OS       libvirtOS        `xml:"os"`
+	Features *libvirtFeatures `xml:"features"`
+	CPU      libvirtCPU       `xml:"cpu"`
+	Devices  libvirtDevices   `xml:"devices"`
+}
+
+type libvirtMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type libvirtOS struct {
+	Firmware string        `xml:"firmware,attr,omitempty"`
+	Type     libvirtOSType `xml:"type"`
+}
+
+type libvirtOSType struct {
+	Arch    string `xml:"arch,attr"`
+	Machine string `xml:"machine,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type libvirtFeatures struct {
+	ACPI struct{} `xml:"acpi"`
+	APIC struct{} `xml:"apic"`
+}
+
+type libvirtCPU struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type libvirtDevices struct {
+	Controllers []libvirtController `xml:"controller"`
+	Disks       []libvirtDisk       `xml:"disk"`
+	Interfaces  []libvirtInterface  `xml:"interface"`
+	Serial      libvirtChar         `xml:"serial"`
+	Console     libvirtChar         `xml:"console"`
+}
+
+type libvirtController struct {
+	Type  string `xml:"type,attr"`
+	Index int    `xml:"index,attr"`
+	Model string `xml:"model,attr,omitempty"`
+}
+
+type libvirtDisk struct {
+	Type   string `xml:"type,attr"`
+	Device string `xml:"device,attr"`
+	Driver struct {
+		Name string `xml:"name,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"driver"`
+	Source struct {
+		File string `xml:"file,attr"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+		Bus string `xml:"bus,attr"`
+	} `xml:"target"`
+	Boot *struct {
+		Order int `xml:"order,attr"`
+	} `xml:"boot"`
+}
+
+type libvirtInterface struct {
+	Type   string `xml:"type,attr"`
+	Source struct {
+		Network string `xml:"network,attr"`
+	} `xml:"source"`
+	Model struct {
+		Type string `xml:"type,attr"`
+	} `xml:"model"`
+}
+
+type libvirtChar struct {
+	Type string `xml:"type,attr"`
+}
+
+// A libvirt domain for the VM, attached to libvirt's default network
+func (s *vmSpec) libvirtXML() ([]byte, error) {
+	d := libvirtDomain{
+		Type:   "kvm",
+		Name:   s.name,
+		Memory: libvirtMemory{Unit: "MiB", Value: s.memoryMiB},
+		VCPU:   s.cpus,
+		OS: libvirtOS{
+			Type: libvirtOSType{Arch: s.arch.libvirt, Machine: s.machine, Value: "hvm"},
+		},
+		CPU: libvirtCPU{Mode: "host-passthrough"},
+		Devices: libvirtDevices{
+			Serial:  libvirtChar{Type: "pty"},
+			Console: libvirtChar{Type: "pty"},
+		},
+	}
+	if s.firmware == FirmwareUEFI {
+		d.OS.Firmware = "efi"
+	}
+	if s.arch.machine == "q35" {
+		d.Features = &libvirtFeatures{}
+	}
+
+	buses := make(map[string]bool)
+	devs := make(map[string]int)
+	for _, disk := range s.disks {
+		var ld libvirtDisk
+		ld.Type, ld.Device = "file", "disk"
+		ld.Driver.Name, ld.Driver.Type = "qemu", disk.format
+		ld.Source.File = disk.path
+		prefix := diskBuses[disk.bus]
+		ld.Target.Dev = prefix + diskLetters(devs[prefix])
+		ld.Target.Bus = disk.bus
+		devs[prefix]++
+		if disk.bootIndex > 0 {
+			ld.Boot = &struct {
+				Order int `xml:"order,attr"`
+			}{disk.bootIndex}
+		}
+		d.Devices.Disks = append(d.Devices.Disks, ld)
+		buses[disk.bus] = true
+	}
+	if buses["scsi"] {
+		d.Devices.Controllers = append(d.Devices.Controllers, libvirtController{Type: "scsi", Model: "virtio-scsi"})
+	}
+	if buses["sata"] {
+		d.Devices.Controllers = append(d.Devices.Controllers, libvirtController{Type: "sata"})
+	}
+	if s.nicModel != "none" {
+		var nic libvirtInterface
+		nic.Type = "network"
+		nic.Source.Network = "default"
+		nic.Model.Type = s.nicModel
+		d.Devices.Interfaces = append(d.Devices.Interfaces, nic)
+	}
+
+	b, err := xml.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Names the n-th disk of a bus like the kernel does: a, b, ..., z, aa, ab, ...
+func diskLetters(n int) string {
+	var s []byte
+	for n++; n > 0; n = (n - 1) / 26 {
+		s = append([]byte{byte('a' + (n-1)%26)}, s...)
+	}
+	return string(s)
+}
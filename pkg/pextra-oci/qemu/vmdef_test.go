@@ -0,0 +1,182 @@
+/*
+Copyright 2025 Pextra Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package qemu
+
+import (
+	"strings"
+	"testing"
+
+	pextraoci "github.com/PextraCloud/pce-osi/pkg/pextra-oci"
+)
+
+// A disk flattened from a layer with the annotations, written as its disk options select
+func testDisk(fileName string, annotations map[string]string) extractedDisk {
+	l := qcow2Layer(map[string]string{pextraoci.AnnotationPextraQemuFileName: fileName})
+	for k, v := range annotations {
+		l.Annotations[k] = v
+	}
+	opts, _ := parseDiskOptions(l)
+	return extractedDisk{layer: l, fileName: diskFileName(fileName, opts.format()), opts: opts}
+}
+
+// A VM with a raw data disk listed before the boot disk, on different buses
+func testVMSpec(t *testing.T, annotations map[string]string) *vmSpec {
+	t.Helper()
+	disks := []extractedDisk{
+		testDisk("data,1.qcow2", map[string]string{pextraoci.AnnotationPextraQemuBus: "scsi", pextraoci.AnnotationPextraQemuDiskFormat: DiskFormatRaw}),
+		testDisk("boot.qcow2", map[string]string{pextraoci.AnnotationPextraQemuBootIndex: "1"}),
+	}
+	s, err := newVMSpec("web", "amd64", annotations, disks, "/vms/web")
+	if err != nil {
+		t.Fatalf("newVMSpec error: %v", err)
+	}
+	return s
+}
+
+func TestNewVMSpec(t *testing.T) {
+	s := testVMSpec(t, nil)
+	if s.machine != "q35" || s.firmware != FirmwareBIOS || s.cpus != defaultCPUs || s.memoryMiB != defaultMemoryMiB || s.nicModel != defaultNICModel {
+		t.Fatalf("unexpected defaults: %+v", s)
+	}
+	if len(s.disks) != 2 || s.disks[0].path != "/vms/web/boot.qcow2" || s.disks[1].bus != "scsi" || s.disks[1].format != DiskFormatRaw {
+		t.Fatalf("expected the boot disk first, got %+v", s.disks)
+	}
+
+	if s, err := newVMSpec("arm", "arm64", nil, nil, "/vms"); err != nil || s.firmware != FirmwareUEFI || s.machine != "virt" {
+		t.Fatalf("expected UEFI and virt for arm64, got %+v (err=%v)", s, err)
+	}
+	if _, err := newVMSpec("x", "mips64", nil, nil, "/vms"); err == nil {
+		t.Fatalf("expected an error for an unknown architecture")
+	}
+	tooMany := make([]extractedDisk, sataPorts+1)
+	for i := range tooMany {
+		tooMany[i] = testDisk(string(rune('a'+i)), map[string]string{pextraoci.AnnotationPextraQemuBus: "sata"})
+	}
+	if _, err := newVMSpec("x", "amd64", nil, tooMany, "/vms"); err == nil || !strings.Contains(err.Error(), "sata disks") {
+		t.Fatalf("expected an error for too many sata disks, got %v", err)
+	}
+
+	// q35 has no IDE controller, so ide disks go to its AHCI controller
+	ide := []extractedDisk{testDisk("old.qcow2", map[string]string{pextraoci.AnnotationPextraQemuBus: "ide"})}
+	for _, tc := range []struct{ machine, bus string }{{"", "sata"}, {"pc-q35-8.2", "sata"}, {"pc", "ide"}, {"pc-i440fx-8.2", "ide"}} {
+		annotations := map[string]string{}
+		if tc.machine != "" {
+			annotations[pextraoci.AnnotationPextraQemuMachine] = tc.machine
+		}
+		s, err := newVMSpec("x", "amd64", annotations, ide, "/vms")
+		if err != nil || s.disks[0].bus != tc.bus {
+			t.Fatalf("machine %q: expected bus %s, got %+v (err=%v)", tc.machine, tc.bus, s, err)
+		}
+	}
+	if _, err := newVMSpec("x", "arm64", nil, ide, "/vms"); err == nil || !strings.Contains(err.Error(), "no IDE controller") {
+		t.Fatalf("expected an error for ide disks on virt, got %v", err)
+	}
+}
+
+func TestVMSpec_QemuScript(t *testing.T) {
+	s := testVMSpec(t, map[string]string{
+		pextraoci.AnnotationPextraQemuFirmware:  FirmwareUEFI,
+		pextraoci.AnnotationPextraQemuCPUs:      "4",
+		pextraoci.AnnotationPextraQemuMemoryMiB: "4096",
+		pextraoci.AnnotationPextraQemuNICModel:  "e1000",
+	})
+	s.name = "web server"
+	got, err := s.qemuScript()
+	if err != nil {
+		t.Fatalf("qemuScript error: %v", err)
+	}
+	want := `#!/bin/sh
+# QEMU command line generated by pce-oci; arguments are passed on to QEMU
+exec qemu-system-x86_64 \
+	-name 'web server' \
+	-machine q35,accel=kvm:tcg \
+	-cpu max \
+	-smp 4 \
+	-m 4096 \
+	-drive if=pflash,format=raw,unit=0,readonly=on,file=/usr/share/OVMF/OVMF_CODE.fd \
+	-device virtio-scsi,id=scsi0 \
+	-drive file=/vms/web/boot.qcow2,format=qcow2,if=none,id=disk0 \
+	-device virtio-blk,drive=disk0,bootindex=1 \
+	-drive file=/vms/web/data,,1.raw,format=raw,if=none,id=disk1 \
+	-device scsi-hd,drive=disk1,bus=scsi0.0 \
+	-netdev user,id=net0 \
+	-device e1000,netdev=net0 \
+	"$@"
+`
+	if string(got) != want {
+		t.Fatalf("unexpected script:\n%s\nwant:\n%s", got, want)
+	}
+
+	s, err = newVMSpec("riscv", "riscv64", map[string]string{pextraoci.AnnotationPextraQemuFirmware: FirmwareUEFI}, nil, "/vms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.qemuScript(); err == nil {
+		t.Fatalf("expected an error for UEFI without known firmware")
+	}
+}
+
+func TestVMSpec_LibvirtXML(t *testing.T) {
+	s := testVMSpec(t, map[string]string{
+		pextraoci.AnnotationPextraQemuMachine:  "pc-q35-8.2",
+		pextraoci.AnnotationPextraQemuNICModel: "none",
+	})
+	got, err := s.libvirtXML()
+	if err != nil {
+		t.Fatalf("libvirtXML error: %v", err)
+	}
+	want := `<domain type="kvm">
+  <name>web</name>
+  <memory unit="MiB">1024</memory>
+  <vcpu>1</vcpu>
+  <os>
+    <type arch="x86_64" machine="pc-q35-8.2">hvm</type>
+  </os>
+  <features>
+    <acpi></acpi>
+    <apic></apic>
+  </features>
+  <cpu mode="host-passthrough"></cpu>
+  <devices>
+    <controller type="scsi" index="0" model="virtio-scsi"></controller>
+    <disk type="file" device="disk">
+      <driver name="qemu" type="qcow2"></driver>
+      <source file="/vms/web/boot.qcow2"></source>
+      <target dev="vda" bus="virtio"></target>
+      <boot order="1"></boot>
+    </disk>
+    <disk type="file" device="disk">
+      <driver name="qemu" type="raw"></driver>
+      <source file="/vms/web/data,1.raw"></source>
+      <target dev="sda" bus="scsi"></target>
+    </disk>
+    <serial type="pty"></serial>
+    <console type="pty"></console>
+  </devices>
+</domain>
+`
+	if string(got) != want {
+		t.Fatalf("unexpected domain XML:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDiskLetters(t *testing.T) {
+	for n, want := range map[int]string{0: "a", 25: "z", 26: "aa", 27: "ab", 701: "zz", 702: "aaa"} {
+		if got := diskLetters(n); got != want {
+			t.Errorf("diskLetters(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
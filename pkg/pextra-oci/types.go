@@ -15,18 +15,33 @@ limitations under the License.
 */
 package pextraoci
 
+import "github.com/PextraCloud/pce-osi/internal/spec"
+
 const (
-	AnnotationPextraImageType = "org.pextra.image.type"
-	PextraImageTypeQemu       = "qemu"
-	PextraImageTypeLxc        = "lxc"
+	AnnotationPextraImageType = spec.AnnotationPextraImageType
+	PextraImageTypeQemu       = spec.PextraImageTypeQemu
+	PextraImageTypeLxc        = spec.PextraImageTypeLxc
 
 	// QEMU (qcow2)
-	MediaTypePextraImageLayerQcow2 = "application/vnd.pextra.image.layer.v1.qcow2"
-	AnnotationPextraQemuFileName   = "org.pextra.qcow2.fileName"
-	AnnotationPextraQemuFlatten    = "org.pextra.qcow2.flatten"
+	MediaTypePextraImageLayerQcow2    = spec.MediaTypePextraImageLayerQcow2
+	AnnotationPextraQemuFileName      = spec.AnnotationPextraQemuFileName
+	AnnotationPextraQemuFlatten       = spec.AnnotationPextraQemuFlatten
+	AnnotationPextraQemuBootIndex     = spec.AnnotationPextraQemuBootIndex
+	AnnotationPextraQemuBus           = spec.AnnotationPextraQemuBus
+	AnnotationPextraQemuDiskFormat    = spec.AnnotationPextraQemuDiskFormat
+	AnnotationPextraQemuCompress      = spec.AnnotationPextraQemuCompress
+	AnnotationPextraQemuPreallocation = spec.AnnotationPextraQemuPreallocation
+	AnnotationPextraQemuClusterSize   = spec.AnnotationPextraQemuClusterSize
+	AnnotationPextraQemuCompat        = spec.AnnotationPextraQemuCompat
+	AnnotationPextraQemuMachine       = spec.AnnotationPextraQemuMachine
+	AnnotationPextraQemuFirmware      = spec.AnnotationPextraQemuFirmware
+	AnnotationPextraQemuCPUs          = spec.AnnotationPextraQemuCPUs
+	AnnotationPextraQemuMemoryMiB     = spec.AnnotationPextraQemuMemoryMiB
+	AnnotationPextraQemuNICModel      = spec.AnnotationPextraQemuNICModel
 
 	// LXC
-	MediaTypePextraImageLayerLxc     = "application/vnd.pextra.image.layer.v1.lxc.tar"
-	MediaTypePextraImageLayerLxcGzip = "application/vnd.pextra.image.layer.v1.lxc.tar+gzip"
-	MediaTypePextraImageLayerLxcZstd = "application/vnd.pextra.image.layer.v1.lxc.tar+zstd"
+	MediaTypePextraImageLayerLxc     = spec.MediaTypePextraImageLayerLxc
+	MediaTypePextraImageLayerLxcGzip = spec.MediaTypePextraImageLayerLxcGzip
+	MediaTypePextraImageLayerLxcZstd = spec.MediaTypePextraImageLayerLxcZstd
+	AnnotationPextraLxcCgroup2Prefix = spec.AnnotationPextraLxcCgroup2Prefix
 )